@@ -0,0 +1,1039 @@
+package redis
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisAofOff = 0 //没有开启AOF
+	redisAofOn  = 1 //开启了AOF
+
+	aofFsyncNo       = 0 //由操作系统决定什么时候刷盘
+	aofFsyncAlways   = 1 //每次写入后都fsync
+	aofFsyncEverysec = 2 //每秒在后台fsync一次
+
+	redisDefaultAofFsync          = aofFsyncEverysec
+	redisDefaultAofFilename       = "appendonly.aof"
+	redisDefaultAofDirname        = "appendonlydir"
+	redisDefaultAofRewritePerc    = 100
+	redisDefaultAofRewriteMinSize = 64 * 1024 * 1024
+
+	redisClientIdAof = -1 //加载AOF使用的伪客户端的id
+)
+
+//loadAppendOnlyFile的返回值
+const (
+	aofOk        = 0
+	aofNotExist  = 1
+	aofEmpty     = 2
+	aofOpenErr   = 3
+	aofFailed    = 4
+	aofTruncated = 5
+)
+
+var aofFsyncNames = map[string]int{
+	"no":       aofFsyncNo,
+	"always":   aofFsyncAlways,
+	"everysec": aofFsyncEverysec,
+}
+
+var errAofFormat = errors.New("bad file format")
+
+//后台fsync的状态，fsync在单独的goroutine中执行，需要加锁访问
+type aofBioFsync struct {
+	jobs       sync.Mutex //后台任务依次执行，避免关闭文件时还在fsync
+	mu         sync.Mutex
+	inProgress bool
+	err        error //上一次后台fsync的错误，成功时为nil
+}
+
+//按照RESP协议将命令追加到buf中，整数编码的参数需要先转换为字符串
+func catAppendOnlyGenericCommand(buf []byte, argv []*robj) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(argv)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range argv {
+		s := getDecodedObject(arg).ptr.(sds)
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(s)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, s...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+//将命令追加到AOF缓冲区，在beforeSleep中写入文件
+//db和上一次写入的命令不同时先写入SELECT，dbid为-1表示不需要切换db（比如EXEC）
+func feedAppendOnlyFile(dbid int, argv []*robj) {
+	if dbid != -1 && dbid != server.aofSelectedDb {
+		selectArgv := []*robj{createStringObject("SELECT"), createStringObjectFromLongLong(int64(dbid))}
+		server.aofBuf = catAppendOnlyGenericCommand(server.aofBuf, selectArgv)
+		server.aofSelectedDb = dbid
+	}
+	server.aofBuf = catAppendOnlyGenericCommand(server.aofBuf, argv)
+}
+
+//后台fsync是否还在执行
+func aofFsyncInProgress() bool {
+	server.aofBioFsync.mu.Lock()
+	defer server.aofBioFsync.mu.Unlock()
+	return server.aofBioFsync.inProgress
+}
+
+//在goroutine中fsync，避免阻塞事件循环
+func aofBackgroundFsync(f *os.File) {
+	server.aofBioFsync.mu.Lock()
+	server.aofBioFsync.inProgress = true
+	server.aofBioFsync.mu.Unlock()
+
+	go func() {
+		server.aofBioFsync.jobs.Lock()
+		defer server.aofBioFsync.jobs.Unlock()
+		err := f.Sync()
+		server.aofBioFsync.mu.Lock()
+		server.aofBioFsync.inProgress = false
+		server.aofBioFsync.err = err
+		server.aofBioFsync.mu.Unlock()
+		if err != nil {
+			log.Printf("Can't persist AOF for fsync error when the AOF fsync policy is 'everysec': %v", err)
+		}
+	}()
+}
+
+//在goroutine中fsync并关闭切换之前的incr文件
+func aofBackgroundFsyncAndClose(f *os.File) {
+	go func() {
+		server.aofBioFsync.jobs.Lock()
+		defer server.aofBioFsync.jobs.Unlock()
+		err := f.Sync()
+		f.Close()
+		if err != nil {
+			server.aofBioFsync.mu.Lock()
+			server.aofBioFsync.err = err
+			server.aofBioFsync.mu.Unlock()
+			log.Printf("Fail to fsync the AOF file: %v", err)
+		}
+	}()
+}
+
+//上一次后台fsync的错误
+func aofBioFsyncError() error {
+	server.aofBioFsync.mu.Lock()
+	defer server.aofBioFsync.mu.Unlock()
+	return server.aofBioFsync.err
+}
+
+//将AOF缓冲区写入文件，并按照appendfsync的配置刷盘
+//必须在回复客户端之前调用，客户端收到回复时命令已经写入了AOF
+func flushAppendOnlyFile() {
+	now := time.Now().Unix()
+	if len(server.aofBuf) > 0 {
+		n, err := server.aofFile.Write(server.aofBuf)
+		if err != nil {
+			log.Printf("Error writing to the AOF file: %v", err)
+
+			//写入了部分数据时尝试截断到写入之前的长度，避免重放时读到不完整的命令
+			if n > 0 {
+				if terr := server.aofFile.Truncate(server.aofLastIncrSize); terr != nil {
+					log.Printf("Could not remove short write from the append-only file. "+
+						"Redis may refuse to load the AOF the next time it starts. ftruncate: %v", terr)
+				} else {
+					n = 0
+				}
+			}
+
+			//always策略下不能丢失已经回复过的命令，无法恢复时只能退出
+			if server.aofFsync == aofFsyncAlways {
+				log.Fatalf("Can't recover from AOF write error when the AOF fsync policy is 'always'. Exiting...")
+			}
+
+			//拒绝写命令，在之后的beforeSleep中继续重试
+			server.aofLastWriteStatus = redisErr
+			server.aofLastWriteErr = err
+			if n > 0 {
+				server.aofCurrentSize += int64(n)
+				server.aofLastIncrSize += int64(n)
+				server.aofBuf = server.aofBuf[n:]
+			}
+			return
+		}
+		if server.aofLastWriteStatus == redisErr {
+			log.Printf("AOF write error looks solved, Redis can write again.")
+			server.aofLastWriteStatus = redisOk
+			server.aofLastWriteErr = nil
+		}
+		server.aofCurrentSize += int64(n)
+		server.aofLastIncrSize += int64(n)
+
+		//缓冲区比较小时复用
+		if cap(server.aofBuf) < 4000 {
+			server.aofBuf = server.aofBuf[:0]
+		} else {
+			server.aofBuf = nil
+		}
+	} else if server.aofFsync != aofFsyncEverysec || server.aofFsyncOffset == server.aofCurrentSize {
+		//没有新数据，everysec时还需要检查上一秒写入的数据是否已经刷盘
+		return
+	}
+
+	if server.aofFsync == aofFsyncAlways {
+		if err := server.aofFile.Sync(); err != nil {
+			log.Fatalf("Can't persist AOF for fsync error when the AOF fsync policy is 'always': %v. Exiting...", err)
+		}
+		server.aofFsyncOffset = server.aofCurrentSize
+		server.aofLastFsync = now
+	} else if server.aofFsync == aofFsyncEverysec && now > server.aofLastFsync {
+		if !aofFsyncInProgress() {
+			aofBackgroundFsync(server.aofFile)
+			server.aofFsyncOffset = server.aofCurrentSize
+		}
+		server.aofLastFsync = now
+	}
+}
+
+//启动时打开最后一个incr文件，之后的写命令都追加到这个文件的末尾
+//没有任何AOF文件时先生成空的base文件
+func aofOpenIfNeededOnServerStart() {
+	if server.aofState != redisAofOn {
+		return
+	}
+	if err := dirCreateIfMissing(server.aofDirname); err != nil {
+		log.Fatalf("Can't open or create append-only dir %s: %v", server.aofDirname, err)
+	}
+
+	am := server.aofManifest
+	incrAofLen := len(am.incrAofList)
+	if am.baseAofInfo == nil && incrAofLen == 0 {
+		baseName := getNewBaseFileNameAndMarkPreAsHistory(am)
+		if rewriteAppendOnlyFile(filepath.Join(server.aofDirname, baseName)) != redisOk {
+			log.Fatalf("Can't create the AOF base file %s on server start", baseName)
+		}
+		log.Printf("Creating AOF base file %s on server start", baseName)
+	}
+
+	aofName := getLastIncrAofName(am)
+	f, err := os.OpenFile(filepath.Join(server.aofDirname, aofName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatalf("Can't open the append-only file %s: %v", aofName, err)
+	}
+	if persistAofManifest(am) != redisOk {
+		log.Fatalf("Can't persist the AOF manifest on server start")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatalf("Unable to obtain the AOF file %s length. stat: %v", aofName, err)
+	}
+	server.aofFile = f
+	server.aofLastIncrSize = fi.Size()
+	//文件末尾的db是不确定的，第一条命令之前总是写入SELECT
+	server.aofSelectedDb = -1
+
+	if incrAofLen > 0 {
+		log.Printf("Opening AOF incr file %s on server start", aofName)
+	} else {
+		log.Printf("Creating AOF incr file %s on server start", aofName)
+	}
+}
+
+//创建加载AOF使用的伪客户端，没有连接，回复都会被丢弃
+func createAOFClient() *redisClient {
+	return &redisClient{
+		id:      redisClientIdAof,
+		db:      server.db[0],
+		bulklen: -1,
+		reply:   list.New(),
+		resp:    2,
+		bpop:    blockingState{keys: dictCreate()},
+		//重放的命令不能阻塞
+		flags:               redisDenyBlocking,
+		watchedKeys:         list.New(),
+		pubsubChannels:      dictCreate(),
+		pubsubPatterns:      dictCreate(),
+		pubsubShardChannels: dictCreate(),
+		authenticated:       true,
+	}
+}
+
+//读取一行，去掉结尾的\r\n，返回读取的字节数
+func aofReadLine(r *bufio.Reader) (string, int64, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF {
+		return "", 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return "", 0, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", 0, errAofFormat
+	}
+	return line[:len(line)-2], int64(len(line)), nil
+}
+
+//读取一个RESP格式的命令，返回命令参数和读取的字节数
+//命令不完整时返回io.ErrUnexpectedEOF
+func aofReadCommand(r *bufio.Reader) ([]*robj, int64, error) {
+	line, total, err := aofReadLine(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(line) < 2 || line[0] != '*' {
+		return nil, 0, errAofFormat
+	}
+	argc, err := strconv.Atoi(line[1:])
+	if err != nil || argc < 1 {
+		return nil, 0, errAofFormat
+	}
+
+	argv := make([]*robj, argc)
+	for j := 0; j < argc; j++ {
+		line, n, err := aofReadLine(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		total += n
+		if len(line) < 2 || line[0] != '$' {
+			return nil, 0, errAofFormat
+		}
+		l, err := strconv.Atoi(line[1:])
+		if err != nil || l < 0 || l > redisMaxBulkLen {
+			return nil, 0, errAofFormat
+		}
+		buf := make([]byte, l+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, 0, err
+		}
+		if buf[l] != '\r' || buf[l+1] != '\n' {
+			return nil, 0, errAofFormat
+		}
+		total += int64(l + 2)
+		argv[j] = createStringObject(sds(buf[:l]))
+	}
+	return argv, total, nil
+}
+
+//加载一个AOF文件，每个命令都通过伪客户端交给processCommand执行
+//RDB格式的base文件先加载RDB数据，之后的内容仍然按照AOF格式加载
+//最后一个文件结尾不完整时，如果开启了aof-load-truncated，截断到最后一个完整的命令并继续启动
+func loadAppendOnlyFile(filename string, lastFile bool) int {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return aofNotExist
+		}
+		log.Printf("Fatal error: can't open the append log file %s for reading: %v", filename, err)
+		return aofOpenErr
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("Unable to obtain the AOF file %s length. stat: %v", filename, err)
+		return aofOpenErr
+	}
+	if fi.Size() == 0 {
+		return aofEmpty
+	}
+
+	//重放的命令不需要再写入AOF
+	oldAofState := server.aofState
+	server.aofState = redisAofOff
+	server.loading = true
+	defer func() {
+		server.aofState = oldAofState
+		server.loading = false
+	}()
+
+	client := createAOFClient()
+	reader := bufio.NewReader(f)
+	var offset, validUpTo, validBeforeMulti int64
+	if sig, _ := reader.Peek(5); string(sig) == "REDIS" {
+		log.Printf("Reading RDB base file on AOF loading...")
+		r := &rio{reader: reader, size: fi.Size()}
+		if err := rdbLoadRio(r); err != nil {
+			log.Printf("Error reading the RDB base file %s, AOF loading aborted: %v", filename, err)
+			return aofFailed
+		}
+		offset = r.processed
+		validUpTo = offset
+		validBeforeMulti = offset
+	}
+	truncated := false
+	for {
+		//在命令的开头遇到文件结尾，说明文件是完整的
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+
+		argv, n, err := aofReadCommand(reader)
+		if err == io.ErrUnexpectedEOF {
+			truncated = true
+			break
+		} else if err == errAofFormat {
+			log.Printf("Bad file format reading the append only file %s: "+
+				"make a backup of your AOF file, then use ./redis-check-aof --fix <filename>", filename)
+			return aofFailed
+		} else if err != nil {
+			log.Printf("Unrecoverable error reading the append only file %s: %v", filename, err)
+			return aofFailed
+		}
+		offset += n
+
+		cmd := lookupCommand(argv[0].ptr.(sds))
+		if cmd == nil {
+			log.Printf("Unknown command '%s' reading the append only file %s", argv[0].ptr.(sds), filename)
+			return aofFailed
+		}
+		//记录MULTI之前的位置，事务不完整时截断到这里
+		if cmd.name == "multi" {
+			validBeforeMulti = validUpTo
+		}
+
+		client.argv = argv
+		client.argc = len(argv)
+		processCommand(client)
+		resetClient(client)
+		validUpTo = offset
+	}
+
+	//文件以不完整的事务结尾，事务中的命令还在队列中没有执行
+	if client.flags&redisMulti != 0 {
+		log.Printf("Revert incomplete MULTI/EXEC transaction in AOF file %s", filename)
+		discardTransaction(client)
+		validUpTo = validBeforeMulti
+		truncated = true
+	}
+
+	if truncated {
+		//切换incr文件之前已经完整写入了之前的文件，只有最后一个文件可能不完整
+		if !lastFile {
+			log.Printf("Fatal error: the truncated file %s is not the last file", filename)
+			return aofFailed
+		}
+		if !server.aofLoadTruncated {
+			log.Printf("Unexpected end of file reading the append only file %s. You can: "+
+				"1) Make a backup of your AOF file, then use ./redis-check-aof --fix <filename>. "+
+				"2) Alternatively you can set the 'aof-load-truncated' configuration option to yes and restart the server.",
+				filename)
+			return aofFailed
+		}
+		log.Printf("!!! Warning: short read while loading the AOF file %s!!!", filename)
+		log.Printf("!!! Truncating the AOF %s at offset %d !!!", filename, validUpTo)
+		if err := os.Truncate(filename, validUpTo); err != nil {
+			log.Printf("Error truncating the AOF file %s: %v", filename, err)
+			return aofFailed
+		}
+		log.Printf("AOF %s loaded anyway because aof-load-truncated is enabled", filename)
+		return aofTruncated
+	}
+	return aofOk
+}
+
+//-----------------------------------------------------------------------------
+// AOF manifest
+//-----------------------------------------------------------------------------
+
+//AOF目录中有一个base文件（重写时生成的RDB格式的快照）和之后依次追加的incr文件，
+//manifest文件记录了这些文件和加载的顺序。更新manifest时先写入临时文件再重命名，
+//所以切换文件是原子的，任何时候重启都能加载到完整的数据
+const (
+	aofFileTypeBase = 'b' //base文件
+	aofFileTypeHist = 'h' //已经被重写的文件，等待删除
+	aofFileTypeIncr = 'i' //incr文件
+
+	aofManifestKeyFileName = "file"
+	aofManifestKeyFileSeq  = "seq"
+	aofManifestKeyFileType = "type"
+)
+
+//manifest中的一个文件
+type aofInfo struct {
+	fileName string
+	fileSeq  int64
+	fileType byte
+}
+
+type aofManifest struct {
+	baseAofInfo     *aofInfo   //base文件，没有时为nil
+	incrAofList     []*aofInfo //incr文件，按照序号排列
+	historyAofList  []*aofInfo //等待删除的文件
+	currBaseFileSeq int64      //最后一个base文件的序号
+	currIncrFileSeq int64      //最后一个incr文件的序号
+	dirty           bool       //修改之后还没有写入磁盘
+}
+
+//manifest中的一行，文件名包含空格或者特殊字符时需要转义
+func (ai *aofInfo) String() string {
+	name := ai.fileName
+	if sdsneedsrepr(name) {
+		name = sdscatrepr(name)
+	}
+	return fmt.Sprintf("%s %s %s %d %s %c\n", aofManifestKeyFileName, name,
+		aofManifestKeyFileSeq, ai.fileSeq, aofManifestKeyFileType, ai.fileType)
+}
+
+func (ai *aofInfo) dup() *aofInfo {
+	n := *ai
+	return &n
+}
+
+//复制manifest，修改复制的manifest并写入磁盘成功之后才替换server.aofManifest
+func (am *aofManifest) dup() *aofManifest {
+	n := &aofManifest{
+		currBaseFileSeq: am.currBaseFileSeq,
+		currIncrFileSeq: am.currIncrFileSeq,
+		dirty:           am.dirty,
+	}
+	if am.baseAofInfo != nil {
+		n.baseAofInfo = am.baseAofInfo.dup()
+	}
+	for _, ai := range am.incrAofList {
+		n.incrAofList = append(n.incrAofList, ai.dup())
+	}
+	for _, ai := range am.historyAofList {
+		n.historyAofList = append(n.historyAofList, ai.dup())
+	}
+	return n
+}
+
+//manifest文件的内容，依次为base文件、history文件和incr文件
+func (am *aofManifest) String() string {
+	var sb strings.Builder
+	if am.baseAofInfo != nil {
+		sb.WriteString(am.baseAofInfo.String())
+	}
+	for _, ai := range am.historyAofList {
+		sb.WriteString(ai.String())
+	}
+	for _, ai := range am.incrAofList {
+		sb.WriteString(ai.String())
+	}
+	return sb.String()
+}
+
+func getAofManifestFileName() string {
+	return server.aofFilename + ".manifest"
+}
+
+func getTempAofManifestFileName() string {
+	return "temp-" + getAofManifestFileName()
+}
+
+//启动时加载AOF目录中的manifest，没有时使用空的manifest
+func aofLoadManifestFromDisk() {
+	server.aofManifest = &aofManifest{}
+	if !dirExists(server.aofDirname) {
+		return
+	}
+	amFilepath := filepath.Join(server.aofDirname, getAofManifestFileName())
+	if !fileExist(amFilepath) {
+		return
+	}
+	am, err := aofLoadManifestFromFile(amFilepath)
+	if err != nil {
+		log.Fatalf("*** FATAL AOF MANIFEST FILE ERROR *** %v", err)
+	}
+	server.aofManifest = am
+}
+
+//解析manifest文件，每行的格式为 file <name> seq <seq> type <b|h|i>，#开头的行是注释
+func aofLoadManifestFromFile(amFilepath string) (*aofManifest, error) {
+	data, err := os.ReadFile(amFilepath)
+	if err != nil {
+		return nil, fmt.Errorf("can't open the AOF manifest %s for reading: %v", amFilepath, err)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("Found an empty AOF manifest")
+	}
+
+	am := &aofManifest{}
+	var maxseq int64
+	lines := strings.SplitAfter(string(data), "\n")
+	for j, line := range lines {
+		if line == "" {
+			break
+		}
+		if line[0] == '#' {
+			continue
+		}
+		loadErr := func(msg string) error {
+			return fmt.Errorf("reading the manifest file, at line %d: '%s': %s", j+1, strings.TrimRight(line, "\r\n"), msg)
+		}
+		//manifest总是以换行结尾，最后一行不完整说明文件被截断了
+		if !strings.HasSuffix(line, "\n") {
+			return nil, loadErr("The AOF manifest file is truncated")
+		}
+		argv, ok := sdssplitargs(strings.Trim(line, " \t\r\n"))
+		//字段成对出现，忽略不认识的字段，兼容以后增加的字段
+		if !ok || len(argv) < 6 || len(argv)%2 != 0 {
+			return nil, loadErr("Invalid AOF manifest file format")
+		}
+
+		ai := &aofInfo{}
+		for i := 0; i < len(argv); i += 2 {
+			switch strings.ToLower(argv[i]) {
+			case aofManifestKeyFileName:
+				ai.fileName = argv[i+1]
+				if filepath.Base(ai.fileName) != ai.fileName {
+					return nil, loadErr("File can't be a path, just a filename")
+				}
+			case aofManifestKeyFileSeq:
+				ai.fileSeq, _ = strconv.ParseInt(argv[i+1], 10, 64)
+			case aofManifestKeyFileType:
+				if len(argv[i+1]) > 0 {
+					ai.fileType = argv[i+1][0]
+				}
+			}
+		}
+		if ai.fileName == "" || ai.fileSeq <= 0 || ai.fileType == 0 {
+			return nil, loadErr("Invalid AOF manifest file format")
+		}
+
+		switch ai.fileType {
+		case aofFileTypeBase:
+			if am.baseAofInfo != nil {
+				return nil, loadErr("Found duplicate base file information")
+			}
+			am.baseAofInfo = ai
+			am.currBaseFileSeq = ai.fileSeq
+		case aofFileTypeHist:
+			am.historyAofList = append(am.historyAofList, ai)
+		case aofFileTypeIncr:
+			if ai.fileSeq <= maxseq {
+				return nil, loadErr("Found a non-monotonic sequence number")
+			}
+			am.incrAofList = append(am.incrAofList, ai)
+			am.currIncrFileSeq = ai.fileSeq
+			maxseq = ai.fileSeq
+		default:
+			return nil, loadErr("Unknown AOF file type")
+		}
+	}
+	return am, nil
+}
+
+//生成新的base文件名，之前的base文件标记为history
+func getNewBaseFileNameAndMarkPreAsHistory(am *aofManifest) string {
+	if am.baseAofInfo != nil {
+		am.baseAofInfo.fileType = aofFileTypeHist
+		am.historyAofList = append([]*aofInfo{am.baseAofInfo}, am.historyAofList...)
+	}
+	am.currBaseFileSeq++
+	am.baseAofInfo = &aofInfo{
+		fileName: fmt.Sprintf("%s.%d.base.rdb", server.aofFilename, am.currBaseFileSeq),
+		fileSeq:  am.currBaseFileSeq,
+		fileType: aofFileTypeBase,
+	}
+	am.dirty = true
+	return am.baseAofInfo.fileName
+}
+
+//生成新的incr文件名，添加到incr文件列表的末尾
+func getNewIncrAofName(am *aofManifest) string {
+	am.currIncrFileSeq++
+	ai := &aofInfo{
+		fileName: fmt.Sprintf("%s.%d.incr.aof", server.aofFilename, am.currIncrFileSeq),
+		fileSeq:  am.currIncrFileSeq,
+		fileType: aofFileTypeIncr,
+	}
+	am.incrAofList = append(am.incrAofList, ai)
+	am.dirty = true
+	return ai.fileName
+}
+
+//最后一个incr文件，没有时生成一个新的
+func getLastIncrAofName(am *aofManifest) string {
+	if len(am.incrAofList) == 0 {
+		return getNewIncrAofName(am)
+	}
+	return am.incrAofList[len(am.incrAofList)-1].fileName
+}
+
+//重写完成后，重写开始之前的incr文件中的数据都已经包含在新的base文件中了，标记为history
+func markRewrittenIncrAofAsHistory(am *aofManifest) {
+	n := len(am.incrAofList)
+	if n == 0 {
+		return
+	}
+	//开启了AOF时最后一个incr文件是重写开始时打开的，正在写入
+	if server.aofFile != nil {
+		n--
+	}
+	for _, ai := range am.incrAofList[:n] {
+		ai.fileType = aofFileTypeHist
+		am.historyAofList = append(am.historyAofList, ai)
+	}
+	am.incrAofList = am.incrAofList[n:]
+	am.dirty = true
+}
+
+//先写入临时文件再重命名为manifest文件，然后fsync目录，保证新的文件和manifest都已经持久化
+func writeAofManifestFile(buf string) int {
+	amName := getAofManifestFileName()
+	tmpAmName := getTempAofManifestFileName()
+	amFilepath := filepath.Join(server.aofDirname, amName)
+	tmpAmFilepath := filepath.Join(server.aofDirname, tmpAmName)
+
+	f, err := os.OpenFile(tmpAmFilepath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("Can't open the AOF manifest file %s: %v", tmpAmName, err)
+		return redisErr
+	}
+	_, err = f.WriteString(buf)
+	if err != nil {
+		log.Printf("Error trying to write the temporary AOF manifest file %s: %v", tmpAmName, err)
+	} else if err = f.Sync(); err != nil {
+		log.Printf("Fail to fsync the temp AOF file %s: %v", tmpAmName, err)
+	}
+	f.Close()
+	if err != nil {
+		return redisErr
+	}
+
+	if err := os.Rename(tmpAmFilepath, amFilepath); err != nil {
+		log.Printf("Error trying to rename the temporary AOF manifest file %s into %s: %v", tmpAmName, amName, err)
+		return redisErr
+	}
+	if err := fsyncFileDir(amFilepath); err != nil {
+		log.Printf("Fail to fsync AOF directory %s: %v", amFilepath, err)
+		return redisErr
+	}
+	return redisOk
+}
+
+//manifest修改过时写入磁盘
+func persistAofManifest(am *aofManifest) int {
+	if !am.dirty {
+		return redisOk
+	}
+	ret := writeAofManifestFile(am.String())
+	if ret == redisOk {
+		am.dirty = false
+	}
+	return ret
+}
+
+//从旧版本升级：当前目录中的AOF文件移动到AOF目录中作为base文件
+func aofUpgradePrepare(am *aofManifest) {
+	if err := dirCreateIfMissing(server.aofDirname); err != nil {
+		log.Fatalf("Can't open or create append-only dir %s: %v", server.aofDirname, err)
+	}
+
+	am.baseAofInfo = &aofInfo{
+		fileName: server.aofFilename,
+		fileSeq:  1,
+		fileType: aofFileTypeBase,
+	}
+	am.currBaseFileSeq = 1
+	am.dirty = true
+	if persistAofManifest(am) != redisOk {
+		log.Fatalf("Can't persist the AOF manifest while upgrading the old-style AOF")
+	}
+
+	if err := os.Rename(server.aofFilename, filepath.Join(server.aofDirname, server.aofFilename)); err != nil {
+		log.Fatalf("Error trying to rename the existing AOF to the AOF directory %s: %v", server.aofDirname, err)
+	}
+	log.Printf("Successfully migrated an old-style AOF into the AOF directory (%s).", server.aofDirname)
+}
+
+//删除history文件，大文件的删除比较慢，在goroutine中删除
+func aofDelHistoryFiles() {
+	am := server.aofManifest
+	if am == nil || len(am.historyAofList) == 0 {
+		return
+	}
+	for _, ai := range am.historyAofList {
+		log.Printf("Removing the history file %s in the background", ai.fileName)
+		go os.Remove(filepath.Join(server.aofDirname, ai.fileName))
+	}
+	am.historyAofList = nil
+	am.dirty = true
+	persistAofManifest(am)
+}
+
+//AOF目录中的文件是否存在
+func aofFileExist(filename string) bool {
+	return fileExist(filepath.Join(server.aofDirname, filename))
+}
+
+//AOF目录中的文件的大小
+func getAppendOnlyFileSize(filename string) (int64, int) {
+	fi, err := os.Stat(filepath.Join(server.aofDirname, filename))
+	if err != nil {
+		log.Printf("Unable to obtain the AOF file %s length. stat: %v", filename, err)
+		if os.IsNotExist(err) {
+			return 0, aofNotExist
+		}
+		return 0, aofOpenErr
+	}
+	return fi.Size(), aofOk
+}
+
+//base文件和所有incr文件的总大小
+func getBaseAndIncrAppendOnlyFilesSize(am *aofManifest) (int64, int) {
+	var total int64
+	if am.baseAofInfo != nil {
+		size, status := getAppendOnlyFileSize(am.baseAofInfo.fileName)
+		if status != aofOk {
+			return 0, status
+		}
+		total += size
+	}
+	for _, ai := range am.incrAofList {
+		size, status := getAppendOnlyFileSize(ai.fileName)
+		if status != aofOk {
+			return 0, status
+		}
+		total += size
+	}
+	return total, aofOk
+}
+
+//启动时按照manifest依次加载base文件和所有的incr文件
+func loadAppendOnlyFiles(am *aofManifest) int {
+	//当前目录中有旧版本的AOF文件，并且AOF目录中还没有数据时，先升级到AOF目录
+	if fileExist(server.aofFilename) {
+		if !dirExists(server.aofDirname) ||
+			(am.baseAofInfo == nil && len(am.incrAofList) == 0) ||
+			(am.baseAofInfo != nil && len(am.incrAofList) == 0 &&
+				am.baseAofInfo.fileName == server.aofFilename && !aofFileExist(server.aofFilename)) {
+			aofUpgradePrepare(am)
+		}
+	}
+
+	if am.baseAofInfo == nil && len(am.incrAofList) == 0 {
+		return aofNotExist
+	}
+
+	totalNum := len(am.incrAofList)
+	if am.baseAofInfo != nil {
+		totalNum++
+	}
+	totalSize, ret := getBaseAndIncrAppendOnlyFilesSize(am)
+	if ret != aofOk {
+		//manifest中的文件不存在，说明数据已经丢失了
+		if ret == aofNotExist {
+			ret = aofFailed
+		}
+		return ret
+	} else if totalSize == 0 {
+		return aofEmpty
+	}
+
+	var baseSize int64
+	aofNum := 0
+	if am.baseAofInfo != nil {
+		aofName := am.baseAofInfo.fileName
+		baseSize, _ = getAppendOnlyFileSize(aofName)
+		aofNum++
+		start := ustime()
+		ret = loadAppendOnlyFile(filepath.Join(server.aofDirname, aofName), aofNum == totalNum)
+		if ret == aofOpenErr || ret == aofFailed {
+			return ret
+		}
+		if ret == aofOk || ret == aofTruncated {
+			log.Printf("DB loaded from base file %s: %.3f seconds", aofName, float64(ustime()-start)/1000000)
+		}
+	}
+	for _, ai := range am.incrAofList {
+		aofNum++
+		start := ustime()
+		ret = loadAppendOnlyFile(filepath.Join(server.aofDirname, ai.fileName), aofNum == totalNum)
+		if ret == aofOpenErr || ret == aofFailed {
+			return ret
+		}
+		if ret == aofOk || ret == aofTruncated {
+			log.Printf("DB loaded from incr file %s: %.3f seconds", ai.fileName, float64(ustime()-start)/1000000)
+		}
+		//至少有一个文件不为空，空的incr文件不影响结果
+		if ret == aofEmpty {
+			ret = aofOk
+		}
+	}
+
+	//最后一个文件可能被截断了，重新计算大小
+	//没有保存上一次重写之后的大小，使用base文件的大小，重写期间写入的incr文件可能会让下一次自动重写提前
+	server.aofCurrentSize, _ = getBaseAndIncrAppendOnlyFilesSize(am)
+	server.aofRewriteBaseSize = baseSize
+	server.aofFsyncOffset = server.aofCurrentSize
+	return ret
+}
+
+//-----------------------------------------------------------------------------
+// AOF rewrite
+//-----------------------------------------------------------------------------
+
+//同步生成RDB格式的base文件，启动时没有任何AOF文件时使用
+func rewriteAppendOnlyFile(filename string) int {
+	tmpfile := fmt.Sprintf("temp-rewriteaof-%d.aof", server.pid)
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		log.Printf("Opening the temp file for AOF rewrite in rewriteAppendOnlyFile(): %v", err)
+		return redisErr
+	}
+
+	r := &rio{flush: func(p []byte) error {
+		_, err := f.Write(p)
+		return err
+	}}
+	rdbSaveRio(r, rdbFlagsAofPreamble)
+	err = r.err
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		log.Printf("Write error writing append only file on disk: %v", err)
+		os.Remove(tmpfile)
+		return redisErr
+	}
+	return redisOk
+}
+
+//BGREWRITEAOF开始时打开新的incr文件，之后的命令都写入新的文件
+//重写生成的base文件包含了之前所有文件中的数据，重写完成后之前的文件都可以删除
+func openNewIncrAofForAppend() int {
+	//没有开启AOF时只生成base文件
+	if server.aofState == redisAofOff {
+		return redisOk
+	}
+
+	tempAm := server.aofManifest.dup()
+	newAofName := getNewIncrAofName(tempAm)
+	newAofFilepath := filepath.Join(server.aofDirname, newAofName)
+	f, err := os.OpenFile(newAofFilepath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("Can't open the append-only file %s: %v", newAofName, err)
+		return redisErr
+	}
+	if persistAofManifest(tempAm) != redisOk {
+		f.Close()
+		os.Remove(newAofFilepath)
+		return redisErr
+	}
+	log.Printf("Creating AOF incr file %s on background rewrite", newAofName)
+
+	//everysec时可以延迟fsync之前的文件，always时之前的文件已经fsync过了
+	aofBackgroundFsyncAndClose(server.aofFile)
+	server.aofFsyncOffset = server.aofCurrentSize
+	server.aofLastFsync = time.Now().Unix()
+	server.aofFile = f
+	server.aofLastIncrSize = 0
+	server.aofManifest = tempAm
+	return redisOk
+}
+
+//开始BGREWRITEAOF，已经有后台任务在执行时返回redisErr
+//切换到新的incr文件，然后和BGSAVE一样在定时任务中将当前数据的快照写入临时文件，
+//重写期间的写命令写入新的incr文件，重写完成后临时文件成为新的base文件
+//快照的遍历、incr文件的切换和重写完成的处理都在持有server.mu时执行，和写命令不会并发
+func rewriteAppendOnlyFileBackground() int {
+	if hasActiveChildProcess() {
+		return redisErr
+	}
+	if err := dirCreateIfMissing(server.aofDirname); err != nil {
+		log.Printf("Can't open or create append-only dir %s: %v", server.aofDirname, err)
+		server.aofLastbgrewriteStatus = redisErr
+		return redisErr
+	}
+
+	//新的incr文件的第一条命令之前写入SELECT
+	server.aofSelectedDb = -1
+	if server.aofState == redisAofOn {
+		flushAppendOnlyFile()
+		//缓冲区中的命令已经执行了，快照中包含它们的修改，不能再写入新的incr文件
+		if len(server.aofBuf) > 0 {
+			log.Printf("Can't rewrite the AOF while the AOF buffer can't be written to the disk")
+			server.aofLastbgrewriteStatus = redisErr
+			return redisErr
+		}
+	}
+	if openNewIncrAofForAppend() != redisOk {
+		server.aofLastbgrewriteStatus = redisErr
+		return redisErr
+	}
+
+	tmpfile := fmt.Sprintf("temp-rewriteaof-bg-%d.aof", server.pid)
+	rdbSnapshotCreate(redisChildTypeAof, tmpfile, "", rdbFlagsAofPreamble)
+	server.aofRewriteScheduled = false
+	server.aofRewriteTimeStart = time.Now().Unix()
+	log.Printf("Background append only file rewriting started")
+	return redisOk
+}
+
+//BGREWRITEAOF结束后在serverCron中调用，持有server.mu
+func backgroundRewriteDoneHandler(err error) {
+	tmpfile := server.rdbSnapshot.tmpfile
+	if err == nil {
+		err = aofInstallRewrittenBase(tmpfile)
+	}
+	if err == nil {
+		log.Printf("Background AOF rewrite terminated with success")
+		server.aofLastbgrewriteStatus = redisOk
+	} else {
+		log.Printf("Background AOF rewrite terminated with error: %v", err)
+		server.aofLastbgrewriteStatus = redisErr
+		os.Remove(tmpfile)
+	}
+	server.aofRewriteTimeLast = time.Now().Unix() - server.aofRewriteTimeStart
+	server.aofRewriteTimeStart = -1
+}
+
+//重写生成的临时文件成为新的base文件，之前的base文件和incr文件标记为history并删除
+func aofInstallRewrittenBase(tmpfile string) error {
+	tempAm := server.aofManifest.dup()
+	newBaseName := getNewBaseFileNameAndMarkPreAsHistory(tempAm)
+	newBaseFilepath := filepath.Join(server.aofDirname, newBaseName)
+	if err := os.Rename(tmpfile, newBaseFilepath); err != nil {
+		return fmt.Errorf("error trying to rename the temporary AOF base file %s into %s: %v", tmpfile, newBaseName, err)
+	}
+	markRewrittenIncrAofAsHistory(tempAm)
+	if persistAofManifest(tempAm) != redisOk {
+		os.Remove(newBaseFilepath)
+		return errors.New("can't persist the AOF manifest")
+	}
+	server.aofManifest = tempAm
+	aofDelHistoryFiles()
+
+	if server.aofFile != nil {
+		baseSize, _ := getAppendOnlyFileSize(newBaseName)
+		server.aofCurrentSize = baseSize + server.aofLastIncrSize
+		server.aofRewriteBaseSize = server.aofCurrentSize
+		server.aofFsyncOffset = server.aofCurrentSize
+	}
+	return nil
+}
+
+//BGREWRITEAOF
+func bgrewriteaofCommand(client *redisClient) {
+	if server.childType == redisChildTypeAof {
+		addReplyError(client, "Background append only file rewriting already in progress")
+	} else if hasActiveChildProcess() || server.inExec {
+		//BGSAVE或者事务结束之后在定时任务中开始
+		server.aofRewriteScheduled = true
+		addReplyStatus(client, "Background append only file rewriting scheduled")
+	} else if rewriteAppendOnlyFileBackground() == redisOk {
+		addReplyStatus(client, "Background append only file rewriting started")
+	} else {
+		addReplyError(client, "Can't execute an AOF background rewriting. "+
+			"Please check the server logs for more information.")
+	}
+}
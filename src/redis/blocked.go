@@ -0,0 +1,235 @@
+package redis
+
+import (
+	"container/list"
+	"math"
+	"strconv"
+)
+
+//阻塞类型
+const (
+	redisBlockedNone   = 0
+	redisBlockedList   = 1 //BLPOP & co.
+	redisBlockedStream = 4 //XREAD.
+)
+
+//阻塞命令的状态
+type blockingState struct {
+	timeout int64 //阻塞的超时时间（毫秒时间戳），0表示永久阻塞
+	keys    *dict //阻塞等待的key，key = sds, value = *robj，XREAD/XREADGROUP为*streamID
+
+	//BLMOVE的参数
+	target    *robj //目标key
+	wherefrom int   //从源list的哪一端弹出元素
+	whereto   int   //添加到目标list的哪一端
+
+	count int64 //BLMPOP弹出元素的数量，为0时表示BLPOP/BRPOP
+
+	//XREAD/XREADGROUP的参数
+	xreadCount      int64 //最多返回的消息数量，0表示不限制
+	xreadGroup      sds   //XREADGROUP的消费组名称，XREAD时为空
+	xreadConsumer   sds   //XREADGROUP的消费者名称
+	xreadGroupNoAck bool  //NOACK，消息不添加到PEL中
+}
+
+//key可能已经可以处理被阻塞的客户端了（比如有数据push到了list中）
+type readyList struct {
+	db  *redisDb
+	key *robj
+}
+
+//从对象中解析超时时间，返回毫秒时间戳，0表示永久阻塞
+//unit为unitSeconds时可以是小数，比如BLPOP；unitMilliseconds时必须是整数，比如XREAD的BLOCK
+func getTimeoutFromObjectOrReply(client *redisClient, object *robj, unit int) (int64, bool) {
+	var timeout int64
+	if unit == unitSeconds {
+		tval, err := strconv.ParseFloat(object.ptr.(sds), 64)
+		if err != nil || math.IsNaN(tval) || math.IsInf(tval, 0) {
+			addReplyError(client, "timeout is not a float or out of range")
+			return 0, false
+		}
+		//向上取整，不足1毫秒的超时时间不能变成0（永久阻塞）
+		tval = math.Ceil(tval * 1000)
+		if tval >= math.MaxInt64 {
+			addReplyError(client, "timeout is out of range")
+			return 0, false
+		}
+		timeout = int64(tval)
+	} else {
+		tval, ok := getLongLongFromObjectOrReply(client, object, "timeout is not an integer or out of range")
+		if !ok {
+			return 0, false
+		}
+		timeout = tval
+	}
+	if timeout < 0 {
+		addReplyError(client, "timeout is negative")
+		return 0, false
+	}
+
+	if timeout > 0 {
+		now := mstime()
+		if timeout > math.MaxInt64-now {
+			addReplyError(client, "timeout is out of range")
+			return 0, false
+		}
+		timeout += now
+	}
+	return timeout, true
+}
+
+//阻塞客户端，客户端不会收到回复，也不会处理后续的命令，直到被唤醒或者超时
+func blockClient(client *redisClient, btype int) {
+	client.flags |= redisBlocked
+	client.btype = btype
+	server.blockedClients++
+}
+
+//阻塞客户端，等待keys中的任意一个key可以被处理
+//ids不为nil时（XREAD/XREADGROUP）为每个key对应的消息ID，只有ID更大的消息才能唤醒客户端
+func blockForKeys(client *redisClient, btype int, keys []*robj, timeout int64, target *robj, ids []streamID) {
+	client.bpop.timeout = timeout
+	client.bpop.target = target
+
+	for j, key := range keys {
+		var value interface{} = key
+		if ids != nil {
+			id := ids[j]
+			value = &id
+		}
+
+		//同一个key只需要阻塞一次
+		if client.bpop.keys.dictAdd(key.ptr, value) != dictOk {
+			continue
+		}
+
+		//将客户端添加到db.blockingKeys中key对应的链表末尾，按照阻塞的先后顺序唤醒
+		var l *list.List
+		de := client.db.blockingKeys.dictFind(key.ptr)
+		if de == nil {
+			l = list.New()
+			client.db.blockingKeys.dictAdd(key.ptr, l)
+		} else {
+			l = de.(*list.List)
+		}
+		l.PushBack(client)
+	}
+	blockClient(client, btype)
+}
+
+//将客户端从所有阻塞的key中移除
+func unblockClientWaitingData(client *redisClient) {
+	client.bpop.keys.dictForEach(func(k interface{}, _ interface{}) bool {
+		de := client.db.blockingKeys.dictFind(k)
+		if de == nil {
+			return true
+		}
+		l := de.(*list.List)
+		listDelValue(l, client)
+		//没有阻塞的客户端了，删除key
+		if l.Len() == 0 {
+			client.db.blockingKeys.dictDelete(k)
+		}
+		return true
+	})
+	client.bpop.keys = dictCreate()
+	client.bpop.target = nil
+	client.bpop.count = 0
+	client.bpop.xreadCount = 0
+	client.bpop.xreadGroup = ""
+	client.bpop.xreadConsumer = ""
+	client.bpop.xreadGroupNoAck = false
+}
+
+//取消客户端的阻塞状态，客户端在beforeSleep中继续处理缓冲区中剩余的命令
+func unblockClient(client *redisClient) {
+	if client.btype == redisBlockedList || client.btype == redisBlockedStream {
+		unblockClientWaitingData(client)
+	} else {
+		panic("Unknown btype in unblockClient().")
+	}
+
+	client.flags &^= redisBlocked
+	client.btype = redisBlockedNone
+	server.blockedClients--
+
+	if client.flags&redisUnblocked == 0 {
+		client.flags |= redisUnblocked
+		server.unblockedClients.PushBack(client)
+	}
+}
+
+//阻塞超时，回复客户端
+func replyToBlockedClientTimedOut(client *redisClient) {
+	if client.btype == redisBlockedList || client.btype == redisBlockedStream {
+		addReplyNullArray(client)
+	} else {
+		panic("Unknown btype in replyToBlockedClientTimedOut().")
+	}
+}
+
+//继续处理被唤醒的客户端缓冲区中剩余的命令
+func processUnblockedClients() {
+	for e := server.unblockedClients.Front(); e != nil; e = server.unblockedClients.Front() {
+		client := server.unblockedClients.Remove(e).(*redisClient)
+		client.flags &^= redisUnblocked
+
+		//客户端可能在处理其它命令时又被阻塞了
+		if client.flags&redisBlocked == 0 && len(client.queryBuf) > 0 {
+			processInputBuffer(client)
+		}
+	}
+}
+
+//检查阻塞的客户端是否超时
+//在serverCron中调用，持有server.mu，不会和事件处理并发
+func clientsCronHandleTimeout(client *redisClient, now int64) {
+	if client.flags&redisBlocked != 0 && client.bpop.timeout != 0 && client.bpop.timeout < now {
+		replyToBlockedClientTimedOut(client)
+		unblockClient(client)
+	}
+}
+
+//key有新数据了，如果有客户端阻塞在这个key上，将它添加到server.readyKeys中，
+//在命令执行完之后通过handleClientsBlockedOnKeys唤醒客户端
+func signalKeyAsReady(db *redisDb, key *robj) {
+	//没有客户端阻塞在这个key上
+	if db.blockingKeys.dictFind(key.ptr) == nil {
+		return
+	}
+
+	//已经添加过了
+	if db.readyKeys.dictFind(key.ptr) != nil {
+		return
+	}
+
+	server.readyKeys.PushBack(&readyList{db: db, key: key})
+	db.readyKeys.dictAdd(key.ptr, key)
+}
+
+//处理server.readyKeys中的key，按照阻塞的先后顺序唤醒客户端
+//唤醒客户端的过程中可能会产生新的ready key（比如BLMOVE的目标key），所以循环处理直到为空
+func handleClientsBlockedOnKeys() {
+	for server.readyKeys.Len() > 0 {
+		l := server.readyKeys
+		server.readyKeys = list.New()
+
+		for e := l.Front(); e != nil; e = e.Next() {
+			rl := e.Value.(*readyList)
+
+			//先从db.readyKeys中删除，后续的操作可以再次添加这个key
+			rl.db.readyKeys.dictDelete(rl.key.ptr)
+
+			//唤醒客户端时执行的操作作为一个执行单元传播
+			server.executionNesting++
+			o := rl.db.lookupKeyWrite(rl.key)
+			if o != nil && o.rtype == redisList {
+				serveClientsBlockedOnListKey(o, rl)
+			} else if o != nil && o.rtype == redisStream {
+				serveClientsBlockedOnStreamKey(o, rl)
+			}
+			server.executionNesting--
+			propagatePendingCommands()
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package redis
+
+import "sort"
+
+//B树，key为streamID，用来按照ID的顺序存储stream的消息和消费组的PEL
+//节点中的key按照从小到大的顺序排列，叶子节点没有children
+
+//B树的最小度数，每个节点最多有2*btreeDegree-1个key，除了根节点最少有btreeDegree-1个key
+const btreeDegree = 16
+
+type btreeItem struct {
+	key   streamID
+	value interface{}
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode
+}
+
+type btree struct {
+	root   *btreeNode
+	length int //key的数量
+	nodes  int //节点的数量
+}
+
+func newBtree() *btree {
+	return &btree{root: &btreeNode{}, nodes: 1}
+}
+
+func (n *btreeNode) leaf() bool {
+	return len(n.children) == 0
+}
+
+//查找第一个大于等于key的位置，found表示这个位置的key和key相等
+func (n *btreeNode) search(key streamID) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return streamCompareID(&n.items[i].key, &key) >= 0
+	})
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+//查找key对应的value
+func (t *btree) find(key streamID) (interface{}, bool) {
+	n := t.root
+	for {
+		i, found := n.search(key)
+		if found {
+			return n.items[i].value, true
+		}
+		if n.leaf() {
+			return nil, false
+		}
+		n = n.children[i]
+	}
+}
+
+//插入key，key已经存在时替换value并返回false
+func (t *btree) insert(key streamID, value interface{}) bool {
+	if t.replace(key, value) {
+		return false
+	}
+
+	//根节点已满，分裂根节点，树的高度加1
+	if len(t.root.items) == 2*btreeDegree-1 {
+		root := &btreeNode{children: []*btreeNode{t.root}}
+		t.root = root
+		t.nodes++
+		t.splitChild(root, 0)
+	}
+	t.insertNonFull(t.root, key, value)
+	t.length++
+	return true
+}
+
+//key存在时替换value
+func (t *btree) replace(key streamID, value interface{}) bool {
+	n := t.root
+	for {
+		i, found := n.search(key)
+		if found {
+			n.items[i].value = value
+			return true
+		}
+		if n.leaf() {
+			return false
+		}
+		n = n.children[i]
+	}
+}
+
+//分裂n的第i个子节点，子节点中间的key上移到n中
+func (t *btree) splitChild(n *btreeNode, i int) {
+	child := n.children[i]
+	mid := child.items[btreeDegree-1]
+
+	right := &btreeNode{items: append([]btreeItem(nil), child.items[btreeDegree:]...)}
+	if !child.leaf() {
+		right.children = append([]*btreeNode(nil), child.children[btreeDegree:]...)
+		child.children = child.children[:btreeDegree]
+	}
+	child.items = child.items[:btreeDegree-1]
+	t.nodes++
+
+	n.items = append(n.items, btreeItem{})
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = mid
+
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = right
+}
+
+//在没有满的节点中插入key，经过的满节点会先分裂
+func (t *btree) insertNonFull(n *btreeNode, key streamID, value interface{}) {
+	for {
+		i, _ := n.search(key)
+		if n.leaf() {
+			n.items = append(n.items, btreeItem{})
+			copy(n.items[i+1:], n.items[i:])
+			n.items[i] = btreeItem{key: key, value: value}
+			return
+		}
+		if len(n.children[i].items) == 2*btreeDegree-1 {
+			t.splitChild(n, i)
+			if streamCompareID(&key, &n.items[i].key) > 0 {
+				i++
+			}
+		}
+		n = n.children[i]
+	}
+}
+
+//删除key，返回被删除的value
+func (t *btree) remove(key streamID) (interface{}, bool) {
+	value, ok := t.removeFrom(t.root, key)
+	if ok {
+		t.length--
+	}
+	//根节点没有key了，树的高度减1
+	if len(t.root.items) == 0 && !t.root.leaf() {
+		t.root = t.root.children[0]
+		t.nodes--
+	}
+	return value, ok
+}
+
+func (t *btree) removeFrom(n *btreeNode, key streamID) (interface{}, bool) {
+	i, found := n.search(key)
+	if n.leaf() {
+		if !found {
+			return nil, false
+		}
+		value := n.items[i].value
+		n.items = append(n.items[:i], n.items[i+1:]...)
+		return value, true
+	}
+
+	if found {
+		value := n.items[i].value
+		if len(n.children[i].items) >= btreeDegree {
+			//用前驱替换key，然后从左子树中删除前驱
+			pred := n.children[i].max()
+			n.items[i] = pred
+			t.removeFrom(n.children[i], pred.key)
+		} else if len(n.children[i+1].items) >= btreeDegree {
+			//用后继替换key，然后从右子树中删除后继
+			succ := n.children[i+1].min()
+			n.items[i] = succ
+			t.removeFrom(n.children[i+1], succ.key)
+		} else {
+			//左右子节点都只有最少数量的key，合并后再删除
+			t.merge(n, i)
+			t.removeFrom(n.children[i], key)
+		}
+		return value, true
+	}
+
+	//保证下降的子节点至少有btreeDegree个key，删除后不会少于最少数量
+	if len(n.children[i].items) < btreeDegree {
+		if i > 0 && len(n.children[i-1].items) >= btreeDegree {
+			t.borrowFromLeft(n, i)
+		} else if i < len(n.children)-1 && len(n.children[i+1].items) >= btreeDegree {
+			t.borrowFromRight(n, i)
+		} else if i < len(n.children)-1 {
+			t.merge(n, i)
+		} else {
+			t.merge(n, i-1)
+			i--
+		}
+	}
+	return t.removeFrom(n.children[i], key)
+}
+
+//合并n的第i个和第i+1个子节点，n中第i个key下移到合并后的节点中
+func (t *btree) merge(n *btreeNode, i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.items = append(left.items, n.items[i])
+	left.items = append(left.items, right.items...)
+	left.children = append(left.children, right.children...)
+
+	n.items = append(n.items[:i], n.items[i+1:]...)
+	n.children = append(n.children[:i+1], n.children[i+2:]...)
+	t.nodes--
+}
+
+//从左边的兄弟节点借一个key
+func (t *btree) borrowFromLeft(n *btreeNode, i int) {
+	child, left := n.children[i], n.children[i-1]
+
+	child.items = append(child.items, btreeItem{})
+	copy(child.items[1:], child.items)
+	child.items[0] = n.items[i-1]
+	n.items[i-1] = left.items[len(left.items)-1]
+	left.items = left.items[:len(left.items)-1]
+
+	if !left.leaf() {
+		child.children = append(child.children, nil)
+		copy(child.children[1:], child.children)
+		child.children[0] = left.children[len(left.children)-1]
+		left.children = left.children[:len(left.children)-1]
+	}
+}
+
+//从右边的兄弟节点借一个key
+func (t *btree) borrowFromRight(n *btreeNode, i int) {
+	child, right := n.children[i], n.children[i+1]
+
+	child.items = append(child.items, n.items[i])
+	n.items[i] = right.items[0]
+	right.items = append(right.items[:0], right.items[1:]...)
+
+	if !right.leaf() {
+		child.children = append(child.children, right.children[0])
+		right.children = append(right.children[:0], right.children[1:]...)
+	}
+}
+
+func (n *btreeNode) min() btreeItem {
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.items[0]
+}
+
+func (n *btreeNode) max() btreeItem {
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1]
+}
+
+//最小的key，树为空时返回false
+func (t *btree) first() (btreeItem, bool) {
+	if t.length == 0 {
+		return btreeItem{}, false
+	}
+	return t.root.min(), true
+}
+
+//最大的key，树为空时返回false
+func (t *btree) last() (btreeItem, bool) {
+	if t.length == 0 {
+		return btreeItem{}, false
+	}
+	return t.root.max(), true
+}
+
+//从小到大遍历大于等于from的key，fn返回false时停止遍历
+func (t *btree) ascend(from streamID, fn func(key streamID, value interface{}) bool) {
+	t.root.ascend(from, fn)
+}
+
+func (n *btreeNode) ascend(from streamID, fn func(key streamID, value interface{}) bool) bool {
+	i, _ := n.search(from)
+	for ; i <= len(n.items); i++ {
+		if !n.leaf() && !n.children[i].ascend(from, fn) {
+			return false
+		}
+		if i < len(n.items) && !fn(n.items[i].key, n.items[i].value) {
+			return false
+		}
+	}
+	return true
+}
+
+//从大到小遍历小于等于from的key，fn返回false时停止遍历
+func (t *btree) descend(from streamID, fn func(key streamID, value interface{}) bool) {
+	t.root.descend(from, fn)
+}
+
+func (n *btreeNode) descend(from streamID, fn func(key streamID, value interface{}) bool) bool {
+	//第一个大于from的位置，items[0:i]中的key都小于等于from
+	i := sort.Search(len(n.items), func(i int) bool {
+		return streamCompareID(&n.items[i].key, &from) > 0
+	})
+	for ; i >= 0; i-- {
+		if !n.leaf() && !n.children[i].descend(from, fn) {
+			return false
+		}
+		if i > 0 && !fn(n.items[i-1].key, n.items[i-1].value) {
+			return false
+		}
+	}
+	return true
+}
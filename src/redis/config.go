@@ -0,0 +1,385 @@
+package redis
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var maxMemoryPolicyNames = map[string]int{
+	"volatile-lru":    redisMaxMemoryVolatileLru,
+	"volatile-ttl":    redisMaxMemoryVolatileTtl,
+	"volatile-random": redisMaxMemoryVolatileRandom,
+	"allkeys-lru":     redisMaxMemoryAllKeysLru,
+	"allkeys-random":  redisMaxMemoryAllKeysRandom,
+	"volatile-lfu":    redisMaxMemoryVolatileLfu,
+	"allkeys-lfu":     redisMaxMemoryAllKeysLfu,
+	"noeviction":      redisMaxMemoryNoEviction,
+}
+
+var clientTypeNames = map[string]int{
+	"normal":  redisClientTypeNormal,
+	"slave":   redisClientTypeSlave,
+	"replica": redisClientTypeSlave,
+	"pubsub":  redisClientTypePubsub,
+}
+
+//配置文件中第一次出现save时清除默认的保存条件
+var saveParamsLoaded bool
+
+//解析yes/no，不合法时返回-1
+func yesnotoi(s string) int {
+	if strings.EqualFold(s, "yes") {
+		return 1
+	} else if strings.EqualFold(s, "no") {
+		return 0
+	}
+	return -1
+}
+
+//添加一个自动保存条件
+func appendServerSaveParams(seconds int64, changes int64) {
+	server.saveparams = append(server.saveparams, saveparam{seconds: seconds, changes: changes})
+}
+
+//加载配置文件
+func loadServerConfig(filename string) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatalf("Fatal error, can't open config file '%s': %v", filename, err)
+	}
+	loadServerConfigFromString(string(content))
+}
+
+//逐行解析配置，格式为：<配置名> <参数1> <参数2> ...，以#开头的行为注释
+func loadServerConfigFromString(config string) {
+	lines := strings.Split(config, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		argv, ok := sdssplitargs(line)
+		if !ok {
+			log.Fatalf("*** FATAL CONFIG FILE ERROR *** line %d: '%s' Unbalanced quotes in configuration line", i+1, line)
+		}
+		if len(argv) == 0 {
+			continue
+		}
+		argv[0] = strings.ToLower(argv[0])
+
+		if err := setConfigOption(argv); err != nil {
+			log.Fatalf("*** FATAL CONFIG FILE ERROR *** line %d: '%s' %v", i+1, line, err)
+		}
+	}
+}
+
+//设置一个配置项，argv[0]为配置名（小写），后面为参数
+func setConfigOption(argv []sds) error {
+	name := argv[0]
+	argc := len(argv)
+
+	switch {
+	case name == "port" && argc == 2:
+		port, err := strconv.Atoi(argv[1])
+		if err != nil || port < 0 || port > 65535 {
+			return errors.New("Invalid port")
+		}
+		server.port = port
+	case name == "bind" && argc == 2:
+		server.bindaddr = argv[1]
+	case name == "tcp-backlog" && argc == 2:
+		backlog, err := strconv.Atoi(argv[1])
+		if err != nil || backlog < 0 {
+			return errors.New("Invalid backlog value")
+		}
+		server.tcpBacklog = backlog
+	case name == "hz" && argc == 2:
+		hz, err := strconv.Atoi(argv[1])
+		if err != nil || hz <= 0 || hz > 500 {
+			return errors.New("Invalid hz value")
+		}
+		server.hz = hz
+	case name == "databases" && argc == 2:
+		dbnum, err := strconv.Atoi(argv[1])
+		if err != nil || dbnum < 1 {
+			return errors.New("Invalid number of databases")
+		}
+		server.dbnum = dbnum
+	case name == "maxclients" && argc == 2:
+		maxClients, err := strconv.ParseUint(argv[1], 10, 32)
+		if err != nil || maxClients < 1 {
+			return errors.New("Invalid max clients limit")
+		}
+		server.maxClients = uint(maxClients)
+	case name == "maxmemory" && argc == 2:
+		maxMemory, ok := memtoll(argv[1])
+		if !ok || maxMemory < 0 {
+			return errors.New("Invalid maxmemory value")
+		}
+		server.maxMemory = uint64(maxMemory)
+	case name == "maxmemory-policy" && argc == 2:
+		policy, ok := maxMemoryPolicyNames[strings.ToLower(argv[1])]
+		if !ok {
+			return errors.New("Invalid maxmemory policy")
+		}
+		server.maxMemoryPolicy = policy
+	case name == "maxmemory-samples" && argc == 2:
+		samples, err := strconv.Atoi(argv[1])
+		if err != nil || samples <= 0 {
+			return errors.New("maxmemory-samples must be 1 or greater")
+		}
+		server.maxMemorySamples = samples
+	case name == "lfu-log-factor" && argc == 2:
+		factor, err := strconv.Atoi(argv[1])
+		if err != nil || factor < 0 {
+			return errors.New("Invalid lfu-log-factor value")
+		}
+		server.lfuLogFactor = factor
+	case name == "lfu-decay-time" && argc == 2:
+		decay, err := strconv.Atoi(argv[1])
+		if err != nil || decay < 0 {
+			return errors.New("Invalid lfu-decay-time value")
+		}
+		server.lfuDecayTime = decay
+	case name == "requirepass" && argc == 2:
+		server.requirepass = argv[1]
+	case (name == "hash-max-listpack-entries" || name == "hash-max-ziplist-entries") && argc == 2:
+		entries, err := strconv.Atoi(argv[1])
+		if err != nil || entries < 0 {
+			return errors.New("Invalid hash-max-listpack-entries value")
+		}
+		server.hashMaxListpackEntries = entries
+	case (name == "hash-max-listpack-value" || name == "hash-max-ziplist-value") && argc == 2:
+		value, ok := memtoll(argv[1])
+		if !ok || value < 0 {
+			return errors.New("Invalid hash-max-listpack-value value")
+		}
+		server.hashMaxListpackValue = int(value)
+	case name == "set-max-intset-entries" && argc == 2:
+		entries, err := strconv.Atoi(argv[1])
+		if err != nil || entries < 0 {
+			return errors.New("Invalid set-max-intset-entries value")
+		}
+		server.setMaxIntsetEntries = entries
+	case (name == "zset-max-listpack-entries" || name == "zset-max-ziplist-entries") && argc == 2:
+		entries, err := strconv.Atoi(argv[1])
+		if err != nil || entries < 0 {
+			return errors.New("Invalid zset-max-listpack-entries value")
+		}
+		server.zsetMaxListpackEntries = entries
+	case (name == "zset-max-listpack-value" || name == "zset-max-ziplist-value") && argc == 2:
+		value, ok := memtoll(argv[1])
+		if !ok || value < 0 {
+			return errors.New("Invalid zset-max-listpack-value value")
+		}
+		server.zsetMaxListpackValue = int(value)
+	case name == "hll-sparse-max-bytes" && argc == 2:
+		value, ok := memtoll(argv[1])
+		if !ok || value < 0 {
+			return errors.New("Invalid hll-sparse-max-bytes value")
+		}
+		server.hllSparseMaxBytes = int(value)
+	case name == "notify-keyspace-events" && argc == 2:
+		flags := keyspaceEventsStringToFlags(argv[1])
+		if flags == -1 {
+			return errors.New("Invalid event class character. Use 'Ag$lshzxetmnKE'.")
+		}
+		server.notifyKeyspaceEvents = flags
+	case name == "client-output-buffer-limit" && argc == 5:
+		//client-output-buffer-limit <class> <hard limit> <soft limit> <soft seconds>
+		class, ok := clientTypeNames[strings.ToLower(argv[1])]
+		if !ok {
+			return errors.New("Invalid client class specified in buffer limit configuration.")
+		}
+		hard, hardOk := memtoll(argv[2])
+		soft, softOk := memtoll(argv[3])
+		softSeconds, err := strconv.ParseInt(argv[4], 10, 64)
+		if !hardOk || !softOk || err != nil || hard < 0 || soft < 0 || softSeconds < 0 {
+			return errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		server.clientObufLimits[class] = clientBufferLimitsConfig{
+			hardLimitBytes:   uint64(hard),
+			softLimitBytes:   uint64(soft),
+			softLimitSeconds: softSeconds,
+		}
+	case name == "save" && argc >= 2:
+		//save <seconds> <changes> [<seconds> <changes> ...]，save ""关闭自动保存
+		if !saveParamsLoaded {
+			server.saveparams = nil
+			saveParamsLoaded = true
+		}
+		if argc == 2 && argv[1] == "" {
+			server.saveparams = nil
+			break
+		}
+		if argc%2 == 0 {
+			return errors.New("Invalid save parameters")
+		}
+		for j := 1; j < argc; j += 2 {
+			seconds, err1 := strconv.ParseInt(argv[j], 10, 64)
+			changes, err2 := strconv.ParseInt(argv[j+1], 10, 64)
+			if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+				return errors.New("Invalid save parameters")
+			}
+			appendServerSaveParams(seconds, changes)
+		}
+	case name == "dir" && argc == 2:
+		if err := os.Chdir(argv[1]); err != nil {
+			return err
+		}
+	case name == "dbfilename" && argc == 2:
+		if filepath.Base(argv[1]) != argv[1] {
+			return errors.New("dbfilename can't be a path, just a filename")
+		}
+		server.rdbFilename = argv[1]
+	case name == "rdbchecksum" && argc == 2:
+		yes := yesnotoi(argv[1])
+		if yes == -1 {
+			return errors.New("argument must be 'yes' or 'no'")
+		}
+		server.rdbChecksum = yes == 1
+	case name == "stop-writes-on-bgsave-error" && argc == 2:
+		yes := yesnotoi(argv[1])
+		if yes == -1 {
+			return errors.New("argument must be 'yes' or 'no'")
+		}
+		server.stopWritesOnBgsaveErr = yes == 1
+	case name == "appendonly" && argc == 2:
+		yes := yesnotoi(argv[1])
+		if yes == -1 {
+			return errors.New("argument must be 'yes' or 'no'")
+		}
+		if yes == 1 {
+			server.aofState = redisAofOn
+		} else {
+			server.aofState = redisAofOff
+		}
+	case name == "appendfilename" && argc == 2:
+		if filepath.Base(argv[1]) != argv[1] {
+			return errors.New("appendfilename can't be a path, just a filename")
+		}
+		server.aofFilename = argv[1]
+	case name == "appenddirname" && argc == 2:
+		if filepath.Base(argv[1]) != argv[1] {
+			return errors.New("appenddirname can't be a path, just a dirname")
+		}
+		server.aofDirname = argv[1]
+	case name == "appendfsync" && argc == 2:
+		fsync, ok := aofFsyncNames[strings.ToLower(argv[1])]
+		if !ok {
+			return errors.New("argument must be 'no', 'always' or 'everysec'")
+		}
+		server.aofFsync = fsync
+	case name == "aof-load-truncated" && argc == 2:
+		yes := yesnotoi(argv[1])
+		if yes == -1 {
+			return errors.New("argument must be 'yes' or 'no'")
+		}
+		server.aofLoadTruncated = yes == 1
+	case name == "auto-aof-rewrite-percentage" && argc == 2:
+		perc, err := strconv.Atoi(argv[1])
+		if err != nil || perc < 0 {
+			return errors.New("Invalid negative percentage for AOF auto rewrite")
+		}
+		server.aofRewritePerc = perc
+	case name == "auto-aof-rewrite-min-size" && argc == 2:
+		size, ok := memtoll(argv[1])
+		if !ok || size < 0 {
+			return errors.New("Invalid AOF auto rewrite min size")
+		}
+		server.aofRewriteMinSize = size
+	default:
+		return errors.New("Bad directive or wrong number of arguments")
+	}
+	return nil
+}
+
+//可以通过CONFIG GET/SET在运行时读取和修改的配置，其它配置只能在配置文件中设置
+var configRuntimeOptions = []struct {
+	name string
+	get  func() string
+}{
+	{"notify-keyspace-events", func() string { return keyspaceEventsFlagsToString(server.notifyKeyspaceEvents) }},
+}
+
+var configHelp = []string{
+	"GET <pattern>",
+	"    Return parameters matching the glob-like <pattern> and their values.",
+	"SET <directive> <value>",
+	"    Set the configuration <directive> to <value>.",
+}
+
+//CONFIG GET pattern [pattern ...]
+//CONFIG SET parameter value [parameter value ...]
+func configCommand(client *redisClient) {
+	opt := strings.ToLower(client.argv[1].ptr.(sds))
+
+	switch {
+	case opt == "help" && client.argc == 2:
+		addReplyHelp(client, configHelp)
+	case opt == "get" && client.argc >= 3:
+		configGetCommand(client)
+	case opt == "set" && client.argc >= 4 && client.argc%2 == 0:
+		configSetCommand(client)
+	case opt == "get" || opt == "set":
+		addReplySubcommandArityError(client)
+	default:
+		addReplySubcommandSyntaxError(client)
+	}
+}
+
+func configGetCommand(client *redisClient) {
+	var matched []int
+	for i, opt := range configRuntimeOptions {
+		for j := 2; j < client.argc; j++ {
+			if stringmatchlen(client.argv[j].ptr.(sds), opt.name, true) {
+				matched = append(matched, i)
+				break
+			}
+		}
+	}
+	addReplyMapLen(client, len(matched))
+	for _, i := range matched {
+		addReplyBulkCBuffer(client, configRuntimeOptions[i].name)
+		addReplyBulkCBuffer(client, configRuntimeOptions[i].get())
+	}
+}
+
+//先检查所有参数都可以修改，再依次设置，设置失败时恢复已经修改的配置
+func configSetCommand(client *redisClient) {
+	var olds [][]sds
+	for j := 2; j < client.argc; j += 2 {
+		name := strings.ToLower(client.argv[j].ptr.(sds))
+		found := false
+		for _, opt := range configRuntimeOptions {
+			if opt.name == name {
+				olds = append(olds, []sds{sds(name), sds(opt.get())})
+				found = true
+				break
+			}
+		}
+		if !found {
+			addReplyError(client, "Unknown option or number of arguments for CONFIG SET - '"+client.argv[j].ptr.(sds)+"'")
+			return
+		}
+	}
+
+	for j := 2; j < client.argc; j += 2 {
+		err := setConfigOption([]sds{olds[(j-2)/2][0], client.argv[j+1].ptr.(sds)})
+		if err != nil {
+			for _, old := range olds[:(j-2)/2] {
+				setConfigOption(old)
+			}
+			addReplyError(client, "CONFIG SET failed (possibly related to argument '"+
+				client.argv[j].ptr.(sds)+"') - "+err.Error())
+			return
+		}
+	}
+	addReply(client, shared.ok)
+}
@@ -0,0 +1,15 @@
+package redis
+
+import "hash/crc64"
+
+//RDB文件使用的CRC64，和redis相同：Jones多项式（反射形式），初始值为0，结果不取反
+//crc64(0, "123456789") = 0xe9c6d914c4b8d9ca
+const crc64JonesPoly = 0x95ac9329ac4bc9b5
+
+var crc64Table = crc64.MakeTable(crc64JonesPoly)
+
+//在crc的基础上继续计算p的校验和
+//标准库的实现在开始和结束时都会对crc取反，这里再取反一次抵消
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
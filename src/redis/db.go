@@ -1,6 +1,10 @@
 package redis
 
-import "strconv"
+import (
+	"math"
+	"strconv"
+	"strings"
+)
 
 const (
 	redisEvictionPoolSize = 16
@@ -9,6 +13,7 @@ const (
 type evictionPoolEntry struct {
 	idle uint64
 	key  sds
+	dbid int //key所在的db
 }
 
 //存储数据结构
@@ -17,72 +22,283 @@ type redisDb struct {
 	expires *dict //expires，用来存储带有过期时间的键， key = *robj, value = timestamp
 	id      int   //id
 
-	evictionPool []*evictionPoolEntry
+	blockingKeys *dict //有客户端阻塞等待数据的key，key = sds, value = *list.List(*redisClient)
+	readyKeys    *dict //已经添加到server.readyKeys中的key，用来去重
+	watchedKeys  *dict //被WATCH的key，key = sds, value = *list.List(*watchedKey)
 }
 
-func (r *redisDb) setKey(key *robj, val *robj) {
-	if r.lookupKey(key) == nil {
+//lookupKey的标记
+const (
+	lookupNone    = 0
+	lookupNoTouch = 1 << 0 //不更新对象的访问时间
+)
+
+//设置key的值，keepTTL为false时删除原来的过期时间
+func (r *redisDb) setKey(key *robj, val *robj, keepTTL bool) {
+	if r.lookupKeyWrite(key) == nil {
 		r.dbAdd(key, val)
 	} else {
 		//override
 		r.dbOverwrite(key, val)
 	}
-	val.refcount++
+	incrRefCount(val)
+	if !keepTTL {
+		r.removeExpire(key)
+	}
+	r.signalModifiedKey(key)
 }
 
-func (r *redisDb) lookupKey(key *robj) *robj {
+//key被修改了，每个修改key的命令都需要调用，用于WATCH
+func (r *redisDb) signalModifiedKey(key *robj) {
+	touchWatchedKey(r, key)
+}
+
+func (r *redisDb) lookupKey(key *robj, flags int) *robj {
 	//检查key是否过期，如果过期则删除
 	r.expireIfNeeded(key)
 
-	return r.doLookupKey(key)
+	return r.doLookupKey(key, flags)
 }
 
-func (r *redisDb) expireIfNeeded(key *robj) int {
+//读命令查找key
+func (r *redisDb) lookupKeyRead(key *robj) *robj {
+	return r.lookupKeyReadWithFlags(key, lookupNone)
+}
+
+func (r *redisDb) lookupKeyReadWithFlags(key *robj, flags int) *robj {
+	val := r.lookupKey(key, flags)
+	if val == nil {
+		notifyKeyspaceEvent(notifyKeyMiss, "keymiss", key, r.id)
+	}
+	return val
+}
+
+//写命令查找key
+func (r *redisDb) lookupKeyWrite(key *robj) *robj {
+	return r.lookupKey(key, lookupNone)
+}
+
+//查找key，不存在时回复reply
+func lookupKeyReadOrReply(client *redisClient, key *robj, reply *robj) *robj {
+	o := client.db.lookupKeyRead(key)
+	if o == nil {
+		addReply(client, reply)
+	}
+	return o
+}
+
+func lookupKeyWriteOrReply(client *redisClient, key *robj, reply *robj) *robj {
+	o := client.db.lookupKeyWrite(key)
+	if o == nil {
+		addReply(client, reply)
+	}
+	return o
+}
+
+//key是否已经过期，不会删除key
+func (r *redisDb) keyIsExpired(key *robj) bool {
+	//加载数据时不处理过期，加载完成后再删除
+	if server.loading {
+		return false
+	}
 	when := r.getExpire(key)
 
 	if when < 0 {
-		return 0
+		return false
 	}
-	now := mstime()
+	return mstime() > when
+}
 
-	if now <= when {
+//key过期时删除key并返回1
+func (r *redisDb) expireIfNeeded(key *robj) int {
+	if !r.keyIsExpired(key) {
 		return 0
 	}
-
-	return r.dbDelete(key)
+	r.dbDelete(key)
+	propagateDeletion(r, key)
+	notifyKeyspaceEvent(notifyExpired, "expired", key, r.id)
+	r.signalModifiedKey(key)
+	return 1
 }
 
+//EXPIRE等命令的选项
+const (
+	expireNx = 1 << 0
+	expireXx = 1 << 1
+	expireGt = 1 << 2
+	expireLt = 1 << 3
+)
+
+//EXPIRE key seconds [NX | XX | GT | LT]
 func expireCommand(client *redisClient) {
 	expireGenericCommand(client, mstime(), unitSeconds)
 }
 
+//EXPIREAT key unix-time-seconds [NX | XX | GT | LT]
+func expireatCommand(client *redisClient) {
+	expireGenericCommand(client, 0, unitSeconds)
+}
+
+//PEXPIRE key milliseconds [NX | XX | GT | LT]
+func pexpireCommand(client *redisClient) {
+	expireGenericCommand(client, mstime(), unitMilliseconds)
+}
+
+//PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT]
+func pexpireatCommand(client *redisClient) {
+	expireGenericCommand(client, 0, unitMilliseconds)
+}
+
 func ttlCommand(client *redisClient) {
-	ttlGenericCommand(client, false)
+	ttlGenericCommand(client, false, false)
+}
+
+func pttlCommand(client *redisClient) {
+	ttlGenericCommand(client, true, false)
+}
+
+func expiretimeCommand(client *redisClient) {
+	ttlGenericCommand(client, false, true)
 }
 
+func pexpiretimeCommand(client *redisClient) {
+	ttlGenericCommand(client, true, true)
+}
+
+//PERSIST key
+func persistCommand(client *redisClient) {
+	if client.db.lookupKeyWrite(client.argv[1]) != nil && client.db.removeExpire(client.argv[1]) {
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyGeneric, "persist", client.argv[1], client.db.id)
+		server.dirty++
+		addReply(client, shared.cone)
+	} else {
+		addReply(client, shared.czero)
+	}
+}
+
+//解析EXPIRE等命令的NX/XX/GT/LT选项
+func parseExtendedExpireArgumentsOrReply(client *redisClient) (int, bool) {
+	flags := 0
+	for j := 3; j < client.argc; j++ {
+		opt := client.argv[j].ptr.(sds)
+		if strings.EqualFold(opt, "nx") {
+			flags |= expireNx
+		} else if strings.EqualFold(opt, "xx") {
+			flags |= expireXx
+		} else if strings.EqualFold(opt, "gt") {
+			flags |= expireGt
+		} else if strings.EqualFold(opt, "lt") {
+			flags |= expireLt
+		} else {
+			addReplyError(client, "Unsupported option "+opt)
+			return 0, false
+		}
+	}
+
+	if flags&expireNx != 0 && flags&(expireXx|expireGt|expireLt) != 0 {
+		addReplyError(client, "NX and XX, GT or LT options at the same time are not compatible")
+		return 0, false
+	}
+	if flags&expireGt != 0 && flags&expireLt != 0 {
+		addReplyError(client, "GT and LT options at the same time are not compatible")
+		return 0, false
+	}
+	return flags, true
+}
+
+//EXPIRE, PEXPIRE, EXPIREAT, PEXPIREAT的实现
+//basetime为0时参数是绝对时间，unit为参数的单位
+//设置的时间已经过去时直接删除key
 func expireGenericCommand(client *redisClient, basetime int64, unit int) {
 	key := client.argv[1]
 	param := client.argv[2]
-	w, _ := strconv.Atoi(string(param.ptr.(sds)))
-	when := int64(w)
+
+	flags, ok := parseExtendedExpireArgumentsOrReply(client)
+	if !ok {
+		return
+	}
+	when, ok := getLongLongFromObjectOrReply(client, param, "")
+	if !ok {
+		return
+	}
+
+	//检查单位转换和加上basetime时是否溢出
 	if unit == unitSeconds {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			addReplyError(client, "invalid expire time in '"+client.cmd.name+"' command")
+			return
+		}
 		when *= 1000
 	}
+	if when > math.MaxInt64-basetime {
+		addReplyError(client, "invalid expire time in '"+client.cmd.name+"' command")
+		return
+	}
 	when += basetime
 
-	if client.db.lookupKey(key) == nil {
+	if client.db.lookupKeyWrite(key) == nil {
 		addReply(client, shared.czero)
+		return
 	}
 
+	if flags != 0 {
+		currentExpire := client.db.getExpire(key)
+		//NX：key没有过期时间时才设置
+		if flags&expireNx != 0 && currentExpire != -1 {
+			addReply(client, shared.czero)
+			return
+		}
+		//XX：key有过期时间时才设置
+		if flags&expireXx != 0 && currentExpire == -1 {
+			addReply(client, shared.czero)
+			return
+		}
+		//GT：新的过期时间更大时才设置，没有过期时间的key看作永不过期
+		if flags&expireGt != 0 && (when <= currentExpire || currentExpire == -1) {
+			addReply(client, shared.czero)
+			return
+		}
+		//LT：新的过期时间更小时才设置
+		if flags&expireLt != 0 && currentExpire != -1 && when >= currentExpire {
+			addReply(client, shared.czero)
+			return
+		}
+	}
+
+	//加载AOF时不删除，AOF中的命令已经是确定的时间戳了
+	if when <= mstime() && !server.loading {
+		client.db.dbDelete(key)
+		client.db.signalModifiedKey(key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key, client.db.id)
+		server.dirty++
+		addReply(client, shared.cone)
+		//传播为DEL
+		rewriteClientCommandVector(client, shared.del, key)
+		return
+	}
 	client.db.setExpire(key, when)
+	client.db.signalModifiedKey(key)
+	notifyKeyspaceEvent(notifyGeneric, "expire", key, client.db.id)
+	server.dirty++
 	addReply(client, shared.cone)
+
+	//传播为PEXPIREAT，使用绝对时间戳，AOF重放的结果和执行时相同
+	if client.cmd.name != "pexpireat" {
+		rewriteClientCommandArgument(client, 0, shared.pexpireat)
+	}
+	if basetime != 0 || unit == unitSeconds {
+		rewriteClientCommandArgument(client, 2, createStringObjectFromLongLong(when))
+	}
 }
 
-func ttlGenericCommand(client *redisClient, outputMs bool) {
+//TTL, PTTL, EXPIRETIME, PEXPIRETIME的实现
+//outputMs为true时返回毫秒，outputAbs为true时返回过期的时间戳而不是剩余的时间
+func ttlGenericCommand(client *redisClient, outputMs bool, outputAbs bool) {
 
 	var ttl int64 = -1
 
-	if client.db.lookupKey(client.argv[1]) == nil {
+	if client.db.lookupKeyReadWithFlags(client.argv[1], lookupNoTouch) == nil {
 		addReplyLongLong(client, -2)
 		return
 	}
@@ -90,7 +306,11 @@ func ttlGenericCommand(client *redisClient, outputMs bool) {
 	expire := client.db.getExpire(client.argv[1])
 
 	if expire != -1 {
-		ttl = expire - mstime()
+		if outputAbs {
+			ttl = expire
+		} else {
+			ttl = expire - mstime()
+		}
 		if ttl < 0 {
 			ttl = 0
 		}
@@ -105,32 +325,61 @@ func ttlGenericCommand(client *redisClient, outputMs bool) {
 	}
 }
 
-func (r *redisDb) removeExpire(key *robj) {
-	r.expires.dictDelete(key.ptr)
+//删除key的过期时间，key没有过期时间时返回false
+func (r *redisDb) removeExpire(key *robj) bool {
+	rdbSnapshotTouchKey(r, key.ptr.(sds))
+	return r.expires.dictDelete(key.ptr) == dictOk
 }
 
-func (r *redisDb) doLookupKey(key *robj) *robj {
+func (r *redisDb) doLookupKey(key *robj, flags int) *robj {
+	//BGSAVE需要在key被修改之前保存它
+	rdbSnapshotTouchKey(r, key.ptr.(sds))
 	entry := r.dict.dictFind(key.ptr)
 	if entry != nil {
 		val := entry.(*robj)
-		val.lru = lruClock()
+		//更新对象的访问时间或者访问频率，用于淘汰key
+		if flags&lookupNoTouch == 0 {
+			if maxMemoryPolicyIsLfu() {
+				updateLFU(val)
+			} else {
+				val.lru = lruClock()
+			}
+		}
 		return val
 	}
 	return nil
 }
 
 func (r *redisDb) dbAdd(key *robj, val *robj) {
+	rdbSnapshotTouchKey(r, key.ptr.(sds))
 	r.dict.dictAdd(key.ptr, val)
+	notifyKeyspaceEvent(notifyNew, "new", key, r.id)
+	//新建了list或者stream，唤醒阻塞在这个key上的客户端
+	if val.rtype == redisList || val.rtype == redisStream {
+		signalKeyAsReady(r, key)
+	}
+}
+
+//字符串对象被共享或者不是raw编码时，创建一个新的raw编码的对象替换它
+//返回的对象可以直接修改
+func (r *redisDb) dbUnshareStringValue(key *robj, o *robj) *robj {
+	if o.refcount != 1 || o.encoding != redisEncodingRaw {
+		o = createRawStringObject(getDecodedObject(o).ptr.(sds))
+		r.dbOverwrite(key, o)
+	}
+	return o
 }
 
 func (r *redisDb) dbOverwrite(key *robj, val *robj) {
+	rdbSnapshotTouchKey(r, key.ptr.(sds))
 	r.dict.dictReplace(key.ptr, val)
 }
 
-func (r *redisDb) dbDelete(key *robj) int {
+//删除key，key不存在时返回false
+func (r *redisDb) dbDelete(key *robj) bool {
+	rdbSnapshotTouchKey(r, key.ptr.(sds))
 	r.expires.dictDelete(key.ptr)
-	r.dict.dictDelete(key.ptr)
-	return redisOk
+	return r.dict.dictDelete(key.ptr) == dictOk
 }
 
 func (r *redisDb) dbExists(key *robj) bool {
@@ -149,8 +398,611 @@ func (r *redisDb) getExpire(key *robj) int64 {
 }
 
 func (r *redisDb) setExpire(key *robj, expire int64) {
+	rdbSnapshotTouchKey(r, key.ptr.(sds))
 	kde := r.dict.dictFind(key.ptr)
 	if kde != nil {
 		r.expires.dictReplace(key.ptr, expire)
 	}
 }
+
+//随机返回一个没有过期的key，db为空时返回nil
+func (r *redisDb) dbRandomKey() *robj {
+	for {
+		de := r.dict.dictGetRandomKey()
+		if de == nil {
+			return nil
+		}
+		keyobj := createStringObject(de.(sds))
+		if r.expires.dictFind(de) != nil && r.expireIfNeeded(keyobj) == 1 {
+			//已经过期了，重新选择一个key
+			continue
+		}
+		return keyobj
+	}
+}
+
+//清空db，返回删除的key的数量
+func (r *redisDb) emptyDb() int {
+	removed := r.dict.used()
+	if hasActiveChildProcess() {
+		//BGSAVE或者BGREWRITEAOF还在遍历原来的dict，不能原地清空
+		r.dict = dictCreate()
+		r.expires = dictCreate()
+	} else {
+		r.dict.dictEmpty()
+		r.expires.dictEmpty()
+	}
+	return removed
+}
+
+//清空dbnum指定的db，为-1时清空所有的db，返回删除的key的数量
+func emptyData(dbnum int) int {
+	if dbnum < -1 || dbnum >= server.dbnum {
+		return -1
+	}
+	removed := 0
+	for _, db := range server.db {
+		if dbnum == -1 || dbnum == db.id {
+			//清空之前WATCH的key还存在，需要标记
+			touchAllWatchedKeysInDb(db, nil)
+			removed += db.emptyDb()
+		}
+	}
+	return removed
+}
+
+//切换客户端当前的db
+func selectDb(client *redisClient, id int) int {
+	if id < 0 || id >= server.dbnum {
+		return redisErr
+	}
+	client.db = server.db[id]
+	return redisOk
+}
+
+//交换两个db中的数据，阻塞的客户端仍然留在原来的db中
+func dbSwapDatabases(id1 int, id2 int) int {
+	if id1 < 0 || id1 >= server.dbnum || id2 < 0 || id2 >= server.dbnum {
+		return redisErr
+	}
+	if id1 == id2 {
+		return redisOk
+	}
+	db1 := server.db[id1]
+	db2 := server.db[id2]
+
+	//WATCH的客户端仍然留在原来的db中，交换前标记被修改的key
+	touchAllWatchedKeysInDb(db1, db2)
+	touchAllWatchedKeysInDb(db2, db1)
+
+	db1.dict, db2.dict = db2.dict, db1.dict
+	db1.expires, db2.expires = db2.expires, db1.expires
+
+	//交换后，阻塞的客户端等待的key可能已经存在了
+	scanDatabaseForReadyKeys(db1)
+	scanDatabaseForReadyKeys(db2)
+	return redisOk
+}
+
+//检查db中所有被阻塞等待的key，key存在时唤醒等待的客户端
+func scanDatabaseForReadyKeys(db *redisDb) {
+	db.blockingKeys.dictForEach(func(k interface{}, _ interface{}) bool {
+		if db.dict.dictFind(k) != nil {
+			signalKeyAsReady(db, createStringObject(k.(sds)))
+		}
+		return true
+	})
+}
+
+//-----------------------------------------------------------------------------
+// Type agnostic commands operating on the key space
+//-----------------------------------------------------------------------------
+
+//解析FLUSHDB/FLUSHALL的ASYNC|SYNC参数
+func getFlushCommandFlags(client *redisClient) bool {
+	if client.argc > 2 {
+		addReply(client, shared.syntaxerr)
+		return false
+	}
+	if client.argc == 2 {
+		opt := client.argv[1].ptr.(sds)
+		if !strings.EqualFold(opt, "sync") && !strings.EqualFold(opt, "async") {
+			addReply(client, shared.syntaxerr)
+			return false
+		}
+	}
+	return true
+}
+
+//FLUSHDB [ASYNC|SYNC]
+//对象的内存由GC回收，ASYNC和SYNC的行为相同
+func flushdbCommand(client *redisClient) {
+	if !getFlushCommandFlags(client) {
+		return
+	}
+	server.dirty += int64(emptyData(client.db.id))
+	//db本来就是空的时候也要写入AOF
+	forceCommandPropagation(client)
+	addReply(client, shared.ok)
+}
+
+//FLUSHALL [ASYNC|SYNC]
+func flushallCommand(client *redisClient) {
+	if !getFlushCommandFlags(client) {
+		return
+	}
+	server.dirty += int64(emptyData(-1))
+	//正在执行的BGSAVE保存的是清空之前的数据，直接放弃
+	//BGREWRITEAOF不受影响，FLUSHALL会写入新的incr文件
+	killRDBChild()
+	//配置了自动保存时立即保存空的数据集，加载AOF时不需要
+	if len(server.saveparams) > 0 && !server.loading {
+		rdbSave(server.rdbFilename)
+	}
+	server.dirty++
+	//rdbSave会重置dirty，强制写入AOF
+	forceCommandPropagation(client)
+	addReply(client, shared.ok)
+}
+
+//DEL/UNLINK的实现，对象的内存由GC回收，两者的行为相同
+func delGenericCommand(client *redisClient) {
+	numdel := 0
+	for j := 1; j < client.argc; j++ {
+		client.db.expireIfNeeded(client.argv[j])
+		if client.db.dbDelete(client.argv[j]) {
+			client.db.signalModifiedKey(client.argv[j])
+			notifyKeyspaceEvent(notifyGeneric, "del", client.argv[j], client.db.id)
+			server.dirty++
+			numdel++
+		}
+	}
+	addReplyLongLong(client, int64(numdel))
+}
+
+//DEL key [key ...]
+func delCommand(client *redisClient) {
+	delGenericCommand(client)
+}
+
+//UNLINK key [key ...]
+func unlinkCommand(client *redisClient) {
+	delGenericCommand(client)
+}
+
+//EXISTS key [key ...]
+//返回存在的key的数量，同一个key出现多次时会计算多次
+func existsCommand(client *redisClient) {
+	count := 0
+	for j := 1; j < client.argc; j++ {
+		if client.db.lookupKeyReadWithFlags(client.argv[j], lookupNoTouch) != nil {
+			count++
+		}
+	}
+	addReplyLongLong(client, int64(count))
+}
+
+//KEYS pattern
+func keysCommand(client *redisClient) {
+	pattern := client.argv[1].ptr.(sds)
+	allkeys := pattern == "*"
+
+	numkeys := 0
+	replylen := addReplyDeferredLen(client)
+	client.db.dict.dictForEach(func(k interface{}, _ interface{}) bool {
+		key := k.(sds)
+		if allkeys || stringmatchlen(pattern, key, false) {
+			//不返回已经过期但是还没有被删除的key
+			if !client.db.keyIsExpired(createStringObject(key)) {
+				addReplyBulkCBuffer(client, key)
+				numkeys++
+			}
+		}
+		return true
+	})
+	setDeferredArrayLen(client, replylen, numkeys)
+}
+
+//RANDOMKEY
+func randomkeyCommand(client *redisClient) {
+	key := client.db.dbRandomKey()
+	if key == nil {
+		addReplyNull(client)
+		return
+	}
+	addReplyBulk(client, key)
+}
+
+//DBSIZE
+func dbsizeCommand(client *redisClient) {
+	addReplyLongLong(client, int64(client.db.dict.used()))
+}
+
+//类型的名称
+func getObjectTypeByType(t uint8) string {
+	switch t {
+	case redisString:
+		return "string"
+	case redisList:
+		return "list"
+	case redisSet:
+		return "set"
+	case redisZset:
+		return "zset"
+	case redisHash:
+		return "hash"
+	case redisStream:
+		return "stream"
+	default:
+		return "unknown"
+	}
+}
+
+//TYPE key
+func typeCommand(client *redisClient) {
+	o := client.db.lookupKeyReadWithFlags(client.argv[1], lookupNoTouch)
+	if o == nil {
+		addReplyStatus(client, "none")
+		return
+	}
+	addReplyStatus(client, getObjectTypeByType(o.rtype))
+}
+
+//RENAME/RENAMENX的实现
+func renameGenericCommand(client *redisClient, nx bool) {
+	//源key和目标key相同时不做任何操作，但是源key不存在时仍然回复错误
+	samekey := client.argv[1].ptr.(sds) == client.argv[2].ptr.(sds)
+
+	o := lookupKeyWriteOrReply(client, client.argv[1], shared.nokeyerr)
+	if o == nil {
+		return
+	}
+	if samekey {
+		if nx {
+			addReply(client, shared.czero)
+		} else {
+			addReply(client, shared.ok)
+		}
+		return
+	}
+
+	expire := client.db.getExpire(client.argv[1])
+	if client.db.lookupKeyWrite(client.argv[2]) != nil {
+		if nx {
+			addReply(client, shared.czero)
+			return
+		}
+		//覆盖目标key，先删除再添加
+		client.db.dbDelete(client.argv[2])
+	}
+	client.db.dbAdd(client.argv[2], o)
+	if expire != -1 {
+		client.db.setExpire(client.argv[2], expire)
+	}
+	client.db.dbDelete(client.argv[1])
+	client.db.signalModifiedKey(client.argv[1])
+	client.db.signalModifiedKey(client.argv[2])
+	notifyKeyspaceEvent(notifyGeneric, "rename_from", client.argv[1], client.db.id)
+	notifyKeyspaceEvent(notifyGeneric, "rename_to", client.argv[2], client.db.id)
+	server.dirty++
+
+	if nx {
+		addReply(client, shared.cone)
+	} else {
+		addReply(client, shared.ok)
+	}
+}
+
+//RENAME key newkey
+func renameCommand(client *redisClient) {
+	renameGenericCommand(client, false)
+}
+
+//RENAMENX key newkey
+func renamenxCommand(client *redisClient) {
+	renameGenericCommand(client, true)
+}
+
+//TOUCH key [key ...]
+//更新key的访问时间，返回存在的key的数量
+func touchCommand(client *redisClient) {
+	touched := 0
+	for j := 1; j < client.argc; j++ {
+		if client.db.lookupKeyRead(client.argv[j]) != nil {
+			touched++
+		}
+	}
+	addReplyLongLong(client, int64(touched))
+}
+
+//SELECT index
+func selectCommand(client *redisClient) {
+	id, ok := getLongLongFromObjectOrReply(client, client.argv[1], "")
+	if !ok {
+		return
+	}
+	if selectDb(client, int(id)) == redisErr {
+		addReplyError(client, "DB index is out of range")
+		return
+	}
+	addReply(client, shared.ok)
+}
+
+//MOVE key db
+//把key移动到另一个db，目标db中已经存在这个key时不移动
+func moveCommand(client *redisClient) {
+	src := client.db
+	dbid, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+	if dbid < 0 || dbid >= int64(server.dbnum) {
+		addReplyError(client, "DB index is out of range")
+		return
+	}
+	dst := server.db[dbid]
+
+	if src == dst {
+		addReply(client, shared.sameobjecterr)
+		return
+	}
+
+	key := client.argv[1]
+	o := src.lookupKeyWrite(key)
+	if o == nil {
+		addReply(client, shared.czero)
+		return
+	}
+	expire := src.getExpire(key)
+
+	if dst.lookupKeyWrite(key) != nil {
+		addReply(client, shared.czero)
+		return
+	}
+	dst.dbAdd(key, o)
+	if expire != -1 {
+		dst.setExpire(key, expire)
+	}
+	src.dbDelete(key)
+	src.signalModifiedKey(key)
+	dst.signalModifiedKey(key)
+	notifyKeyspaceEvent(notifyGeneric, "move_from", key, src.id)
+	notifyKeyspaceEvent(notifyGeneric, "move_to", key, dst.id)
+	server.dirty++
+	addReply(client, shared.cone)
+}
+
+//SWAPDB index1 index2
+func swapdbCommand(client *redisClient) {
+	id1, ok := getLongLongFromObjectOrReply(client, client.argv[1], "invalid first DB index")
+	if !ok {
+		return
+	}
+	id2, ok := getLongLongFromObjectOrReply(client, client.argv[2], "invalid second DB index")
+	if !ok {
+		return
+	}
+	if dbSwapDatabases(int(id1), int(id2)) == redisErr {
+		addReplyError(client, "DB index is out of range")
+		return
+	}
+	server.dirty++
+	addReply(client, shared.ok)
+}
+
+//COPY source destination [DB destination-db] [REPLACE]
+func copyCommand(client *redisClient) {
+	dst := client.db
+	replace := false
+	for j := 3; j < client.argc; j++ {
+		additional := client.argc - j - 1
+		opt := client.argv[j].ptr.(sds)
+		if strings.EqualFold(opt, "replace") {
+			replace = true
+		} else if strings.EqualFold(opt, "db") && additional >= 1 {
+			dbid, ok := getLongLongFromObjectOrReply(client, client.argv[j+1], "")
+			if !ok {
+				return
+			}
+			if dbid < 0 || dbid >= int64(server.dbnum) {
+				addReplyError(client, "DB index is out of range")
+				return
+			}
+			dst = server.db[dbid]
+			j++
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	//同一个db中的相同的key
+	key := client.argv[1]
+	newkey := client.argv[2]
+	if client.db == dst && key.ptr.(sds) == newkey.ptr.(sds) {
+		addReply(client, shared.sameobjecterr)
+		return
+	}
+
+	o := client.db.lookupKeyRead(key)
+	if o == nil {
+		addReply(client, shared.czero)
+		return
+	}
+	expire := client.db.getExpire(key)
+
+	//目标key已经存在时，REPLACE选项删除目标key，否则回复0
+	del := false
+	if dst.lookupKeyWrite(newkey) != nil {
+		if !replace {
+			addReply(client, shared.czero)
+			return
+		}
+		del = true
+	}
+
+	var newobj *robj
+	switch o.rtype {
+	case redisString:
+		newobj = dupStringObject(o)
+	case redisList:
+		newobj = listTypeDup(o)
+	case redisSet:
+		newobj = setTypeDup(o)
+	case redisZset:
+		newobj = zsetDup(o)
+	case redisHash:
+		newobj = hashTypeDup(o)
+	case redisStream:
+		newobj = streamDup(o)
+	default:
+		addReplyError(client, "unknown type object")
+		return
+	}
+
+	if del {
+		dst.dbDelete(newkey)
+	}
+	dst.dbAdd(newkey, newobj)
+	if expire != -1 {
+		dst.setExpire(newkey, expire)
+	}
+	dst.signalModifiedKey(newkey)
+	notifyKeyspaceEvent(notifyGeneric, "copy_to", newkey, dst.id)
+	server.dirty++
+	addReply(client, shared.cone)
+}
+
+//解析SCAN类命令的游标
+func parseScanCursorOrReply(client *redisClient, o *robj) (uint64, bool) {
+	cursor, err := strconv.ParseUint(o.ptr.(sds), 10, 64)
+	if err != nil {
+		addReplyError(client, "invalid cursor")
+		return 0, false
+	}
+	return cursor, true
+}
+
+//SCAN/HSCAN/SSCAN/ZSCAN命令的实现，o为需要遍历的对象，为nil时遍历当前db的keyspace
+//SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+//HSCAN key cursor [MATCH pattern] [COUNT count]
+func scanGenericCommand(client *redisClient, o *robj, cursor uint64) {
+	count := 10
+	pattern := ""
+	usePattern := false
+	typename := ""
+
+	//解析选项，参数从cursor后面开始
+	i := 3
+	if o == nil {
+		i = 2
+	}
+	for ; i < client.argc; i += 2 {
+		opt := client.argv[i].ptr.(sds)
+		moreargs := client.argc - i - 1
+		if strings.EqualFold(opt, "count") && moreargs >= 1 {
+			c, ok := getLongLongFromObjectOrReply(client, client.argv[i+1], "")
+			if !ok {
+				return
+			}
+			if c < 1 {
+				addReply(client, shared.syntaxerr)
+				return
+			}
+			count = int(c)
+		} else if strings.EqualFold(opt, "match") && moreargs >= 1 {
+			pattern = client.argv[i+1].ptr.(sds)
+			//*匹配所有元素，不需要过滤
+			usePattern = pattern != "*"
+		} else if strings.EqualFold(opt, "type") && o == nil && moreargs >= 1 {
+			typename = client.argv[i+1].ptr.(sds)
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	//hash和zset的结果为 field, value 交替的列表
+	var keys []sds
+	step := 1
+	var ht *dict
+	if o == nil {
+		ht = client.db.dict
+	} else if o.rtype == redisSet && o.encoding == redisEncodingHt {
+		ht = o.ptr.(*dict)
+	} else if o.rtype == redisHash && o.encoding == redisEncodingHt {
+		ht = o.ptr.(*dict)
+		step = 2
+	} else if o.rtype == redisZset && o.encoding == redisEncodingSkiplist {
+		ht = o.ptr.(*zset).dict
+		step = 2
+	}
+
+	if ht != nil {
+		//最多遍历count*10个桶，避免hash表很稀疏时阻塞太久
+		maxiterations := count * 10
+		for {
+			cursor = ht.dictScan(cursor, func(key interface{}, val interface{}) {
+				if o == nil || o.rtype == redisSet {
+					keys = append(keys, key.(sds))
+				} else if o.rtype == redisHash {
+					keys = append(keys, key.(sds), val.(sds))
+				} else {
+					keys = append(keys, key.(sds), d2string(val.(float64)))
+				}
+			})
+			maxiterations--
+			if cursor == 0 || maxiterations == 0 || len(keys) >= count*step {
+				break
+			}
+		}
+	} else if o.rtype == redisHash || o.rtype == redisZset {
+		//listpack编码的元素很少，一次返回所有的元素
+		step = 2
+		keys = append(keys, o.ptr.([]sds)...)
+		cursor = 0
+	} else if o.rtype == redisSet {
+		//intset编码的元素很少，一次返回所有的元素
+		for _, v := range *o.ptr.(*intset) {
+			keys = append(keys, ll2string(v))
+		}
+		cursor = 0
+	} else {
+		panic("Not handled encoding in SCAN.")
+	}
+
+	//按照pattern、类型过滤，keyspace中过期的key也要过滤掉
+	filtered := keys[:0]
+	for i := 0; i < len(keys); i += step {
+		if usePattern && !stringmatchlen(pattern, keys[i], false) {
+			continue
+		}
+		if o == nil && typename != "" {
+			val := client.db.lookupKeyReadWithFlags(createStringObject(keys[i]), lookupNoTouch)
+			if val == nil || !strings.EqualFold(typename, getObjectTypeByType(val.rtype)) {
+				continue
+			}
+		}
+		if o == nil && client.db.expireIfNeeded(createStringObject(keys[i])) == 1 {
+			continue
+		}
+		filtered = append(filtered, keys[i:i+step]...)
+	}
+	keys = filtered
+
+	addReplyArrayLen(client, 2)
+	addReplyBulkCBuffer(client, strconv.FormatUint(cursor, 10))
+	addReplyArrayLen(client, len(keys))
+	for _, key := range keys {
+		addReplyBulkCBuffer(client, key)
+	}
+}
+
+//SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func scanCommand(client *redisClient) {
+	cursor, ok := parseScanCursorOrReply(client, client.argv[1])
+	if !ok {
+		return
+	}
+	scanGenericCommand(client, nil, cursor)
+}
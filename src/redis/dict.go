@@ -1,82 +1,520 @@
 package redis
 
 import (
-	"github.com/lukechampine/randmap/safe"
-	"log"
-	"unsafe"
+	"math"
+	"math/bits"
+	"math/rand"
 )
 
+//和redis的dict.c一样使用拉链法的hash表，通过两张表做渐进式rehash
+//key只能是sds或者int，相同的key必须可以用==比较
+
 var (
 	dictOk  = 0
 	dictErr = 1
 )
 
-type dict map[interface{}]interface{}
+const dictHtInitialSize = 4
 
-//在字段中查找元素
-func (d dict) dictFind(key interface{}) interface{} {
-	val, ok := d[key]
-	if ok {
-		return val
+type dictEntry struct {
+	key  interface{}
+	val  interface{}
+	next *dictEntry
+}
+
+type dictht struct {
+	table    []*dictEntry
+	size     uint64
+	sizemask uint64
+	used     uint64
+}
+
+type dict struct {
+	ht          [2]dictht
+	rehashidx   int64 //-1表示没有在rehash
+	pauserehash int   //大于0时暂停rehash，用于安全遍历和scan
+}
+
+func dictCreate() *dict {
+	return &dict{rehashidx: -1}
+}
+
+func dictHashKey(key interface{}) uint64 {
+	switch k := key.(type) {
+	case sds:
+		return siphash(k, dictHashFunctionSeed)
+	case int:
+		var buf [8]byte
+		for i := 0; i < 8; i++ {
+			buf[i] = byte(uint64(k) >> (8 * uint(i)))
+		}
+		return siphash(string(buf[:]), dictHashFunctionSeed)
 	}
-	return nil
+	panic("unsupported dict key type")
+}
+
+func (d *dict) isRehashing() bool {
+	return d.rehashidx != -1
+}
+
+func (d *dict) used() int {
+	return int(d.ht[0].used + d.ht[1].used)
+}
+
+//hash表的桶数
+func (d *dict) size() int {
+	return int(d.ht[0].size + d.ht[1].size)
+}
+
+//清空dict
+func (d *dict) dictEmpty() {
+	d.ht[0] = dictht{}
+	d.ht[1] = dictht{}
+	d.rehashidx = -1
+	d.pauserehash = 0
+}
+
+//把hash表缩小到能容纳所有元素的最小的大小
+func (d *dict) dictResize() int {
+	if d.isRehashing() {
+		return dictErr
+	}
+	minimal := d.ht[0].used
+	if minimal < dictHtInitialSize {
+		minimal = dictHtInitialSize
+	}
+	return d.dictExpand(minimal)
+}
+
+func dictNextPower(size uint64) uint64 {
+	if size >= math.MaxInt64 {
+		return math.MaxInt64 + 1
+	}
+	i := uint64(dictHtInitialSize)
+	for i < size {
+		i *= 2
+	}
+	return i
+}
+
+//创建新的hash表，第一次创建时直接作为ht[0]，否则作为ht[1]并开始rehash
+func (d *dict) dictExpand(size uint64) int {
+	if d.isRehashing() || d.ht[0].used > size {
+		return dictErr
+	}
+	realsize := dictNextPower(size)
+	if realsize == d.ht[0].size {
+		return dictErr
+	}
+
+	n := dictht{table: make([]*dictEntry, realsize), size: realsize, sizemask: realsize - 1}
+	if d.ht[0].table == nil {
+		d.ht[0] = n
+		return dictOk
+	}
+	d.ht[1] = n
+	d.rehashidx = 0
+	return dictOk
+}
+
+//执行n步rehash，每步迁移一个桶，返回1表示rehash还没有完成
+//为了避免阻塞太久，最多访问n*10个空桶
+func (d *dict) dictRehash(n int) int {
+	emptyVisits := n * 10
+	if !d.isRehashing() {
+		return 0
+	}
+
+	for ; n > 0 && d.ht[0].used != 0; n-- {
+		for d.ht[0].table[d.rehashidx] == nil {
+			d.rehashidx++
+			emptyVisits--
+			if emptyVisits == 0 {
+				return 1
+			}
+		}
+		de := d.ht[0].table[d.rehashidx]
+		for de != nil {
+			next := de.next
+			h := dictHashKey(de.key) & d.ht[1].sizemask
+			de.next = d.ht[1].table[h]
+			d.ht[1].table[h] = de
+			d.ht[0].used--
+			d.ht[1].used++
+			de = next
+		}
+		d.ht[0].table[d.rehashidx] = nil
+		d.rehashidx++
+	}
+
+	if d.ht[0].used == 0 {
+		d.ht[0] = d.ht[1]
+		d.ht[1] = dictht{}
+		d.rehashidx = -1
+		return 0
+	}
+	return 1
+}
+
+//在ms毫秒内尽可能多地rehash，返回迁移的步数
+func (d *dict) dictRehashMilliseconds(ms int64) int {
+	if d.pauserehash > 0 {
+		return 0
+	}
+	start := mstime()
+	rehashes := 0
+	for d.dictRehash(100) != 0 {
+		rehashes += 100
+		if mstime()-start > ms {
+			break
+		}
+	}
+	return rehashes
+}
+
+//查找和更新时顺便执行一步rehash
+func (d *dict) dictRehashStep() {
+	if d.pauserehash == 0 {
+		d.dictRehash(1)
+	}
+}
+
+func (d *dict) dictExpandIfNeeded() {
+	if d.isRehashing() {
+		return
+	}
+	if d.ht[0].size == 0 {
+		d.dictExpand(dictHtInitialSize)
+		return
+	}
+	if d.ht[0].used >= d.ht[0].size {
+		d.dictExpand(d.ht[0].used + 1)
+	}
+}
+
+//返回key应该插入的桶，key已经存在时返回-1和已经存在的元素
+func (d *dict) dictKeyIndex(key interface{}, hash uint64) (int64, *dictEntry) {
+	d.dictExpandIfNeeded()
+	var idx uint64
+	for table := 0; table <= 1; table++ {
+		idx = hash & d.ht[table].sizemask
+		for he := d.ht[table].table[idx]; he != nil; he = he.next {
+			if he.key == key {
+				return -1, he
+			}
+		}
+		if !d.isRehashing() {
+			break
+		}
+	}
+	return int64(idx), nil
+}
+
+//新增一个没有值的元素，key已经存在时返回nil和已经存在的元素
+func (d *dict) dictAddRaw(key interface{}) (*dictEntry, *dictEntry) {
+	if d.isRehashing() {
+		d.dictRehashStep()
+	}
+	index, existing := d.dictKeyIndex(key, dictHashKey(key))
+	if index == -1 {
+		return nil, existing
+	}
+
+	//rehash时新元素只加到ht[1]中
+	ht := &d.ht[0]
+	if d.isRehashing() {
+		ht = &d.ht[1]
+	}
+	entry := &dictEntry{key: key, next: ht.table[index]}
+	ht.table[index] = entry
+	ht.used++
+	return entry, nil
 }
 
 //新增元素，如果已存在，则返回err， 成功添加，则返回ok
-func (d dict) dictAdd(key interface{}, val interface{}) int {
-	v := d.dictFind(key)
-	if v != nil {
+func (d *dict) dictAdd(key interface{}, val interface{}) int {
+	entry, _ := d.dictAddRaw(key)
+	if entry == nil {
 		return dictErr
 	}
-	d[key] = val
+	entry.val = val
 	return dictOk
 }
 
-//从dict中替换元素，如果已存在，则替换，并返回0
-//如果不存在，则新增，返回1
-func (d dict) dictReplace(key interface{}, val interface{}) int {
-	if d.dictAdd(key, val) != dictOk {
-		d[key] = val
-		return 1
+//从dict中替换元素，如果已存在，则替换，并返回1
+//如果不存在，则新增，返回0
+func (d *dict) dictReplace(key interface{}, val interface{}) int {
+	entry, existing := d.dictAddRaw(key)
+	if entry != nil {
+		entry.val = val
+		return 0
+	}
+	existing.val = val
+	return 1
+}
+
+func (d *dict) dictFindEntry(key interface{}) *dictEntry {
+	if d.used() == 0 {
+		return nil
+	}
+	if d.isRehashing() {
+		d.dictRehashStep()
+	}
+	h := dictHashKey(key)
+	for table := 0; table <= 1; table++ {
+		idx := h & d.ht[table].sizemask
+		for he := d.ht[table].table[idx]; he != nil; he = he.next {
+			if he.key == key {
+				return he
+			}
+		}
+		if !d.isRehashing() {
+			return nil
+		}
+	}
+	return nil
+}
+
+//在字段中查找元素
+func (d *dict) dictFind(key interface{}) interface{} {
+	he := d.dictFindEntry(key)
+	if he == nil {
+		return nil
 	}
-	return 0
+	return he.val
 }
 
 //从dict中删除元素
-func (d dict) dictDelete(key interface{}) int {
-	if _, ok := d[key]; !ok {
+func (d *dict) dictDelete(key interface{}) int {
+	if d.used() == 0 {
 		return dictErr
 	}
-	delete(d, key)
-	return dictOk
+	if d.isRehashing() {
+		d.dictRehashStep()
+	}
+	h := dictHashKey(key)
+	for table := 0; table <= 1; table++ {
+		ht := &d.ht[table]
+		idx := h & ht.sizemask
+		var prev *dictEntry
+		for he := ht.table[idx]; he != nil; he = he.next {
+			if he.key == key {
+				if prev != nil {
+					prev.next = he.next
+				} else {
+					ht.table[idx] = he.next
+				}
+				ht.used--
+				return dictOk
+			}
+			prev = he
+		}
+		if !d.isRehashing() {
+			break
+		}
+	}
+	return dictErr
 }
 
-func (d dict) getRandomKey() (o *robj) {
+//遍历dict中的所有元素，fn返回false时停止遍历
+//遍历期间暂停rehash，fn中可以删除当前的元素
+func (d *dict) dictForEach(fn func(key interface{}, val interface{}) bool) {
+	d.pauserehash++
 	defer func() {
-		if err := recover(); err != nil {
-			log.Print(err)
-			o = nil
-		}
+		d.pauserehash--
 	}()
-	de := randmap.Key(d)
-	return createObject(redisString, de.(sds))
+	for table := 0; table <= 1; table++ {
+		for idx := uint64(0); idx < d.ht[table].size; idx++ {
+			he := d.ht[table].table[idx]
+			for he != nil {
+				next := he.next
+				if !fn(he.key, he.val) {
+					return
+				}
+				he = next
+			}
+		}
+		if !d.isRehashing() {
+			break
+		}
+	}
+}
+
+//随机返回一个元素，dict为空时返回nil
+func (d *dict) dictGetRandomEntry() *dictEntry {
+	if d.used() == 0 {
+		return nil
+	}
+	if d.isRehashing() {
+		d.dictRehashStep()
+	}
+
+	var he *dictEntry
+	if d.isRehashing() {
+		//ht[0]中rehashidx之前的桶都是空的
+		for he == nil {
+			h := uint64(d.rehashidx) + uint64(rand.Int63n(int64(d.ht[0].size+d.ht[1].size-uint64(d.rehashidx))))
+			if h >= d.ht[0].size {
+				he = d.ht[1].table[h-d.ht[0].size]
+			} else {
+				he = d.ht[0].table[h]
+			}
+		}
+	} else {
+		for he == nil {
+			he = d.ht[0].table[rand.Uint64()&d.ht[0].sizemask]
+		}
+	}
+
+	//再从桶的链表中随机选择一个
+	listlen := 0
+	for e := he; e != nil; e = e.next {
+		listlen++
+	}
+	for listele := rand.Intn(listlen); listele > 0; listele-- {
+		he = he.next
+	}
+	return he
 }
 
-func (d dict) getSomeKeys(n int) dict {
-	ret := make(dict, n)
-	for i := 0; i < n; i++ {
-		k := randmap.Key(d)
-		ret.dictAdd(k, d.dictFind(k))
+//随机返回一个key，dict为空时返回nil
+func (d *dict) dictGetRandomKey() interface{} {
+	he := d.dictGetRandomEntry()
+	if he == nil {
+		return nil
 	}
-	return ret
+	return he.key
 }
 
-func (d dict) used() int {
-	return len(d)
+func (d *dict) getRandomKey() *robj {
+	de := d.dictGetRandomKey()
+	if de == nil {
+		return nil
+	}
+	return createObject(redisString, de.(sds))
 }
 
-func (d dict) size() int {
-	point := (**hmap)(unsafe.Pointer(&d))
-	value := *point
-	return int(6.5 * float32(uintptr(1)<<value.B))
+//从随机的位置开始，返回连续的桶中的最多count个元素，用于淘汰时的采样
+//返回的元素可能少于count，也不保证是均匀分布的
+func (d *dict) dictGetSomeKeys(count int) []*dictEntry {
+	if d.used() < count {
+		count = d.used()
+	}
+	if count == 0 {
+		return nil
+	}
+	maxsteps := count * 10
+
+	for j := 0; j < count; j++ {
+		if !d.isRehashing() {
+			break
+		}
+		d.dictRehashStep()
+	}
+
+	tables := 1
+	maxsizemask := d.ht[0].sizemask
+	if d.isRehashing() {
+		tables = 2
+		if maxsizemask < d.ht[1].sizemask {
+			maxsizemask = d.ht[1].sizemask
+		}
+	}
+
+	des := make([]*dictEntry, 0, count)
+	i := rand.Uint64() & maxsizemask
+	emptylen := 0
+	for ; len(des) < count && maxsteps > 0; maxsteps-- {
+		for j := 0; j < tables; j++ {
+			//rehashidx之前的桶在ht[0]中都是空的
+			if tables == 2 && j == 0 && i < uint64(d.rehashidx) {
+				//超出了ht[1]的范围时，两张表在rehashidx之前都没有元素
+				if i >= d.ht[1].size {
+					i = uint64(d.rehashidx)
+				} else {
+					continue
+				}
+			}
+			if i >= d.ht[j].size {
+				continue
+			}
+			he := d.ht[j].table[i]
+			if he == nil {
+				//连续的空桶太多时换一个位置
+				emptylen++
+				if emptylen >= 5 && emptylen > count {
+					i = rand.Uint64() & maxsizemask
+					emptylen = 0
+				}
+				continue
+			}
+			emptylen = 0
+			for ; he != nil; he = he.next {
+				des = append(des, he)
+				if len(des) == count {
+					return des
+				}
+			}
+		}
+		i = (i + 1) & maxsizemask
+	}
+	return des
+}
+
+//遍历游标v指向的桶，返回下一次遍历的游标，返回0表示遍历结束
+//游标按照高位加1的方式递增，在两次调用之间表扩大或者缩小时，
+//已经遍历过的桶不会再被遍历，遍历开始到结束一直存在的元素至少会返回一次，
+//但是可能返回多次
+func (d *dict) dictScan(v uint64, fn func(key interface{}, val interface{})) uint64 {
+	if d.used() == 0 {
+		return 0
+	}
+
+	emit := func(he *dictEntry) {
+		for he != nil {
+			next := he.next
+			fn(he.key, he.val)
+			he = next
+		}
+	}
+
+	//避免fn中查找元素时触发rehash
+	d.pauserehash++
+	if !d.isRehashing() {
+		m0 := d.ht[0].sizemask
+		emit(d.ht[0].table[v&m0])
+
+		//把掩码之外的位都置为1，这样反转后加1只会作用在掩码内的位上
+		v |= ^m0
+		v = bits.Reverse64(v)
+		v++
+		v = bits.Reverse64(v)
+	} else {
+		t0 := &d.ht[0]
+		t1 := &d.ht[1]
+		//保证t0是较小的表
+		if t0.size > t1.size {
+			t0, t1 = t1, t0
+		}
+		m0 := t0.sizemask
+		m1 := t1.sizemask
+
+		emit(t0.table[v&m0])
+
+		//遍历大表中所有由小表的这个桶扩展出来的桶
+		for {
+			emit(t1.table[v&m1])
+
+			v |= ^m1
+			v = bits.Reverse64(v)
+			v++
+			v = bits.Reverse64(v)
+
+			if v&(m0^m1) == 0 {
+				break
+			}
+		}
+	}
+	d.pauserehash--
+	return v
 }
@@ -10,6 +10,7 @@ import (
 type eventloop struct {
 	react  func(frame []byte, c gnet.Conn) (out []byte, action gnet.Action)
 	accept func(c gnet.Conn) (out []byte, action gnet.Action)
+	closed func(c gnet.Conn, err error) (action gnet.Action)
 	tick   func() (delay time.Duration, action gnet.Action)
 
 	*gnet.EventServer
@@ -17,15 +18,30 @@ type eventloop struct {
 
 //读事件处理
 func (e *eventloop) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
 	return e.react(frame, c)
 }
 
 //新连接处理
 func (e *eventloop) OnOpened(c gnet.Conn) (out []byte, action gnet.Action) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
 	return e.accept(c)
 }
 
+//连接关闭处理
+func (e *eventloop) OnClosed(c gnet.Conn, err error) (action gnet.Action) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return e.closed(c, err)
+}
+
+//定时任务，gnet在ticker goroutine中调用，不在事件循环中，
+//需要和其他回调一样持有server.mu，serverCron里的回复、释放客户端才不会和事件处理并发
 func (e *eventloop) Tick() (delay time.Duration, action gnet.Action) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
 	return e.tick()
 }
 
@@ -0,0 +1,588 @@
+package redis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//geo命令使用zset保存位置，score为52位的geohash
+
+//搜索到的位置
+type geoPoint struct {
+	longitude float64
+	latitude  float64
+	dist      float64
+	score     float64
+	member    sds
+}
+
+//georadiusGeneric的标记
+const (
+	geoSearch      = 1 << 0 //GEOSEARCH
+	geoSearchStore = 1 << 1 //GEOSEARCHSTORE
+)
+
+//结果的排序方式
+const (
+	geoSortNone = 0
+	geoSortAsc  = 1
+	geoSortDesc = 2
+)
+
+//-----------------------------------------------------------------------------
+// Helpers
+//-----------------------------------------------------------------------------
+
+//将score解码为[经度, 纬度]
+func decodeGeohash(bits float64) ([2]float64, bool) {
+	hash := geoHashBits{bits: uint64(bits), step: geoStepMax}
+	return geohashDecodeToLongLatWGS84(hash)
+}
+
+//解析经度和纬度，超出范围时回复错误
+func extractLongLatOrReply(client *redisClient, argv []*robj) ([2]float64, bool) {
+	var xy [2]float64
+	for i := 0; i < 2; i++ {
+		value, ok := getDoubleFromObjectOrReply(client, argv[i], "")
+		if !ok {
+			return xy, false
+		}
+		xy[i] = value
+	}
+	if xy[0] < geoLongMin || xy[0] > geoLongMax || xy[1] < geoLatMin || xy[1] > geoLatMax {
+		addReplyError(client, fmt.Sprintf("invalid longitude,latitude pair %f,%f", xy[0], xy[1]))
+		return xy, false
+	}
+	return xy, true
+}
+
+//获取member的经纬度
+func longLatFromMember(zobj *robj, member *robj) ([2]float64, bool) {
+	score, ok := zsetScore(zobj, member.ptr.(sds))
+	if !ok {
+		return [2]float64{}, false
+	}
+	return decodeGeohash(score)
+}
+
+//解析距离单位，返回转换为米的倍数，不支持的单位回复错误并返回-1
+func extractUnitOrReply(client *redisClient, unit *robj) float64 {
+	u := unit.ptr.(sds)
+	if strings.EqualFold(u, "m") {
+		return 1
+	} else if strings.EqualFold(u, "km") {
+		return 1000
+	} else if strings.EqualFold(u, "ft") {
+		return 0.3048
+	} else if strings.EqualFold(u, "mi") {
+		return 1609.34
+	}
+	addReplyError(client, "unsupported unit provided. please use M, KM, FT, MI")
+	return -1
+}
+
+//解析半径和单位：radius m|km|ft|mi
+func extractDistanceOrReply(client *redisClient, argv []*robj, shape *geoShape) bool {
+	distance, ok := getDoubleFromObjectOrReply(client, argv[0], "need numeric radius")
+	if !ok {
+		return false
+	}
+	if distance < 0 {
+		addReplyError(client, "radius cannot be negative")
+		return false
+	}
+	toMeters := extractUnitOrReply(client, argv[1])
+	if toMeters < 0 {
+		return false
+	}
+	shape.radius = distance
+	shape.conversion = toMeters
+	return true
+}
+
+//解析矩形的宽度、高度和单位：width height m|km|ft|mi
+func extractBoxOrReply(client *redisClient, argv []*robj, shape *geoShape) bool {
+	w, ok := getDoubleFromObjectOrReply(client, argv[0], "need numeric width")
+	if !ok {
+		return false
+	}
+	h, ok := getDoubleFromObjectOrReply(client, argv[1], "need numeric height")
+	if !ok {
+		return false
+	}
+	if h < 0 || w < 0 {
+		addReplyError(client, "height or width cannot be negative")
+		return false
+	}
+	toMeters := extractUnitOrReply(client, argv[2])
+	if toMeters < 0 {
+		return false
+	}
+	shape.width = w
+	shape.height = h
+	shape.conversion = toMeters
+	return true
+}
+
+//距离保留4位小数
+func addReplyDoubleDistance(client *redisClient, d float64) {
+	addReplyBulkCBuffer(client, fmt.Sprintf("%.4f", d))
+}
+
+//判断score表示的位置是否在形状中，在时返回位置的经纬度和到中心点的距离
+func geoWithinShape(shape *geoShape, score float64) ([2]float64, float64, bool) {
+	xy, ok := decodeGeohash(score)
+	if !ok {
+		return xy, 0, false
+	}
+	var distance float64
+	if shape.shapeType == geoShapeCircular {
+		distance, ok = geohashGetDistanceIfInRadiusWGS84(shape.xy[0], shape.xy[1], xy[0], xy[1],
+			shape.radius*shape.conversion)
+	} else {
+		distance, ok = geohashGetDistanceIfInRectangle(shape.width*shape.conversion, shape.height*shape.conversion,
+			shape.xy[0], shape.xy[1], xy[0], xy[1])
+	}
+	return xy, distance, ok
+}
+
+//查找score在[min, max)之间并且在形状中的位置，limit不为0时最多找到limit个，返回找到的数量
+func geoGetPointsInRange(zobj *robj, min float64, max float64, shape *geoShape, ga *[]geoPoint,
+	limit int) int {
+	spec := &zrangespec{min: min, max: max, minex: false, maxex: true}
+	origincount := len(*ga)
+
+	first, last := zsetRankRangeInRange(zobj, spec.valueGteMin, spec.valueLteMax)
+	zsetRangeForEach(zobj, first, last, false, func(ele sds, score float64) {
+		if limit != 0 && len(*ga) >= limit {
+			return
+		}
+		xy, dist, ok := geoWithinShape(shape, score)
+		if !ok {
+			return
+		}
+		*ga = append(*ga, geoPoint{
+			longitude: xy[0],
+			latitude:  xy[1],
+			dist:      dist,
+			score:     score,
+			member:    ele,
+		})
+	})
+	return len(*ga) - origincount
+}
+
+//hash表示的区域对应的score范围[min, max)
+func scoresOfGeoHashBox(hash geoHashBits) (float64, float64) {
+	min := geohashAlign52Bits(hash)
+	hash.bits++
+	max := geohashAlign52Bits(hash)
+	return float64(min), float64(max)
+}
+
+func membersOfGeoHashBox(zobj *robj, hash geoHashBits, ga *[]geoPoint, shape *geoShape, limit int) int {
+	min, max := scoresOfGeoHashBox(hash)
+	return geoGetPointsInRange(zobj, min, max, shape, ga, limit)
+}
+
+//在中心区域和周围的8个区域中查找位置
+func membersOfAllNeighbors(zobj *robj, n *geoHashRadius, shape *geoShape, ga *[]geoPoint, limit int) int {
+	neighbors := [9]geoHashBits{
+		n.hash,
+		n.neighbors.north,
+		n.neighbors.south,
+		n.neighbors.east,
+		n.neighbors.west,
+		n.neighbors.northEast,
+		n.neighbors.northWest,
+		n.neighbors.southEast,
+		n.neighbors.southWest,
+	}
+
+	count, lastProcessed := 0, 0
+	for i := range neighbors {
+		if neighbors[i].isZero() {
+			continue
+		}
+		//半径非常大时，相邻的区域可能相同，跳过和上一个处理过的区域相同的区域，避免重复
+		if lastProcessed != 0 && neighbors[i] == neighbors[lastProcessed] {
+			continue
+		}
+		if len(*ga) != 0 && limit != 0 && len(*ga) >= limit {
+			break
+		}
+		count += membersOfGeoHashBox(zobj, neighbors[i], ga, shape, limit)
+		lastProcessed = i
+	}
+	return count
+}
+
+//-----------------------------------------------------------------------------
+// Commands
+//-----------------------------------------------------------------------------
+
+//GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+//改写为ZADD key [NX|XX] [CH] score member [score member ...]后执行
+func geoaddCommand(client *redisClient) {
+	xx, nx := false, false
+	longidx := 2
+	for ; longidx < client.argc; longidx++ {
+		opt := client.argv[longidx].ptr.(sds)
+		if strings.EqualFold(opt, "nx") {
+			nx = true
+		} else if strings.EqualFold(opt, "xx") {
+			xx = true
+		} else if !strings.EqualFold(opt, "ch") {
+			break
+		}
+	}
+
+	if (client.argc-longidx)%3 != 0 || (xx && nx) {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	elements := (client.argc - longidx) / 3
+	argv := make([]*robj, longidx+elements*2)
+	argv[0] = createRawStringObject(sds("zadd"))
+	for i := 1; i < longidx; i++ {
+		argv[i] = client.argv[i]
+	}
+	for i := 0; i < elements; i++ {
+		xy, ok := extractLongLatOrReply(client, client.argv[longidx+i*3:])
+		if !ok {
+			return
+		}
+		//经纬度已经检查过了，编码不会失败
+		hash, _ := geohashEncodeWGS84(xy[0], xy[1], geoStepMax)
+		bits := geohashAlign52Bits(hash)
+		argv[longidx+i*2] = createStringObject(ll2string(int64(bits)))
+		argv[longidx+1+i*2] = client.argv[longidx+i*3+2]
+	}
+	//复用的参数对象在旧的argv释放时会减少引用计数
+	for i := 1; i < longidx; i++ {
+		incrRefCount(argv[i])
+	}
+	for i := 0; i < elements; i++ {
+		incrRefCount(argv[longidx+1+i*2])
+	}
+
+	replaceClientCommandVector(client, argv)
+	zaddCommand(client)
+}
+
+//GEOSEARCH/GEOSEARCHSTORE的实现，srcKeyIndex为源key的位置
+func georadiusGeneric(client *redisClient, srcKeyIndex int, flags int) {
+	var storekey *robj
+	storedist := false
+
+	zobj := client.db.lookupKeyRead(client.argv[srcKeyIndex])
+	if zobj != nil && checkType(client, zobj, redisZset) {
+		return
+	}
+
+	baseArgs := 2
+	if flags&geoSearchStore != 0 {
+		baseArgs = 3
+		storekey = client.argv[1]
+	}
+
+	//解析选项
+	shape := &geoShape{}
+	withdist, withhash, withcoords := false, false, false
+	frommember, fromloc, byradius, bybox := false, false, false, false
+	sortType := geoSortNone
+	//ANY时找到count个结果后立即停止搜索
+	searchAny := false
+	var count int64
+	remaining := client.argc - baseArgs
+	for i := 0; i < remaining; i++ {
+		arg := client.argv[baseArgs+i].ptr.(sds)
+		if strings.EqualFold(arg, "withdist") {
+			withdist = true
+		} else if strings.EqualFold(arg, "withhash") {
+			withhash = true
+		} else if strings.EqualFold(arg, "withcoord") {
+			withcoords = true
+		} else if strings.EqualFold(arg, "any") {
+			searchAny = true
+		} else if strings.EqualFold(arg, "asc") {
+			sortType = geoSortAsc
+		} else if strings.EqualFold(arg, "desc") {
+			sortType = geoSortDesc
+		} else if strings.EqualFold(arg, "count") && i+1 < remaining {
+			var ok bool
+			if count, ok = getLongLongFromObjectOrReply(client, client.argv[baseArgs+i+1], ""); !ok {
+				return
+			}
+			if count <= 0 {
+				addReplyError(client, "COUNT must be > 0")
+				return
+			}
+			i++
+		} else if strings.EqualFold(arg, "storedist") && flags&geoSearchStore != 0 {
+			storedist = true
+		} else if strings.EqualFold(arg, "frommember") && i+1 < remaining && !fromloc {
+			//源key不存在时继续解析，解析完后回复空结果
+			if zobj != nil {
+				xy, ok := longLatFromMember(zobj, client.argv[baseArgs+i+1])
+				if !ok {
+					addReplyError(client, "could not decode requested zset member")
+					return
+				}
+				shape.xy = xy
+			}
+			frommember = true
+			i++
+		} else if strings.EqualFold(arg, "fromlonlat") && i+2 < remaining && !frommember {
+			xy, ok := extractLongLatOrReply(client, client.argv[baseArgs+i+1:])
+			if !ok {
+				return
+			}
+			shape.xy = xy
+			fromloc = true
+			i += 2
+		} else if strings.EqualFold(arg, "byradius") && i+2 < remaining && !bybox {
+			if !extractDistanceOrReply(client, client.argv[baseArgs+i+1:], shape) {
+				return
+			}
+			shape.shapeType = geoShapeCircular
+			byradius = true
+			i += 2
+		} else if strings.EqualFold(arg, "bybox") && i+3 < remaining && !byradius {
+			if !extractBoxOrReply(client, client.argv[baseArgs+i+1:], shape) {
+				return
+			}
+			shape.shapeType = geoShapeRectangle
+			bybox = true
+			i += 3
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	//检查选项的组合
+	if storekey != nil && (withdist || withhash || withcoords) {
+		addReplyError(client, "GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+		return
+	}
+	if !frommember && !fromloc {
+		addReplyError(client, "exactly one of FROMMEMBER or FROMLONLAT can be specified for "+client.argv[0].ptr.(sds))
+		return
+	}
+	if !byradius && !bybox {
+		addReplyError(client, "exactly one of BYRADIUS and BYBOX can be specified for "+client.argv[0].ptr.(sds))
+		return
+	}
+	if searchAny && count == 0 {
+		addReplyError(client, "the ANY argument requires COUNT argument")
+		return
+	}
+
+	//源key不存在
+	if zobj == nil {
+		if storekey != nil {
+			if client.db.dbDelete(storekey) {
+				client.db.signalModifiedKey(storekey)
+				notifyKeyspaceEvent(notifyGeneric, "del", storekey, client.db.id)
+				server.dirty++
+			}
+			addReply(client, shared.czero)
+		} else {
+			addReply(client, shared.emptyarray)
+		}
+		return
+	}
+
+	//指定了COUNT时需要排序才能返回最近的位置，ANY除外
+	if count != 0 && sortType == geoSortNone && !searchAny {
+		sortType = geoSortAsc
+	}
+
+	//搜索中心区域和周围的区域
+	georadius := geohashCalculateAreasByShapeWGS84(shape)
+	limit := 0
+	if searchAny {
+		limit = int(count)
+	}
+	ga := make([]geoPoint, 0)
+	membersOfAllNeighbors(zobj, &georadius, shape, &ga, limit)
+
+	if len(ga) == 0 && storekey == nil {
+		addReply(client, shared.emptyarray)
+		return
+	}
+
+	returnedItems := len(ga)
+	if count != 0 && int64(returnedItems) > count {
+		returnedItems = int(count)
+	}
+
+	if sortType == geoSortAsc {
+		sort.Slice(ga, func(i, j int) bool {
+			return ga[i].dist < ga[j].dist
+		})
+	} else if sortType == geoSortDesc {
+		sort.Slice(ga, func(i, j int) bool {
+			return ga[i].dist > ga[j].dist
+		})
+	}
+
+	if storekey == nil {
+		optionLength := 0
+		if withdist {
+			optionLength++
+		}
+		if withcoords {
+			optionLength++
+		}
+		if withhash {
+			optionLength++
+		}
+
+		//有选项时，每个结果为[member, 选项...]数组
+		addReplyArrayLen(client, returnedItems)
+		for i := 0; i < returnedItems; i++ {
+			gp := &ga[i]
+			gp.dist /= shape.conversion
+			if optionLength > 0 {
+				addReplyArrayLen(client, optionLength+1)
+			}
+			addReplyBulkCBuffer(client, gp.member)
+			if withdist {
+				addReplyDoubleDistance(client, gp.dist)
+			}
+			if withhash {
+				addReplyLongLong(client, int64(gp.score))
+			}
+			if withcoords {
+				addReplyArrayLen(client, 2)
+				addReplyHumanLongDouble(client, gp.longitude)
+				addReplyHumanLongDouble(client, gp.latitude)
+			}
+		}
+	} else {
+		//保存到storekey中，STOREDIST时使用距离作为score
+		entries := make([]zsetEntry, returnedItems)
+		for i := 0; i < returnedItems; i++ {
+			gp := &ga[i]
+			gp.dist /= shape.conversion
+			entries[i].ele = gp.member
+			if storedist {
+				entries[i].score = gp.dist
+			} else {
+				entries[i].score = gp.score
+			}
+		}
+		zsetStoreEntries(client, storekey, entries)
+	}
+}
+
+//GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude BYRADIUS radius unit|BYBOX width height unit
+//[ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func geosearchCommand(client *redisClient) {
+	georadiusGeneric(client, 1, geoSearch)
+}
+
+//GEOSEARCHSTORE destination source FROMMEMBER member|FROMLONLAT longitude latitude
+//BYRADIUS radius unit|BYBOX width height unit [ASC|DESC] [COUNT count [ANY]] [STOREDIST]
+func geosearchstoreCommand(client *redisClient) {
+	georadiusGeneric(client, 2, geoSearch|geoSearchStore)
+}
+
+//GEOHASH key [member ...]
+//返回标准的11个字符的geohash字符串
+func geohashCommand(client *redisClient) {
+	const geoalphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj != nil && checkType(client, zobj, redisZset) {
+		return
+	}
+
+	addReplyArrayLen(client, client.argc-2)
+	for j := 2; j < client.argc; j++ {
+		var score float64
+		ok := false
+		if zobj != nil {
+			score, ok = zsetScore(zobj, client.argv[j].ptr.(sds))
+		}
+		if !ok {
+			addReplyNull(client)
+			continue
+		}
+
+		//内部编码使用的纬度范围为[-85, 85]，标准的geohash使用[-90, 90]，需要重新编码
+		xy, ok := decodeGeohash(score)
+		if !ok {
+			addReplyNull(client)
+			continue
+		}
+		longRange := geoHashRange{min: -180, max: 180}
+		latRange := geoHashRange{min: -90, max: 90}
+		hash, _ := geohashEncode(longRange, latRange, xy[0], xy[1], 26)
+
+		buf := make([]byte, 11)
+		for i := 0; i < 11; i++ {
+			idx := 0
+			//只有52位，第11个字符为0
+			if i != 10 {
+				idx = int(hash.bits>>(52-uint(i+1)*5)) & 0x1f
+			}
+			buf[i] = geoalphabet[idx]
+		}
+		addReplyBulkCBuffer(client, string(buf))
+	}
+}
+
+//GEOPOS key [member ...]
+func geoposCommand(client *redisClient) {
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj != nil && checkType(client, zobj, redisZset) {
+		return
+	}
+
+	addReplyArrayLen(client, client.argc-2)
+	for j := 2; j < client.argc; j++ {
+		var xy [2]float64
+		ok := false
+		if zobj != nil {
+			xy, ok = longLatFromMember(zobj, client.argv[j])
+		}
+		if !ok {
+			addReplyNullArray(client)
+			continue
+		}
+		addReplyArrayLen(client, 2)
+		addReplyHumanLongDouble(client, xy[0])
+		addReplyHumanLongDouble(client, xy[1])
+	}
+}
+
+//GEODIST key member1 member2 [m|km|ft|mi]
+func geodistCommand(client *redisClient) {
+	toMeter := 1.0
+	if client.argc == 5 {
+		if toMeter = extractUnitOrReply(client, client.argv[4]); toMeter < 0 {
+			return
+		}
+	} else if client.argc > 5 {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	zobj := lookupKeyReadOrReply(client, client.argv[1], shared.null[client.resp])
+	if zobj == nil || checkType(client, zobj, redisZset) {
+		return
+	}
+
+	xy1, ok1 := longLatFromMember(zobj, client.argv[2])
+	xy2, ok2 := longLatFromMember(zobj, client.argv[3])
+	if !ok1 || !ok2 {
+		addReplyNull(client)
+		return
+	}
+	addReplyDoubleDistance(client, geohashGetDistance(xy1[0], xy1[1], xy2[0], xy2[1])/toMeter)
+}
@@ -0,0 +1,218 @@
+package redis
+
+//geohash编码，经度和纬度交错保存在一个整数中：纬度在偶数位，经度在奇数位
+//step为每个坐标使用的位数，最大为32
+
+const (
+	geoStepMax = 26 //26*2 = 52位，可以被double精确表示
+
+	//经纬度的范围，纬度使用墨卡托投影的范围
+	geoLatMin  = -85.05112878
+	geoLatMax  = 85.05112878
+	geoLongMin = -180.0
+	geoLongMax = 180.0
+)
+
+type geoHashBits struct {
+	bits uint64
+	step uint8
+}
+
+type geoHashRange struct {
+	min float64
+	max float64
+}
+
+type geoHashArea struct {
+	hash      geoHashBits
+	longitude geoHashRange
+	latitude  geoHashRange
+}
+
+type geoHashNeighbors struct {
+	north     geoHashBits
+	east      geoHashBits
+	west      geoHashBits
+	south     geoHashBits
+	northEast geoHashBits
+	southEast geoHashBits
+	northWest geoHashBits
+	southWest geoHashBits
+}
+
+func (h geoHashBits) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+func (r geoHashRange) isZero() bool {
+	return r.max == 0 && r.min == 0
+}
+
+//将两个32位整数交错为64位整数，x在偶数位，y在奇数位
+func interleave64(xlo uint32, ylo uint32) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F,
+		0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF}
+	s := [...]uint{1, 2, 4, 8, 16}
+
+	x := uint64(xlo)
+	y := uint64(ylo)
+	for i := 4; i >= 0; i-- {
+		x = (x | (x << s[i])) & b[i]
+		y = (y | (y << s[i])) & b[i]
+	}
+	return x | (y << 1)
+}
+
+//interleave64的逆运算，偶数位在低32位，奇数位在高32位
+func deinterleave64(interleaved uint64) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F,
+		0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF, 0x00000000FFFFFFFF}
+	s := [...]uint{0, 1, 2, 4, 8, 16}
+
+	x := interleaved
+	y := interleaved >> 1
+	for i := 0; i < 6; i++ {
+		x = (x | (x >> s[i])) & b[i]
+		y = (y | (y >> s[i])) & b[i]
+	}
+	return x | (y << 32)
+}
+
+//WGS84坐标系下的经纬度范围
+func geohashGetCoordRange() (geoHashRange, geoHashRange) {
+	return geoHashRange{min: geoLongMin, max: geoLongMax}, geoHashRange{min: geoLatMin, max: geoLatMax}
+}
+
+//在指定的范围内编码经纬度，坐标超出范围时返回false
+func geohashEncode(longRange geoHashRange, latRange geoHashRange, longitude float64, latitude float64,
+	step uint8) (geoHashBits, bool) {
+	if step > 32 || step == 0 || latRange.isZero() || longRange.isZero() {
+		return geoHashBits{}, false
+	}
+	if longitude > geoLongMax || longitude < geoLongMin || latitude > geoLatMax || latitude < geoLatMin {
+		return geoHashBits{}, false
+	}
+	if latitude < latRange.min || latitude > latRange.max || longitude < longRange.min || longitude > longRange.max {
+		return geoHashBits{step: step}, false
+	}
+
+	latOffset := (latitude - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (longitude - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return geoHashBits{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+func geohashEncodeWGS84(longitude float64, latitude float64, step uint8) (geoHashBits, bool) {
+	longRange, latRange := geohashGetCoordRange()
+	return geohashEncode(longRange, latRange, longitude, latitude, step)
+}
+
+//解码为hash表示的区域
+func geohashDecode(longRange geoHashRange, latRange geoHashRange, hash geoHashBits) (geoHashArea, bool) {
+	if hash.isZero() || latRange.isZero() || longRange.isZero() {
+		return geoHashArea{}, false
+	}
+
+	area := geoHashArea{hash: hash}
+	step := hash.step
+	hashSep := deinterleave64(hash.bits) //[LAT][LONG]
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	ilato := uint32(hashSep)
+	ilono := uint32(hashSep >> 32)
+
+	div := float64(uint64(1) << step)
+	area.latitude.min = latRange.min + (float64(ilato)/div)*latScale
+	area.latitude.max = latRange.min + ((float64(ilato)+1)/div)*latScale
+	area.longitude.min = longRange.min + (float64(ilono)/div)*longScale
+	area.longitude.max = longRange.min + ((float64(ilono)+1)/div)*longScale
+	return area, true
+}
+
+//区域的中心点，返回[经度, 纬度]
+func geohashDecodeAreaToLongLat(area geoHashArea) [2]float64 {
+	var xy [2]float64
+	xy[0] = (area.longitude.min + area.longitude.max) / 2
+	if xy[0] > geoLongMax {
+		xy[0] = geoLongMax
+	}
+	if xy[0] < geoLongMin {
+		xy[0] = geoLongMin
+	}
+	xy[1] = (area.latitude.min + area.latitude.max) / 2
+	if xy[1] > geoLatMax {
+		xy[1] = geoLatMax
+	}
+	if xy[1] < geoLatMin {
+		xy[1] = geoLatMin
+	}
+	return xy
+}
+
+func geohashDecodeToLongLatWGS84(hash geoHashBits) ([2]float64, bool) {
+	longRange, latRange := geohashGetCoordRange()
+	area, ok := geohashDecode(longRange, latRange, hash)
+	if !ok {
+		return [2]float64{}, false
+	}
+	return geohashDecodeAreaToLongLat(area), true
+}
+
+//沿经度方向移动一格，d > 0向东，d < 0向西
+func geohashMoveX(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - uint(hash.step)*2)
+
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(hash.step)*2)
+	hash.bits = x | y
+}
+
+//沿纬度方向移动一格，d > 0向北，d < 0向南
+func geohashMoveY(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(hash.step)*2)
+
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - uint(hash.step)*2)
+	hash.bits = x | y
+}
+
+//计算周围的8个区域
+func geohashNeighbors(hash geoHashBits) geoHashNeighbors {
+	move := func(dx int, dy int) geoHashBits {
+		h := hash
+		geohashMoveX(&h, dx)
+		geohashMoveY(&h, dy)
+		return h
+	}
+	return geoHashNeighbors{
+		east:      move(1, 0),
+		west:      move(-1, 0),
+		south:     move(0, -1),
+		north:     move(0, 1),
+		northWest: move(-1, 1),
+		southWest: move(-1, -1),
+		northEast: move(1, 1),
+		southEast: move(1, -1),
+	}
+}
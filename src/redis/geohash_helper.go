@@ -0,0 +1,230 @@
+package redis
+
+import "math"
+
+const (
+	degToRad            = 0.017453292519943295769236907684886
+	earthRadiusInMeters = 6372797.560856 //地球半径，和redis使用的值相同
+	mercatorMax         = 20037726.37
+)
+
+//搜索的形状
+const (
+	geoShapeCircular  = 1
+	geoShapeRectangle = 2
+)
+
+//搜索的形状，xy为中心点，长度的单位为conversion表示的单位
+type geoShape struct {
+	shapeType  int
+	xy         [2]float64
+	conversion float64 //转换为米的倍数
+	bounds     [4]float64
+	radius     float64
+	width      float64
+	height     float64
+}
+
+//搜索的区域：中心点所在的区域以及周围的8个区域
+type geoHashRadius struct {
+	hash      geoHashBits
+	area      geoHashArea
+	neighbors geoHashNeighbors
+}
+
+func degRad(ang float64) float64 {
+	return ang * degToRad
+}
+
+func radDeg(ang float64) float64 {
+	return ang / degToRad
+}
+
+//根据半径估算geohash的step，保证周围的区域可以覆盖整个半径
+func geohashEstimateStepsByRadius(rangeMeters float64, lat float64) uint8 {
+	if rangeMeters == 0 {
+		return 26
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	//保证大部分情况下区域可以包含半径
+	step -= 2
+
+	//在两极附近，经度方向的区域很小，需要更大的区域
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+
+	if step < 1 {
+		step = 1
+	}
+	if step > 26 {
+		step = 26
+	}
+	return uint8(step)
+}
+
+//计算形状的外接矩形：[最小经度, 最小纬度, 最大经度, 最大纬度]
+func geohashBoundingBox(shape *geoShape) [4]float64 {
+	longitude := shape.xy[0]
+	latitude := shape.xy[1]
+	var height, width float64
+	if shape.shapeType == geoShapeCircular {
+		height = shape.conversion * shape.radius
+		width = shape.conversion * shape.radius
+	} else {
+		height = shape.conversion * shape.height / 2
+		width = shape.conversion * shape.width / 2
+	}
+
+	latDelta := radDeg(height / earthRadiusInMeters)
+	longDeltaTop := radDeg(width / earthRadiusInMeters / math.Cos(degRad(latitude+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadiusInMeters / math.Cos(degRad(latitude-latDelta)))
+
+	//纬度越靠近两极，相同距离对应的经度差越大
+	var bounds [4]float64
+	if latitude < 0 {
+		bounds[0] = longitude - longDeltaBottom
+		bounds[2] = longitude + longDeltaBottom
+	} else {
+		bounds[0] = longitude - longDeltaTop
+		bounds[2] = longitude + longDeltaTop
+	}
+	bounds[1] = latitude - latDelta
+	bounds[3] = latitude + latDelta
+	return bounds
+}
+
+//计算覆盖形状需要搜索的区域
+func geohashCalculateAreasByShapeWGS84(shape *geoShape) geoHashRadius {
+	shape.bounds = geohashBoundingBox(shape)
+	minLon, minLat := shape.bounds[0], shape.bounds[1]
+	maxLon, maxLat := shape.bounds[2], shape.bounds[3]
+
+	longitude := shape.xy[0]
+	latitude := shape.xy[1]
+	var radiusMeters float64
+	if shape.shapeType == geoShapeCircular {
+		radiusMeters = shape.radius
+	} else {
+		radiusMeters = math.Sqrt((shape.width/2)*(shape.width/2) + (shape.height/2)*(shape.height/2))
+	}
+	radiusMeters *= shape.conversion
+
+	steps := geohashEstimateStepsByRadius(radiusMeters, latitude)
+	longRange, latRange := geohashGetCoordRange()
+	hash, _ := geohashEncode(longRange, latRange, longitude, latitude, steps)
+	neighbors := geohashNeighbors(hash)
+	area, _ := geohashDecode(longRange, latRange, hash)
+
+	//估算的step可能太大，周围的区域不能覆盖整个形状时减小step
+	decreaseStep := false
+	{
+		north, _ := geohashDecode(longRange, latRange, neighbors.north)
+		south, _ := geohashDecode(longRange, latRange, neighbors.south)
+		east, _ := geohashDecode(longRange, latRange, neighbors.east)
+		west, _ := geohashDecode(longRange, latRange, neighbors.west)
+
+		if north.latitude.max < maxLat {
+			decreaseStep = true
+		}
+		if south.latitude.min > minLat {
+			decreaseStep = true
+		}
+		if east.longitude.max < maxLon {
+			decreaseStep = true
+		}
+		if west.longitude.min > minLon {
+			decreaseStep = true
+		}
+	}
+
+	if steps > 1 && decreaseStep {
+		steps--
+		hash, _ = geohashEncode(longRange, latRange, longitude, latitude, steps)
+		neighbors = geohashNeighbors(hash)
+		area, _ = geohashDecode(longRange, latRange, hash)
+	}
+
+	//排除不需要搜索的区域
+	if steps >= 2 {
+		if area.latitude.min < minLat {
+			neighbors.south = geoHashBits{}
+			neighbors.southWest = geoHashBits{}
+			neighbors.southEast = geoHashBits{}
+		}
+		if area.latitude.max > maxLat {
+			neighbors.north = geoHashBits{}
+			neighbors.northEast = geoHashBits{}
+			neighbors.northWest = geoHashBits{}
+		}
+		if area.longitude.min < minLon {
+			neighbors.west = geoHashBits{}
+			neighbors.southWest = geoHashBits{}
+			neighbors.northWest = geoHashBits{}
+		}
+		if area.longitude.max > maxLon {
+			neighbors.east = geoHashBits{}
+			neighbors.southEast = geoHashBits{}
+			neighbors.northEast = geoHashBits{}
+		}
+	}
+	return geoHashRadius{hash: hash, area: area, neighbors: neighbors}
+}
+
+//将hash对齐到52位，用作zset的score
+func geohashAlign52Bits(hash geoHashBits) uint64 {
+	return hash.bits << (52 - uint(hash.step)*2)
+}
+
+//两个纬度之间的距离
+func geohashGetLatDistance(lat1d float64, lat2d float64) float64 {
+	return earthRadiusInMeters * math.Abs(degRad(lat2d)-degRad(lat1d))
+}
+
+//使用haversine公式计算两点之间的距离，单位为米
+func geohashGetDistance(lon1d float64, lat1d float64, lon2d float64, lat2d float64) float64 {
+	lon1r := degRad(lon1d)
+	lon2r := degRad(lon2d)
+	v := math.Sin((lon2r - lon1r) / 2)
+	//经度相同时只需要计算纬度的距离
+	if v == 0.0 {
+		return geohashGetLatDistance(lat1d, lat2d)
+	}
+	lat1r := degRad(lat1d)
+	lat2r := degRad(lat2d)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * earthRadiusInMeters * math.Asin(math.Sqrt(a))
+}
+
+//计算两点之间的距离，超过半径时返回false
+func geohashGetDistanceIfInRadiusWGS84(x1 float64, y1 float64, x2 float64, y2 float64,
+	radius float64) (float64, bool) {
+	distance := geohashGetDistance(x1, y1, x2, y2)
+	if distance > radius {
+		return distance, false
+	}
+	return distance, true
+}
+
+//判断(x2, y2)是否在以(x1, y1)为中心的矩形中，在时返回两点之间的距离
+func geohashGetDistanceIfInRectangle(widthM float64, heightM float64, x1 float64, y1 float64,
+	x2 float64, y2 float64) (float64, bool) {
+	//先检查计算量更小的纬度距离
+	latDistance := geohashGetLatDistance(y2, y1)
+	if latDistance > heightM/2 {
+		return 0, false
+	}
+	lonDistance := geohashGetDistance(x2, y2, x1, y2)
+	if lonDistance > widthM/2 {
+		return 0, false
+	}
+	return geohashGetDistance(x1, y1, x2, y2), true
+}
@@ -0,0 +1,924 @@
+package redis
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+//HyperLogLog，和redis的内存布局完全相同，使用字符串对象保存：
+//
+//+------+---+-----+----------+
+//| HYLL | E | N/U | Cardin.  |
+//+------+---+-----+----------+
+//
+//前4个字节为"HYLL"，E为编码（dense或者sparse），N/U为3个未使用的字节，
+//Cardin.为8个字节的小端序基数缓存，最高位为1时表示缓存失效
+//
+//dense表示：16384个6位的寄存器，低位在前
+//sparse表示：使用三种操作码压缩连续的相同值
+//  ZERO:  00xxxxxx，xxxxxx+1个寄存器为0，最多64个
+//  XZERO: 01xxxxxx yyyyyyyy，xxxxxxyyyyyyyy+1个寄存器为0，最多16384个
+//  VAL:   1vvvvvxx，xx+1个寄存器的值为vvvvv+1，值最大为32，最多4个
+
+const (
+	hllP           = 14                 //用于选择寄存器的位数
+	hllQ           = 64 - hllP          //用于计算连续0的位数
+	hllRegisters   = 1 << hllP          //寄存器的数量
+	hllPMask       = hllRegisters - 1   //选择寄存器的掩码
+	hllBits        = 6                  //每个寄存器的位数
+	hllRegisterMax = (1 << hllBits) - 1 //寄存器的最大值
+	hllHdrSize     = 16                 //头部的长度
+	hllDenseSize   = hllHdrSize + (hllRegisters*hllBits+7)/8
+
+	hllDense       = 0   //dense编码
+	hllSparse      = 1   //sparse编码
+	hllRaw         = 255 //每个寄存器一个字节，只在内部使用
+	hllMaxEncoding = 1
+
+	hllSparseXzeroBit    = 0x40
+	hllSparseValBit      = 0x80
+	hllSparseValMaxValue = 32
+	hllSparseValMaxLen   = 4
+	hllSparseZeroMaxLen  = 64
+	hllSparseXzeroMaxLen = 16384
+
+	hllAlphaInf = 0.721347520444481703680 //1/(2*ln(2))
+)
+
+const invalidHllErr = "-INVALIDOBJ Corrupted HLL object detected\r\n"
+
+//-----------------------------------------------------------------------------
+// Header
+//-----------------------------------------------------------------------------
+
+func hllEncoding(hll []byte) byte {
+	return hll[4]
+}
+
+//基数缓存失效
+func hllInvalidateCache(hll []byte) {
+	hll[15] |= 1 << 7
+}
+
+func hllValidCache(hll []byte) bool {
+	return hll[15]&(1<<7) == 0
+}
+
+func hllGetCachedCard(hll []byte) uint64 {
+	var card uint64
+	for i := 7; i >= 0; i-- {
+		card = card<<8 | uint64(hll[8+i])
+	}
+	return card
+}
+
+func hllSetCachedCard(hll []byte, card uint64) {
+	for i := 0; i < 8; i++ {
+		hll[8+i] = byte(card >> (8 * i))
+	}
+}
+
+//-----------------------------------------------------------------------------
+// Sparse opcodes
+//-----------------------------------------------------------------------------
+
+func hllSparseIsZero(b byte) bool {
+	return b&0xc0 == 0
+}
+
+func hllSparseIsXzero(b byte) bool {
+	return b&0xc0 == hllSparseXzeroBit
+}
+
+func hllSparseIsVal(b byte) bool {
+	return b&hllSparseValBit != 0
+}
+
+func hllSparseZeroLen(b byte) int {
+	return int(b&0x3f) + 1
+}
+
+func hllSparseXzeroLen(b0 byte, b1 byte) int {
+	return (int(b0&0x3f)<<8 | int(b1)) + 1
+}
+
+func hllSparseValValue(b byte) int {
+	return int(b>>2&0x1f) + 1
+}
+
+func hllSparseValLen(b byte) int {
+	return int(b&0x3) + 1
+}
+
+func hllSparseValSet(val int, length int) byte {
+	return byte((val-1)<<2|(length-1)) | hllSparseValBit
+}
+
+func hllSparseZeroSet(length int) byte {
+	return byte(length - 1)
+}
+
+func hllSparseXzeroSet(length int) (byte, byte) {
+	l := length - 1
+	return byte(l>>8) | hllSparseXzeroBit, byte(l & 0xff)
+}
+
+//-----------------------------------------------------------------------------
+// Dense registers
+//-----------------------------------------------------------------------------
+
+//读取第regnum个寄存器，寄存器可能跨越两个字节
+func hllDenseGetRegister(registers []byte, regnum int) uint8 {
+	byteIdx := regnum * hllBits / 8
+	fb := uint(regnum * hllBits & 7)
+	fb8 := 8 - fb
+	b0 := uint(registers[byteIdx])
+	var b1 uint
+	if byteIdx+1 < len(registers) {
+		b1 = uint(registers[byteIdx+1])
+	}
+	return uint8((b0>>fb | b1<<fb8) & hllRegisterMax)
+}
+
+func hllDenseSetRegister(registers []byte, regnum int, val uint8) {
+	byteIdx := regnum * hllBits / 8
+	fb := uint(regnum * hllBits & 7)
+	fb8 := 8 - fb
+	v := uint(val)
+	registers[byteIdx] &^= byte(hllRegisterMax << fb)
+	registers[byteIdx] |= byte(v << fb)
+	if byteIdx+1 < len(registers) {
+		registers[byteIdx+1] &^= byte(hllRegisterMax >> fb8)
+		registers[byteIdx+1] |= byte(v >> fb8)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// HyperLogLog algorithm
+//-----------------------------------------------------------------------------
+
+//MurmurHash2的64位版本，按照小端序读取，和redis的结果相同
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m uint64 = 0xc6a4a7935bd1e995
+	const r = 47
+	length := len(key)
+	h := seed ^ (uint64(length) * m)
+
+	data := key
+	for len(data) >= 8 {
+		k := uint64(data[0]) | uint64(data[1])<<8 | uint64(data[2])<<16 | uint64(data[3])<<24 |
+			uint64(data[4])<<32 | uint64(data[5])<<40 | uint64(data[6])<<48 | uint64(data[7])<<56
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+
+	switch len(data) {
+	case 7:
+		h ^= uint64(data[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(data[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(data[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(data[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(data[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+//计算元素对应的寄存器，以及hash中剩余的位从低位开始连续0的数量加1
+func hllPatLen(ele []byte) (int, uint8) {
+	hash := murmurHash64A(ele, 0xadc83b19)
+	index := int(hash & hllPMask)
+	hash >>= hllP
+	//保证循环一定会结束，count最大为hllQ+1
+	hash |= 1 << hllQ
+	bit := uint64(1)
+	count := uint8(1)
+	for hash&bit == 0 {
+		count++
+		bit <<= 1
+	}
+	return index, count
+}
+
+//寄存器的值小于count时更新，返回1表示更新了
+func hllDenseSet(registers []byte, index int, count uint8) int {
+	oldcount := hllDenseGetRegister(registers, index)
+	if count > oldcount {
+		hllDenseSetRegister(registers, index, count)
+		return 1
+	}
+	return 0
+}
+
+func hllDenseAdd(registers []byte, ele []byte) int {
+	index, count := hllPatLen(ele)
+	return hllDenseSet(registers, index, count)
+}
+
+//统计每个寄存器值出现的次数
+func hllDenseRegHisto(registers []byte, reghisto *[64]int) {
+	for j := 0; j < hllRegisters; j++ {
+		reghisto[hllDenseGetRegister(registers, j)]++
+	}
+}
+
+//将sparse表示转换为dense表示，sparse表示无效时返回false
+func hllSparseToDense(hll []byte) ([]byte, bool) {
+	if hllEncoding(hll) == hllDense {
+		return hll, true
+	}
+
+	dense := make([]byte, hllDenseSize)
+	copy(dense, hll[:hllHdrSize])
+	dense[4] = hllDense
+	registers := dense[hllHdrSize:]
+
+	idx := 0
+	p := hllHdrSize
+	for p < len(hll) {
+		if hllSparseIsZero(hll[p]) {
+			idx += hllSparseZeroLen(hll[p])
+			p++
+		} else if hllSparseIsXzero(hll[p]) {
+			if p+1 >= len(hll) {
+				return nil, false
+			}
+			idx += hllSparseXzeroLen(hll[p], hll[p+1])
+			p += 2
+		} else {
+			runlen := hllSparseValLen(hll[p])
+			regval := uint8(hllSparseValValue(hll[p]))
+			if runlen+idx > hllRegisters {
+				break
+			}
+			for ; runlen > 0; runlen-- {
+				hllDenseSetRegister(registers, idx, regval)
+				idx++
+			}
+			p++
+		}
+	}
+
+	//寄存器的数量必须正好是hllRegisters
+	if idx != hllRegisters {
+		return nil, false
+	}
+	return dense, true
+}
+
+//更新sparse表示中的寄存器，返回更新后的hll和结果：1表示更新了，0表示没有更新，-1表示sparse表示无效
+//更新后sparse表示的长度超过hllSparseMaxBytes或者值超过VAL操作码的最大值时，转换为dense表示
+func hllSparseSet(hll []byte, index int, count uint8) ([]byte, int) {
+	if count > hllSparseValMaxValue {
+		return hllSparsePromote(hll, index, count)
+	}
+
+	//1. 找到包含index的操作码
+	end := len(hll)
+	p := hllHdrSize
+	first, span := 0, 0
+	prev := -1
+	for p < end {
+		oplen := 1
+		if hllSparseIsZero(hll[p]) {
+			span = hllSparseZeroLen(hll[p])
+		} else if hllSparseIsVal(hll[p]) {
+			span = hllSparseValLen(hll[p])
+		} else {
+			if p+1 >= end {
+				return hll, -1
+			}
+			span = hllSparseXzeroLen(hll[p], hll[p+1])
+			oplen = 2
+		}
+		//index在这个操作码表示的范围中
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += oplen
+		first += span
+	}
+	if span == 0 || p >= end {
+		return hll, -1
+	}
+
+	next := p + 1
+	if hllSparseIsXzero(hll[p]) {
+		next = p + 2
+	}
+	if next >= end {
+		next = -1
+	}
+
+	isZero, isXzero, isVal := false, false, false
+	var runlen int
+	if hllSparseIsZero(hll[p]) {
+		isZero = true
+		runlen = hllSparseZeroLen(hll[p])
+	} else if hllSparseIsXzero(hll[p]) {
+		isXzero = true
+		runlen = hllSparseXzeroLen(hll[p], hll[p+1])
+	} else {
+		isVal = true
+		runlen = hllSparseValLen(hll[p])
+	}
+
+	//2. 不需要拆分操作码的情况
+	updated := false
+	if isVal {
+		oldcount := hllSparseValValue(hll[p])
+		//原来的值更大，不需要更新
+		if oldcount >= int(count) {
+			return hll, 0
+		}
+		if runlen == 1 {
+			hll[p] = hllSparseValSet(int(count), 1)
+			updated = true
+		}
+	}
+	if !updated && isZero && runlen == 1 {
+		hll[p] = hllSparseValSet(int(count), 1)
+		updated = true
+	}
+
+	//3. 拆分成最多3个操作码：index之前的部分、index和index之后的部分
+	if !updated {
+		seq := make([]byte, 0, 5)
+		last := first + span - 1
+
+		if isZero || isXzero {
+			if index != first {
+				length := index - first
+				if length > hllSparseZeroMaxLen {
+					b0, b1 := hllSparseXzeroSet(length)
+					seq = append(seq, b0, b1)
+				} else {
+					seq = append(seq, hllSparseZeroSet(length))
+				}
+			}
+			seq = append(seq, hllSparseValSet(int(count), 1))
+			if index != last {
+				length := last - index
+				if length > hllSparseZeroMaxLen {
+					b0, b1 := hllSparseXzeroSet(length)
+					seq = append(seq, b0, b1)
+				} else {
+					seq = append(seq, hllSparseZeroSet(length))
+				}
+			}
+		} else {
+			curval := hllSparseValValue(hll[p])
+			if index != first {
+				seq = append(seq, hllSparseValSet(curval, index-first))
+			}
+			seq = append(seq, hllSparseValSet(int(count), 1))
+			if index != last {
+				seq = append(seq, hllSparseValSet(curval, last-index))
+			}
+		}
+
+		oldlen := 1
+		if isXzero {
+			oldlen = 2
+		}
+		deltalen := len(seq) - oldlen
+
+		//sparse表示太长了，转换为dense表示
+		if deltalen > 0 && len(hll)+deltalen > server.hllSparseMaxBytes {
+			return hllSparsePromote(hll, index, count)
+		}
+
+		//用新的操作码替换原来的操作码
+		tail := []byte(nil)
+		if next != -1 {
+			tail = append(tail, hll[next:end]...)
+		}
+		hll = append(hll[:p], seq...)
+		hll = append(hll, tail...)
+		end = len(hll)
+	}
+
+	//4. 合并相邻的相同值的VAL操作码，从prev开始最多检查5个操作码
+	p = prev
+	if p == -1 {
+		p = hllHdrSize
+	}
+	for scanlen := 5; p < end && scanlen > 0; scanlen-- {
+		if hllSparseIsXzero(hll[p]) {
+			p += 2
+			continue
+		} else if hllSparseIsZero(hll[p]) {
+			p++
+			continue
+		}
+		if p+1 < end && hllSparseIsVal(hll[p+1]) {
+			v1 := hllSparseValValue(hll[p])
+			v2 := hllSparseValValue(hll[p+1])
+			if v1 == v2 {
+				length := hllSparseValLen(hll[p]) + hllSparseValLen(hll[p+1])
+				if length <= hllSparseValMaxLen {
+					hll[p+1] = hllSparseValSet(v1, length)
+					copy(hll[p:], hll[p+1:end])
+					end--
+					hll = hll[:end]
+					//合并后不移动p，继续尝试和右边的操作码合并
+					continue
+				}
+			}
+		}
+		p++
+	}
+
+	hllInvalidateCache(hll)
+	return hll, 1
+}
+
+//转换为dense表示后再更新寄存器，需要转换说明寄存器一定会被更新
+func hllSparsePromote(hll []byte, index int, count uint8) ([]byte, int) {
+	dense, ok := hllSparseToDense(hll)
+	if !ok {
+		return hll, -1
+	}
+	return dense, hllDenseSet(dense[hllHdrSize:], index, count)
+}
+
+func hllSparseAdd(hll []byte, ele []byte) ([]byte, int) {
+	index, count := hllPatLen(ele)
+	return hllSparseSet(hll, index, count)
+}
+
+//统计sparse表示中每个寄存器值出现的次数，sparse表示无效时返回false
+func hllSparseRegHisto(sparse []byte, reghisto *[64]int) bool {
+	idx := 0
+	for p := 0; p < len(sparse); {
+		if hllSparseIsZero(sparse[p]) {
+			runlen := hllSparseZeroLen(sparse[p])
+			idx += runlen
+			reghisto[0] += runlen
+			p++
+		} else if hllSparseIsXzero(sparse[p]) {
+			if p+1 >= len(sparse) {
+				return false
+			}
+			runlen := hllSparseXzeroLen(sparse[p], sparse[p+1])
+			idx += runlen
+			reghisto[0] += runlen
+			p += 2
+		} else {
+			runlen := hllSparseValLen(sparse[p])
+			idx += runlen
+			reghisto[hllSparseValValue(sparse[p])] += runlen
+			p++
+		}
+	}
+	return idx == hllRegisters
+}
+
+//统计raw表示中每个寄存器值出现的次数
+func hllRawRegHisto(registers []byte, reghisto *[64]int) {
+	for j := 0; j < hllRegisters; j++ {
+		reghisto[registers[j]]++
+	}
+}
+
+//Otmar Ertl的改进估计算法中的sigma函数
+func hllSigma(x float64) float64 {
+	if x == 1. {
+		return math.Inf(1)
+	}
+	var zPrime float64
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		zPrime = z
+		z += x * y
+		y += y
+		if zPrime == z {
+			break
+		}
+	}
+	return z
+}
+
+//Otmar Ertl的改进估计算法中的tau函数
+func hllTau(x float64) float64 {
+	if x == 0. || x == 1. {
+		return 0.
+	}
+	var zPrime float64
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		zPrime = z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			break
+		}
+	}
+	return z / 3
+}
+
+//估算基数，hll为sparse表示并且无效时返回false
+func hllCount(hll []byte) (uint64, bool) {
+	m := float64(hllRegisters)
+	var reghisto [64]int
+
+	switch hllEncoding(hll) {
+	case hllDense:
+		hllDenseRegHisto(hll[hllHdrSize:], &reghisto)
+	case hllSparse:
+		if !hllSparseRegHisto(hll[hllHdrSize:], &reghisto) {
+			return 0, false
+		}
+	case hllRaw:
+		hllRawRegHisto(hll[hllHdrSize:], &reghisto)
+	default:
+		return 0, false
+	}
+
+	z := m * hllTau((m-float64(reghisto[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(reghisto[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(reghisto[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z)), true
+}
+
+//添加元素，返回更新后的hll和结果：1表示更新了寄存器，0表示没有更新，-1表示hll无效
+func hllAdd(hll []byte, ele []byte) ([]byte, int) {
+	switch hllEncoding(hll) {
+	case hllDense:
+		return hll, hllDenseAdd(hll[hllHdrSize:], ele)
+	case hllSparse:
+		return hllSparseAdd(hll, ele)
+	default:
+		return hll, -1
+	}
+}
+
+//将hll合并到max中，max为每个寄存器一个字节的raw表示，每个寄存器取最大值
+func hllMerge(max []byte, hll []byte) bool {
+	if hllEncoding(hll) == hllDense {
+		registers := hll[hllHdrSize:]
+		for i := 0; i < hllRegisters; i++ {
+			if val := hllDenseGetRegister(registers, i); val > max[i] {
+				max[i] = val
+			}
+		}
+		return true
+	}
+
+	i := 0
+	for p := hllHdrSize; p < len(hll); {
+		if hllSparseIsZero(hll[p]) {
+			i += hllSparseZeroLen(hll[p])
+			p++
+		} else if hllSparseIsXzero(hll[p]) {
+			if p+1 >= len(hll) {
+				return false
+			}
+			i += hllSparseXzeroLen(hll[p], hll[p+1])
+			p += 2
+		} else {
+			runlen := hllSparseValLen(hll[p])
+			regval := byte(hllSparseValValue(hll[p]))
+			if runlen+i > hllRegisters {
+				break
+			}
+			for ; runlen > 0; runlen-- {
+				if regval > max[i] {
+					max[i] = regval
+				}
+				i++
+			}
+			p++
+		}
+	}
+	return i == hllRegisters
+}
+
+//-----------------------------------------------------------------------------
+// HyperLogLog commands
+//-----------------------------------------------------------------------------
+
+//创建空的HyperLogLog对象，使用sparse表示，所有寄存器都用XZERO操作码表示
+func createHLLObject() *robj {
+	sparselen := hllHdrSize + (hllRegisters+(hllSparseXzeroMaxLen-1))/hllSparseXzeroMaxLen*2
+	s := make([]byte, hllHdrSize, sparselen)
+	copy(s, "HYLL")
+	s[4] = hllSparse
+
+	for aux := hllRegisters; aux > 0; {
+		xzero := hllSparseXzeroMaxLen
+		if xzero > aux {
+			xzero = aux
+		}
+		b0, b1 := hllSparseXzeroSet(xzero)
+		s = append(s, b0, b1)
+		aux -= xzero
+	}
+	return createRawStringObject(sds(s))
+}
+
+//检查对象是不是有效的HyperLogLog，不是时回复错误并返回false
+func isHLLObjectOrReply(client *redisClient, o *robj) bool {
+	if checkType(client, o, redisString) {
+		return false
+	}
+
+	valid := o.encoding != redisEncodingInt
+	if valid {
+		s := o.ptr.(sds)
+		valid = len(s) >= hllHdrSize && s[:4] == "HYLL" && s[4] <= hllMaxEncoding &&
+			(s[4] != hllDense || len(s) == hllDenseSize)
+	}
+	if !valid {
+		addReplyString(client, "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n")
+		return false
+	}
+	return true
+}
+
+//PFADD key [element ...]
+func pfaddCommand(client *redisClient) {
+	updated := 0
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o == nil {
+		//没有元素时也会创建key
+		o = createHLLObject()
+		client.db.dbAdd(client.argv[1], o)
+		updated++
+	} else {
+		if !isHLLObjectOrReply(client, o) {
+			return
+		}
+		o = client.db.dbUnshareStringValue(client.argv[1], o)
+	}
+
+	hll := []byte(o.ptr.(sds))
+	for j := 2; j < client.argc; j++ {
+		var retval int
+		hll, retval = hllAdd(hll, []byte(client.argv[j].ptr.(sds)))
+		switch retval {
+		case 1:
+			updated++
+		case -1:
+			addReplyString(client, invalidHllErr)
+			return
+		}
+	}
+
+	if updated > 0 {
+		hllInvalidateCache(hll)
+		o.ptr = sds(hll)
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyString, "pfadd", client.argv[1], client.db.id)
+		server.dirty++
+		addReply(client, shared.cone)
+	} else {
+		addReply(client, shared.czero)
+	}
+}
+
+//PFCOUNT key [key ...]
+//多个key时，合并后估算基数，不修改任何key
+func pfcountCommand(client *redisClient) {
+	if client.argc > 2 {
+		max := make([]byte, hllHdrSize+hllRegisters)
+		max[4] = hllRaw
+		for j := 1; j < client.argc; j++ {
+			o := client.db.lookupKeyRead(client.argv[j])
+			if o == nil {
+				continue
+			}
+			if !isHLLObjectOrReply(client, o) {
+				return
+			}
+			if !hllMerge(max[hllHdrSize:], []byte(o.ptr.(sds))) {
+				addReplyString(client, invalidHllErr)
+				return
+			}
+		}
+		card, _ := hllCount(max)
+		addReplyLongLong(client, int64(card))
+		return
+	}
+
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o == nil {
+		addReply(client, shared.czero)
+		return
+	}
+	if !isHLLObjectOrReply(client, o) {
+		return
+	}
+	o = client.db.dbUnshareStringValue(client.argv[1], o)
+
+	//缓存有效时直接使用，否则重新估算并更新缓存
+	hll := []byte(o.ptr.(sds))
+	var card uint64
+	if hllValidCache(hll) {
+		card = hllGetCachedCard(hll)
+	} else {
+		var ok bool
+		if card, ok = hllCount(hll); !ok {
+			addReplyString(client, invalidHllErr)
+			return
+		}
+		hllSetCachedCard(hll, card)
+		o.ptr = sds(hll)
+		//更新了缓存，虽然是只读命令也算修改了key
+		client.db.signalModifiedKey(client.argv[1])
+		server.dirty++
+	}
+	addReplyLongLong(client, int64(card))
+}
+
+//PFMERGE destkey [sourcekey ...]
+func pfmergeCommand(client *redisClient) {
+	//destkey也参与合并
+	max := make([]byte, hllRegisters)
+	useDense := false
+	for j := 1; j < client.argc; j++ {
+		o := client.db.lookupKeyRead(client.argv[j])
+		if o == nil {
+			continue
+		}
+		if !isHLLObjectOrReply(client, o) {
+			return
+		}
+		hll := []byte(o.ptr.(sds))
+		//有一个dense表示时，结果也使用dense表示
+		if hllEncoding(hll) == hllDense {
+			useDense = true
+		}
+		if !hllMerge(max, hll) {
+			addReplyString(client, invalidHllErr)
+			return
+		}
+	}
+
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o == nil {
+		o = createHLLObject()
+		client.db.dbAdd(client.argv[1], o)
+	} else {
+		o = client.db.dbUnshareStringValue(client.argv[1], o)
+	}
+
+	hll := []byte(o.ptr.(sds))
+	if useDense {
+		var ok bool
+		if hll, ok = hllSparseToDense(hll); !ok {
+			addReplyString(client, invalidHllErr)
+			return
+		}
+	}
+
+	//将合并的结果写入destkey的寄存器
+	for j := 0; j < hllRegisters; j++ {
+		if max[j] == 0 {
+			continue
+		}
+		switch hllEncoding(hll) {
+		case hllDense:
+			hllDenseSet(hll[hllHdrSize:], j, max[j])
+		case hllSparse:
+			var retval int
+			if hll, retval = hllSparseSet(hll, j, max[j]); retval == -1 {
+				addReplyString(client, invalidHllErr)
+				return
+			}
+		}
+	}
+
+	hllInvalidateCache(hll)
+	o.ptr = sds(hll)
+	client.db.signalModifiedKey(client.argv[1])
+	//PFMERGE发布的事件和PFADD相同
+	notifyKeyspaceEvent(notifyString, "pfadd", client.argv[1], client.db.id)
+	server.dirty++
+	addReply(client, shared.ok)
+}
+
+//PFDEBUG GETREG|DECODE|ENCODING|TODENSE key
+func pfdebugCommand(client *redisClient) {
+	cmd := client.argv[1].ptr.(sds)
+	o := client.db.lookupKeyWrite(client.argv[2])
+	if o == nil {
+		addReplyError(client, "The specified key does not exist")
+		return
+	}
+	if !isHLLObjectOrReply(client, o) {
+		return
+	}
+	o = client.db.dbUnshareStringValue(client.argv[2], o)
+	hll := []byte(o.ptr.(sds))
+
+	switch strings.ToLower(cmd) {
+	case "getreg":
+		//回复所有寄存器的值，sparse表示会先转换为dense表示
+		if client.argc != 3 {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+		var ok bool
+		if hll, ok = hllSparseToDense(hll); !ok {
+			addReplyString(client, invalidHllErr)
+			return
+		}
+		o.ptr = sds(hll)
+		addReplyArrayLen(client, hllRegisters)
+		for j := 0; j < hllRegisters; j++ {
+			addReplyLongLong(client, int64(hllDenseGetRegister(hll[hllHdrSize:], j)))
+		}
+	case "decode":
+		//回复sparse表示的操作码
+		if client.argc != 3 {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+		if hllEncoding(hll) != hllSparse {
+			addReplyError(client, "HLL encoding is not sparse")
+			return
+		}
+		var decoded strings.Builder
+		for p := hllHdrSize; p < len(hll); {
+			if hllSparseIsZero(hll[p]) {
+				decoded.WriteString("z:" + strconv.Itoa(hllSparseZeroLen(hll[p])) + " ")
+				p++
+			} else if hllSparseIsXzero(hll[p]) {
+				if p+1 >= len(hll) {
+					break
+				}
+				decoded.WriteString("Z:" + strconv.Itoa(hllSparseXzeroLen(hll[p], hll[p+1])) + " ")
+				p += 2
+			} else {
+				decoded.WriteString("v:" + strconv.Itoa(hllSparseValValue(hll[p])) + "," +
+					strconv.Itoa(hllSparseValLen(hll[p])) + " ")
+				p++
+			}
+		}
+		addReplyStatus(client, strings.TrimRight(decoded.String(), " "))
+	case "encoding":
+		if client.argc != 3 {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+		if hllEncoding(hll) == hllDense {
+			addReplyStatus(client, "dense")
+		} else {
+			addReplyStatus(client, "sparse")
+		}
+	case "todense":
+		//转换为dense表示，回复是否进行了转换
+		if client.argc != 3 {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+		conv := hllEncoding(hll) == hllSparse
+		var ok bool
+		if hll, ok = hllSparseToDense(hll); !ok {
+			addReplyString(client, invalidHllErr)
+			return
+		}
+		o.ptr = sds(hll)
+		if conv {
+			client.db.signalModifiedKey(client.argv[2])
+			server.dirty++
+			addReply(client, shared.cone)
+		} else {
+			addReply(client, shared.czero)
+		}
+	default:
+		addReplyError(client, "Unknown PFDEBUG subcommand '"+cmd+"'")
+	}
+}
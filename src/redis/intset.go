@@ -0,0 +1,87 @@
+package redis
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sort"
+)
+
+//整数集合，元素有序且不重复，用于只包含整数的小集合
+type intset []int64
+
+//查找元素的位置，不存在时返回false，以及应该插入的位置
+func (is intset) intsetSearch(value int64) (int, bool) {
+	pos := sort.Search(len(is), func(i int) bool {
+		return is[i] >= value
+	})
+	return pos, pos < len(is) && is[pos] == value
+}
+
+//添加元素，已经存在时返回false
+func (is *intset) intsetAdd(value int64) bool {
+	pos, found := is.intsetSearch(value)
+	if found {
+		return false
+	}
+	*is = append(*is, 0)
+	copy((*is)[pos+1:], (*is)[pos:])
+	(*is)[pos] = value
+	return true
+}
+
+//删除元素，不存在时返回false
+func (is *intset) intsetRemove(value int64) bool {
+	pos, found := is.intsetSearch(value)
+	if !found {
+		return false
+	}
+	*is = append((*is)[:pos], (*is)[pos+1:]...)
+	return true
+}
+
+func (is intset) intsetFind(value int64) bool {
+	_, found := is.intsetSearch(value)
+	return found
+}
+
+//随机返回一个元素
+func (is intset) intsetRandom() int64 {
+	return is[rand.Intn(len(is))]
+}
+
+func (is intset) intsetLen() int {
+	return len(is)
+}
+
+var errIntsetCorrupt = errors.New("invalid intset")
+
+//解析redis序列化的intset，用于加载RDB文件
+//<encoding(4)> <length(4)> <contents>，encoding为每个元素的字节数：2、4或8，都是小端
+func intsetDecode(buf []byte) (intset, error) {
+	if len(buf) < 8 {
+		return nil, errIntsetCorrupt
+	}
+	enc := int(binary.LittleEndian.Uint32(buf))
+	length := int(binary.LittleEndian.Uint32(buf[4:]))
+	if (enc != 2 && enc != 4 && enc != 8) || length < 0 || len(buf) != 8+enc*length {
+		return nil, errIntsetCorrupt
+	}
+	is := make(intset, length)
+	for i := range is {
+		p := buf[8+i*enc:]
+		switch enc {
+		case 2:
+			is[i] = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			is[i] = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			is[i] = int64(binary.LittleEndian.Uint64(p))
+		}
+		//元素必须有序且不重复
+		if i > 0 && is[i] <= is[i-1] {
+			return nil, errIntsetCorrupt
+		}
+	}
+	return is, nil
+}
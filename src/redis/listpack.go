@@ -0,0 +1,201 @@
+package redis
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//listpack的序列化格式，用于RDB中的stream节点，以及加载redis保存的listpack编码的对象
+//内存中的listpack编码直接使用[]sds，只有读写RDB时才会转换
+//
+//<total-bytes(4)> <num-elements(2)> <element-1> ... <element-N> <end(0xFF)>
+//每个元素为：<encoding-type><element-data><element-tot-len>
+//element-tot-len为encoding-type和element-data的长度，从右往左读取，每个字节7位，最高位为1表示左边还有字节
+
+const (
+	lpHeaderSize       = 6
+	lpEOF              = 0xFF
+	lpHdrNumeleUnknown = 65535 //元素数量超过65535时，需要遍历才能知道
+)
+
+var errListpackCorrupt = errors.New("invalid listpack")
+
+type listpack struct {
+	buf    []byte
+	numele int
+}
+
+func lpNew() *listpack {
+	return &listpack{buf: make([]byte, lpHeaderSize, 64)}
+}
+
+//元素的长度编码在元素末尾，用于从后往前遍历
+func lpEncodeBacklen(l int) []byte {
+	switch {
+	case l <= 127:
+		return []byte{byte(l)}
+	case l < 16383:
+		return []byte{byte(l >> 7), byte(l&127) | 128}
+	case l < 2097151:
+		return []byte{byte(l >> 14), byte((l>>7)&127) | 128, byte(l&127) | 128}
+	case l < 268435455:
+		return []byte{byte(l >> 21), byte((l>>14)&127) | 128, byte((l>>7)&127) | 128, byte(l&127) | 128}
+	default:
+		return []byte{byte(l >> 28), byte((l>>21)&127) | 128, byte((l>>14)&127) | 128,
+			byte((l>>7)&127) | 128, byte(l&127) | 128}
+	}
+}
+
+func (lp *listpack) appendEntry(entry []byte) {
+	lp.buf = append(lp.buf, entry...)
+	lp.buf = append(lp.buf, lpEncodeBacklen(len(entry))...)
+	lp.numele++
+}
+
+//添加整数，使用能保存这个整数的最短编码
+func (lp *listpack) appendInteger(v int64) {
+	var entry []byte
+	switch {
+	case v >= 0 && v <= 127:
+		//0xxxxxxx
+		entry = []byte{byte(v)}
+	case v >= -4096 && v <= 4095:
+		//110xxxxx yyyyyyyy，13位有符号整数
+		uv := uint64(v) & (1<<13 - 1)
+		entry = []byte{byte(uv>>8) | 0xC0, byte(uv)}
+	case v >= -32768 && v <= 32767:
+		entry = []byte{0xF1, byte(v), byte(v >> 8)}
+	case v >= -8388608 && v <= 8388607:
+		entry = []byte{0xF2, byte(v), byte(v >> 8), byte(v >> 16)}
+	case v >= -2147483648 && v <= 2147483647:
+		entry = []byte{0xF3, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(entry[1:], uint32(v))
+	default:
+		entry = make([]byte, 9)
+		entry[0] = 0xF4
+		binary.LittleEndian.PutUint64(entry[1:], uint64(v))
+	}
+	lp.appendEntry(entry)
+}
+
+//添加字符串，可以转换为整数的字符串按照整数保存
+func (lp *listpack) appendString(s sds) {
+	if v, ok := string2ll(s); ok {
+		lp.appendInteger(v)
+		return
+	}
+	var entry []byte
+	l := len(s)
+	switch {
+	case l < 64:
+		//10xxxxxx
+		entry = append([]byte{0x80 | byte(l)}, s...)
+	case l < 4096:
+		//1110xxxx yyyyyyyy
+		entry = append([]byte{0xE0 | byte(l>>8), byte(l)}, s...)
+	default:
+		entry = []byte{0xF0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(entry[1:], uint32(l))
+		entry = append(entry, s...)
+	}
+	lp.appendEntry(entry)
+}
+
+//写入结束标记和头部，返回序列化后的listpack
+func (lp *listpack) bytes() []byte {
+	buf := append(lp.buf, lpEOF)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)))
+	numele := lp.numele
+	if numele >= lpHdrNumeleUnknown {
+		numele = lpHdrNumeleUnknown
+	}
+	binary.LittleEndian.PutUint16(buf[4:], uint16(numele))
+	return buf
+}
+
+//解析listpack中的所有元素，整数元素转换为字符串
+func lpDecode(buf []byte) ([]sds, error) {
+	if len(buf) < lpHeaderSize+1 || int(binary.LittleEndian.Uint32(buf)) != len(buf) {
+		return nil, errListpackCorrupt
+	}
+	var elements []sds
+	p := lpHeaderSize
+	for {
+		if p >= len(buf) {
+			return nil, errListpackCorrupt
+		}
+		b := buf[p]
+		if b == lpEOF {
+			break
+		}
+
+		//encoding-type之后的数据长度，字符串为字符串的长度
+		var entrylen int
+		var ele sds
+		switch {
+		case b&0x80 == 0:
+			entrylen = 1
+			ele = ll2string(int64(b & 0x7F))
+		case b&0xC0 == 0x80:
+			l := int(b & 0x3F)
+			entrylen = 1 + l
+			if p+entrylen > len(buf) {
+				return nil, errListpackCorrupt
+			}
+			ele = sds(buf[p+1 : p+entrylen])
+		case b&0xE0 == 0xC0:
+			if p+2 > len(buf) {
+				return nil, errListpackCorrupt
+			}
+			entrylen = 2
+			uv := int64(b&0x1F)<<8 | int64(buf[p+1])
+			if uv >= 1<<12 {
+				uv -= 1 << 13
+			}
+			ele = ll2string(uv)
+		case b&0xF0 == 0xE0:
+			if p+2 > len(buf) {
+				return nil, errListpackCorrupt
+			}
+			l := int(b&0x0F)<<8 | int(buf[p+1])
+			entrylen = 2 + l
+			if p+entrylen > len(buf) {
+				return nil, errListpackCorrupt
+			}
+			ele = sds(buf[p+2 : p+entrylen])
+		case b == 0xF0:
+			if p+5 > len(buf) {
+				return nil, errListpackCorrupt
+			}
+			l := int(binary.LittleEndian.Uint32(buf[p+1:]))
+			entrylen = 5 + l
+			if l < 0 || p+entrylen > len(buf) {
+				return nil, errListpackCorrupt
+			}
+			ele = sds(buf[p+5 : p+entrylen])
+		case b >= 0xF1 && b <= 0xF4:
+			//16、24、32、64位有符号整数，小端
+			size := [...]int{2, 3, 4, 8}[b-0xF1]
+			entrylen = 1 + size
+			if p+entrylen > len(buf) {
+				return nil, errListpackCorrupt
+			}
+			var uv uint64
+			for i := size - 1; i >= 0; i-- {
+				uv = uv<<8 | uint64(buf[p+1+i])
+			}
+			//符号扩展
+			shift := uint(64 - size*8)
+			ele = ll2string(int64(uv<<shift) >> shift)
+		default:
+			return nil, errListpackCorrupt
+		}
+
+		p += entrylen + len(lpEncodeBacklen(entrylen))
+		elements = append(elements, ele)
+	}
+	if p != len(buf)-1 {
+		return nil, errListpackCorrupt
+	}
+	return elements, nil
+}
@@ -0,0 +1,55 @@
+package redis
+
+import "errors"
+
+var errLzfCorrupt = errors.New("invalid LZF compressed data")
+
+//LZF解压，outlen为解压后的长度，用来加载redis压缩保存的字符串
+//控制字节小于32时，后面跟着ctrl+1个原始字节；否则为向前引用：
+//高3位为长度-2（为7时再读一个字节累加），低5位和下一个字节组成距离-1
+func lzfDecompress(in []byte, outlen int) ([]byte, error) {
+	out := make([]byte, 0, outlen)
+	ip := 0
+	for ip < len(in) {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 1<<5 {
+			//原始字节
+			ctrl++
+			if ip+ctrl > len(in) || len(out)+ctrl > outlen {
+				return nil, errLzfCorrupt
+			}
+			out = append(out, in[ip:ip+ctrl]...)
+			ip += ctrl
+			continue
+		}
+
+		//向前引用
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, errLzfCorrupt
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errLzfCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - 1 - int(in[ip])
+		ip++
+		length += 2
+		if ref < 0 || len(out)+length > outlen {
+			return nil, errLzfCorrupt
+		}
+		//引用的区域可能和输出重叠，需要逐个字节复制
+		for i := 0; i < length; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != outlen {
+		return nil, errLzfCorrupt
+	}
+	return out, nil
+}
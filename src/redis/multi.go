@@ -0,0 +1,297 @@
+package redis
+
+import "container/list"
+
+//事务中排队的命令
+type multiCmd struct {
+	argv []*robj
+	argc int
+	cmd  *redisCommand
+}
+
+//客户端的事务状态
+type multiState struct {
+	commands []multiCmd
+}
+
+//客户端WATCH的key
+//同一个对象同时保存在client.watchedKeys和db.watchedKeys中
+type watchedKey struct {
+	key     *robj
+	db      *redisDb
+	client  *redisClient
+	expired bool //WATCH时key已经过期了
+}
+
+//================================ MULTI/EXEC ==================================
+
+//释放事务中排队的命令
+func freeClientMultiState(client *redisClient) {
+	for _, mc := range client.mstate.commands {
+		for _, arg := range mc.argv {
+			decrRefCount(arg)
+		}
+	}
+	client.mstate.commands = nil
+}
+
+//把当前命令加到事务队列中
+func queueMultiCommand(client *redisClient) {
+	//事务已经失败了，不需要再保存命令
+	if client.flags&(redisDirtyCas|redisDirtyExec) != 0 {
+		return
+	}
+	client.mstate.commands = append(client.mstate.commands, multiCmd{
+		argv: client.argv,
+		argc: client.argc,
+		cmd:  client.cmd,
+	})
+	//argv已经保存在事务队列中，不能被复用
+	client.argv = nil
+	client.argc = 0
+}
+
+func discardTransaction(client *redisClient) {
+	freeClientMultiState(client)
+	client.flags &^= redisMulti | redisDirtyCas | redisDirtyExec
+	unwatchAllKeys(client)
+}
+
+//排队时命令出错，EXEC时放弃整个事务
+func flagTransaction(client *redisClient) {
+	if client.flags&redisMulti != 0 {
+		client.flags |= redisDirtyExec
+	}
+}
+
+//MULTI
+func multiCommand(client *redisClient) {
+	if client.flags&redisMulti != 0 {
+		addReplyError(client, "MULTI calls can not be nested")
+		return
+	}
+	client.flags |= redisMulti
+	addReply(client, shared.ok)
+}
+
+//DISCARD
+func discardCommand(client *redisClient) {
+	if client.flags&redisMulti == 0 {
+		addReplyError(client, "DISCARD without MULTI")
+		return
+	}
+	discardTransaction(client)
+	addReply(client, shared.ok)
+}
+
+//EXEC
+//依次执行事务中的命令，WATCH的key被修改或者排队时出错时不执行
+func execCommand(client *redisClient) {
+	if client.flags&redisMulti == 0 {
+		addReplyError(client, "EXEC without MULTI")
+		return
+	}
+
+	//WATCH的key已经过期了，等同于被修改
+	if isWatchedKeyExpired(client) {
+		client.flags |= redisDirtyCas
+	}
+
+	if client.flags&(redisDirtyCas|redisDirtyExec) != 0 {
+		if client.flags&redisDirtyExec != 0 {
+			addReply(client, shared.execaborterr)
+		} else {
+			addReplyNullArray(client)
+		}
+		discardTransaction(client)
+		return
+	}
+
+	//尽快取消WATCH，事务中的命令修改key时不需要再检查这个客户端
+	unwatchAllKeys(client)
+
+	origArgv := client.argv
+	origArgc := client.argc
+	origCmd := client.cmd
+	addReplyArrayLen(client, len(client.mstate.commands))
+	server.inExec = true
+	for j := range client.mstate.commands {
+		mc := &client.mstate.commands[j]
+		client.argv = mc.argv
+		client.argc = mc.argc
+		client.cmd = mc.cmd
+
+		call(client, redisCallFull)
+
+		//命令可能会改写argv
+		mc.argv = client.argv
+		mc.argc = client.argc
+		mc.cmd = client.cmd
+	}
+	server.inExec = false
+	client.argv = origArgv
+	client.argc = origArgc
+	client.cmd = origCmd
+	discardTransaction(client)
+
+	//事务中的命令已经传播了，EXEC本身不需要传播
+	preventCommandPropagation(client)
+}
+
+//===================== WATCH (CAS alike for MULTI/EXEC) ===================
+
+//WATCH一个key，已经WATCH过时不做处理
+func watchForKey(client *redisClient, key *robj) {
+	for e := client.watchedKeys.Front(); e != nil; e = e.Next() {
+		wk := e.Value.(*watchedKey)
+		if wk.db == client.db && wk.key.ptr.(sds) == key.ptr.(sds) {
+			return
+		}
+	}
+
+	var clients *list.List
+	if de := client.db.watchedKeys.dictFind(key.ptr); de != nil {
+		clients = de.(*list.List)
+	} else {
+		clients = list.New()
+		client.db.watchedKeys.dictAdd(key.ptr, clients)
+	}
+	incrRefCount(key)
+	wk := &watchedKey{
+		key:     key,
+		db:      client.db,
+		client:  client,
+		expired: client.db.keyIsExpired(key),
+	}
+	clients.PushBack(wk)
+	client.watchedKeys.PushBack(wk)
+}
+
+//取消客户端WATCH的所有key
+func unwatchAllKeys(client *redisClient) {
+	if client.watchedKeys.Len() == 0 {
+		return
+	}
+	for e := client.watchedKeys.Front(); e != nil; e = e.Next() {
+		wk := e.Value.(*watchedKey)
+		de := wk.db.watchedKeys.dictFind(wk.key.ptr)
+		if de == nil {
+			panic("unwatchAllKeys: key not found in db.watchedKeys")
+		}
+		clients := de.(*list.List)
+		listDelValue(clients, wk)
+		//没有客户端WATCH这个key了
+		if clients.Len() == 0 {
+			wk.db.watchedKeys.dictDelete(wk.key.ptr)
+		}
+		decrRefCount(wk.key)
+	}
+	client.watchedKeys.Init()
+}
+
+//WATCH的key中是否有已经过期的，WATCH时已经过期的key不算
+func isWatchedKeyExpired(client *redisClient) bool {
+	for e := client.watchedKeys.Front(); e != nil; e = e.Next() {
+		wk := e.Value.(*watchedKey)
+		if wk.expired {
+			continue
+		}
+		if wk.db.keyIsExpired(wk.key) {
+			return true
+		}
+	}
+	return false
+}
+
+//key被修改了，WATCH这个key的客户端的事务会失败
+func touchWatchedKey(db *redisDb, key *robj) {
+	if db.watchedKeys.used() == 0 {
+		return
+	}
+	de := db.watchedKeys.dictFind(key.ptr)
+	if de == nil {
+		return
+	}
+
+	clients := de.(*list.List)
+	for e := clients.Front(); e != nil; {
+		next := e.Next()
+		wk := e.Value.(*watchedKey)
+		client := wk.client
+
+		if wk.expired {
+			//WATCH时已经过期的key被删除了，逻辑上没有变化
+			if db.dict.dictFind(key.ptr) == nil {
+				wk.expired = false
+				e = next
+				continue
+			}
+		}
+
+		client.flags |= redisDirtyCas
+		//事务已经失败了，不需要再WATCH其它的key
+		unwatchAllKeys(client)
+		e = next
+	}
+}
+
+//db被清空或者被SWAPDB替换时，WATCH的key中存在的key都被修改了
+//replacedWith为替换emptied的db，清空时为nil
+func touchAllWatchedKeysInDb(emptied *redisDb, replacedWith *redisDb) {
+	if emptied.watchedKeys.used() == 0 {
+		return
+	}
+	emptied.watchedKeys.dictForEach(func(k interface{}, v interface{}) bool {
+		key := createStringObject(k.(sds))
+		existsInEmptied := emptied.dict.dictFind(k) != nil
+		existsInReplaced := replacedWith != nil && replacedWith.dict.dictFind(k) != nil
+		if !existsInEmptied && !existsInReplaced {
+			return true
+		}
+
+		//不能在这里调用unwatchAllKeys，会修改正在遍历的watchedKeys
+		for e := v.(*list.List).Front(); e != nil; e = e.Next() {
+			wk := e.Value.(*watchedKey)
+			if wk.expired {
+				if !existsInReplaced {
+					//已经过期的key被删除了，逻辑上没有变化
+					wk.expired = false
+					continue
+				} else if replacedWith.keyIsExpired(key) {
+					//替换后的key仍然是过期的
+					continue
+				}
+			} else if !existsInEmptied && replacedWith.keyIsExpired(key) {
+				//不存在的key被替换为过期的key
+				wk.expired = true
+				continue
+			}
+			wk.client.flags |= redisDirtyCas
+		}
+		return true
+	})
+}
+
+//WATCH key [key ...]
+func watchCommand(client *redisClient) {
+	if client.flags&redisMulti != 0 {
+		addReplyError(client, "WATCH inside MULTI is not allowed")
+		return
+	}
+	//事务已经失败了，不需要再WATCH
+	if client.flags&redisDirtyCas != 0 {
+		addReply(client, shared.ok)
+		return
+	}
+	for j := 1; j < client.argc; j++ {
+		watchForKey(client, client.argv[j])
+	}
+	addReply(client, shared.ok)
+}
+
+//UNWATCH
+func unwatchCommand(client *redisClient) {
+	unwatchAllKeys(client)
+	client.flags &^= redisDirtyCas
+	addReply(client, shared.ok)
+}
@@ -1,6 +1,9 @@
 package redis
 
 import (
+	"bytes"
+	"container/list"
+	"fmt"
 	"github.com/panjf2000/gnet"
 	"log"
 	"runtime"
@@ -16,15 +19,21 @@ func acceptHandler(c gnet.Conn) (out []byte, action gnet.Action) {
 	return out, action
 }
 
+//连接关闭，释放对应的client
+func closeHandler(c gnet.Conn, err error) (action gnet.Action) {
+	v := server.clients.dictFind(c.Context())
+	if v == nil {
+		return action
+	}
+	client := v.(*redisClient)
+	//连接已经关闭，不需要再调用Close
+	client.conn = nil
+	freeClient(client)
+	return action
+}
+
 //接收到客户端的命令
 func dataHandler(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
-
-	//找到对应的client对象
-	client := server.clients.dictFind(c.Context()).(*redisClient)
-
-	//将数据设置到client中
-	client.queryBuf = sds(frame)
-
 	defer func() {
 		if err := recover(); err != nil {
 			var buf [4096]byte
@@ -34,45 +43,82 @@ func dataHandler(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
 		}
 	}()
 
+	//找到对应的client对象
+	//客户端被释放时（比如协议错误、QUIT、输出缓冲区超过限制）gnet的Close是异步执行的，
+	//连接真正关闭之前还可能收到数据或者被Wake，这时直接关闭连接
+	v := server.clients.dictFind(c.Context())
+	if v == nil {
+		return out, gnet.Close
+	}
+	client := v.(*redisClient)
+
+	//将数据追加到client的查询缓冲区中，上一次没有解析完的数据会保留在queryBuf里
+	//queryBuf是[]byte，追加时不需要复制之前的数据，读取很大的bulk时不会因为反复复制变慢
+	client.queryBuf = append(client.queryBuf, frame...)
+
 	//处理数据
 	processInputBuffer(client)
 
+	//本轮事件处理结束，发送回复数据
+	beforeSleep()
+
 	return out, action
 }
 
 //处理客户端收到的数据
+//一次读事件中可能包含多个完整的命令（pipeline），也可能只有半个命令，
+//这里循环解析直到缓冲区中没有完整的命令为止，剩下的数据留到下一次读事件继续处理
 func processInputBuffer(client *redisClient) {
-	//判断命令类型
-	if client.queryBuf[0] == '*' {
-		client.reqtype = redisReqMultibulk
-	} else {
-		client.reqtype = redisReqInline
-	}
-	log.Printf("client reqtype is : %v", client.reqtype)
+	for len(client.queryBuf) > 0 {
+		//客户端被阻塞了，等待唤醒后再处理后续的命令
+		if client.flags&redisBlocked != 0 {
+			break
+		}
+
+		//客户端已经被标记为回复后关闭，不再处理后续的命令
+		if client.flags&redisCloseAfterReply != 0 {
+			break
+		}
 
-	//协议解析
-	if client.reqtype == redisReqInline {
-		if processInlineBuffer(client) == redisErr {
-			//error
+		//判断命令类型
+		if client.reqtype == 0 {
+			if client.queryBuf[0] == '*' {
+				client.reqtype = redisReqMultibulk
+			} else {
+				client.reqtype = redisReqInline
+			}
 		}
-	}
-	if client.reqtype == redisReqMultibulk {
-		if processMultibulkBuffer(client) == redisErr {
-			//error
-			log.Printf("analysis protocol error")
+
+		//协议解析，返回err表示数据还不完整，需要等待更多的数据
+		if client.reqtype == redisReqInline {
+			if processInlineBuffer(client) != redisOk {
+				break
+			}
+		} else if client.reqtype == redisReqMultibulk {
+			if processMultibulkBuffer(client) != redisOk {
+				break
+			}
+		} else {
+			panic("Unknown request type")
 		}
-	} else {
-		panic("Unknown request type")
-	}
 
-	if client.argc == 0 {
-		resetClient(client)
-	} else {
-		if processCommand(client) == redisErr {
-			//error
+		if client.argc == 0 {
+			resetClient(client)
+		} else {
+			//processCommand返回err时表示客户端需要关闭，不需要重置
+			if processCommand(client) == redisOk {
+				resetClient(client)
+			}
+			//server.currentClient = nil
 		}
-		resetClient(client)
-		//server.currentClient = nil
+	}
+
+	//已经处理的数据是从前面截掉的，剩下的数据仍然引用着原来的数组，
+	//剩下的数据不多时复制出来，避免读取过很大的参数之后一直占用这块内存
+	if len(client.queryBuf) == 0 {
+		client.queryBuf = nil
+	} else if len(client.queryBuf) < redisIoBufLen {
+		client.queryBuf = append([]byte(nil), client.queryBuf...)
 	}
 }
 
@@ -93,13 +139,133 @@ func addReplyLongLongWithPrefix(client *redisClient, ll int64, prefix string) {
 }
 
 func addReplyString(client *redisClient, str string) {
-	addReplyToBuffer(client, sds(str))
-	sendReplyToClient(client)
+	if prepareClientToWrite(client) != redisOk {
+		return
+	}
+	if addReplyToBuffer(client, sds(str)) != redisOk {
+		addReplyStringToList(client, sds(str))
+	}
+}
+
+func addReplyError(client *redisClient, err string) {
+	addReplyString(client, "-ERR "+err+"\r\n")
+}
+
+//回复状态，比如 +OK
+func addReplyStatus(client *redisClient, status string) {
+	addReplyString(client, "+"+status+"\r\n")
+}
+
+//回复聚合类型的长度，RESP2中map/set/push都是用数组表示
+func addReplyAggregateLen(client *redisClient, length int, prefix string) {
+	addReplyString(client, prefix+strconv.Itoa(length)+"\r\n")
+}
+
+func addReplyArrayLen(client *redisClient, length int) {
+	addReplyAggregateLen(client, length, "*")
+}
+
+//length为键值对的数量，RESP2中用2*length个元素的数组表示
+func addReplyMapLen(client *redisClient, length int) {
+	if client.resp == 2 {
+		addReplyAggregateLen(client, length*2, "*")
+	} else {
+		addReplyAggregateLen(client, length, "%")
+	}
+}
+
+func addReplySetLen(client *redisClient, length int) {
+	if client.resp == 2 {
+		addReplyAggregateLen(client, length, "*")
+	} else {
+		addReplyAggregateLen(client, length, "~")
+	}
+}
+
+//服务端主动推送的消息（比如pubsub），RESP2中用数组表示
+func addReplyPushLen(client *redisClient, length int) {
+	if client.resp == 2 {
+		addReplyAggregateLen(client, length, "*")
+	} else {
+		addReplyAggregateLen(client, length, ">")
+	}
+}
+
+//空值，RESP2中为空的bulk string
+func addReplyNull(client *redisClient) {
+	addReply(client, shared.null[client.resp])
+}
+
+//空数组，RESP2中为 *-1
+func addReplyNullArray(client *redisClient) {
+	addReply(client, shared.nullarray[client.resp])
+}
+
+//布尔值，RESP2中用整数0和1表示
+func addReplyBool(client *redisClient, b bool) {
+	if client.resp == 2 {
+		if b {
+			addReply(client, shared.cone)
+		} else {
+			addReply(client, shared.czero)
+		}
+	} else {
+		if b {
+			addReplyString(client, "#t\r\n")
+		} else {
+			addReplyString(client, "#f\r\n")
+		}
+	}
+}
+
+//浮点数，RESP2中用bulk string表示
+func addReplyDouble(client *redisClient, d float64) {
+	if client.resp == 2 {
+		addReplyBulkCBuffer(client, d2string(d))
+	} else {
+		addReplyString(client, ","+d2string(d)+"\r\n")
+	}
+}
+
+//便于阅读的浮点数，不使用科学计数法，RESP2中用bulk string表示
+func addReplyHumanLongDouble(client *redisClient, d float64) {
+	if client.resp == 2 {
+		s := strconv.FormatFloat(d, 'f', 17, 64)
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+		addReplyBulkCBuffer(client, s)
+	} else {
+		addReplyDouble(client, d)
+	}
+}
+
+//大整数，RESP2中用bulk string表示
+func addReplyBigNum(client *redisClient, num string) {
+	if client.resp == 2 {
+		addReplyBulkCBuffer(client, num)
+	} else {
+		addReplyString(client, "("+num+"\r\n")
+	}
+}
+
+//带格式的字符串，ext为3个字符的格式，比如txt、mkd，RESP2中用bulk string表示
+func addReplyVerbatim(client *redisClient, str string, ext string) {
+	if client.resp == 2 {
+		addReplyBulkCBuffer(client, str)
+	} else {
+		addReplyString(client, "="+strconv.Itoa(len(str)+4)+"\r\n"+ext+":"+str+"\r\n")
+	}
+}
+
+//回复一个字符串，按照bulk string的格式
+func addReplyBulkCBuffer(client *redisClient, str string) {
+	addReplyString(client, "$"+strconv.Itoa(len(str))+"\r\n")
+	addReplyString(client, str)
+	addReply(client, shared.crlf)
 }
 
 func addReplyBulkLen(client *redisClient, obj *robj) {
-	bulkLen := "$" + strconv.Itoa(len(obj.ptr.(sds))) + "\r\n"
-	addReply(client, createObject(redisString, sds(bulkLen)))
+	bulkLen := "$" + strconv.Itoa(stringObjectLen(obj)) + "\r\n"
+	addReplyString(client, bulkLen)
 }
 
 func addReplyBulk(client *redisClient, obj *robj) {
@@ -108,91 +274,620 @@ func addReplyBulk(client *redisClient, obj *robj) {
 	addReply(client, shared.crlf)
 }
 
+//回复的数据先写入client的缓冲区，等到本轮事件循环结束时（beforeSleep）再统一发送给客户端
 func addReply(client *redisClient, robj *robj) {
-	log.Printf("add reply: %v", robj)
-	//redis中使用reactor，所以这里理论上不是马上执行的, redis是先将 sendReplyToClient事件注册上去，然后再执行addReplyToBuffer
-	addReplyToBuffer(client, robj.ptr.(sds))
-	sendReplyToClient(client)
+	if robj.encoding == redisEncodingInt {
+		addReplyString(client, ll2string(robj.ptr.(int64)))
+		return
+	}
+	addReplyString(client, robj.ptr.(sds))
+}
+
+//准备向客户端写数据，如果客户端还没有待发送的数据，将它加入server.clientsPendingWrite中
+//返回err表示不需要给这个客户端回复数据（比如客户端即将被关闭）
+func prepareClientToWrite(client *redisClient) int {
+	if client.flags&(redisCloseAfterReply|redisCloseAsap) != 0 {
+		return redisErr
+	}
+	//没有连接的客户端（比如伪客户端）不需要回复
+	if client.conn == nil {
+		return redisErr
+	}
+
+	if client.flags&redisPendingWrite == 0 {
+		client.flags |= redisPendingWrite
+		server.clientsPendingWrite.PushBack(client)
+	}
+	return redisOk
+}
+
+//添加一个长度还不确定的聚合类型回复，返回占位节点，长度确定后调用setDeferredArrayLen等函数设置
+//比如XRANGE在遍历之前不知道会返回多少条消息
+func addReplyDeferredLen(client *redisClient) *list.Element {
+	if prepareClientToWrite(client) != redisOk {
+		return nil
+	}
+	//占位节点之后的数据都会追加到回复链表中，保证回复的顺序
+	//占位节点没有空间，后面的数据不会追加到这个节点中
+	return client.reply.PushBack(&clientReplyBlock{})
+}
+
+//设置占位节点的长度
+func setDeferredAggregateLen(client *redisClient, node *list.Element, length int, prefix string) {
+	if node == nil {
+		return
+	}
+	header := []byte(prefix + strconv.Itoa(length) + "\r\n")
+	node.Value = &clientReplyBlock{buf: header, used: len(header)}
+	client.replyBytes += uint64(len(header))
+}
+
+func setDeferredArrayLen(client *redisClient, node *list.Element, length int) {
+	setDeferredAggregateLen(client, node, length, "*")
+}
+
+//RESP2中map用长度为length*2的数组表示
+func setDeferredMapLen(client *redisClient, node *list.Element, length int) {
+	if client.resp == 2 {
+		setDeferredAggregateLen(client, node, length*2, "*")
+	} else {
+		setDeferredAggregateLen(client, node, length, "%")
+	}
 }
 
-func addReplyToBuffer(client *redisClient, data sds) {
+//回复命令的帮助信息，每一行为一个状态回复
+func addReplyHelp(client *redisClient, help []string) {
+	cmd := strings.ToUpper(client.argv[0].ptr.(sds))
+	addReplyArrayLen(client, len(help)+3)
+	addReplyStatus(client, cmd+" <subcommand> [<arg> [value] [opt] ...]. Subcommands are:")
+	for _, line := range help {
+		addReplyStatus(client, line)
+	}
+	addReplyStatus(client, "HELP")
+	addReplyStatus(client, "    Print this help.")
+}
+
+//未知的子命令
+func addReplySubcommandSyntaxError(client *redisClient) {
+	cmd := strings.ToUpper(client.argv[0].ptr.(sds))
+	addReplyError(client, "unknown subcommand '"+client.argv[1].ptr.(sds)+"'. Try "+cmd+" HELP.")
+}
+
+//子命令的参数数量错误
+func addReplySubcommandArityError(client *redisClient) {
+	addReplyError(client, "wrong number of arguments for '"+client.cmd.name+"|"+
+		strings.ToLower(client.argv[1].ptr.(sds))+"' command")
+}
+
+//将数据写入client的固定缓冲区，缓冲区已满或者回复链表中已经有数据时返回err
+func addReplyToBuffer(client *redisClient, data sds) int {
+	//回复链表中已经有数据了，后续的数据只能追加到链表中，保证回复的顺序
+	if client.reply.Len() > 0 {
+		return redisErr
+	}
+
+	available := len(client.buf) - client.bufpos
+	if len(data) > available {
+		return redisErr
+	}
+
 	copy(client.buf[client.bufpos:], data)
-	client.bufpos = client.bufpos + len([]byte(data))
+	client.bufpos += len(data)
+	return redisOk
 }
 
-func sendReplyToClient(client *redisClient) int {
-	log.Printf("send reply to client: %v", client.buf[client.sentlen:client.bufpos])
-	err := client.conn.AsyncWrite(client.buf[client.sentlen:client.bufpos])
+//将数据追加到回复链表中，先写入最后一个节点剩余的空间，放不下的数据写入新的节点
+func addReplyStringToList(client *redisClient, data sds) {
+	client.replyBytes += uint64(len(data))
+
+	if tail := client.reply.Back(); tail != nil {
+		b := tail.Value.(*clientReplyBlock)
+		n := copy(b.buf[b.used:], data)
+		b.used += n
+		data = data[n:]
+	}
+	if len(data) > 0 {
+		size := redisReplyChunkBytes
+		if len(data) > size {
+			size = len(data)
+		}
+		b := &clientReplyBlock{buf: make([]byte, size)}
+		b.used = copy(b.buf, data)
+		client.reply.PushBack(b)
+	}
+	asyncCloseClientOnOutputBufferLimitReached(client)
+}
+
+//client还没有发送的回复数据
+func clientHasPendingReplies(client *redisClient) bool {
+	return client.bufpos > 0 || client.reply.Len() > 0
+}
+
+//将缓冲区和回复链表中的数据一次性发送给客户端
+func writeToClient(client *redisClient) int {
+	if !clientHasPendingReplies(client) {
+		return redisOk
+	}
+
+	//gnet的AsyncWrite是异步的，不能直接把client.buf交给它，这里复制一份数据
+	data := make([]byte, 0, client.bufpos-client.sentlen+int(client.replyBytes))
+	data = append(data, client.buf[client.sentlen:client.bufpos]...)
+	for e := client.reply.Front(); e != nil; e = e.Next() {
+		b := e.Value.(*clientReplyBlock)
+		data = append(data, b.buf[:b.used]...)
+	}
+	//交给gnet之后不再计入输出缓冲区，见getClientOutputBufferMemoryUsage
+	client.bufpos = 0
+	client.sentlen = 0
+	client.reply.Init()
+	client.replyBytes = 0
+
+	err := client.conn.AsyncWrite(data)
 	if err != nil {
-		log.Printf("err: %v", err)
+		log.Printf("write to client err: %v", err)
+		freeClient(client)
+		return redisErr
 	}
-	client.sentlen = client.bufpos
-	if client.flags&redisCloseAfterReply == 1 {
+
+	//数据已经发送完毕，如果需要在回复后关闭客户端，在这里关闭
+	if client.flags&redisCloseAfterReply != 0 {
 		freeClient(client)
+		return redisErr
 	}
 	return redisOk
 }
 
+//将所有待发送的回复数据发送给客户端，每一轮事件循环调用一次
+func handleClientsWithPendingWrites() int {
+	processed := server.clientsPendingWrite.Len()
+	for e := server.clientsPendingWrite.Front(); e != nil; e = server.clientsPendingWrite.Front() {
+		client := server.clientsPendingWrite.Remove(e).(*redisClient)
+		client.flags &^= redisPendingWrite
+
+		if client.flags&redisCloseAsap != 0 {
+			continue
+		}
+		writeToClient(client)
+	}
+	return processed
+}
+
+//客户端类型，用来选择输出缓冲区的限制
+func getClientType(client *redisClient) int {
+	if client.flags&redisPubsub != 0 {
+		return redisClientTypePubsub
+	}
+	return redisClientTypeNormal
+}
+
+//客户端输出缓冲区（回复链表）占用的内存
+//gnet v1没有提供接口查询连接中还没有写入socket的数据，writeToClient交给AsyncWrite的数据不再计入，
+//所以输出缓冲区的限制只能检查到一轮事件处理中产生的回复（比如一个很大的回复，或者一次PUBLISH发给订阅者的消息），
+//客户端读得慢时堆积在gnet中的数据不受限制
+func getClientOutputBufferMemoryUsage(client *redisClient) uint64 {
+	return client.replyBytes
+}
+
+//检查客户端的输出缓冲区是否超过了限制
+//超过硬限制，或者超过软限制的时间大于配置的秒数时返回true
+func checkClientOutputBufferLimits(client *redisClient) bool {
+	used := getClientOutputBufferMemoryUsage(client)
+	limit := server.clientObufLimits[getClientType(client)]
+
+	hard := limit.hardLimitBytes > 0 && used >= limit.hardLimitBytes
+	soft := limit.softLimitBytes > 0 && used >= limit.softLimitBytes
+
+	if soft {
+		now := mstime() / 1000
+		if client.obufSoftLimitReachedTime == 0 {
+			//第一次达到软限制，记录时间
+			client.obufSoftLimitReachedTime = now
+			soft = false
+		} else if now-client.obufSoftLimitReachedTime <= limit.softLimitSeconds {
+			//还没有超过软限制的时间
+			soft = false
+		}
+	} else {
+		client.obufSoftLimitReachedTime = 0
+	}
+	return soft || hard
+}
+
+//输出缓冲区超过限制时，异步关闭客户端
+//这个函数在添加回复的过程中调用，不能直接释放客户端
+func asyncCloseClientOnOutputBufferLimitReached(client *redisClient) {
+	if client.replyBytes == 0 || client.flags&redisCloseAsap != 0 {
+		return
+	}
+	if checkClientOutputBufferLimits(client) {
+		log.Printf("Client %v scheduled to be closed ASAP for overcoming of output buffer limits.", client.id)
+		freeClientAsync(client)
+	}
+}
+
+//HELLO [protover [AUTH username password] [SETNAME clientname]]
+//切换协议版本，同时可以进行认证和设置客户端名称，返回服务端的信息
+func helloCommand(client *redisClient) {
+	ver := int64(0)
+	nextArg := 1
+
+	if client.argc >= 2 {
+		v, err := strconv.ParseInt(client.argv[1].ptr.(sds), 10, 64)
+		if err != nil {
+			addReplyError(client, "Protocol version is not an integer or out of range")
+			return
+		}
+		ver = v
+		nextArg++
+
+		if ver < 2 || ver > 3 {
+			addReplyString(client, "-NOPROTO unsupported protocol version\r\n")
+			return
+		}
+	}
+
+	var username, password, clientname *robj
+	for j := nextArg; j < client.argc; j++ {
+		moreargs := client.argc - 1 - j
+		opt := client.argv[j].ptr.(sds)
+		if strings.EqualFold(opt, "AUTH") && moreargs >= 2 {
+			username = client.argv[j+1]
+			password = client.argv[j+2]
+			j += 2
+		} else if strings.EqualFold(opt, "SETNAME") && moreargs > 0 {
+			clientname = client.argv[j+1]
+			j++
+		} else {
+			addReplyError(client, "Syntax error in HELLO option '"+opt+"'")
+			return
+		}
+	}
+
+	//先认证，认证失败时不修改客户端的状态
+	if username != nil {
+		if !checkPassword(username.ptr.(sds), password.ptr.(sds)) {
+			addReplyString(client, "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+			return
+		}
+		client.authenticated = true
+	}
+
+	if !client.authenticated {
+		addReplyString(client, "-NOAUTH HELLO must be called with the client already authenticated, "+
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and "+
+			"select the RESP protocol version at the same time\r\n")
+		return
+	}
+
+	if clientname != nil {
+		if !validateClientName(clientname.ptr.(sds)) {
+			addReplyError(client, "Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		client.name = clientname
+	}
+
+	if ver != 0 {
+		client.resp = int(ver)
+	}
+
+	addReplyMapLen(client, 7)
+
+	addReplyBulkCBuffer(client, "server")
+	addReplyBulkCBuffer(client, "redis")
+
+	addReplyBulkCBuffer(client, "version")
+	addReplyBulkCBuffer(client, redisVersion)
+
+	addReplyBulkCBuffer(client, "proto")
+	addReplyLongLong(client, int64(client.resp))
+
+	addReplyBulkCBuffer(client, "id")
+	addReplyLongLong(client, int64(client.id))
+
+	addReplyBulkCBuffer(client, "mode")
+	addReplyBulkCBuffer(client, "standalone")
+
+	addReplyBulkCBuffer(client, "role")
+	addReplyBulkCBuffer(client, "master")
+
+	addReplyBulkCBuffer(client, "modules")
+	addReplyArrayLen(client, 0)
+}
+
+//客户端名称不能包含空格、换行等特殊字符
+func validateClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+//解析inline协议，比如telnet发送的 PING\r\n 或者 set "a b" c\n
+//以换行符结束一个请求，参数之间用空格分隔，支持引号和转义
 func processInlineBuffer(client *redisClient) int {
-	return redisErr
+	buf := client.queryBuf
+
+	newline := bytes.IndexByte(buf, '\n')
+	if newline < 0 {
+		if len(buf) > redisInlineMaxSize {
+			setProtocolError(client, "Protocol error: too big inline request")
+		}
+		//数据不完整，等待更多的数据
+		return redisErr
+	}
+
+	//兼容只以\n结尾的请求
+	end := newline
+	if end > 0 && buf[end-1] == '\r' {
+		end--
+	}
+
+	argv, ok := sdssplitargs(sds(buf[:end]))
+	if !ok {
+		setProtocolError(client, "Protocol error: unbalanced quotes in request")
+		return redisErr
+	}
+
+	//丢弃已经处理的数据
+	client.queryBuf = buf[newline+1:]
+
+	//和multibulk一样，将参数放入client.argv中，引号中的空字符串也是一个参数
+	client.argv = make([]*robj, 0, len(argv))
+	for _, arg := range argv {
+		client.argv = append(client.argv, createObject(redisString, arg))
+	}
+	client.argc = len(client.argv)
+	return redisOk
 }
 
 //解析协议，将解析出来的命令放入client中
+//格式为：*<argc>\r\n$<len>\r\n<arg>\r\n...
+//数据不完整时返回err，已经解析的参数和解析状态（multibulklen/bulklen）保存在client中，
+//下次收到数据后从断开的地方继续解析
 func processMultibulkBuffer(client *redisClient) int {
-	newLines := strings.Split(string(client.queryBuf), "\n")
-
-	argIdx := 0
-	for i, line := range newLines {
-		line = strings.Replace(line, "\r", "", 1)
-		if i == 0 {
-			//arg count
-			var err error
-			client.argc, err = strconv.Atoi(line[1:])
-			if err != nil {
+	pos := 0
+	buf := client.queryBuf
+
+	if client.multibulklen == 0 {
+		//解析参数数量
+		newline := bytes.IndexByte(buf, '\r')
+		if newline < 0 {
+			if len(buf) > redisInlineMaxSize {
+				setProtocolError(client, "Protocol error: too big mbulk count string")
+			}
+			return redisErr
+		}
+
+		//缓冲区中还没有\n
+		if newline+1 >= len(buf) {
+			return redisErr
+		}
+
+		ll, err := strconv.ParseInt(string(buf[1:newline]), 10, 64)
+		if err != nil || ll > 1024*1024 {
+			setProtocolError(client, "Protocol error: invalid multibulk length")
+			return redisErr
+		}
+
+		pos = newline + 2
+		if ll <= 0 {
+			client.queryBuf = buf[pos:]
+			return redisOk
+		}
+
+		client.multibulklen = int(ll)
+		client.argv = make([]*robj, 0, client.multibulklen)
+	}
+
+	for client.multibulklen > 0 {
+		//解析bulk的长度
+		if client.bulklen == -1 {
+			newline := bytes.IndexByte(buf[pos:], '\r')
+			if newline < 0 {
+				if len(buf)-pos > redisInlineMaxSize {
+					setProtocolError(client, "Protocol error: too big bulk count string")
+					return redisErr
+				}
+				break
+			}
+			newline += pos
+
+			if newline+1 >= len(buf) {
+				break
+			}
+
+			if buf[pos] != '$' {
+				setProtocolError(client, fmt.Sprintf("Protocol error: expected '$', got '%c'", buf[pos]))
 				return redisErr
 			}
-			client.argv = make([]*robj, client.argc)
-			continue
+
+			ll, err := strconv.ParseInt(string(buf[pos+1:newline]), 10, 64)
+			if err != nil || ll < 0 || ll > redisMaxBulkLen {
+				setProtocolError(client, "Protocol error: invalid bulk length")
+				return redisErr
+			}
+
+			pos = newline + 2
+			client.bulklen = int(ll)
 		}
-		if client.argc <= argIdx {
+
+		//bulk数据还没有完全读到
+		if len(buf)-pos < client.bulklen+2 {
 			break
 		}
-		if line[0] != '$' {
-			client.argv[argIdx] = createObject(redisString, sds(line))
-			argIdx++
-		}
+
+		//按照长度截取参数，参数中可以包含\r\n或二进制数据
+		client.argv = append(client.argv, createObject(redisString, sds(buf[pos:pos+client.bulklen])))
+		client.argc = len(client.argv)
+		pos += client.bulklen + 2
+		client.bulklen = -1
+		client.multibulklen--
 	}
-	log.Printf("analysis command, command count: %v, value: %v", client.argc, client.argv)
-	return redisOk
+
+	//丢弃已经处理的数据
+	client.queryBuf = buf[pos:]
+
+	if client.multibulklen == 0 {
+		log.Printf("analysis command, command count: %v, value: %v", client.argc, client.argv)
+		return redisOk
+	}
+	return redisErr
+}
+
+//协议错误，清空缓冲区，回复错误信息后关闭客户端
+func setProtocolError(client *redisClient, err string) {
+	log.Printf("protocol error from client: %v, %s", client.id, err)
+	addReplyError(client, err)
+	client.flags |= redisCloseAfterReply
+	client.queryBuf = nil
 }
 
 //清理client数据，准备处理下一个命令
+//回复数据会在事件循环结束时统一发送，这里不能清理回复缓冲区
 func resetClient(client *redisClient) {
-	client.argv = nil
+	freeClientArgv(client)
 	client.argc = 0
-	client.bufpos = 0
 	client.reqtype = 0
-	client.sentlen = 0
+	client.multibulklen = 0
+	client.bulklen = -1
+}
+
+//释放命令参数，被保存到db中的参数对象引用计数大于1
+func freeClientArgv(client *redisClient) {
+	for _, arg := range client.argv {
+		decrRefCount(arg)
+	}
+	client.argv = nil
+}
+
+//替换client的命令参数，用于将命令改写为另一个命令执行，比如GEOADD改写为ZADD
+func replaceClientCommandVector(client *redisClient, argv []*robj) {
+	freeClientArgv(client)
+	client.argv = argv
+	client.argc = len(argv)
+	client.cmd = lookupCommand(argv[0].ptr.(sds))
+}
+
+//使用新的参数改写client的命令，参数可以复用原来argv中的对象
+//用于将命令改写为确定的形式传播到AOF，比如过期时间已经过去的EXPIRE改写为DEL
+func rewriteClientCommandVector(client *redisClient, argv ...*robj) {
+	for _, arg := range argv {
+		incrRefCount(arg)
+	}
+	replaceClientCommandVector(client, argv)
+}
+
+//替换client的第i个命令参数，i不小于argc时追加到末尾
+func rewriteClientCommandArgument(client *redisClient, i int, newval *robj) {
+	incrRefCount(newval)
+	if i >= client.argc {
+		client.argv = append(client.argv, newval)
+		client.argc = len(client.argv)
+	} else {
+		decrRefCount(client.argv[i])
+		client.argv[i] = newval
+	}
+	if i == 0 {
+		client.cmd = lookupCommand(newval.ptr.(sds))
+	}
 }
 
 func freeClient(client *redisClient) {
-	server.clients.dictDelete(client.id)
-	err := client.conn.Close()
-	if err != nil {
-		log.Printf("close client err: %v", err)
+	if server.clients.dictDelete(client.id) != dictOk {
+		//已经释放过了
+		return
+	}
+
+	//取消阻塞状态
+	if client.flags&redisBlocked != 0 {
+		unblockClient(client)
+	}
+	if client.flags&redisUnblocked != 0 {
+		listDelValue(server.unblockedClients, client)
+	}
+
+	//取消WATCH并释放事务中的命令
+	unwatchAllKeys(client)
+	freeClientMultiState(client)
+
+	//取消所有的订阅
+	pubsubUnsubscribeAllChannels(client, false)
+	pubsubUnsubscribeShardAllChannels(client, false)
+	pubsubUnsubscribeAllPatterns(client, false)
+
+	//从待发送列表和异步关闭列表中移除
+	if client.flags&redisPendingWrite != 0 {
+		listDelValue(server.clientsPendingWrite, client)
+		client.flags &^= redisPendingWrite
+	}
+	if client.flags&redisCloseAsap != 0 {
+		listDelValue(server.clientsToClose, client)
+	}
+
+	client.reply.Init()
+	client.replyBytes = 0
+
+	if client.conn != nil {
+		err := client.conn.Close()
+		if err != nil {
+			log.Printf("close client err: %v", err)
+		}
+		client.conn = nil
+	}
+}
+
+//标记客户端需要尽快关闭，在beforeSleep或serverCron中真正释放
+func freeClientAsync(client *redisClient) {
+	if client.flags&redisCloseAsap != 0 {
+		return
+	}
+	client.flags |= redisCloseAsap
+	server.clientsToClose.PushBack(client)
+}
+
+//释放所有被标记为异步关闭的客户端
+func freeClientsInAsyncFreeQueue() {
+	for e := server.clientsToClose.Front(); e != nil; e = server.clientsToClose.Front() {
+		client := server.clientsToClose.Remove(e).(*redisClient)
+		client.flags &^= redisCloseAsap
+		freeClient(client)
+	}
+}
+
+//从链表中删除指定的元素
+func listDelValue(l *list.List, value interface{}) {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e.Value == value {
+			l.Remove(e)
+			return
+		}
 	}
-	client = nil
 }
 
 //创建客户端对象，用来处理命令和回复命令
 func createClient(c gnet.Conn) *redisClient {
 	c.SetContext(generateClientId())
 	return &redisClient{
-		id:     c.Context().(int),
-		conn:   c,
-		db:     server.db,
-		argc:   0,
-		buf:    make([]byte, 1024*12),
-		bufpos: 0,
+		id:      c.Context().(int),
+		conn:    c,
+		db:      server.db[0],
+		argc:    0,
+		bulklen: -1,
+		buf:     make([]byte, redisReplyChunkBytes),
+		bufpos:  0,
+		reply:   list.New(),
+		resp:    2,
+		bpop:    blockingState{keys: dictCreate()},
+		//事务
+		watchedKeys: list.New(),
+		//pubsub
+		pubsubChannels:      dictCreate(),
+		pubsubPatterns:      dictCreate(),
+		pubsubShardChannels: dictCreate(),
+		//没有设置密码时，客户端默认已经认证
+		authenticated: server.requirepass == "",
 	}
 }
@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"github.com/panjf2000/gnet"
+	"strings"
+	"testing"
+)
+
+//协议错误之后客户端已经被释放，gnet关闭连接之前收到的数据不能导致panic
+func TestDataAfterProtocolError(t *testing.T) {
+	c := newTestConn(t)
+	reply, _ := c.send("*1\r\n$x\r\n")
+	if reply != "-ERR Protocol error: invalid bulk length\r\n" {
+		t.Fatalf("protocol error: %q", reply)
+	}
+	if !c.closed {
+		t.Fatal("connection not closed")
+	}
+	reply, action := c.send("PING\r\n")
+	if reply != "" || action != gnet.Close {
+		t.Fatalf("data after close: %q %v", reply, action)
+	}
+}
+
+//输出缓冲区的限制只检查一轮事件处理中产生的回复，交给gnet发送的数据不再计入
+func TestClientOutputBufferLimit(t *testing.T) {
+	c := newTestConn(t)
+	other := newTestConn(t)
+	client := server.clients.dictFind(c.Context()).(*redisClient)
+
+	old := server.clientObufLimits[redisClientTypeNormal]
+	defer func() {
+		server.clientObufLimits[redisClientTypeNormal] = old
+		other.command("del", "big")
+	}()
+	server.clientObufLimits[redisClientTypeNormal] = clientBufferLimitsConfig{hardLimitBytes: 64 * 1024}
+
+	value := strings.Repeat("x", 32*1024)
+	other.command("set", "big", value)
+
+	//每一轮都没有超过限制，发送之后输出缓冲区为空，即使客户端还没有读取这些数据
+	for i := 0; i < 4; i++ {
+		if reply := c.command("get", "big"); reply != "$32768\r\n"+value+"\r\n" {
+			t.Fatalf("GET: %d bytes", len(reply))
+		}
+		if used := getClientOutputBufferMemoryUsage(client); used != 0 {
+			t.Fatalf("output buffer after write: %d", used)
+		}
+	}
+	if c.closed {
+		t.Fatal("client closed below the limit")
+	}
+
+	//一轮事件处理中的回复超过了硬限制，客户端被关闭
+	get := "*2\r\n$3\r\nget\r\n$3\r\nbig\r\n"
+	if reply, _ := c.send(get + get + get); reply != "" {
+		t.Fatalf("reply over the limit: %d bytes", len(reply))
+	}
+	if !c.closed {
+		t.Fatal("client not closed over the limit")
+	}
+}
@@ -0,0 +1,136 @@
+package redis
+
+import "strconv"
+
+//keyspace事件的类型，通过notify-keyspace-events配置需要发布的事件
+const (
+	notifyKeyspace = 1 << 0  //K
+	notifyKeyevent = 1 << 1  //E
+	notifyGeneric  = 1 << 2  //g
+	notifyString   = 1 << 3  //$
+	notifyList     = 1 << 4  //l
+	notifySet      = 1 << 5  //s
+	notifyHash     = 1 << 6  //h
+	notifyZset     = 1 << 7  //z
+	notifyExpired  = 1 << 8  //x
+	notifyEvicted  = 1 << 9  //e
+	notifyStream   = 1 << 10 //t
+	notifyKeyMiss  = 1 << 11 //m，A中不包含
+	notifyNew      = 1 << 12 //n，A中不包含
+	notifyAll      = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset |
+		notifyExpired | notifyEvicted | notifyStream //A
+)
+
+//将notify-keyspace-events配置的字符串转换为事件类型，有不认识的字符时返回-1
+func keyspaceEventsStringToFlags(classes string) int {
+	flags := 0
+	for _, c := range classes {
+		switch c {
+		case 'A':
+			flags |= notifyAll
+		case 'g':
+			flags |= notifyGeneric
+		case '$':
+			flags |= notifyString
+		case 'l':
+			flags |= notifyList
+		case 's':
+			flags |= notifySet
+		case 'h':
+			flags |= notifyHash
+		case 'z':
+			flags |= notifyZset
+		case 'x':
+			flags |= notifyExpired
+		case 'e':
+			flags |= notifyEvicted
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		case 't':
+			flags |= notifyStream
+		case 'm':
+			flags |= notifyKeyMiss
+		case 'n':
+			flags |= notifyNew
+		default:
+			return -1
+		}
+	}
+	return flags
+}
+
+//将事件类型转换为notify-keyspace-events配置的字符串，CONFIG GET使用
+func keyspaceEventsFlagsToString(flags int) string {
+	var res []byte
+	if flags&notifyAll == notifyAll {
+		res = append(res, 'A')
+	} else {
+		if flags&notifyGeneric != 0 {
+			res = append(res, 'g')
+		}
+		if flags&notifyString != 0 {
+			res = append(res, '$')
+		}
+		if flags&notifyList != 0 {
+			res = append(res, 'l')
+		}
+		if flags&notifySet != 0 {
+			res = append(res, 's')
+		}
+		if flags&notifyHash != 0 {
+			res = append(res, 'h')
+		}
+		if flags&notifyZset != 0 {
+			res = append(res, 'z')
+		}
+		if flags&notifyExpired != 0 {
+			res = append(res, 'x')
+		}
+		if flags&notifyEvicted != 0 {
+			res = append(res, 'e')
+		}
+		if flags&notifyStream != 0 {
+			res = append(res, 't')
+		}
+	}
+	if flags&notifyKeyspace != 0 {
+		res = append(res, 'K')
+	}
+	if flags&notifyKeyevent != 0 {
+		res = append(res, 'E')
+	}
+	if flags&notifyKeyMiss != 0 {
+		res = append(res, 'm')
+	}
+	if flags&notifyNew != 0 {
+		res = append(res, 'n')
+	}
+	return string(res)
+}
+
+//发布keyspace事件
+//__keyspace@<db>__:<key> 频道的消息为事件名称
+//__keyevent@<db>__:<event> 频道的消息为key
+func notifyKeyspaceEvent(typ int, event string, key *robj, dbid int) {
+	//没有配置这个类型的事件
+	if server.notifyKeyspaceEvents&typ == 0 {
+		return
+	}
+
+	eventobj := createStringObject(sds(event))
+	dbidstr := strconv.Itoa(dbid)
+
+	//__keyspace@<db>__:<key> <event>
+	if server.notifyKeyspaceEvents&notifyKeyspace != 0 {
+		chanobj := createStringObject(sds("__keyspace@" + dbidstr + "__:" + key.ptr.(sds)))
+		pubsubPublishMessage(chanobj, eventobj)
+	}
+
+	//__keyevent@<db>__:<event> <key>
+	if server.notifyKeyspaceEvents&notifyKeyevent != 0 {
+		chanobj := createStringObject(sds("__keyevent@" + dbidstr + "__:" + event))
+		pubsubPublishMessage(chanobj, key)
+	}
+}
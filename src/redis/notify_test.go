@@ -0,0 +1,41 @@
+package redis
+
+import "testing"
+
+func TestConfigSetNotifyKeyspaceEvents(t *testing.T) {
+	sub := newTestConn(t)
+	c := newTestConn(t)
+	defer c.command("config", "set", "notify-keyspace-events", "")
+
+	sub.command("subscribe", "__keyspace@0__:foo", "__keyevent@0__:set")
+	sub.out = sub.out[:0]
+
+	//默认不发布事件
+	c.command("set", "foo", "bar")
+	if len(sub.out) != 0 {
+		t.Fatalf("unexpected notification %q", sub.out)
+	}
+
+	if reply := c.command("config", "set", "notify-keyspace-events", "K$"); reply != "+OK\r\n" {
+		t.Fatalf("CONFIG SET: %q", reply)
+	}
+	want := "*2\r\n$22\r\nnotify-keyspace-events\r\n$2\r\n$K\r\n"
+	if reply := c.command("config", "get", "notify-*"); reply != want {
+		t.Fatalf("CONFIG GET: %q", reply)
+	}
+
+	//只发布了keyspace事件
+	c.command("set", "foo", "bar")
+	want = "*3\r\n$7\r\nmessage\r\n$18\r\n__keyspace@0__:foo\r\n$3\r\nset\r\n"
+	if string(sub.out) != want {
+		t.Fatalf("notification: %q", sub.out)
+	}
+
+	//不合法的配置不会修改当前的值
+	if reply := c.command("config", "set", "notify-keyspace-events", "KQ"); reply[0] != '-' {
+		t.Fatalf("CONFIG SET invalid: %q", reply)
+	}
+	if server.notifyKeyspaceEvents != notifyKeyspace|notifyString {
+		t.Fatalf("notify-keyspace-events changed to %d", server.notifyKeyspaceEvents)
+	}
+}
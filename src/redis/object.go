@@ -1,5 +1,23 @@
 package redis
 
+import (
+	"math"
+	"strings"
+)
+
+//对象编码
+const (
+	redisEncodingRaw        uint8 = 0  //Raw representation
+	redisEncodingInt        uint8 = 1  //Encoded as integer
+	redisEncodingHt         uint8 = 2  //Encoded as hash table
+	redisEncodingLinkedList uint8 = 4  //Encoded as regular linked list
+	redisEncodingIntset     uint8 = 6  //Encoded as intset
+	redisEncodingSkiplist   uint8 = 7  //Encoded as skiplist
+	redisEncodingEmbstr     uint8 = 8  //Embedded sds string encoding
+	redisEncodingStream     uint8 = 10 //Encoded as a B-tree
+	redisEncodingListpack   uint8 = 11 //Encoded as a listpack
+)
+
 type robj struct {
 	rtype    uint8
 	encoding uint8
@@ -9,11 +27,375 @@ type robj struct {
 }
 
 func createObject(t uint8, ptr interface{}) *robj {
-	return &robj{
+	o := &robj{
 		rtype:    t,
 		encoding: 0,
 		refcount: 1,
 		ptr:      ptr,
-		lru:      lruClock(),
+	}
+	//LFU策略中lru字段保存访问时间（分钟）和访问频率
+	if maxMemoryPolicyIsLfu() {
+		o.lru = lfuGetTimeInMinutes()<<8 | redisLfuInitVal
+	} else {
+		o.lru = lruClock()
+	}
+	return o
+}
+
+//不超过这个长度的字符串使用embstr编码
+const redisEncodingEmbstrSizeLimit = 44
+
+//共享整数对象的数量，0 ~ redisSharedIntegers-1
+const redisSharedIntegers = 10000
+
+//共享对象的引用计数，不会增加也不会减少
+const redisSharedRefcount = math.MaxInt32
+
+//创建字符串对象，短字符串使用embstr编码，否则使用raw编码
+func createStringObject(s sds) *robj {
+	if len(s) <= redisEncodingEmbstrSizeLimit {
+		return createEmbeddedStringObject(s)
+	}
+	return createRawStringObject(s)
+}
+
+func createRawStringObject(s sds) *robj {
+	return createObject(redisString, s)
+}
+
+//embstr编码的字符串是只读的，修改时需要创建新的对象
+func createEmbeddedStringObject(s sds) *robj {
+	o := createObject(redisString, s)
+	o.encoding = redisEncodingEmbstr
+	return o
+}
+
+//是否可以使用共享的整数对象
+//共享对象的lru字段也是共享的，按照LRU或LFU淘汰key时不能使用
+func sharedIntegersAllowed() bool {
+	return server.maxMemory == 0 ||
+		(server.maxMemoryPolicy != redisMaxMemoryAllKeysLru && server.maxMemoryPolicy != redisMaxMemoryVolatileLru &&
+			!maxMemoryPolicyIsLfu())
+}
+
+//根据整数创建字符串对象，小整数使用共享对象，否则使用int编码
+func createStringObjectFromLongLong(value int64) *robj {
+	if value >= 0 && value < redisSharedIntegers && sharedIntegersAllowed() {
+		return shared.integers[value]
+	}
+	o := createObject(redisString, value)
+	o.encoding = redisEncodingInt
+	return o
+}
+
+//尝试用更节省内存的编码保存字符串对象：整数使用int编码或者共享对象，短字符串使用embstr编码
+func tryObjectEncoding(o *robj) *robj {
+	if o.rtype != redisString {
+		return o
+	}
+	//只处理raw和embstr编码的对象
+	if o.encoding != redisEncodingRaw && o.encoding != redisEncodingEmbstr {
+		return o
+	}
+	//被其他地方引用的对象不能修改
+	if o.refcount > 1 {
+		return o
+	}
+
+	s := o.ptr.(sds)
+	if len(s) <= 20 {
+		if value, ok := string2ll(s); ok {
+			if value >= 0 && value < redisSharedIntegers && sharedIntegersAllowed() {
+				return shared.integers[value]
+			}
+			o.encoding = redisEncodingInt
+			o.ptr = value
+			return o
+		}
+	}
+
+	if len(s) <= redisEncodingEmbstrSizeLimit && o.encoding == redisEncodingRaw {
+		return createEmbeddedStringObject(s)
+	}
+	return o
+}
+
+//获取字符串对象解码后的版本，int编码时创建一个新的字符串对象
+func getDecodedObject(o *robj) *robj {
+	if o.encoding == redisEncodingInt {
+		return createStringObject(ll2string(o.ptr.(int64)))
+	}
+	return o
+}
+
+//字符串对象的长度
+func stringObjectLen(o *robj) int {
+	if o.encoding == redisEncodingInt {
+		return len(ll2string(o.ptr.(int64)))
+	}
+	return len(o.ptr.(sds))
+}
+
+//复制字符串对象，返回的对象没有被共享
+func dupStringObject(o *robj) *robj {
+	switch o.encoding {
+	case redisEncodingRaw:
+		return createRawStringObject(o.ptr.(sds))
+	case redisEncodingEmbstr:
+		return createEmbeddedStringObject(o.ptr.(sds))
+	case redisEncodingInt:
+		d := createObject(redisString, o.ptr.(int64))
+		d.encoding = redisEncodingInt
+		return d
+	default:
+		panic("Wrong encoding.")
+	}
+}
+
+//创建list对象，使用双向链表存储，链表中的元素为sds
+func createListObject() *robj {
+	o := createObject(redisList, (&rlist{}).Init())
+	o.encoding = redisEncodingLinkedList
+	return o
+}
+
+//创建hash对象，默认使用listpack编码：[field1, value1, field2, value2, ...]
+func createHashObject() *robj {
+	o := createObject(redisHash, make([]sds, 0))
+	o.encoding = redisEncodingListpack
+	return o
+}
+
+//创建set对象，使用hashtable编码，key = sds, value = struct{}{}
+func createSetObject() *robj {
+	o := createObject(redisSet, dictCreate())
+	o.encoding = redisEncodingHt
+	return o
+}
+
+//创建set对象，使用intset编码
+func createIntsetObject() *robj {
+	o := createObject(redisSet, &intset{})
+	o.encoding = redisEncodingIntset
+	return o
+}
+
+//创建zset对象，使用skiplist + dict编码
+func createZsetObject() *robj {
+	o := createObject(redisZset, &zset{dict: dictCreate(), zsl: zslCreate()})
+	o.encoding = redisEncodingSkiplist
+	return o
+}
+
+//创建zset对象，使用listpack编码：[member1, score1, member2, score2, ...]，按照score从小到大排序
+func createZsetListpackObject() *robj {
+	o := createObject(redisZset, make([]sds, 0))
+	o.encoding = redisEncodingListpack
+	return o
+}
+
+//创建stream对象
+func createStreamObject() *robj {
+	o := createObject(redisStream, streamCreate())
+	o.encoding = redisEncodingStream
+	return o
+}
+
+//检查对象的类型，类型不匹配时回复WRONGTYPE错误并返回true
+func checkType(client *redisClient, o *robj, t uint8) bool {
+	if o.rtype != t {
+		addReply(client, shared.wrongtypeerr)
+		return true
+	}
+	return false
+}
+
+//从字符串对象中解析出整数
+func getLongLongFromObject(o *robj) (int64, bool) {
+	if o == nil {
+		return 0, true
+	}
+	if o.encoding == redisEncodingInt {
+		return o.ptr.(int64), true
+	}
+	return string2ll(o.ptr.(sds))
+}
+
+//从字符串对象中解析出整数，解析失败时回复错误，msg为空时使用默认的错误信息
+func getLongLongFromObjectOrReply(client *redisClient, o *robj, msg string) (int64, bool) {
+	value, ok := getLongLongFromObject(o)
+	if !ok {
+		if msg != "" {
+			addReplyError(client, msg)
+		} else {
+			addReplyError(client, "value is not an integer or out of range")
+		}
+		return 0, false
+	}
+	return value, true
+}
+
+//解析正整数（包括0），解析失败或为负数时回复错误
+func getPositiveLongFromObjectOrReply(client *redisClient, o *robj, msg string) (int64, bool) {
+	if msg == "" {
+		msg = "value is out of range, must be positive"
+	}
+	value, ok := getLongLongFromObjectOrReply(client, o, msg)
+	if !ok {
+		return 0, false
+	}
+	if value < 0 {
+		addReplyError(client, msg)
+		return 0, false
+	}
+	return value, true
+}
+
+//从字符串对象中解析出浮点数
+func getDoubleFromObject(o *robj) (float64, bool) {
+	if o == nil {
+		return 0, true
+	}
+	if o.encoding == redisEncodingInt {
+		return float64(o.ptr.(int64)), true
+	}
+	return string2d(o.ptr.(sds))
+}
+
+//从字符串对象中解析出浮点数，解析失败时回复错误，msg为空时使用默认的错误信息
+func getDoubleFromObjectOrReply(client *redisClient, o *robj, msg string) (float64, bool) {
+	value, ok := getDoubleFromObject(o)
+	if !ok {
+		if msg != "" {
+			addReplyError(client, msg)
+		} else {
+			addReplyError(client, "value is not a valid float")
+		}
+		return 0, false
+	}
+	return value, true
+}
+
+//增加对象的引用计数，共享对象的引用计数不变
+func incrRefCount(o *robj) {
+	if o.refcount != redisSharedRefcount {
+		o.refcount++
+	}
+}
+
+//减少对象的引用计数，对象的内存由GC回收，这里只需要维护计数
+func decrRefCount(o *robj) {
+	if o.refcount != redisSharedRefcount && o.refcount > 0 {
+		o.refcount--
+	}
+}
+
+//按照RDB中保存的访问频率或者空闲时间（秒）设置对象的lru字段，为-1表示没有保存
+func objectSetLRUOrLFU(val *robj, lfuFreq int64, lruIdle int64, lruClock uint64) {
+	//共享对象的lru不能修改
+	if val.refcount == redisSharedRefcount {
+		return
+	}
+	if maxMemoryPolicyIsLfu() {
+		if lfuFreq >= 0 {
+			val.lru = lfuGetTimeInMinutes()<<8 | uint64(lfuFreq)
+		}
+	} else if lruIdle >= 0 {
+		lruAbs := int64(lruClock) - lruIdle*1000/redisLruClockResolution
+		//lru时钟会循环，空闲时间太长时设置为时钟的一半，这样计算出的空闲时间会保持很大
+		if lruAbs < 0 {
+			lruAbs = int64((lruClock + redisLruClockMax/2) % redisLruClockMax)
+		}
+		val.lru = uint64(lruAbs)
+	}
+}
+
+//对象编码的名称
+func strEncoding(encoding uint8) string {
+	switch encoding {
+	case redisEncodingRaw:
+		return "raw"
+	case redisEncodingInt:
+		return "int"
+	case redisEncodingHt:
+		return "hashtable"
+	case redisEncodingLinkedList:
+		return "linkedlist"
+	case redisEncodingIntset:
+		return "intset"
+	case redisEncodingSkiplist:
+		return "skiplist"
+	case redisEncodingEmbstr:
+		return "embstr"
+	case redisEncodingStream:
+		return "stream"
+	case redisEncodingListpack:
+		return "listpack"
+	default:
+		return "unknown"
+	}
+}
+
+//OBJECT命令查找key，不更新对象的lru
+func objectCommandLookup(client *redisClient, key *robj) *robj {
+	return client.db.lookupKeyReadWithFlags(key, lookupNoTouch)
+}
+
+var objectHelp = []string{
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+}
+
+//OBJECT ENCODING|IDLETIME|FREQ|REFCOUNT key
+func objectCommand(client *redisClient) {
+	opt := strings.ToLower(client.argv[1].ptr.(sds))
+
+	if opt == "help" && client.argc == 2 {
+		addReplyHelp(client, objectHelp)
+		return
+	}
+	if opt != "encoding" && opt != "idletime" && opt != "freq" && opt != "refcount" {
+		addReplySubcommandSyntaxError(client)
+		return
+	}
+	if client.argc != 3 {
+		addReplySubcommandArityError(client)
+		return
+	}
+
+	o := objectCommandLookup(client, client.argv[2])
+	if o == nil {
+		addReplyNull(client)
+		return
+	}
+	switch opt {
+	case "encoding":
+		addReplyBulkCBuffer(client, strEncoding(o.encoding))
+	case "idletime":
+		if maxMemoryPolicyIsLfu() {
+			addReplyError(client, "An LFU maxmemory policy is selected, idle time not tracked. "+
+				"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+			return
+		}
+		addReplyLongLong(client, int64(estimateObjectIdleTime(o)/1000))
+	case "freq":
+		if !maxMemoryPolicyIsLfu() {
+			addReplyError(client, "An LFU maxmemory policy is not selected, access frequency not tracked. "+
+				"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+			return
+		}
+		addReplyLongLong(client, int64(lfuDecrAndReturn(o)))
+	case "refcount":
+		addReplyLongLong(client, int64(o.refcount))
 	}
 }
@@ -0,0 +1,444 @@
+package redis
+
+import (
+	"container/list"
+	"strings"
+)
+
+//普通channel和shard channel的订阅逻辑相同，只是使用的字典和回复的消息类型不同
+type pubsubType struct {
+	shard                bool
+	clientPubSubChannels func(client *redisClient) *dict //客户端订阅的channel
+	subscriptionCount    func(client *redisClient) int   //SUBSCRIBE/UNSUBSCRIBE回复中的订阅数量
+	serverPubSubChannels func() *dict                    //channel -> 订阅的客户端
+	subscribeMsg         string
+	unsubscribeMsg       string
+	messageBulk          string
+}
+
+var pubSubType = pubsubType{
+	shard: false,
+	clientPubSubChannels: func(client *redisClient) *dict {
+		return client.pubsubChannels
+	},
+	subscriptionCount: clientSubscriptionsCount,
+	serverPubSubChannels: func() *dict {
+		return server.pubsubChannels
+	},
+	subscribeMsg:   "subscribe",
+	unsubscribeMsg: "unsubscribe",
+	messageBulk:    "message",
+}
+
+var pubSubShardType = pubsubType{
+	shard: true,
+	clientPubSubChannels: func(client *redisClient) *dict {
+		return client.pubsubShardChannels
+	},
+	subscriptionCount: clientShardSubscriptionsCount,
+	serverPubSubChannels: func() *dict {
+		return server.pubsubShardChannels
+	},
+	subscribeMsg:   "ssubscribe",
+	unsubscribeMsg: "sunsubscribe",
+	messageBulk:    "smessage",
+}
+
+//-----------------------------------------------------------------------------
+// Pubsub client replies API
+//-----------------------------------------------------------------------------
+
+//发送给订阅者的消息头，RESP3中使用push类型
+func addReplyPubsubHeader(client *redisClient, length int, kind string) {
+	addReplyPushLen(client, length)
+	addReplyBulkCBuffer(client, kind)
+}
+
+//发送channel中的消息
+func addReplyPubsubMessage(client *redisClient, channel *robj, msg *robj, messageBulk string) {
+	addReplyPubsubHeader(client, 3, messageBulk)
+	addReplyBulk(client, channel)
+	addReplyBulk(client, msg)
+}
+
+//发送匹配pattern的channel中的消息
+func addReplyPubsubPatMessage(client *redisClient, pat *robj, channel *robj, msg *robj) {
+	addReplyPubsubHeader(client, 4, "pmessage")
+	addReplyBulk(client, pat)
+	addReplyBulk(client, channel)
+	addReplyBulk(client, msg)
+}
+
+//订阅成功的回复，包含客户端当前的订阅数量
+func addReplyPubsubSubscribed(client *redisClient, channel *robj, t *pubsubType) {
+	addReplyPubsubHeader(client, 3, t.subscribeMsg)
+	addReplyBulk(client, channel)
+	addReplyLongLong(client, int64(t.subscriptionCount(client)))
+}
+
+//取消订阅的回复，channel为nil表示客户端没有订阅任何channel
+func addReplyPubsubUnsubscribed(client *redisClient, channel *robj, t *pubsubType) {
+	addReplyPubsubHeader(client, 3, t.unsubscribeMsg)
+	if channel != nil {
+		addReplyBulk(client, channel)
+	} else {
+		addReplyNull(client)
+	}
+	addReplyLongLong(client, int64(t.subscriptionCount(client)))
+}
+
+func addReplyPubsubPatSubscribed(client *redisClient, pattern *robj) {
+	addReplyPubsubHeader(client, 3, "psubscribe")
+	addReplyBulk(client, pattern)
+	addReplyLongLong(client, int64(clientSubscriptionsCount(client)))
+}
+
+func addReplyPubsubPatUnsubscribed(client *redisClient, pattern *robj) {
+	addReplyPubsubHeader(client, 3, "punsubscribe")
+	if pattern != nil {
+		addReplyBulk(client, pattern)
+	} else {
+		addReplyNull(client)
+	}
+	addReplyLongLong(client, int64(clientSubscriptionsCount(client)))
+}
+
+//-----------------------------------------------------------------------------
+// Pubsub low level API
+//-----------------------------------------------------------------------------
+
+//客户端订阅的channel和pattern数量
+func clientSubscriptionsCount(client *redisClient) int {
+	return client.pubsubChannels.used() + client.pubsubPatterns.used()
+}
+
+//客户端订阅的shard channel数量
+func clientShardSubscriptionsCount(client *redisClient) int {
+	return client.pubsubShardChannels.used()
+}
+
+//客户端有订阅时进入pubsub模式，只能执行订阅相关的命令
+func markClientAsPubsub(client *redisClient) {
+	if clientSubscriptionsCount(client)+clientShardSubscriptionsCount(client) > 0 {
+		client.flags |= redisPubsub
+	} else {
+		client.flags &^= redisPubsub
+	}
+}
+
+//订阅channel，回复订阅结果，返回是否是新的订阅
+func pubsubSubscribeChannel(client *redisClient, channel *robj, t *pubsubType) bool {
+	retval := false
+	if t.clientPubSubChannels(client).dictAdd(channel.ptr, nil) == dictOk {
+		retval = true
+		var clients *list.List
+		if de := t.serverPubSubChannels().dictFind(channel.ptr); de != nil {
+			clients = de.(*list.List)
+		} else {
+			clients = list.New()
+			t.serverPubSubChannels().dictAdd(channel.ptr, clients)
+		}
+		clients.PushBack(client)
+	}
+	addReplyPubsubSubscribed(client, channel, t)
+	return retval
+}
+
+//取消订阅channel，notify为true时回复取消订阅的结果，返回是否订阅过这个channel
+func pubsubUnsubscribeChannel(client *redisClient, channel *robj, notify bool, t *pubsubType) bool {
+	retval := false
+	if t.clientPubSubChannels(client).dictDelete(channel.ptr) == dictOk {
+		retval = true
+		de := t.serverPubSubChannels().dictFind(channel.ptr)
+		if de == nil {
+			panic("pubsubUnsubscribeChannel: channel not found in server")
+		}
+		clients := de.(*list.List)
+		listDelValue(clients, client)
+		//没有客户端订阅这个channel了
+		if clients.Len() == 0 {
+			t.serverPubSubChannels().dictDelete(channel.ptr)
+		}
+	}
+	if notify {
+		addReplyPubsubUnsubscribed(client, channel, t)
+	}
+	return retval
+}
+
+//订阅pattern，回复订阅结果，返回是否是新的订阅
+func pubsubSubscribePattern(client *redisClient, pattern *robj) bool {
+	retval := false
+	if client.pubsubPatterns.dictAdd(pattern.ptr, nil) == dictOk {
+		retval = true
+		var clients *list.List
+		if de := server.pubsubPatterns.dictFind(pattern.ptr); de != nil {
+			clients = de.(*list.List)
+		} else {
+			clients = list.New()
+			server.pubsubPatterns.dictAdd(pattern.ptr, clients)
+		}
+		clients.PushBack(client)
+	}
+	addReplyPubsubPatSubscribed(client, pattern)
+	return retval
+}
+
+//取消订阅pattern，notify为true时回复取消订阅的结果，返回是否订阅过这个pattern
+func pubsubUnsubscribePattern(client *redisClient, pattern *robj, notify bool) bool {
+	retval := false
+	if client.pubsubPatterns.dictDelete(pattern.ptr) == dictOk {
+		retval = true
+		de := server.pubsubPatterns.dictFind(pattern.ptr)
+		if de == nil {
+			panic("pubsubUnsubscribePattern: pattern not found in server")
+		}
+		clients := de.(*list.List)
+		listDelValue(clients, client)
+		if clients.Len() == 0 {
+			server.pubsubPatterns.dictDelete(pattern.ptr)
+		}
+	}
+	if notify {
+		addReplyPubsubPatUnsubscribed(client, pattern)
+	}
+	return retval
+}
+
+//字典中所有的key，遍历时不能修改字典
+func pubsubDictKeys(d *dict) []sds {
+	keys := make([]sds, 0, d.used())
+	d.dictForEach(func(key interface{}, val interface{}) bool {
+		keys = append(keys, key.(sds))
+		return true
+	})
+	return keys
+}
+
+//取消订阅客户端的所有channel，返回取消订阅的数量
+func pubsubUnsubscribeAllChannelsInternal(client *redisClient, notify bool, t *pubsubType) int {
+	count := 0
+	for _, channel := range pubsubDictKeys(t.clientPubSubChannels(client)) {
+		if pubsubUnsubscribeChannel(client, createStringObject(channel), notify, t) {
+			count++
+		}
+	}
+	//没有订阅任何channel时也需要回复
+	if notify && count == 0 {
+		addReplyPubsubUnsubscribed(client, nil, t)
+	}
+	return count
+}
+
+func pubsubUnsubscribeAllChannels(client *redisClient, notify bool) int {
+	return pubsubUnsubscribeAllChannelsInternal(client, notify, &pubSubType)
+}
+
+func pubsubUnsubscribeShardAllChannels(client *redisClient, notify bool) int {
+	return pubsubUnsubscribeAllChannelsInternal(client, notify, &pubSubShardType)
+}
+
+//取消订阅客户端的所有pattern，返回取消订阅的数量
+func pubsubUnsubscribeAllPatterns(client *redisClient, notify bool) int {
+	count := 0
+	for _, pattern := range pubsubDictKeys(client.pubsubPatterns) {
+		if pubsubUnsubscribePattern(client, createStringObject(pattern), notify) {
+			count++
+		}
+	}
+	if notify && count == 0 {
+		addReplyPubsubPatUnsubscribed(client, nil)
+	}
+	return count
+}
+
+//发布消息，返回收到消息的客户端数量
+//消息和其它回复一样写入客户端的输出缓冲区，消费慢的订阅者会受到输出缓冲区的限制
+func pubsubPublishMessageInternal(channel *robj, message *robj, t *pubsubType) int {
+	receivers := 0
+
+	//订阅了channel的客户端
+	if de := t.serverPubSubChannels().dictFind(channel.ptr); de != nil {
+		for e := de.(*list.List).Front(); e != nil; e = e.Next() {
+			addReplyPubsubMessage(e.Value.(*redisClient), channel, message, t.messageBulk)
+			receivers++
+		}
+	}
+
+	//shard channel不匹配pattern
+	if t.shard {
+		return receivers
+	}
+
+	//订阅了匹配channel的pattern的客户端
+	server.pubsubPatterns.dictForEach(func(key interface{}, val interface{}) bool {
+		if !stringmatchlen(key.(sds), channel.ptr.(sds), false) {
+			return true
+		}
+		pattern := createStringObject(key.(sds))
+		for e := val.(*list.List).Front(); e != nil; e = e.Next() {
+			addReplyPubsubPatMessage(e.Value.(*redisClient), pattern, channel, message)
+			receivers++
+		}
+		return true
+	})
+	return receivers
+}
+
+func pubsubPublishMessage(channel *robj, message *robj) int {
+	return pubsubPublishMessageInternal(channel, message, &pubSubType)
+}
+
+func pubsubPublishMessageShard(channel *robj, message *robj) int {
+	return pubsubPublishMessageInternal(channel, message, &pubSubShardType)
+}
+
+//-----------------------------------------------------------------------------
+// Pubsub commands implementation
+//-----------------------------------------------------------------------------
+
+//SUBSCRIBE channel [channel ...]
+func subscribeCommand(client *redisClient) {
+	for j := 1; j < client.argc; j++ {
+		pubsubSubscribeChannel(client, client.argv[j], &pubSubType)
+	}
+	markClientAsPubsub(client)
+}
+
+//UNSUBSCRIBE [channel [channel ...]]
+func unsubscribeCommand(client *redisClient) {
+	if client.argc == 1 {
+		pubsubUnsubscribeAllChannels(client, true)
+	} else {
+		for j := 1; j < client.argc; j++ {
+			pubsubUnsubscribeChannel(client, client.argv[j], true, &pubSubType)
+		}
+	}
+	markClientAsPubsub(client)
+}
+
+//PSUBSCRIBE pattern [pattern ...]
+func psubscribeCommand(client *redisClient) {
+	for j := 1; j < client.argc; j++ {
+		pubsubSubscribePattern(client, client.argv[j])
+	}
+	markClientAsPubsub(client)
+}
+
+//PUNSUBSCRIBE [pattern [pattern ...]]
+func punsubscribeCommand(client *redisClient) {
+	if client.argc == 1 {
+		pubsubUnsubscribeAllPatterns(client, true)
+	} else {
+		for j := 1; j < client.argc; j++ {
+			pubsubUnsubscribePattern(client, client.argv[j], true)
+		}
+	}
+	markClientAsPubsub(client)
+}
+
+//PUBLISH channel message
+func publishCommand(client *redisClient) {
+	receivers := pubsubPublishMessage(client.argv[1], client.argv[2])
+	addReplyLongLong(client, int64(receivers))
+}
+
+//SSUBSCRIBE shardchannel [shardchannel ...]
+func ssubscribeCommand(client *redisClient) {
+	for j := 1; j < client.argc; j++ {
+		pubsubSubscribeChannel(client, client.argv[j], &pubSubShardType)
+	}
+	markClientAsPubsub(client)
+}
+
+//SUNSUBSCRIBE [shardchannel [shardchannel ...]]
+func sunsubscribeCommand(client *redisClient) {
+	if client.argc == 1 {
+		pubsubUnsubscribeShardAllChannels(client, true)
+	} else {
+		for j := 1; j < client.argc; j++ {
+			pubsubUnsubscribeChannel(client, client.argv[j], true, &pubSubShardType)
+		}
+	}
+	markClientAsPubsub(client)
+}
+
+//SPUBLISH shardchannel message
+func spublishCommand(client *redisClient) {
+	receivers := pubsubPublishMessageShard(client.argv[1], client.argv[2])
+	addReplyLongLong(client, int64(receivers))
+}
+
+var pubsubHelp = []string{
+	"CHANNELS [<pattern>]",
+	"    Return the currently active channels matching a <pattern> (default: '*').",
+	"NUMPAT",
+	"    Return number of subscriptions to patterns.",
+	"NUMSUB [<channel> ...]",
+	"    Return the number of subscribers for the specified channels, excluding",
+	"    pattern subscriptions(default: no channels).",
+	"SHARDCHANNELS [<pattern>]",
+	"    Return the currently active shard level channels matching a <pattern> (default: '*').",
+	"SHARDNUMSUB [<shardchannel> ...]",
+	"    Return the number of subscribers for the specified shard level channel(s)",
+}
+
+//PUBSUB CHANNELS [pattern]
+//PUBSUB NUMSUB [channel ...]
+//PUBSUB NUMPAT
+//PUBSUB SHARDCHANNELS [pattern]
+//PUBSUB SHARDNUMSUB [shardchannel ...]
+func pubsubCommand(client *redisClient) {
+	opt := strings.ToLower(client.argv[1].ptr.(sds))
+
+	switch {
+	case opt == "help" && client.argc == 2:
+		addReplyHelp(client, pubsubHelp)
+	case opt == "channels" && (client.argc == 2 || client.argc == 3):
+		channelList(client, server.pubsubChannels)
+	case opt == "numsub" && client.argc >= 2:
+		numsubReply(client, server.pubsubChannels)
+	case opt == "numpat" && client.argc == 2:
+		//不同客户端订阅的相同pattern只算一个
+		addReplyLongLong(client, int64(server.pubsubPatterns.used()))
+	case opt == "shardchannels" && (client.argc == 2 || client.argc == 3):
+		channelList(client, server.pubsubShardChannels)
+	case opt == "shardnumsub" && client.argc >= 2:
+		numsubReply(client, server.pubsubShardChannels)
+	default:
+		addReplySubcommandSyntaxError(client)
+	}
+}
+
+//回复有客户端订阅的channel，指定了pattern时只回复匹配的channel
+func channelList(client *redisClient, channels *dict) {
+	allchannels := client.argc == 2
+	var pattern sds
+	if !allchannels {
+		pattern = client.argv[2].ptr.(sds)
+	}
+	var matched []sds
+	channels.dictForEach(func(key interface{}, val interface{}) bool {
+		if allchannels || stringmatchlen(pattern, key.(sds), false) {
+			matched = append(matched, key.(sds))
+		}
+		return true
+	})
+	addReplyArrayLen(client, len(matched))
+	for _, channel := range matched {
+		addReplyBulkCBuffer(client, channel)
+	}
+}
+
+//回复每个channel的订阅者数量，不包括pattern的订阅者
+func numsubReply(client *redisClient, channels *dict) {
+	addReplyMapLen(client, client.argc-2)
+	for j := 2; j < client.argc; j++ {
+		count := 0
+		if de := channels.dictFind(client.argv[j].ptr); de != nil {
+			count = de.(*list.List).Len()
+		}
+		addReplyBulk(client, client.argv[j])
+		addReplyLongLong(client, int64(count))
+	}
+}
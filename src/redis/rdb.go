@@ -0,0 +1,1776 @@
+package redis
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// RDB file format
+//-----------------------------------------------------------------------------
+
+//保存时使用的RDB版本，和redis 7.0相同，加载时支持1到这个版本
+const redisRdbVersion = 10
+
+//rdbSaveRio等函数的rdbflags
+const (
+	rdbFlagsNone        = 0
+	rdbFlagsAofPreamble = 1 << 0 //生成AOF的base文件
+)
+
+//对象类型
+const (
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZset             = 3
+	rdbTypeHash             = 4
+	rdbTypeZset2            = 5 //score使用二进制保存
+	rdbTypeModule2          = 7
+	rdbTypeHashZipmap       = 9
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZsetZiplist      = 12
+	rdbTypeHashZiplist      = 13
+	rdbTypeListQuicklist    = 14
+	rdbTypeStreamListpacks  = 15
+	rdbTypeHashListpack     = 16
+	rdbTypeZsetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+)
+
+//特殊的操作码
+const (
+	rdbOpcodeFunction2    = 245
+	rdbOpcodeFunction     = 246
+	rdbOpcodeModuleAux    = 247
+	rdbOpcodeIdle         = 248 //LRU空闲时间
+	rdbOpcodeFreq         = 249 //LFU访问频率
+	rdbOpcodeAux          = 250 //辅助字段
+	rdbOpcodeResizedb     = 251 //db的大小，加载时预先扩容
+	rdbOpcodeExpiretimeMs = 252 //过期时间（毫秒）
+	rdbOpcodeExpiretime   = 253 //过期时间（秒），旧版本使用
+	rdbOpcodeSelectdb     = 254
+	rdbOpcodeEOF          = 255
+)
+
+//长度编码，第一个字节的高2位
+//00|XXXXXX 6位长度，01|XXXXXX XXXXXXXX 14位长度，
+//10000000 + 4字节 32位长度，10000001 + 8字节 64位长度，11|XXXXXX 特殊编码的字符串
+const (
+	rdb6bitLen  = 0
+	rdb14bitLen = 1
+	rdb32bitLen = 0x80
+	rdb64bitLen = 0x81
+	rdbEncVal   = 3
+)
+
+//特殊编码的字符串
+const (
+	rdbEncInt8  = 0 //8位整数
+	rdbEncInt16 = 1 //16位整数
+	rdbEncInt32 = 2 //32位整数
+	rdbEncLzf   = 3 //LZF压缩的字符串
+)
+
+//quicklist节点的类型
+const (
+	quicklistNodeContainerPlain  = 1
+	quicklistNodeContainerPacked = 2
+)
+
+//stream listpack节点中每个消息的标记
+const (
+	streamItemFlagNone       = 0
+	streamItemFlagDeleted    = 1 << 0 //已经删除
+	streamItemFlagSamefields = 1 << 1 //field和master entry相同，只保存value
+)
+
+//保存stream时每个listpack节点最多保存的消息数量，和redis的stream-node-max-entries默认值相同
+const streamNodeMaxEntries = 100
+
+//写缓冲区超过这个大小时写入文件
+const rioBufferSize = 64 * 1024
+
+//-----------------------------------------------------------------------------
+// rio
+//-----------------------------------------------------------------------------
+
+//RDB数据的读写，同时计算校验和
+type rio struct {
+	reader    *bufio.Reader
+	size      int64 //读取的文件大小，用来检查长度是否合法
+	processed int64 //已经读取的字节数
+
+	buf   []byte               //写缓冲区
+	flush func(p []byte) error //写缓冲区满了时调用，调用之后p不会再被修改
+	err   error                //写入时发生的第一个错误
+
+	cksum uint64
+}
+
+func (r *rio) write(p []byte) {
+	if server.rdbChecksum {
+		r.cksum = crc64Update(r.cksum, p)
+	}
+	r.buf = append(r.buf, p...)
+	if len(r.buf) >= rioBufferSize {
+		r.flushBuffer()
+	}
+}
+
+func (r *rio) flushBuffer() {
+	if len(r.buf) == 0 {
+		return
+	}
+	if r.err == nil {
+		r.err = r.flush(r.buf)
+	}
+	r.buf = nil
+}
+
+func (r *rio) read(n uint64) ([]byte, error) {
+	if n > uint64(r.size-r.processed) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r.reader, p); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r.processed += int64(n)
+	if server.rdbChecksum {
+		r.cksum = crc64Update(r.cksum, p)
+	}
+	return p, nil
+}
+
+//-----------------------------------------------------------------------------
+// Low level saving
+//-----------------------------------------------------------------------------
+
+func rdbSaveType(r *rio, t byte) {
+	r.write([]byte{t})
+}
+
+func rdbSaveLen(r *rio, l uint64) {
+	switch {
+	case l < 1<<6:
+		r.write([]byte{byte(l) | rdb6bitLen<<6})
+	case l < 1<<14:
+		r.write([]byte{byte(l>>8) | rdb14bitLen<<6, byte(l)})
+	case l <= math.MaxUint32:
+		buf := [5]byte{rdb32bitLen}
+		binary.BigEndian.PutUint32(buf[1:], uint32(l))
+		r.write(buf[:])
+	default:
+		buf := [9]byte{rdb64bitLen}
+		binary.BigEndian.PutUint64(buf[1:], l)
+		r.write(buf[:])
+	}
+}
+
+//毫秒时间戳，小端
+func rdbSaveMillisecondTime(r *rio, t int64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(t))
+	r.write(buf[:])
+}
+
+//double按照IEEE 754保存，小端
+func rdbSaveBinaryDoubleValue(r *rio, v float64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	r.write(buf[:])
+}
+
+//可以用8、16或者32位保存的整数使用特殊编码，返回编码后的数据，不能编码时返回nil
+func rdbEncodeInteger(v int64) []byte {
+	switch {
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return []byte{rdbEncVal<<6 | rdbEncInt8, byte(v)}
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return []byte{rdbEncVal<<6 | rdbEncInt16, byte(v), byte(v >> 8)}
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return []byte{rdbEncVal<<6 | rdbEncInt32, byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+	}
+	return nil
+}
+
+//保存字符串，可以表示为整数的短字符串按照整数保存
+func rdbSaveRawString(r *rio, s sds) {
+	if len(s) <= 11 {
+		if v, ok := string2ll(s); ok {
+			if enc := rdbEncodeInteger(v); enc != nil {
+				r.write(enc)
+				return
+			}
+		}
+	}
+	rdbSaveLen(r, uint64(len(s)))
+	r.write([]byte(s))
+}
+
+func rdbSaveLongLongAsStringObject(r *rio, v int64) {
+	if enc := rdbEncodeInteger(v); enc != nil {
+		r.write(enc)
+		return
+	}
+	s := ll2string(v)
+	rdbSaveLen(r, uint64(len(s)))
+	r.write([]byte(s))
+}
+
+func rdbSaveStringObject(r *rio, o *robj) {
+	if o.encoding == redisEncodingInt {
+		rdbSaveLongLongAsStringObject(r, o.ptr.(int64))
+	} else {
+		rdbSaveRawString(r, o.ptr.(sds))
+	}
+}
+
+//streamID保存为16字节，大端，和rax中的key相同
+func rdbEncodeStreamID(id *streamID) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, id.ms)
+	binary.BigEndian.PutUint64(buf[8:], id.seq)
+	return buf
+}
+
+//-----------------------------------------------------------------------------
+// Objects saving
+//-----------------------------------------------------------------------------
+
+func rdbSaveObjectType(r *rio, o *robj) {
+	switch o.rtype {
+	case redisString:
+		rdbSaveType(r, rdbTypeString)
+	case redisList:
+		rdbSaveType(r, rdbTypeList)
+	case redisSet:
+		rdbSaveType(r, rdbTypeSet)
+	case redisZset:
+		rdbSaveType(r, rdbTypeZset2)
+	case redisHash:
+		rdbSaveType(r, rdbTypeHash)
+	case redisStream:
+		rdbSaveType(r, rdbTypeStreamListpacks2)
+	default:
+		panic("Unknown object type")
+	}
+}
+
+func rdbSaveObject(r *rio, o *robj) {
+	switch o.rtype {
+	case redisString:
+		rdbSaveStringObject(r, o)
+	case redisList:
+		l := o.ptr.(*rlist)
+		rdbSaveLen(r, uint64(l.Len()))
+		for e := l.Front(); e != nil; e = e.Next() {
+			rdbSaveRawString(r, e.Value.(sds))
+		}
+	case redisSet:
+		rdbSaveLen(r, uint64(setTypeSize(o)))
+		setTypeForEach(o, func(value sds) bool {
+			rdbSaveRawString(r, value)
+			return true
+		})
+	case redisZset:
+		//和redis相同，从score最大的元素开始保存
+		n := int64(zsetLength(o))
+		rdbSaveLen(r, uint64(n))
+		zsetRangeForEach(o, 0, n-1, true, func(ele sds, score float64) {
+			rdbSaveRawString(r, ele)
+			rdbSaveBinaryDoubleValue(r, score)
+		})
+	case redisHash:
+		rdbSaveLen(r, uint64(hashTypeLength(o)))
+		hashTypeForEach(o, func(field sds, value sds) bool {
+			rdbSaveRawString(r, field)
+			rdbSaveRawString(r, value)
+			return true
+		})
+	case redisStream:
+		rdbSaveStreamObject(r, o.ptr.(*stream))
+	default:
+		panic("Unknown object type")
+	}
+}
+
+//按照redis的格式把stream的消息保存为多个listpack节点
+//每个节点的第一个元素为master entry：count、deleted、field的数量、field...、0
+//之后每个消息为：flags、ms-diff、seq-diff、[field的数量、field、value... | value...]、lp-count
+func streamEncodeListpacks(s *stream, fn func(master streamID, lp []byte)) {
+	var lp *listpack
+	var master streamID
+	var masterFields []sds
+	var count int
+	emit := func() {
+		if lp == nil {
+			return
+		}
+		//第一个元素是消息的数量，写完节点后才知道
+		head := lpNew()
+		head.appendInteger(int64(count))
+		head.appendInteger(0)
+		head.appendInteger(int64(len(masterFields) / 2))
+		for i := 0; i < len(masterFields); i += 2 {
+			head.appendString(masterFields[i])
+		}
+		head.appendInteger(0)
+		head.buf = append(head.buf, lp.buf[lpHeaderSize:]...)
+		head.numele += lp.numele
+		fn(master, head.bytes())
+		lp = nil
+	}
+
+	s.rax.ascend(streamID{}, func(id streamID, value interface{}) bool {
+		fields := value.([]sds)
+		if lp != nil && count == streamNodeMaxEntries {
+			emit()
+		}
+		if lp == nil {
+			lp = lpNew()
+			master = id
+			masterFields = fields
+			count = 0
+		}
+
+		flags := streamItemFlagNone
+		same := len(fields) == len(masterFields)
+		for i := 0; same && i < len(fields); i += 2 {
+			same = fields[i] == masterFields[i]
+		}
+		if same {
+			flags |= streamItemFlagSamefields
+		}
+		lp.appendInteger(int64(flags))
+		lp.appendInteger(int64(id.ms - master.ms))
+		lp.appendInteger(int64(id.seq - master.seq))
+		numfields := len(fields) / 2
+		if same {
+			for i := 1; i < len(fields); i += 2 {
+				lp.appendString(fields[i])
+			}
+			lp.appendInteger(int64(numfields + 3))
+		} else {
+			lp.appendInteger(int64(numfields))
+			for _, f := range fields {
+				lp.appendString(f)
+			}
+			lp.appendInteger(int64(numfields + 3 + numfields + 1))
+		}
+		count++
+		return true
+	})
+	emit()
+}
+
+func rdbSaveStreamObject(r *rio, s *stream) {
+	nodes := (s.rax.length + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	rdbSaveLen(r, uint64(nodes))
+	streamEncodeListpacks(s, func(master streamID, lp []byte) {
+		rdbSaveRawString(r, sds(rdbEncodeStreamID(&master)))
+		rdbSaveRawString(r, sds(lp))
+	})
+
+	rdbSaveLen(r, s.length)
+	rdbSaveLen(r, s.lastID.ms)
+	rdbSaveLen(r, s.lastID.seq)
+	rdbSaveLen(r, s.firstID.ms)
+	rdbSaveLen(r, s.firstID.seq)
+	rdbSaveLen(r, s.maxDeletedEntryID.ms)
+	rdbSaveLen(r, s.maxDeletedEntryID.seq)
+	rdbSaveLen(r, s.entriesAdded)
+
+	//消费组
+	cgs := streamSortedCGs(s)
+	rdbSaveLen(r, uint64(len(cgs)))
+	for _, cg := range cgs {
+		rdbSaveRawString(r, cg.name)
+		rdbSaveLen(r, cg.lastID.ms)
+		rdbSaveLen(r, cg.lastID.seq)
+		rdbSaveLen(r, uint64(cg.entriesRead))
+
+		//消费组的PEL，保存NACK的完整信息
+		rdbSaveLen(r, uint64(cg.pel.length))
+		cg.pel.ascend(streamID{}, func(id streamID, value interface{}) bool {
+			nack := value.(*streamNACK)
+			r.write(rdbEncodeStreamID(&id))
+			rdbSaveMillisecondTime(r, nack.deliveryTime)
+			rdbSaveLen(r, nack.deliveryCount)
+			return true
+		})
+
+		//消费者的PEL只保存ID，加载时从消费组的PEL中查找NACK
+		consumers := streamSortedConsumers(cg)
+		rdbSaveLen(r, uint64(len(consumers)))
+		for _, consumer := range consumers {
+			rdbSaveRawString(r, consumer.name)
+			rdbSaveMillisecondTime(r, consumer.seenTime)
+			rdbSaveLen(r, uint64(consumer.pel.length))
+			consumer.pel.ascend(streamID{}, func(id streamID, _ interface{}) bool {
+				r.write(rdbEncodeStreamID(&id))
+				return true
+			})
+		}
+	}
+}
+
+//保存一个key，expiretime为-1表示没有过期时间
+func rdbSaveKeyValuePair(r *rio, key sds, val *robj, expiretime int64) {
+	if expiretime != -1 {
+		rdbSaveType(r, rdbOpcodeExpiretimeMs)
+		rdbSaveMillisecondTime(r, expiretime)
+	}
+
+	//按照淘汰策略保存空闲时间或者访问频率
+	if maxMemoryPolicyIsLru() {
+		rdbSaveType(r, rdbOpcodeIdle)
+		rdbSaveLen(r, estimateObjectIdleTime(val)/1000)
+	}
+	if maxMemoryPolicyIsLfu() {
+		rdbSaveType(r, rdbOpcodeFreq)
+		r.write([]byte{byte(lfuDecrAndReturn(val))})
+	}
+
+	rdbSaveObjectType(r, val)
+	rdbSaveRawString(r, key)
+	rdbSaveObject(r, val)
+}
+
+func rdbSaveAuxField(r *rio, key string, val string) {
+	rdbSaveType(r, rdbOpcodeAux)
+	rdbSaveRawString(r, sds(key))
+	rdbSaveRawString(r, sds(val))
+}
+
+func rdbSaveInfoAuxFields(r *rio, rdbflags int) {
+	aofBase := "0"
+	if rdbflags&rdbFlagsAofPreamble != 0 {
+		aofBase = "1"
+	}
+	rdbSaveAuxField(r, "redis-ver", redisVersion)
+	rdbSaveAuxField(r, "redis-bits", "64")
+	rdbSaveAuxField(r, "ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	rdbSaveAuxField(r, "used-mem", strconv.FormatUint(usedMemory(), 10))
+	rdbSaveAuxField(r, "aof-base", aofBase)
+}
+
+func rdbSaveHeader(r *rio, rdbflags int) {
+	r.write([]byte(fmt.Sprintf("REDIS%04d", redisRdbVersion)))
+	rdbSaveInfoAuxFields(r, rdbflags)
+}
+
+func rdbSaveSelectDb(r *rio, dbid int) {
+	rdbSaveType(r, rdbOpcodeSelectdb)
+	rdbSaveLen(r, uint64(dbid))
+}
+
+func rdbSaveResizeDb(r *rio, dbsize int, expiresSize int) {
+	rdbSaveType(r, rdbOpcodeResizedb)
+	rdbSaveLen(r, uint64(dbsize))
+	rdbSaveLen(r, uint64(expiresSize))
+}
+
+//写入EOF和校验和，关闭校验时校验和为0，加载时不检查
+func rdbSaveTrailer(r *rio) {
+	rdbSaveType(r, rdbOpcodeEOF)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], r.cksum)
+	r.write(buf[:])
+	r.flushBuffer()
+}
+
+//过期字典中key的过期时间，没有过期时间时返回-1
+func rdbGetExpire(expires *dict, key sds) int64 {
+	if expires.used() == 0 {
+		return -1
+	}
+	de := expires.dictFind(key)
+	if de == nil {
+		return -1
+	}
+	return de.(int64)
+}
+
+//生成所有db的RDB数据
+func rdbSaveRio(r *rio, rdbflags int) {
+	rdbSaveHeader(r, rdbflags)
+	for _, db := range server.db {
+		if db.dict.used() == 0 {
+			continue
+		}
+		rdbSaveSelectDb(r, db.id)
+		rdbSaveResizeDb(r, db.dict.used(), db.expires.used())
+		db.dict.dictForEach(func(key interface{}, val interface{}) bool {
+			rdbSaveKeyValuePair(r, key.(sds), val.(*robj), rdbGetExpire(db.expires, key.(sds)))
+			return r.err == nil
+		})
+		if r.err != nil {
+			return
+		}
+	}
+	rdbSaveTrailer(r)
+}
+
+//同步保存RDB文件，先写入临时文件，成功后再重命名，保证RDB文件总是完整的
+func rdbSave(filename string) int {
+	tmpfile := fmt.Sprintf("temp-%d.rdb", server.pid)
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		cwd, _ := os.Getwd()
+		log.Printf("Failed opening the temp RDB file %s (in server root dir %s) for saving: %v", tmpfile, cwd, err)
+		return redisErr
+	}
+
+	r := &rio{flush: func(p []byte) error {
+		_, err := f.Write(p)
+		return err
+	}}
+	rdbSaveRio(r, rdbFlagsNone)
+	err = r.err
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		log.Printf("Write error saving DB on disk: %v", err)
+		os.Remove(tmpfile)
+		return redisErr
+	}
+
+	log.Printf("DB saved on disk")
+	server.dirty = 0
+	server.lastsave = time.Now().Unix()
+	server.lastbgsaveStatus = redisOk
+	return redisOk
+}
+
+//-----------------------------------------------------------------------------
+// Background saving
+//-----------------------------------------------------------------------------
+
+//后台任务的类型，同一时间只能有一个后台任务
+const (
+	redisChildTypeNone = 0
+	redisChildTypeRdb  = 1 //BGSAVE
+	redisChildTypeAof  = 2 //BGREWRITEAOF
+)
+
+//BGSAVE每次定时任务中生成的数据还没有写入文件的部分超过这个值时，暂停遍历key
+const rdbSnapshotMaxPendingBytes = 64 * 1024 * 1024
+
+//BGSAVE和BGREWRITEAOF的快照
+//go不能fork，BGSAVE在定时任务中分多次遍历所有的key，
+//key被访问或者修改之前，如果还没有保存，先保存它当前的值（写时复制），
+//这样文件中保存的是BGSAVE开始时的数据。生成数据在事件循环中完成，
+//写文件和fsync在单独的goroutine中完成，不会阻塞事件循环
+type rdbSnapshot struct {
+	rdb       *rio
+	queue     *rdbWriteQueue
+	dicts     []*dict            //BGSAVE开始时每个db的dict
+	expires   []*dict            //BGSAVE开始时每个db的过期字典
+	dictIndex map[*dict]int      //dict对应的db编号，SWAPDB之后db中的dict会交换
+	processed []map[sds]struct{} //每个db中已经处理过的key
+	dbid      int                //正在遍历的db
+	cursor    uint64             //正在遍历的db的游标
+	dbStarted bool               //是否已经开始遍历dbid
+	curdb     int                //最后一次SELECTDB的db
+	finished  bool               //所有的数据都已经交给写文件的goroutine
+	tmpfile   string             //写入的临时文件
+	done      chan error         //写文件的goroutine结束时发送结果
+}
+
+//事件循环生成的RDB数据通过这个队列交给写文件的goroutine，写入队列不会阻塞
+type rdbWriteQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	chunks  [][]byte
+	pending int  //队列中的字节数
+	closed  bool //数据已经全部写入队列
+	aborted bool //放弃保存
+}
+
+func newRdbWriteQueue() *rdbWriteQueue {
+	q := &rdbWriteQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *rdbWriteQueue) push(p []byte) {
+	q.mu.Lock()
+	q.chunks = append(q.chunks, p)
+	q.pending += len(p)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+//取出队列中的所有数据，队列为空时等待，没有更多的数据时返回false
+func (q *rdbWriteQueue) pop() ([][]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.chunks) == 0 && !q.closed && !q.aborted {
+		q.cond.Wait()
+	}
+	if q.aborted || len(q.chunks) == 0 {
+		return nil, false
+	}
+	chunks := q.chunks
+	q.chunks = nil
+	q.pending = 0
+	return chunks, true
+}
+
+func (q *rdbWriteQueue) pendingBytes() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+func (q *rdbWriteQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *rdbWriteQueue) abort() {
+	q.mu.Lock()
+	q.aborted = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *rdbWriteQueue) isAborted() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.aborted
+}
+
+//写文件的goroutine，写入临时文件，完成后重命名为filename，filename为空时由结束的回调处理临时文件
+func rdbSnapshotWriter(q *rdbWriteQueue, tmpfile string, filename string, done chan<- error) {
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		cwd, _ := os.Getwd()
+		err = fmt.Errorf("failed opening the temp RDB file %s (in server root dir %s) for saving: %v", tmpfile, cwd, err)
+	}
+	//出错之后继续读取队列，直到事件循环结束保存
+	for {
+		chunks, ok := q.pop()
+		if !ok {
+			break
+		}
+		for _, p := range chunks {
+			if err == nil {
+				_, err = f.Write(p)
+			}
+		}
+	}
+
+	aborted := q.isAborted()
+	if f != nil {
+		if err == nil && !aborted {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if aborted && err == nil {
+		err = errors.New("background saving aborted")
+	}
+	if err == nil && filename != "" {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	done <- err
+}
+
+//是否有正在执行的后台任务
+func hasActiveChildProcess() bool {
+	return server.rdbSnapshot != nil
+}
+
+//后台任务结束或者被放弃后调用
+func resetChildState() {
+	server.rdbSnapshot = nil
+	server.childType = redisChildTypeNone
+}
+
+//创建当前数据的快照，在定时任务中生成RDB数据写入tmpfile
+func rdbSnapshotCreate(childType int, tmpfile string, filename string, rdbflags int) {
+	s := &rdbSnapshot{
+		queue:     newRdbWriteQueue(),
+		dicts:     make([]*dict, server.dbnum),
+		expires:   make([]*dict, server.dbnum),
+		dictIndex: make(map[*dict]int, server.dbnum),
+		processed: make([]map[sds]struct{}, server.dbnum),
+		curdb:     -1,
+		tmpfile:   tmpfile,
+		done:      make(chan error, 1),
+	}
+	for j, db := range server.db {
+		s.dicts[j] = db.dict
+		s.expires[j] = db.expires
+		s.dictIndex[db.dict] = j
+		s.processed[j] = make(map[sds]struct{})
+	}
+	s.rdb = &rio{flush: func(p []byte) error {
+		s.queue.push(p)
+		return nil
+	}}
+	rdbSaveHeader(s.rdb, rdbflags)
+	go rdbSnapshotWriter(s.queue, tmpfile, filename, s.done)
+
+	server.rdbSnapshot = s
+	server.childType = childType
+}
+
+//开始BGSAVE，已经有后台任务在执行时返回redisErr
+func rdbSaveBackground(filename string) int {
+	if hasActiveChildProcess() {
+		return redisErr
+	}
+	server.dirtyBeforeBgsave = server.dirty
+	server.lastbgsaveTry = time.Now().Unix()
+
+	tmpfile := fmt.Sprintf("temp-%d-%d.rdb", server.pid, ustime())
+	rdbSnapshotCreate(redisChildTypeRdb, tmpfile, filename, rdbFlagsNone)
+	server.rdbSaveTimeStart = time.Now().Unix()
+	log.Printf("Background saving started")
+	return redisOk
+}
+
+//保存快照中dbid的一个key
+func (s *rdbSnapshot) saveKey(dbid int, key sds, val *robj) {
+	if s.curdb != dbid {
+		rdbSaveSelectDb(s.rdb, dbid)
+		s.curdb = dbid
+	}
+	rdbSaveKeyValuePair(s.rdb, key, val, rdbGetExpire(s.expires[dbid], key))
+}
+
+//key被访问或者修改之前调用，BGSAVE还没有保存这个key时，先保存它当前的值
+//BGSAVE开始之后才添加的key也会被标记为已处理，之后遍历到时不会保存
+func rdbSnapshotTouchKey(db *redisDb, key sds) {
+	s := server.rdbSnapshot
+	if s == nil || s.finished {
+		return
+	}
+	dbid, ok := s.dictIndex[db.dict]
+	if !ok {
+		//BGSAVE开始之后清空db时创建的dict
+		return
+	}
+	if _, ok := s.processed[dbid][key]; ok {
+		return
+	}
+	s.processed[dbid][key] = struct{}{}
+	if val := s.dicts[dbid].dictFind(key); val != nil {
+		s.saveKey(dbid, key, val.(*robj))
+	}
+}
+
+//在定时任务中执行BGSAVE，每次遍历一部分key，timelimit为最长执行时间（微秒）
+func rdbSnapshotStep(timelimit int64) {
+	s := server.rdbSnapshot
+	if s.finished {
+		return
+	}
+	//写文件的速度跟不上时暂停遍历，避免占用太多内存
+	if s.queue.pendingBytes() > rdbSnapshotMaxPendingBytes {
+		return
+	}
+
+	start := ustime()
+	for s.dbid < len(s.dicts) {
+		dbid := s.dbid
+		d := s.dicts[dbid]
+		if !s.dbStarted {
+			s.dbStarted = true
+			if d.used() > 0 {
+				rdbSaveSelectDb(s.rdb, dbid)
+				s.curdb = dbid
+				rdbSaveResizeDb(s.rdb, d.used(), s.expires[dbid].used())
+			}
+		}
+		s.cursor = d.dictScan(s.cursor, func(k interface{}, v interface{}) {
+			key := k.(sds)
+			if _, ok := s.processed[dbid][key]; ok {
+				return
+			}
+			s.processed[dbid][key] = struct{}{}
+			s.saveKey(dbid, key, v.(*robj))
+		})
+		if s.cursor == 0 {
+			s.dbid++
+			s.dbStarted = false
+			s.processed[dbid] = nil
+		}
+		if ustime()-start > timelimit {
+			break
+		}
+	}
+
+	if s.dbid == len(s.dicts) {
+		rdbSaveTrailer(s.rdb)
+		s.queue.close()
+		s.finished = true
+	}
+}
+
+//BGSAVE结束后调用
+func backgroundSaveDoneHandler(err error) {
+	now := time.Now().Unix()
+	if err == nil {
+		log.Printf("Background saving terminated with success")
+		server.dirty -= server.dirtyBeforeBgsave
+		server.lastsave = now
+		server.lastbgsaveStatus = redisOk
+	} else {
+		log.Printf("Background saving error: %v", err)
+		server.lastbgsaveStatus = redisErr
+	}
+	server.rdbSaveTimeLast = now - server.rdbSaveTimeStart
+	server.rdbSaveTimeStart = -1
+}
+
+//后台任务的定时任务，遍历一部分key，并检查写文件的goroutine是否已经结束
+//serverCron在ticker goroutine中执行，但是和事件处理一样持有server.mu，
+//遍历和rdbSnapshotTouchKey不会并发，写文件的goroutine只读取队列中已经生成好的数据
+func rdbSnapshotCron() {
+	s := server.rdbSnapshot
+	//最多使用定时任务周期的25%
+	rdbSnapshotStep(1000000 / int64(server.hz) / 4)
+	if !s.finished {
+		return
+	}
+	select {
+	case err := <-s.done:
+		if server.childType == redisChildTypeRdb {
+			backgroundSaveDoneHandler(err)
+		} else {
+			backgroundRewriteDoneHandler(err)
+		}
+		resetChildState()
+	default:
+	}
+}
+
+//放弃正在执行的BGSAVE，删除临时文件
+func killRDBChild() {
+	if server.childType != redisChildTypeRdb {
+		return
+	}
+	server.rdbSnapshot.queue.abort()
+	resetChildState()
+	server.rdbSaveTimeStart = -1
+	log.Printf("Background saving aborted")
+}
+
+//-----------------------------------------------------------------------------
+// Low level loading
+//-----------------------------------------------------------------------------
+
+func rdbLoadType(r *rio) (byte, error) {
+	buf, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+//读取长度，encoded为true时表示特殊编码的字符串，返回值为编码类型
+func rdbLoadLenByRef(r *rio) (uint64, bool, error) {
+	buf, err := r.read(1)
+	if err != nil {
+		return 0, false, err
+	}
+	switch t := buf[0] >> 6; {
+	case t == rdbEncVal:
+		return uint64(buf[0] & 0x3F), true, nil
+	case t == rdb6bitLen:
+		return uint64(buf[0] & 0x3F), false, nil
+	case t == rdb14bitLen:
+		next, err := r.read(1)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(buf[0]&0x3F)<<8 | uint64(next[0]), false, nil
+	case buf[0] == rdb32bitLen:
+		next, err := r.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(next)), false, nil
+	case buf[0] == rdb64bitLen:
+		next, err := r.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(next), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding %d in rdbLoadLen()", buf[0])
+}
+
+func rdbLoadLen(r *rio) (uint64, error) {
+	l, encoded, err := rdbLoadLenByRef(r)
+	if err == nil && encoded {
+		err = errors.New("unexpected encoded length")
+	}
+	return l, err
+}
+
+func rdbLoadMillisecondTime(r *rio) (int64, error) {
+	buf, err := r.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func rdbLoadBinaryDoubleValue(r *rio) (float64, error) {
+	buf, err := r.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+//旧版本RDB中score按照字符串保存，第一个字节为长度，253、254、255分别表示NaN、+inf、-inf
+func rdbLoadDoubleValue(r *rio) (float64, error) {
+	buf, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	switch buf[0] {
+	case 255:
+		return math.Inf(-1), nil
+	case 254:
+		return math.Inf(1), nil
+	case 253:
+		return math.NaN(), nil
+	}
+	s, err := r.read(uint64(buf[0]))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(s), 64)
+}
+
+func rdbLoadIntegerObject(r *rio, enctype uint64) (sds, error) {
+	var v int64
+	switch enctype {
+	case rdbEncInt8:
+		buf, err := r.read(1)
+		if err != nil {
+			return "", err
+		}
+		v = int64(int8(buf[0]))
+	case rdbEncInt16:
+		buf, err := r.read(2)
+		if err != nil {
+			return "", err
+		}
+		v = int64(int16(binary.LittleEndian.Uint16(buf)))
+	case rdbEncInt32:
+		buf, err := r.read(4)
+		if err != nil {
+			return "", err
+		}
+		v = int64(int32(binary.LittleEndian.Uint32(buf)))
+	}
+	return ll2string(v), nil
+}
+
+func rdbLoadLzfStringObject(r *rio) (sds, error) {
+	clen, err := rdbLoadLen(r)
+	if err != nil {
+		return "", err
+	}
+	l, err := rdbLoadLen(r)
+	if err != nil {
+		return "", err
+	}
+	c, err := r.read(clen)
+	if err != nil {
+		return "", err
+	}
+	if l > uint64(math.MaxInt32) {
+		return "", errLzfCorrupt
+	}
+	val, err := lzfDecompress(c, int(l))
+	if err != nil {
+		return "", err
+	}
+	return sds(val), nil
+}
+
+func rdbGenericLoadStringObject(r *rio) (sds, error) {
+	l, encoded, err := rdbLoadLenByRef(r)
+	if err != nil {
+		return "", err
+	}
+	if encoded {
+		switch l {
+		case rdbEncInt8, rdbEncInt16, rdbEncInt32:
+			return rdbLoadIntegerObject(r, l)
+		case rdbEncLzf:
+			return rdbLoadLzfStringObject(r)
+		}
+		return "", fmt.Errorf("unknown RDB string encoding type %d", l)
+	}
+	buf, err := r.read(l)
+	if err != nil {
+		return "", err
+	}
+	return sds(buf), nil
+}
+
+func rdbLoadStreamID(r *rio) (streamID, error) {
+	buf, err := r.read(16)
+	if err != nil {
+		return streamID{}, err
+	}
+	return streamID{ms: binary.BigEndian.Uint64(buf), seq: binary.BigEndian.Uint64(buf[8:])}, nil
+}
+
+//-----------------------------------------------------------------------------
+// Objects loading
+//-----------------------------------------------------------------------------
+
+//向加载中的hash添加field，field或者value太长时转换为hashtable编码
+func rdbLoadHashField(o *robj, field sds, value sds) error {
+	if o.encoding == redisEncodingListpack &&
+		(len(field) > server.hashMaxListpackValue || len(value) > server.hashMaxListpackValue) {
+		hashTypeConvert(o, redisEncodingHt)
+	}
+	if hashTypeSet(o, field, value) {
+		return errors.New("duplicate hash fields detected")
+	}
+	return nil
+}
+
+func rdbLoadZsetElement(o *robj, ele sds, score float64) error {
+	flags, _, ok := zsetAdd(o, score, ele, zaddInNone)
+	if !ok {
+		return errors.New("zset with NAN score detected")
+	}
+	if flags&zaddOutAdded == 0 {
+		return errors.New("duplicate zset fields detected")
+	}
+	return nil
+}
+
+//加载ziplist或者listpack编码的对象中的元素
+func rdbLoadPackedElements(r *rio, typ byte) ([]sds, error) {
+	blob, err := rdbGenericLoadStringObject(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ == rdbTypeListZiplist || typ == rdbTypeZsetZiplist || typ == rdbTypeHashZiplist ||
+		typ == rdbTypeListQuicklist {
+		return zipDecode([]byte(blob))
+	}
+	return lpDecode([]byte(blob))
+}
+
+func lpGetInteger(eles []sds, i int) (int64, error) {
+	if i >= len(eles) {
+		return 0, errListpackCorrupt
+	}
+	v, ok := string2ll(eles[i])
+	if !ok {
+		return 0, errListpackCorrupt
+	}
+	return v, nil
+}
+
+//解析stream的一个listpack节点，把消息添加到s中
+func streamDecodeListpack(s *stream, master streamID, eles []sds) error {
+	count, err := lpGetInteger(eles, 0)
+	if err != nil {
+		return err
+	}
+	deleted, err := lpGetInteger(eles, 1)
+	if err != nil {
+		return err
+	}
+	numMasterFields, err := lpGetInteger(eles, 2)
+	if err != nil || numMasterFields < 0 || int(numMasterFields)+4 > len(eles) {
+		return errListpackCorrupt
+	}
+	masterFields := eles[3 : 3+numMasterFields]
+	p := 4 + int(numMasterFields)
+
+	var entries int64
+	for p < len(eles) {
+		flags, err := lpGetInteger(eles, p)
+		if err != nil {
+			return err
+		}
+		msDiff, err := lpGetInteger(eles, p+1)
+		if err != nil {
+			return err
+		}
+		seqDiff, err := lpGetInteger(eles, p+2)
+		if err != nil {
+			return err
+		}
+		p += 3
+
+		var fields []sds
+		if flags&streamItemFlagSamefields != 0 {
+			if p+len(masterFields) > len(eles) {
+				return errListpackCorrupt
+			}
+			fields = make([]sds, 0, len(masterFields)*2)
+			for i, f := range masterFields {
+				fields = append(fields, f, eles[p+i])
+			}
+			p += len(masterFields)
+		} else {
+			numfields, err := lpGetInteger(eles, p)
+			if err != nil || numfields < 0 || p+1+int(numfields)*2 > len(eles) {
+				return errListpackCorrupt
+			}
+			fields = append([]sds(nil), eles[p+1:p+1+int(numfields)*2]...)
+			p += 1 + int(numfields)*2
+		}
+		//lp-count
+		if _, err := lpGetInteger(eles, p); err != nil {
+			return err
+		}
+		p++
+
+		entries++
+		if flags&streamItemFlagDeleted != 0 {
+			continue
+		}
+		id := streamID{ms: master.ms + uint64(msDiff), seq: master.seq + uint64(seqDiff)}
+		if !s.rax.insert(id, fields) {
+			return errors.New("duplicate stream entry detected")
+		}
+	}
+	if entries != count+deleted {
+		return errListpackCorrupt
+	}
+	return nil
+}
+
+func rdbLoadStreamObject(r *rio, typ byte) (*robj, error) {
+	o := createStreamObject()
+	s := o.ptr.(*stream)
+
+	nodes, err := rdbLoadLen(r)
+	if err != nil {
+		return nil, err
+	}
+	for ; nodes > 0; nodes-- {
+		nodekey, err := rdbGenericLoadStringObject(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(nodekey) != 16 {
+			return nil, errors.New("stream node key entry is not the size of a stream ID")
+		}
+		eles, err := rdbLoadPackedElements(r, typ)
+		if err != nil {
+			return nil, err
+		}
+		if len(eles) == 0 {
+			return nil, errors.New("empty listpack inside stream")
+		}
+		master := streamID{ms: binary.BigEndian.Uint64([]byte(nodekey)), seq: binary.BigEndian.Uint64([]byte(nodekey[8:]))}
+		if err := streamDecodeListpack(s, master, eles); err != nil {
+			return nil, err
+		}
+	}
+
+	var v [8]uint64
+	n := 3
+	if typ >= rdbTypeStreamListpacks2 {
+		n = 8
+	}
+	for i := 0; i < n; i++ {
+		if v[i], err = rdbLoadLen(r); err != nil {
+			return nil, err
+		}
+	}
+	s.length = v[0]
+	s.lastID = streamID{ms: v[1], seq: v[2]}
+	if typ >= rdbTypeStreamListpacks2 {
+		s.firstID = streamID{ms: v[3], seq: v[4]}
+		s.maxDeletedEntryID = streamID{ms: v[5], seq: v[6]}
+		s.entriesAdded = v[7]
+	} else {
+		//旧版本没有保存这些信息
+		streamUpdateFirstID(s)
+		s.entriesAdded = s.length
+	}
+	if s.length != uint64(s.rax.length) {
+		return nil, errors.New("stream length inconsistent with the number of entries")
+	}
+
+	//消费组
+	ngroups, err := rdbLoadLen(r)
+	if err != nil {
+		return nil, err
+	}
+	for ; ngroups > 0; ngroups-- {
+		name, err := rdbGenericLoadStringObject(r)
+		if err != nil {
+			return nil, err
+		}
+		var cgID streamID
+		if cgID.ms, err = rdbLoadLen(r); err != nil {
+			return nil, err
+		}
+		if cgID.seq, err = rdbLoadLen(r); err != nil {
+			return nil, err
+		}
+		var entriesRead int64
+		if typ >= rdbTypeStreamListpacks2 {
+			offset, err := rdbLoadLen(r)
+			if err != nil {
+				return nil, err
+			}
+			entriesRead = int64(offset)
+		} else {
+			entriesRead = streamEstimateDistanceFromFirstEverEntry(s, &cgID)
+		}
+		cg := streamCreateCG(s, name, cgID, entriesRead)
+		if cg == nil {
+			return nil, fmt.Errorf("duplicated consumer group name %s", name)
+		}
+
+		//消费组的PEL，consumer在加载消费者时设置
+		pelSize, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		for ; pelSize > 0; pelSize-- {
+			id, err := rdbLoadStreamID(r)
+			if err != nil {
+				return nil, err
+			}
+			nack := &streamNACK{}
+			if nack.deliveryTime, err = rdbLoadMillisecondTime(r); err != nil {
+				return nil, err
+			}
+			if nack.deliveryCount, err = rdbLoadLen(r); err != nil {
+				return nil, err
+			}
+			if !cg.pel.insert(id, nack) {
+				return nil, errors.New("duplicated global PEL entry loading stream consumer group")
+			}
+		}
+
+		nconsumers, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		for ; nconsumers > 0; nconsumers-- {
+			cname, err := rdbGenericLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			consumer := streamCreateConsumer(cg, cname)
+			if consumer == nil {
+				return nil, fmt.Errorf("duplicate stream consumer detected")
+			}
+			if consumer.seenTime, err = rdbLoadMillisecondTime(r); err != nil {
+				return nil, err
+			}
+			pelSize, err := rdbLoadLen(r)
+			if err != nil {
+				return nil, err
+			}
+			for ; pelSize > 0; pelSize-- {
+				id, err := rdbLoadStreamID(r)
+				if err != nil {
+					return nil, err
+				}
+				nack, ok := cg.pel.find(id)
+				if !ok {
+					return nil, errors.New("consumer entry not found in group global PEL")
+				}
+				nack.(*streamNACK).consumer = consumer
+				if !consumer.pel.insert(id, nack) {
+					return nil, errors.New("duplicated consumer PEL entry loading a stream consumer group")
+				}
+			}
+		}
+
+		//每个NACK都必须属于一个消费者
+		var orphan bool
+		cg.pel.ascend(streamID{}, func(_ streamID, value interface{}) bool {
+			orphan = value.(*streamNACK).consumer == nil
+			return !orphan
+		})
+		if orphan {
+			return nil, errors.New("stream CG PEL entry without consumer")
+		}
+	}
+	return o, nil
+}
+
+//加载一个对象，集合类型为空时返回nil，这个key会被跳过
+func rdbLoadObject(typ byte, r *rio) (*robj, error) {
+	var o *robj
+	switch typ {
+	case rdbTypeString:
+		s, err := rdbGenericLoadStringObject(r)
+		if err != nil {
+			return nil, err
+		}
+		return tryObjectEncoding(createStringObject(s)), nil
+	case rdbTypeList:
+		n, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		o = createListObject()
+		for ; n > 0; n-- {
+			s, err := rdbGenericLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			listTypePush(o, s, redisTail)
+		}
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		n, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		o = createListObject()
+		for ; n > 0; n-- {
+			container := uint64(quicklistNodeContainerPacked)
+			if typ == rdbTypeListQuicklist2 {
+				if container, err = rdbLoadLen(r); err != nil {
+					return nil, err
+				}
+				if container != quicklistNodeContainerPlain && container != quicklistNodeContainerPacked {
+					return nil, fmt.Errorf("quicklist integrity check failed")
+				}
+			}
+			if container == quicklistNodeContainerPlain {
+				s, err := rdbGenericLoadStringObject(r)
+				if err != nil {
+					return nil, err
+				}
+				listTypePush(o, s, redisTail)
+				continue
+			}
+			eles, err := rdbLoadPackedElements(r, typ)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range eles {
+				listTypePush(o, s, redisTail)
+			}
+		}
+	case rdbTypeListZiplist:
+		eles, err := rdbLoadPackedElements(r, typ)
+		if err != nil {
+			return nil, err
+		}
+		o = createListObject()
+		for _, s := range eles {
+			listTypePush(o, s, redisTail)
+		}
+	case rdbTypeSet:
+		n, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		if n <= uint64(server.setMaxIntsetEntries) {
+			o = createIntsetObject()
+		} else {
+			o = createSetObject()
+			o.ptr.(*dict).dictExpand(n)
+		}
+		for ; n > 0; n-- {
+			s, err := rdbGenericLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			if !setTypeAdd(o, s) {
+				return nil, errors.New("duplicate set members detected")
+			}
+		}
+	case rdbTypeSetIntset:
+		blob, err := rdbGenericLoadStringObject(r)
+		if err != nil {
+			return nil, err
+		}
+		is, err := intsetDecode([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		o = createIntsetObject()
+		o.ptr = &is
+		if is.intsetLen() > server.setMaxIntsetEntries {
+			setTypeConvert(o, redisEncodingHt)
+		}
+	case rdbTypeZset, rdbTypeZset2:
+		n, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		o = zsetTypeCreate(int(n), 0)
+		for ; n > 0; n-- {
+			ele, err := rdbGenericLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if typ == rdbTypeZset2 {
+				score, err = rdbLoadBinaryDoubleValue(r)
+			} else {
+				score, err = rdbLoadDoubleValue(r)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := rdbLoadZsetElement(o, ele, score); err != nil {
+				return nil, err
+			}
+		}
+	case rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		eles, err := rdbLoadPackedElements(r, typ)
+		if err != nil {
+			return nil, err
+		}
+		if len(eles)%2 != 0 {
+			return nil, errors.New("zset listpack integrity check failed")
+		}
+		o = zsetTypeCreate(len(eles)/2, 0)
+		for i := 0; i < len(eles); i += 2 {
+			score, err := strconv.ParseFloat(string(eles[i+1]), 64)
+			if err != nil {
+				return nil, err
+			}
+			if err := rdbLoadZsetElement(o, eles[i], score); err != nil {
+				return nil, err
+			}
+		}
+	case rdbTypeHash:
+		n, err := rdbLoadLen(r)
+		if err != nil {
+			return nil, err
+		}
+		o = createHashObject()
+		if n > uint64(server.hashMaxListpackEntries) {
+			hashTypeConvert(o, redisEncodingHt)
+		}
+		for ; n > 0; n-- {
+			field, err := rdbGenericLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			value, err := rdbGenericLoadStringObject(r)
+			if err != nil {
+				return nil, err
+			}
+			if err := rdbLoadHashField(o, field, value); err != nil {
+				return nil, err
+			}
+		}
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		eles, err := rdbLoadPackedElements(r, typ)
+		if err != nil {
+			return nil, err
+		}
+		if len(eles)%2 != 0 {
+			return nil, errors.New("hash listpack integrity check failed")
+		}
+		o = createHashObject()
+		if len(eles)/2 > server.hashMaxListpackEntries {
+			hashTypeConvert(o, redisEncodingHt)
+		}
+		for i := 0; i < len(eles); i += 2 {
+			if err := rdbLoadHashField(o, eles[i], eles[i+1]); err != nil {
+				return nil, err
+			}
+		}
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2:
+		return rdbLoadStreamObject(r, typ)
+	default:
+		return nil, fmt.Errorf("unknown RDB encoding type %d", typ)
+	}
+
+	//空的集合不加载
+	var empty bool
+	switch o.rtype {
+	case redisList:
+		empty = listTypeLength(o) == 0
+	case redisSet:
+		empty = setTypeSize(o) == 0
+	case redisZset:
+		empty = zsetLength(o) == 0
+	case redisHash:
+		empty = hashTypeLength(o) == 0
+	}
+	if empty {
+		return nil, nil
+	}
+	return o, nil
+}
+
+//-----------------------------------------------------------------------------
+// RDB loading
+//-----------------------------------------------------------------------------
+
+//加载RDB数据
+func rdbLoadRio(r *rio) error {
+	buf, err := r.read(9)
+	if err != nil {
+		return err
+	}
+	if string(buf[:5]) != "REDIS" {
+		return errors.New("wrong signature trying to load DB from file")
+	}
+	rdbver, err := strconv.Atoi(string(buf[5:]))
+	if err != nil || rdbver < 1 || rdbver > redisRdbVersion {
+		return fmt.Errorf("can't handle RDB format version %s", buf[5:])
+	}
+
+	db := server.db[0]
+	now := mstime()
+	lruclock := lruClock()
+	var expiretime, lruIdle, lfuFreq int64 = -1, -1, -1
+	for {
+		typ, err := rdbLoadType(r)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case rdbOpcodeExpiretime:
+			buf, err := r.read(4)
+			if err != nil {
+				return err
+			}
+			expiretime = int64(int32(binary.LittleEndian.Uint32(buf))) * 1000
+			continue
+		case rdbOpcodeExpiretimeMs:
+			if expiretime, err = rdbLoadMillisecondTime(r); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeFreq:
+			buf, err := r.read(1)
+			if err != nil {
+				return err
+			}
+			lfuFreq = int64(buf[0])
+			continue
+		case rdbOpcodeIdle:
+			idle, err := rdbLoadLen(r)
+			if err != nil {
+				return err
+			}
+			lruIdle = int64(idle)
+			continue
+		case rdbOpcodeSelectdb:
+			dbid, err := rdbLoadLen(r)
+			if err != nil {
+				return err
+			}
+			if dbid >= uint64(server.dbnum) {
+				return fmt.Errorf("data file was created with a Redis server configured to handle more than %d databases", server.dbnum)
+			}
+			db = server.db[dbid]
+			continue
+		case rdbOpcodeResizedb:
+			dbsize, err := rdbLoadLen(r)
+			if err != nil {
+				return err
+			}
+			expiresSize, err := rdbLoadLen(r)
+			if err != nil {
+				return err
+			}
+			db.dict.dictExpand(dbsize)
+			db.expires.dictExpand(expiresSize)
+			continue
+		case rdbOpcodeAux:
+			auxkey, err := rdbGenericLoadStringObject(r)
+			if err != nil {
+				return err
+			}
+			auxval, err := rdbGenericLoadStringObject(r)
+			if err != nil {
+				return err
+			}
+			switch auxkey {
+			case "redis-ver":
+				log.Printf("Loading RDB produced by version %s", auxval)
+			case "ctime":
+				if ctime, ok := string2ll(auxval); ok {
+					age := now/1000 - ctime
+					if age < 0 {
+						age = 0
+					}
+					log.Printf("RDB age %d seconds", age)
+				}
+			case "used-mem":
+				if usedmem, ok := string2ll(auxval); ok {
+					log.Printf("RDB memory usage when created %.2f Mb", float64(usedmem)/(1024*1024))
+				}
+			}
+			continue
+		case rdbOpcodeModuleAux, rdbOpcodeFunction, rdbOpcodeFunction2, rdbTypeModule2:
+			return fmt.Errorf("unsupported RDB opcode %d, modules and functions are not supported", typ)
+		case rdbOpcodeEOF:
+		default:
+			key, err := rdbGenericLoadStringObject(r)
+			if err != nil {
+				return err
+			}
+			val, err := rdbLoadObject(typ, r)
+			if err != nil {
+				return fmt.Errorf("error loading key '%s': %v", key, err)
+			}
+
+			//空的集合和已经过期的key不加载
+			if val != nil && (expiretime == -1 || expiretime >= now) {
+				if db.dict.dictAdd(key, val) != dictOk {
+					return fmt.Errorf("duplicate key '%s' found in RDB file", key)
+				}
+				if expiretime != -1 {
+					db.expires.dictReplace(key, expiretime)
+				}
+				objectSetLRUOrLFU(val, lfuFreq, lruIdle, lruclock)
+			}
+			expiretime, lruIdle, lfuFreq = -1, -1, -1
+			continue
+		}
+		break
+	}
+
+	//版本5开始在EOF之后保存了校验和
+	if rdbver >= 5 {
+		expected := r.cksum
+		buf, err := r.read(8)
+		if err != nil {
+			return err
+		}
+		cksum := binary.LittleEndian.Uint64(buf)
+		if server.rdbChecksum && cksum != 0 && cksum != expected {
+			return fmt.Errorf("wrong RDB checksum expected: (%x) got (%x)", cksum, expected)
+		}
+	}
+	return nil
+}
+
+//加载RDB文件
+func rdbLoad(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := &rio{reader: bufio.NewReaderSize(f, rioBufferSize), size: fi.Size()}
+	return rdbLoadRio(r)
+}
+
+//启动时加载AOF或者RDB文件，文件不存在时使用空的数据集
+func loadDataFromDisk() {
+	start := ustime()
+	//开启了AOF时只从AOF加载，AOF的数据总是比RDB新
+	if server.aofState == redisAofOn {
+		ret := loadAppendOnlyFiles(server.aofManifest)
+		if ret == aofFailed || ret == aofOpenErr {
+			log.Fatalf("Fatal error loading the append only files. Exiting.")
+		}
+		if ret != aofNotExist {
+			log.Printf("DB loaded from append only file: %.3f seconds", float64(ustime()-start)/1000000)
+		}
+		//加载的数据已经在AOF中了
+		server.dirty = 0
+		return
+	}
+	err := rdbLoad(server.rdbFilename)
+	if err == nil {
+		log.Printf("DB loaded from disk: %.3f seconds", float64(ustime()-start)/1000000)
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Fatal error loading the DB: %v. Exiting.", err)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// Commands
+//-----------------------------------------------------------------------------
+
+//SAVE
+func saveCommand(client *redisClient) {
+	if server.childType == redisChildTypeRdb {
+		addReplyError(client, "Background save already in progress")
+		return
+	}
+	if rdbSave(server.rdbFilename) == redisOk {
+		addReply(client, shared.ok)
+	} else {
+		addReply(client, shared.err)
+	}
+}
+
+//BGSAVE [SCHEDULE]
+func bgsaveCommand(client *redisClient) {
+	schedule := false
+	if client.argc > 1 {
+		if client.argc != 2 || !strings.EqualFold(string(client.argv[1].ptr.(sds)), "schedule") {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+		schedule = true
+	}
+
+	if server.childType == redisChildTypeRdb {
+		addReplyError(client, "Background save already in progress")
+	} else if hasActiveChildProcess() || server.inExec {
+		//正在执行BGREWRITEAOF时，SCHEDULE在定时任务中等它结束之后再开始BGSAVE
+		//在事务中开始的快照会包含事务中前面命令的修改，总是等事务结束之后再开始
+		if schedule || server.inExec {
+			server.rdbBgsaveScheduled = true
+			addReplyStatus(client, "Background saving scheduled")
+		} else {
+			addReplyError(client, "Another child process is active (AOF?): can't BGSAVE right now. "+
+				"Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible.")
+		}
+	} else if rdbSaveBackground(server.rdbFilename) == redisOk {
+		addReplyStatus(client, "Background saving started")
+	} else {
+		addReply(client, shared.err)
+	}
+}
+
+//LASTSAVE
+func lastsaveCommand(client *redisClient) {
+	addReplyLongLong(client, server.lastsave)
+}
@@ -1,9 +1,15 @@
 package redis
 
 import (
+	"container/list"
+	"crypto/subtle"
 	"github.com/panjf2000/gnet"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -12,9 +18,58 @@ const (
 	redisErr = -1
 )
 
+const redisVersion = "7.0.0"
+
+//command flags
+const (
+	redisCmdWrite    = 1 << 0  //"w" flag
+	redisCmdReadonly = 1 << 1  //"r" flag
+	redisCmdDenyoom  = 1 << 2  //"m" flag
+	redisCmdAdmin    = 1 << 4  //"a" flag
+	redisCmdPubsub   = 1 << 5  //"p" flag
+	redisCmdNoscript = 1 << 6  //"s" flag
+	redisCmdRandom   = 1 << 7  //"R" flag
+	redisCmdLoading  = 1 << 9  //"l" flag
+	redisCmdStale    = 1 << 10 //"t" flag
+	redisCmdFast     = 1 << 13 //"F" flag
+)
+
 //client flags
 const (
+	redisMulti           = 1 << 3 //客户端在MULTI中
+	redisBlocked         = 1 << 4 //客户端被阻塞命令阻塞了
+	redisDirtyCas        = 1 << 5 //WATCH的key被修改了，EXEC会失败
 	redisCloseAfterReply = 1 << 6
+	redisUnblocked       = 1 << 7  //客户端被唤醒了，需要继续处理缓冲区中的命令
+	redisCloseAsap       = 1 << 10 //在beforeSleep或serverCron中尽快关闭客户端
+	redisDirtyExec       = 1 << 12 //事务排队时出错，EXEC会失败
+	redisForceAof        = 1 << 14 //即使没有修改数据也要传播到AOF
+	redisPubsub          = 1 << 18 //客户端订阅了channel或pattern
+	redisPreventAofProp  = 1 << 19 //不传播到AOF，命令自己传播了改写后的命令
+	redisPendingWrite    = 1 << 21 //客户端有待发送的回复数据
+	redisDenyBlocking    = 1 << 41 //客户端不能被阻塞，比如加载AOF的伪客户端
+)
+
+//call() flags
+const (
+	redisCallNone         = 0
+	redisCallPropagateAof = 1 << 2 //修改了数据的命令需要传播到AOF
+	redisCallFull         = redisCallPropagateAof
+)
+
+//writeCommandsDeniedByDiskError的返回值
+const (
+	diskErrorTypeNone = 0
+	diskErrorTypeRdb  = 1
+	diskErrorTypeAof  = 2
+)
+
+//client types，用来区分客户端输出缓冲区的限制
+const (
+	redisClientTypeNormal = 0
+	redisClientTypeSlave  = 1
+	redisClientTypePubsub = 2
+	redisClientTypeCount  = 3
 )
 
 const (
@@ -28,15 +83,39 @@ const (
 	redisReqInline    = 1
 	redisReqMultibulk = 2
 
+	redisInlineMaxSize = 1024 * 64         //inline请求和bulk长度行的最大长度
+	redisMaxBulkLen    = 512 * 1024 * 1024 //单个bulk参数的最大长度
+	redisIoBufLen      = 1024 * 16         //查询缓冲区中剩余的数据小于这个长度时，复制到新的缓冲区
+
 	redisString uint8 = 0
 	redisList   uint8 = 1
+	redisSet    uint8 = 2
+	redisZset   uint8 = 3
+	redisHash   uint8 = 4
+	redisStream uint8 = 6
 
 	redisMaxWritePerEvent = 1024 * 64
+	redisReplyChunkBytes  = 16 * 1024 //client固定回复缓冲区和回复链表每个节点的大小
 
 	activeExpireCycleLookupsPerLoop = 20
 	activeExpireCycleSlowTimeperc   = 25
 
+	hashtableMinFill = 10 //hash表的最小使用率，低于时缩小hash表
+	cronDbsPerCall   = 16 //每次定时任务最多处理的db数量
+
+	redisDefaultDbnum = 16
+
 	redisDefaultMaxMemorySamples = 5
+
+	redisDefaultHashMaxListpackEntries = 128
+	redisDefaultHashMaxListpackValue   = 64
+	redisDefaultSetMaxIntsetEntries    = 512
+	redisDefaultZsetMaxListpackEntries = 128
+	redisDefaultZsetMaxListpackValue   = 64
+	redisDefaultHllSparseMaxBytes      = 3000
+
+	redisDefaultRdbFilename = "dump.rdb"
+	redisBgsaveRetryDelay   = 5 //BGSAVE失败后等待多少秒再根据save配置重试
 )
 
 const (
@@ -46,17 +125,220 @@ const (
 	redisMaxMemoryAllKeysLru     = 3
 	redisMaxMemoryAllKeysRandom  = 4
 	redisMaxMemoryNoEviction     = 5
+	redisMaxMemoryVolatileLfu    = 6
+	redisMaxMemoryAllKeysLfu     = 7
 	redisDefaultMaxMemoryPolicy  = redisMaxMemoryNoEviction
 )
 
+//LFU，对象的lru字段高16位为最后一次访问的时间（分钟），低8位为对数计数器
+const (
+	redisLfuInitVal          = 5 //新对象的计数器，避免新的key马上被淘汰
+	redisDefaultLfuLogFactor = 10
+	redisDefaultLfuDecayTime = 1
+)
+
 var (
 	shared *sharedObjectsStruct
 
+	//arity: 参数数量（包括命令名称），负数表示参数数量 >= -arity
+	//sflags: 命令标记，每个字符表示一个标记
+	//  w: 写命令
+	//  r: 读命令
+	//  m: 可能会占用更多内存，内存超过maxmemory时拒绝执行
+	//  a: 管理命令
+	//  p: pubsub相关命令
+	//  s: 不能在脚本中执行
+	//  R: 随机命令，相同的参数和数据可能返回不同的结果
+	//  l: 加载数据时可以执行
+	//  t: 从节点数据过期时可以执行
+	//  F: 快速命令，时间复杂度为O(1)或O(log(N))
 	redisCommandTable = []*redisCommand{
-		{sds("get"), getCommand},
-		{sds("set"), setCommand},
-		{sds("expire"), expireCommand},
-		{sds("ttl"), ttlCommand},
+		{sds("get"), getCommand, 2, "rF", 0},
+		{sds("set"), setCommand, -3, "wm", 0},
+		{sds("setnx"), setnxCommand, 3, "wmF", 0},
+		{sds("setex"), setexCommand, 4, "wm", 0},
+		{sds("psetex"), psetexCommand, 4, "wm", 0},
+		{sds("getex"), getexCommand, -2, "wF", 0},
+		{sds("getdel"), getdelCommand, 2, "wF", 0},
+		{sds("getset"), getsetCommand, 3, "wm", 0},
+		{sds("append"), appendCommand, 3, "wm", 0},
+		{sds("strlen"), strlenCommand, 2, "rF", 0},
+		{sds("setrange"), setrangeCommand, 4, "wm", 0},
+		{sds("getrange"), getrangeCommand, 4, "r", 0},
+		{sds("substr"), getrangeCommand, 4, "r", 0},
+		{sds("incr"), incrCommand, 2, "wmF", 0},
+		{sds("decr"), decrCommand, 2, "wmF", 0},
+		{sds("incrby"), incrbyCommand, 3, "wmF", 0},
+		{sds("decrby"), decrbyCommand, 3, "wmF", 0},
+		{sds("incrbyfloat"), incrbyfloatCommand, 3, "wmF", 0},
+		{sds("mget"), mgetCommand, -2, "rF", 0},
+		{sds("mset"), msetCommand, -3, "wm", 0},
+		{sds("msetnx"), msetnxCommand, -3, "wm", 0},
+		{sds("lcs"), lcsCommand, -3, "r", 0},
+		{sds("setbit"), setbitCommand, 4, "wm", 0},
+		{sds("getbit"), getbitCommand, 3, "rF", 0},
+		{sds("bitcount"), bitcountCommand, -2, "r", 0},
+		{sds("bitpos"), bitposCommand, -3, "r", 0},
+		{sds("bitop"), bitopCommand, -4, "wm", 0},
+		{sds("bitfield"), bitfieldCommand, -2, "wm", 0},
+		{sds("bitfield_ro"), bitfieldCommand, -2, "rF", 0},
+		{sds("pfadd"), pfaddCommand, -2, "wmF", 0},
+		{sds("pfcount"), pfcountCommand, -2, "r", 0},
+		{sds("pfmerge"), pfmergeCommand, -2, "wm", 0},
+		{sds("pfdebug"), pfdebugCommand, -3, "w", 0},
+		{sds("del"), delCommand, -2, "w", 0},
+		{sds("unlink"), unlinkCommand, -2, "wF", 0},
+		{sds("exists"), existsCommand, -2, "rF", 0},
+		{sds("type"), typeCommand, 2, "rF", 0},
+		{sds("rename"), renameCommand, 3, "w", 0},
+		{sds("renamenx"), renamenxCommand, 3, "wF", 0},
+		{sds("keys"), keysCommand, 2, "rR", 0},
+		{sds("scan"), scanCommand, -2, "rR", 0},
+		{sds("randomkey"), randomkeyCommand, 1, "rR", 0},
+		{sds("dbsize"), dbsizeCommand, 1, "rF", 0},
+		{sds("flushdb"), flushdbCommand, -1, "w", 0},
+		{sds("flushall"), flushallCommand, -1, "w", 0},
+		{sds("touch"), touchCommand, -2, "rF", 0},
+		{sds("copy"), copyCommand, -3, "wm", 0},
+		{sds("select"), selectCommand, 2, "lF", 0},
+		{sds("move"), moveCommand, 3, "wF", 0},
+		{sds("swapdb"), swapdbCommand, 3, "wF", 0},
+		{sds("object"), objectCommand, -2, "rR", 0},
+		{sds("expire"), expireCommand, -3, "wF", 0},
+		{sds("expireat"), expireatCommand, -3, "wF", 0},
+		{sds("pexpire"), pexpireCommand, -3, "wF", 0},
+		{sds("pexpireat"), pexpireatCommand, -3, "wF", 0},
+		{sds("ttl"), ttlCommand, 2, "rF", 0},
+		{sds("pttl"), pttlCommand, 2, "rF", 0},
+		{sds("expiretime"), expiretimeCommand, 2, "rF", 0},
+		{sds("pexpiretime"), pexpiretimeCommand, 2, "rF", 0},
+		{sds("persist"), persistCommand, 2, "wF", 0},
+		{sds("ping"), pingCommand, -1, "tF", 0},
+		{sds("echo"), echoCommand, 2, "F", 0},
+		{sds("hello"), helloCommand, -1, "sltF", 0},
+		{sds("auth"), authCommand, -2, "sltF", 0},
+		{sds("multi"), multiCommand, 1, "sF", 0},
+		{sds("exec"), execCommand, 1, "s", 0},
+		{sds("discard"), discardCommand, 1, "sF", 0},
+		{sds("watch"), watchCommand, -2, "sF", 0},
+		{sds("unwatch"), unwatchCommand, 1, "sF", 0},
+		{sds("subscribe"), subscribeCommand, -2, "pslt", 0},
+		{sds("unsubscribe"), unsubscribeCommand, -1, "pslt", 0},
+		{sds("psubscribe"), psubscribeCommand, -2, "pslt", 0},
+		{sds("punsubscribe"), punsubscribeCommand, -1, "pslt", 0},
+		{sds("publish"), publishCommand, 3, "pltF", 0},
+		{sds("ssubscribe"), ssubscribeCommand, -2, "pslt", 0},
+		{sds("sunsubscribe"), sunsubscribeCommand, -1, "pslt", 0},
+		{sds("spublish"), spublishCommand, 3, "pltF", 0},
+		{sds("pubsub"), pubsubCommand, -2, "pltR", 0},
+		{sds("lpush"), lpushCommand, -3, "wmF", 0},
+		{sds("rpush"), rpushCommand, -3, "wmF", 0},
+		{sds("lpushx"), lpushxCommand, -3, "wmF", 0},
+		{sds("rpushx"), rpushxCommand, -3, "wmF", 0},
+		{sds("lpop"), lpopCommand, -2, "wF", 0},
+		{sds("rpop"), rpopCommand, -2, "wF", 0},
+		{sds("lrange"), lrangeCommand, 4, "r", 0},
+		{sds("lindex"), lindexCommand, 3, "r", 0},
+		{sds("lset"), lsetCommand, 4, "wm", 0},
+		{sds("linsert"), linsertCommand, 5, "wm", 0},
+		{sds("llen"), llenCommand, 2, "rF", 0},
+		{sds("lrem"), lremCommand, 4, "w", 0},
+		{sds("ltrim"), ltrimCommand, 4, "w", 0},
+		{sds("lpos"), lposCommand, -3, "r", 0},
+		{sds("lmove"), lmoveCommand, 5, "wm", 0},
+		{sds("rpoplpush"), rpoplpushCommand, 3, "wm", 0},
+		{sds("lmpop"), lmpopCommand, -4, "w", 0},
+		{sds("blpop"), blpopCommand, -3, "ws", 0},
+		{sds("brpop"), brpopCommand, -3, "ws", 0},
+		{sds("blmove"), blmoveCommand, 6, "wms", 0},
+		{sds("blmpop"), blmpopCommand, -5, "ws", 0},
+		{sds("hset"), hsetCommand, -4, "wmF", 0},
+		{sds("hmset"), hsetCommand, -4, "wmF", 0},
+		{sds("hsetnx"), hsetnxCommand, 4, "wmF", 0},
+		{sds("hget"), hgetCommand, 3, "rF", 0},
+		{sds("hmget"), hmgetCommand, -3, "rF", 0},
+		{sds("hgetall"), hgetallCommand, 2, "rR", 0},
+		{sds("hdel"), hdelCommand, -3, "wF", 0},
+		{sds("hexists"), hexistsCommand, 3, "rF", 0},
+		{sds("hlen"), hlenCommand, 2, "rF", 0},
+		{sds("hkeys"), hkeysCommand, 2, "rR", 0},
+		{sds("hvals"), hvalsCommand, 2, "rR", 0},
+		{sds("hincrby"), hincrbyCommand, 4, "wmF", 0},
+		{sds("hincrbyfloat"), hincrbyfloatCommand, 4, "wmF", 0},
+		{sds("hstrlen"), hstrlenCommand, 3, "rF", 0},
+		{sds("hrandfield"), hrandfieldCommand, -2, "rR", 0},
+		{sds("hscan"), hscanCommand, -3, "rR", 0},
+		{sds("sadd"), saddCommand, -3, "wmF", 0},
+		{sds("srem"), sremCommand, -3, "wF", 0},
+		{sds("smove"), smoveCommand, 4, "wF", 0},
+		{sds("sismember"), sismemberCommand, 3, "rF", 0},
+		{sds("smismember"), smismemberCommand, -3, "rF", 0},
+		{sds("scard"), scardCommand, 2, "rF", 0},
+		{sds("spop"), spopCommand, -2, "wRF", 0},
+		{sds("srandmember"), srandmemberCommand, -2, "rR", 0},
+		{sds("sinter"), sinterCommand, -2, "r", 0},
+		{sds("sintercard"), sintercardCommand, -3, "r", 0},
+		{sds("sinterstore"), sinterstoreCommand, -3, "wm", 0},
+		{sds("sunion"), sunionCommand, -2, "r", 0},
+		{sds("sunionstore"), sunionstoreCommand, -3, "wm", 0},
+		{sds("sdiff"), sdiffCommand, -2, "r", 0},
+		{sds("sdiffstore"), sdiffstoreCommand, -3, "wm", 0},
+		{sds("smembers"), sinterCommand, 2, "r", 0},
+		{sds("sscan"), sscanCommand, -3, "rR", 0},
+		{sds("zadd"), zaddCommand, -4, "wmF", 0},
+		{sds("zincrby"), zincrbyCommand, 4, "wmF", 0},
+		{sds("zrem"), zremCommand, -3, "wF", 0},
+		{sds("zremrangebyscore"), zremrangebyscoreCommand, 4, "w", 0},
+		{sds("zremrangebyrank"), zremrangebyrankCommand, 4, "w", 0},
+		{sds("zremrangebylex"), zremrangebylexCommand, 4, "w", 0},
+		{sds("zunionstore"), zunionstoreCommand, -4, "wm", 0},
+		{sds("zinterstore"), zinterstoreCommand, -4, "wm", 0},
+		{sds("zdiffstore"), zdiffstoreCommand, -4, "wm", 0},
+		{sds("zunion"), zunionCommand, -3, "r", 0},
+		{sds("zinter"), zinterCommand, -3, "r", 0},
+		{sds("zdiff"), zdiffCommand, -3, "r", 0},
+		{sds("zrange"), zrangeCommand, -4, "r", 0},
+		{sds("zrangestore"), zrangestoreCommand, -5, "wm", 0},
+		{sds("zrangebyscore"), zrangebyscoreCommand, -4, "r", 0},
+		{sds("zrevrangebyscore"), zrevrangebyscoreCommand, -4, "r", 0},
+		{sds("zrangebylex"), zrangebylexCommand, -4, "r", 0},
+		{sds("zrevrangebylex"), zrevrangebylexCommand, -4, "r", 0},
+		{sds("zcount"), zcountCommand, 4, "rF", 0},
+		{sds("zlexcount"), zlexcountCommand, 4, "rF", 0},
+		{sds("zrevrange"), zrevrangeCommand, -4, "r", 0},
+		{sds("zcard"), zcardCommand, 2, "rF", 0},
+		{sds("zscore"), zscoreCommand, 3, "rF", 0},
+		{sds("zmscore"), zmscoreCommand, -3, "rF", 0},
+		{sds("zrank"), zrankCommand, 3, "rF", 0},
+		{sds("zrevrank"), zrevrankCommand, 3, "rF", 0},
+		{sds("zpopmin"), zpopminCommand, -2, "wF", 0},
+		{sds("zpopmax"), zpopmaxCommand, -2, "wF", 0},
+		{sds("zscan"), zscanCommand, -3, "rR", 0},
+		{sds("geoadd"), geoaddCommand, -5, "wm", 0},
+		{sds("geosearch"), geosearchCommand, -7, "r", 0},
+		{sds("geosearchstore"), geosearchstoreCommand, -8, "wm", 0},
+		{sds("geohash"), geohashCommand, -2, "r", 0},
+		{sds("geopos"), geoposCommand, -2, "r", 0},
+		{sds("geodist"), geodistCommand, -4, "r", 0},
+		{sds("xadd"), xaddCommand, -5, "wmF", 0},
+		{sds("xrange"), xrangeCommand, -4, "r", 0},
+		{sds("xrevrange"), xrevrangeCommand, -4, "r", 0},
+		{sds("xlen"), xlenCommand, 2, "rF", 0},
+		{sds("xread"), xreadCommand, -4, "rs", 0},
+		{sds("xreadgroup"), xreadCommand, -7, "wms", 0},
+		{sds("xgroup"), xgroupCommand, -2, "wm", 0},
+		{sds("xack"), xackCommand, -4, "wF", 0},
+		{sds("xpending"), xpendingCommand, -3, "r", 0},
+		{sds("xclaim"), xclaimCommand, -6, "wF", 0},
+		{sds("xautoclaim"), xautoclaimCommand, -6, "wF", 0},
+		{sds("xinfo"), xinfoCommand, -2, "rR", 0},
+		{sds("xdel"), xdelCommand, -3, "wF", 0},
+		{sds("xtrim"), xtrimCommand, -4, "w", 0},
+		{sds("save"), saveCommand, 1, "as", 0},
+		{sds("bgsave"), bgsaveCommand, -1, "as", 0},
+		{sds("lastsave"), lastsaveCommand, 1, "RFlt", 0},
+		{sds("bgrewriteaof"), bgrewriteaofCommand, 1, "as", 0},
+		{sds("config"), configCommand, -2, "alt", 0},
 	}
 )
 
@@ -64,9 +346,20 @@ var (
 type redisServer struct {
 	pid int //pid
 
-	hz       int      //hz
-	db       *redisDb //db
-	commands *dict    //redis命令字典，key = sds(命令，比如get/set)， value = *redisCommand
+	//gnet在单独的goroutine中调用Tick，和事件循环的回调并发执行，
+	//所有事件回调和定时任务都要持有这个锁，保证同一时间只有一个在访问server的状态
+	mu sync.Mutex
+
+	hz       int        //hz
+	db       []*redisDb //db数组
+	dbnum    int        //db的数量，由databases配置
+	commands *dict      //redis命令字典，key = sds(命令，比如get/set)， value = *redisCommand
+
+	//定时任务中按顺序轮流处理db，记录下一次处理的db
+	activeExpireCurrentDb     int
+	activeExpireTimelimitExit bool //上一次过期处理是否因为超时退出
+	resizeDb                  int
+	rehashDb                  int
 
 	clientCounter int   //存储client的id计数器
 	clients       *dict //客户端字典， key = id, value = *redisClient
@@ -84,6 +377,110 @@ type redisServer struct {
 	maxMemory        uint64 //max number of memory bytes to use
 	maxMemoryPolicy  int    //policy for key eviction
 	maxMemorySamples int
+	evictionPool     []*evictionPoolEntry //所有db共用的淘汰池
+	evictionNextDb   int                  //随机淘汰时下一个选择的db
+	lfuLogFactor     int                  //LFU计数器增长的对数因子
+	lfuDecayTime     int                  //LFU计数器每经过多少分钟减1
+
+	requirepass string //客户端需要认证的密码，为空表示不需要认证
+
+	notifyKeyspaceEvents int //需要发布的keyspace事件类型，由notify-keyspace-events配置
+
+	//数据结构编码的阈值
+	hashMaxListpackEntries int //hash元素数量超过这个值时转换为hashtable编码
+	hashMaxListpackValue   int //hash中field或value的长度超过这个值时转换为hashtable编码
+	setMaxIntsetEntries    int //intset编码的set元素数量超过这个值时转换为hashtable编码
+	zsetMaxListpackEntries int //zset元素数量超过这个值时转换为skiplist编码
+	zsetMaxListpackValue   int //zset中member的长度超过这个值时转换为skiplist编码
+	hllSparseMaxBytes      int //HyperLogLog的sparse表示超过这个长度时转换为dense表示
+
+	clientObufLimits [redisClientTypeCount]clientBufferLimitsConfig //每种客户端的输出缓冲区限制
+
+	clientsPendingWrite *list.List //有待发送回复数据的客户端
+	clientsToClose      *list.List //需要异步关闭的客户端
+
+	//blocking
+	blockedClients   int        //被阻塞的客户端数量
+	unblockedClients *list.List //被唤醒的客户端，需要继续处理缓冲区中的命令
+	readyKeys        *list.List //有新数据的key，value = *readyList
+
+	//pubsub
+	pubsubChannels      *dict //key = sds(channel), value = *list.List(订阅的客户端)
+	pubsubPatterns      *dict //key = sds(pattern), value = *list.List(订阅的客户端)
+	pubsubShardChannels *dict //key = sds(shard channel), value = *list.List(订阅的客户端)
+
+	//RDB persistence
+	dirty                 int64        //上一次保存之后修改的次数
+	dirtyBeforeBgsave     int64        //BGSAVE开始时的dirty，BGSAVE成功后从dirty中减去
+	saveparams            []saveparam  //save配置的自动保存条件
+	rdbFilename           string       //RDB文件名，由dbfilename配置
+	rdbChecksum           bool         //是否计算和检查RDB文件的校验和
+	stopWritesOnBgsaveErr bool         //BGSAVE失败时是否拒绝写命令
+	rdbSnapshot           *rdbSnapshot //正在执行的BGSAVE或者BGREWRITEAOF，没有时为nil
+	childType             int          //正在执行的后台任务的类型
+	rdbBgsaveScheduled    bool         //BGREWRITEAOF或者事务结束之后需要开始BGSAVE
+	lastsave              int64        //上一次保存成功的时间（秒）
+	lastbgsaveTry         int64        //上一次尝试BGSAVE的时间（秒）
+	lastbgsaveStatus      int          //上一次BGSAVE的结果，redisOk或者redisErr
+	rdbSaveTimeLast       int64        //上一次BGSAVE花费的时间（秒）
+	rdbSaveTimeStart      int64        //当前BGSAVE开始的时间（秒），没有BGSAVE时为-1
+
+	//AOF persistence
+	aofState               int          //redisAofOn或者redisAofOff，由appendonly配置
+	aofFsync               int          //fsync策略，由appendfsync配置
+	aofFilename            string       //AOF文件名的前缀，由appendfilename配置
+	aofDirname             string       //保存AOF文件的目录，由appenddirname配置
+	aofManifest            *aofManifest //AOF目录中的文件列表
+	aofLoadTruncated       bool         //加载时AOF结尾不完整是否可以继续启动
+	aofFile                *os.File     //正在追加的incr文件
+	aofBuf                 []byte       //本轮事件循环中需要写入AOF的数据，在beforeSleep中写入文件
+	aofSelectedDb          int          //AOF中最后一次SELECT的db，-1表示需要重新SELECT
+	aofCurrentSize         int64        //base文件和incr文件的总大小
+	aofLastIncrSize        int64        //正在追加的incr文件的大小
+	aofFsyncOffset         int64        //已经fsync的数据的位置
+	aofLastFsync           int64        //上一次fsync的时间（秒）
+	aofLastWriteStatus     int          //上一次写入AOF的结果，redisOk或者redisErr
+	aofLastWriteErr        error        //上一次写入AOF的错误
+	aofBioFsync            aofBioFsync  //后台fsync的状态
+	aofRewritePerc         int          //AOF比上一次重写之后增长了这个百分比时自动重写，0表示不自动重写
+	aofRewriteMinSize      int64        //AOF超过这个大小时才会自动重写
+	aofRewriteBaseSize     int64        //上一次重写之后AOF的大小
+	aofRewriteScheduled    bool         //BGSAVE或者事务结束之后需要开始BGREWRITEAOF
+	aofRewriteTimeLast     int64        //上一次BGREWRITEAOF花费的时间（秒）
+	aofRewriteTimeStart    int64        //当前BGREWRITEAOF开始的时间（秒），没有BGREWRITEAOF时为-1
+	aofLastbgrewriteStatus int          //上一次BGREWRITEAOF的结果，redisOk或者redisErr
+	loading                bool         //是否正在从磁盘加载数据
+
+	//propagation
+	executionNesting int       //call的嵌套层数，最外层的call结束时才传播命令
+	inExec           bool      //是否正在执行EXEC
+	alsoPropagate    []redisOp //当前执行单元中需要传播的命令
+}
+
+//需要传播到AOF的命令
+type redisOp struct {
+	dbid int
+	argv []*robj
+}
+
+//save <seconds> <changes>，seconds秒内至少有changes次修改时自动BGSAVE
+type saveparam struct {
+	seconds int64
+	changes int64
+}
+
+//客户端输出缓冲区限制
+//超过硬限制立即关闭客户端，超过软限制并持续softLimitSeconds秒后关闭客户端
+type clientBufferLimitsConfig struct {
+	hardLimitBytes   uint64
+	softLimitBytes   uint64
+	softLimitSeconds int64
+}
+
+var clientBufferLimitsDefaults = [redisClientTypeCount]clientBufferLimitsConfig{
+	{0, 0, 0}, //normal
+	{1024 * 1024 * 256, 1024 * 1024 * 64, 60}, //slave
+	{1024 * 1024 * 32, 1024 * 1024 * 8, 60},   //pubsub
 }
 
 type redisClient struct {
@@ -97,20 +494,48 @@ type redisClient struct {
 	cmd     *redisCommand //当前执行的命令
 	lastcmd *redisCommand //最后执行的命令
 
-	reqtype  int //请求类型
-	queryBuf sds //从客户端读到的数据
+	reqtype      int    //请求类型
+	queryBuf     []byte //从客户端读到的数据，未解析完的数据会保留到下一次读事件
+	multibulklen int    //当前multibulk请求中还未读取的参数数量
+	bulklen      int    //当前正在读取的bulk参数的长度，-1表示还未读取到长度
+
+	buf        []byte     //准备发回给客户端的数据，固定大小的缓冲区
+	bufpos     int        //发回给客户端的数据的pos
+	sentlen    int        //已发送的字节数
+	reply      *list.List //固定缓冲区放不下时，回复数据追加到这个链表中，value = *clientReplyBlock
+	replyBytes uint64     //回复链表中数据的总字节数
 
-	buf     []byte //准备发回给客户端的数据
-	bufpos  int    //发回给客户端的数据的pos
-	sentlen int    //已发送的字节数
+	obufSoftLimitReachedTime int64 //输出缓冲区第一次达到软限制的时间（秒）
 
 	flags int //处理标记
+
+	btype int           //阻塞类型
+	bpop  blockingState //阻塞命令的状态
+
+	mstate      multiState //MULTI/EXEC的状态
+	watchedKeys *list.List //WATCH的key，value = *watchedKey
+
+	pubsubChannels      *dict //订阅的channel，key = sds(channel), value = nil
+	pubsubPatterns      *dict //订阅的pattern，key = sds(pattern), value = nil
+	pubsubShardChannels *dict //订阅的shard channel，key = sds(shard channel), value = nil
+
+	resp          int  //协议版本，2或3，通过HELLO命令切换
+	authenticated bool //是否已经认证
+}
+
+//回复链表的节点，数据直接追加到buf中，写满之后再创建新的节点
+type clientReplyBlock struct {
+	buf  []byte //节点的缓冲区，len(buf)为节点的大小
+	used int    //已经使用的字节数
 }
 
 //reids命令结构
 type redisCommand struct {
 	name             sds                       //命令名称
 	redisCommandFunc func(client *redisClient) //命令处理函数
+	arity            int                       //参数数量，负数表示至少需要 -arity 个参数
+	sflags           string                    //字符串形式的命令标记
+	flags            int                       //根据sflags解析出来的标记
 }
 
 type sharedObjectsStruct struct {
@@ -122,6 +547,27 @@ type sharedObjectsStruct struct {
 	czero     *robj
 	cone      *robj
 	oomerr    *robj
+	bgsaveerr *robj
+	noautherr *robj
+	pong      *robj
+	queued    *robj
+
+	execaborterr *robj
+
+	wrongtypeerr  *robj
+	nokeyerr      *robj
+	outofrangeerr *robj
+	emptyarray    *robj
+	emptybulk     *robj
+	emptyscan     *robj
+	sameobjecterr *robj
+	null          [4]*robj //按照协议版本回复空值，null[client.resp]
+	nullarray     [4]*robj //按照协议版本回复空数组，nullarray[client.resp]
+	integers      [redisSharedIntegers]*robj
+
+	//传播到AOF时改写命令使用的参数
+	del, multi, exec, set, keepttl, pxat, pexpireat, persist *robj
+	lpop, rpop, lmove, left, right, srem, hset               *robj
 }
 
 //初始化server配置
@@ -129,10 +575,34 @@ func initServerConfig() {
 	server.port = redisServerPort
 	server.tcpBacklog = redisTcpBacklog
 	server.hz = 10
+	server.dbnum = redisDefaultDbnum
 	server.events = &eventloop{}
 	server.maxMemorySamples = redisDefaultMaxMemorySamples
+	server.lfuLogFactor = redisDefaultLfuLogFactor
+	server.lfuDecayTime = redisDefaultLfuDecayTime
 	server.maxMemoryPolicy = redisMaxMemoryAllKeysLru
 	server.maxMemory = 10
+	server.clientObufLimits = clientBufferLimitsDefaults
+	server.hashMaxListpackEntries = redisDefaultHashMaxListpackEntries
+	server.hashMaxListpackValue = redisDefaultHashMaxListpackValue
+	server.setMaxIntsetEntries = redisDefaultSetMaxIntsetEntries
+	server.zsetMaxListpackEntries = redisDefaultZsetMaxListpackEntries
+	server.zsetMaxListpackValue = redisDefaultZsetMaxListpackValue
+	server.hllSparseMaxBytes = redisDefaultHllSparseMaxBytes
+	server.rdbFilename = redisDefaultRdbFilename
+	server.rdbChecksum = true
+	server.stopWritesOnBgsaveErr = true
+	appendServerSaveParams(60*60, 1)  //1小时内至少1次修改
+	appendServerSaveParams(300, 100)  //5分钟内至少100次修改
+	appendServerSaveParams(60, 10000) //1分钟内至少10000次修改
+	server.aofState = redisAofOff
+	server.aofFsync = redisDefaultAofFsync
+	server.aofFilename = redisDefaultAofFilename
+	server.aofDirname = redisDefaultAofDirname
+	server.aofRewritePerc = redisDefaultAofRewritePerc
+	server.aofRewriteMinSize = redisDefaultAofRewriteMinSize
+	server.aofLoadTruncated = true
+	server.aofSelectedDb = -1
 	populateCommandTable()
 }
 
@@ -141,7 +611,14 @@ func initServer() {
 
 	server.pid = os.Getpid()
 
-	server.clients = &dict{}
+	server.clients = dictCreate()
+	server.clientsPendingWrite = list.New()
+	server.clientsToClose = list.New()
+	server.unblockedClients = list.New()
+	server.readyKeys = list.New()
+	server.pubsubChannels = dictCreate()
+	server.pubsubPatterns = dictCreate()
+	server.pubsubShardChannels = dictCreate()
 
 	//if server.port != 0 {
 	//	if listenToPort(server.port) != nil {
@@ -152,19 +629,41 @@ func initServer() {
 	//初始化事件处理器
 	server.events.react = dataHandler
 	server.events.accept = acceptHandler
+	server.events.closed = closeHandler
 	server.events.tick = func() (delay time.Duration, action gnet.Action) {
 		return serverCron(), action
 	}
 
 	//初始化db
-	server.db = &redisDb{
-		dict:         &dict{},
-		expires:      &dict{},
-		evictionPool: evictionPoolAlloc(),
-		id:           1,
+	server.db = make([]*redisDb, server.dbnum)
+	for j := 0; j < server.dbnum; j++ {
+		server.db[j] = &redisDb{
+			dict:         dictCreate(),
+			expires:      dictCreate(),
+			blockingKeys: dictCreate(),
+			readyKeys:    dictCreate(),
+			watchedKeys:  dictCreate(),
+			id:           j,
+		}
 	}
+	server.evictionPool = evictionPoolAlloc()
 
 	createSharedObjects()
+
+	server.lastsave = time.Now().Unix()
+	server.lastbgsaveStatus = redisOk
+	server.rdbSaveTimeLast = -1
+	server.rdbSaveTimeStart = -1
+	server.aofLastWriteStatus = redisOk
+	server.aofLastFsync = time.Now().Unix()
+	server.aofRewriteTimeLast = -1
+	server.aofRewriteTimeStart = -1
+	server.aofLastbgrewriteStatus = redisOk
+
+	aofLoadManifestFromDisk()
+	loadDataFromDisk()
+	aofOpenIfNeededOnServerStart()
+	aofDelHistoryFiles()
 }
 
 func evictionPoolAlloc() []*evictionPoolEntry {
@@ -178,12 +677,29 @@ func evictionPoolAlloc() []*evictionPoolEntry {
 	return pool
 }
 
+//save配置了自动保存，并且stop-writes-on-bgsave-error为yes时，上一次BGSAVE失败后拒绝写命令
+//开启了AOF时，写入或者fsync失败后也拒绝写命令
+func writeCommandsDeniedByDiskError() int {
+	if server.stopWritesOnBgsaveErr && len(server.saveparams) > 0 && server.lastbgsaveStatus == redisErr {
+		return diskErrorTypeRdb
+	} else if server.aofState != redisAofOff {
+		if server.aofLastWriteStatus == redisErr {
+			return diskErrorTypeAof
+		}
+		if err := aofBioFsyncError(); err != nil {
+			server.aofLastWriteErr = err
+			return diskErrorTypeAof
+		}
+	}
+	return diskErrorTypeNone
+}
+
 //处理命令
 func processCommand(client *redisClient) int {
 
-	if client.argv[0].ptr == "quit" {
-		client.flags |= redisCloseAfterReply
+	if strings.EqualFold(client.argv[0].ptr.(sds), "quit") {
 		addReply(client, shared.ok)
+		client.flags |= redisCloseAfterReply
 		return redisErr
 	}
 
@@ -191,25 +707,82 @@ func processCommand(client *redisClient) int {
 	client.lastcmd = client.cmd
 
 	if client.cmd == nil {
-		log.Printf("client is empty,return err")
-		addReply(client, shared.err)
+		rejectCommandFormat(client, "unknown command '"+client.argv[0].ptr.(sds)+"'")
+		return redisOk
+	} else if (client.cmd.arity > 0 && client.cmd.arity != client.argc) ||
+		(client.argc < -client.cmd.arity) {
+		rejectCommandFormat(client, "wrong number of arguments for '"+client.cmd.name+"' command")
+		return redisOk
+	}
+
+	//设置了密码时，没有认证的客户端只能执行AUTH和HELLO
+	if !client.authenticated && client.cmd.name != "auth" && client.cmd.name != "hello" {
+		rejectCommand(client, shared.noautherr)
 		return redisOk
 	}
 
-	if server.maxMemory > 0 {
+	//内存超过限制时，拒绝执行可能占用更多内存的命令，加载数据时不淘汰key
+	if server.maxMemory > 0 && !server.loading {
 		ret := freeMemoryIfNeeded()
-		if ret == redisErr {
-			addReply(client, shared.oomerr)
+		if client.cmd.flags&redisCmdDenyoom != 0 && ret == redisErr {
+			rejectCommand(client, shared.oomerr)
 			return redisOk
 		}
 	}
 
-	call(client, 0)
+	//RDB或者AOF保存失败时拒绝写命令，避免用户在没有察觉的情况下丢失数据
+	if deny := writeCommandsDeniedByDiskError(); deny != diskErrorTypeNone &&
+		(client.cmd.flags&redisCmdWrite != 0 || client.cmd.name == "ping") {
+		if deny == diskErrorTypeRdb {
+			rejectCommand(client, shared.bgsaveerr)
+		} else {
+			rejectCommand(client, createObject(redisString,
+				sds("-MISCONF Errors writing to the AOF file: "+server.aofLastWriteErr.Error()+"\r\n")))
+		}
+		return redisOk
+	}
+
+	//RESP2中订阅了channel或pattern后，只能执行订阅相关的命令
+	if client.flags&redisPubsub != 0 && client.resp == 2 &&
+		client.cmd.name != "ping" && client.cmd.name != "subscribe" && client.cmd.name != "ssubscribe" &&
+		client.cmd.name != "unsubscribe" && client.cmd.name != "sunsubscribe" &&
+		client.cmd.name != "psubscribe" && client.cmd.name != "punsubscribe" {
+		rejectCommandFormat(client, "Can't execute '"+client.cmd.name+"': only (P|S)SUBSCRIBE / "+
+			"(P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+		return redisOk
+	}
+
+	//MULTI中除了控制事务的命令，其它命令都放到队列中，EXEC时再执行
+	if client.flags&redisMulti != 0 && client.cmd.name != "exec" && client.cmd.name != "discard" &&
+		client.cmd.name != "multi" && client.cmd.name != "watch" {
+		queueMultiCommand(client)
+		addReply(client, shared.queued)
+		return redisOk
+	}
+
+	call(client, redisCallFull)
+
+	//命令执行过程中有key可以唤醒阻塞的客户端
+	if server.readyKeys.Len() > 0 {
+		handleClientsBlockedOnKeys()
+	}
 	return redisOk
 }
 
+//拒绝执行命令，在MULTI中时EXEC会失败
+func rejectCommand(client *redisClient, reply *robj) {
+	flagTransaction(client)
+	addReply(client, reply)
+}
+
+func rejectCommandFormat(client *redisClient, msg string) {
+	flagTransaction(client)
+	addReplyError(client, msg)
+}
+
 func lookupCommand(name sds) *redisCommand {
-	cmd := server.commands.dictFind(name)
+	//命令名称不区分大小写
+	cmd := server.commands.dictFind(strings.ToLower(name))
 	log.Printf("lookup command: %v", cmd)
 	if cmd == nil {
 		return nil
@@ -218,9 +791,167 @@ func lookupCommand(name sds) *redisCommand {
 }
 
 //Call() is the core of Redis execution of a command
-func call(client *redisClient, flag int) {
+//修改了数据的命令在最外层的call结束时传播到AOF，同一个执行单元中的多个命令使用MULTI/EXEC包裹
+func call(client *redisClient, flags int) {
 	log.Printf("call command: %v", client.argv)
+
+	//EXEC中的命令和EXEC使用同一个客户端，保存传播相关的标记，执行结束后恢复
+	clientOldFlags := client.flags
+	client.flags &^= redisForceAof | redisPreventAofProp
+	dirty := server.dirty
+	server.executionNesting++
+
 	client.cmd.redisCommandFunc(client)
+
+	dirty = server.dirty - dirty
+	if dirty < 0 {
+		dirty = 0
+	}
+
+	if flags&redisCallPropagateAof != 0 && client.flags&redisPreventAofProp == 0 &&
+		(dirty > 0 || client.flags&redisForceAof != 0) {
+		alsoPropagate(client.db.id, client.argv)
+	}
+
+	client.flags &^= redisForceAof | redisPreventAofProp
+	client.flags |= clientOldFlags & (redisForceAof | redisPreventAofProp)
+
+	server.executionNesting--
+	if server.executionNesting == 0 {
+		propagatePendingCommands()
+	}
+}
+
+//将命令添加到当前执行单元的传播列表中，执行单元结束时再传播
+func alsoPropagate(dbid int, argv []*robj) {
+	//开启AOF时才需要传播
+	if server.aofState == redisAofOff {
+		return
+	}
+	argvcopy := make([]*robj, len(argv))
+	for j, arg := range argv {
+		argvcopy[j] = arg
+		incrRefCount(arg)
+	}
+	server.alsoPropagate = append(server.alsoPropagate, redisOp{dbid: dbid, argv: argvcopy})
+}
+
+//传播当前执行单元中的所有命令，多于一个命令时使用MULTI/EXEC包裹，保证AOF重放时是原子的
+func propagatePendingCommands() {
+	ops := server.alsoPropagate
+	if len(ops) == 0 {
+		return
+	}
+	server.alsoPropagate = nil
+
+	transaction := len(ops) > 1
+	if transaction {
+		propagate(ops[0].dbid, []*robj{shared.multi})
+	}
+	for _, op := range ops {
+		propagate(op.dbid, op.argv)
+		for _, arg := range op.argv {
+			decrRefCount(arg)
+		}
+	}
+	if transaction {
+		propagate(-1, []*robj{shared.exec})
+	}
+}
+
+//将命令写入AOF
+func propagate(dbid int, argv []*robj) {
+	if server.aofState != redisAofOff {
+		feedAppendOnlyFile(dbid, argv)
+	}
+}
+
+//不传播当前执行的命令，命令自己通过alsoPropagate传播了改写后的命令
+func preventCommandPropagation(client *redisClient) {
+	client.flags |= redisPreventAofProp
+}
+
+//即使当前执行的命令没有修改数据，也要传播
+func forceCommandPropagation(client *redisClient) {
+	client.flags |= redisForceAof
+}
+
+//key过期或者被淘汰时传播DEL，AOF重放时不会再根据时间删除key，结果才是确定的
+//不在命令的执行过程中时（比如定时删除过期的key），立即传播
+func propagateDeletion(db *redisDb, key *robj) {
+	alsoPropagate(db.id, []*robj{shared.del, key})
+	if server.executionNesting == 0 {
+		propagatePendingCommands()
+	}
+}
+
+//PING [message]
+func pingCommand(client *redisClient) {
+	if client.argc > 2 {
+		addReplyError(client, "wrong number of arguments for 'ping' command")
+		return
+	}
+	//RESP2的pubsub模式中回复的格式和消息相同
+	if client.flags&redisPubsub != 0 && client.resp == 2 {
+		addReplyArrayLen(client, 2)
+		addReplyBulkCBuffer(client, "pong")
+		if client.argc == 1 {
+			addReplyBulkCBuffer(client, "")
+		} else {
+			addReplyBulk(client, client.argv[1])
+		}
+		return
+	}
+
+	if client.argc == 1 {
+		addReply(client, shared.pong)
+	} else {
+		addReplyBulk(client, client.argv[1])
+	}
+}
+
+//ECHO message
+func echoCommand(client *redisClient) {
+	addReplyBulk(client, client.argv[1])
+}
+
+//AUTH [username] password
+func authCommand(client *redisClient) {
+	if client.argc < 2 || client.argc > 3 {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	username := "default"
+	password := client.argv[1].ptr.(sds)
+	if client.argc == 3 {
+		username = client.argv[1].ptr.(sds)
+		password = client.argv[2].ptr.(sds)
+	} else if server.requirepass == "" {
+		addReplyError(client, "AUTH <password> called without any password configured for the default user. "+
+			"Are you sure your configuration is correct?")
+		return
+	}
+
+	if checkPassword(username, password) {
+		client.authenticated = true
+		addReply(client, shared.ok)
+	} else {
+		client.authenticated = false
+		addReplyString(client, "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	}
+}
+
+//校验用户名和密码，只有default用户，没有设置密码时任意密码都可以通过
+func checkPassword(username string, password string) bool {
+	if username != "default" {
+		return false
+	}
+	if server.requirepass == "" {
+		return true
+	}
+	//使用固定时间的比较，避免时间攻击
+	return subtle.ConstantTimeCompare([]byte(password), []byte(server.requirepass)) == 1
 }
 
 func lruClock() uint64 {
@@ -257,12 +988,79 @@ func createSharedObjects() {
 		czero:     createObject(redisString, sds(":0\r\n")),
 		cone:      createObject(redisString, sds(":1\r\n")),
 		oomerr:    createObject(redisString, sds("-OOM command not allowed when used memory > 'maxmemory'.\r\n")),
+		noautherr: createObject(redisString, sds("-NOAUTH Authentication required.\r\n")),
+		bgsaveerr: createObject(redisString, sds("-MISCONF Redis is configured to save RDB snapshots, "+
+			"but it's currently unable to persist to disk. Commands that may modify the data set are disabled, "+
+			"because this instance is configured to report errors during writes if RDB snapshotting fails "+
+			"(stop-writes-on-bgsave-error option). Please check the Redis logs for details about the RDB error.\r\n")),
+		pong:   createObject(redisString, sds("+PONG\r\n")),
+		queued: createObject(redisString, sds("+QUEUED\r\n")),
+
+		execaborterr: createObject(redisString, sds("-EXECABORT Transaction discarded because of previous errors.\r\n")),
+
+		wrongtypeerr:  createObject(redisString, sds("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")),
+		nokeyerr:      createObject(redisString, sds("-ERR no such key\r\n")),
+		outofrangeerr: createObject(redisString, sds("-ERR index out of range\r\n")),
+		emptyarray:    createObject(redisString, sds("*0\r\n")),
+		emptybulk:     createObject(redisString, sds("$0\r\n\r\n")),
+		emptyscan:     createObject(redisString, sds("*2\r\n$1\r\n0\r\n*0\r\n")),
+		sameobjecterr: createObject(redisString, sds("-ERR source and destination objects are the same\r\n")),
+	}
+	shared.del = createStringObject("DEL")
+	shared.multi = createStringObject("MULTI")
+	shared.exec = createStringObject("EXEC")
+	shared.set = createStringObject("SET")
+	shared.keepttl = createStringObject("KEEPTTL")
+	shared.pxat = createStringObject("PXAT")
+	shared.pexpireat = createStringObject("PEXPIREAT")
+	shared.persist = createStringObject("PERSIST")
+	shared.lpop = createStringObject("LPOP")
+	shared.rpop = createStringObject("RPOP")
+	shared.lmove = createStringObject("LMOVE")
+	shared.left = createStringObject("LEFT")
+	shared.right = createStringObject("RIGHT")
+	shared.srem = createStringObject("SREM")
+	shared.hset = createStringObject("HSET")
+	shared.null[2] = createObject(redisString, sds("$-1\r\n"))
+	shared.null[3] = createObject(redisString, sds("_\r\n"))
+	shared.nullarray[2] = createObject(redisString, sds("*-1\r\n"))
+	shared.nullarray[3] = createObject(redisString, sds("_\r\n"))
+	for i := range shared.integers {
+		shared.integers[i] = createObject(redisString, int64(i))
+		shared.integers[i].encoding = redisEncodingInt
+		shared.integers[i].refcount = redisSharedRefcount
 	}
 }
 
 func populateCommandTable() {
-	server.commands = &dict{}
+	server.commands = dictCreate()
 	for _, c := range redisCommandTable {
+		for _, f := range c.sflags {
+			switch f {
+			case 'w':
+				c.flags |= redisCmdWrite
+			case 'r':
+				c.flags |= redisCmdReadonly
+			case 'm':
+				c.flags |= redisCmdDenyoom
+			case 'a':
+				c.flags |= redisCmdAdmin
+			case 'p':
+				c.flags |= redisCmdPubsub
+			case 's':
+				c.flags |= redisCmdNoscript
+			case 'R':
+				c.flags |= redisCmdRandom
+			case 'l':
+				c.flags |= redisCmdLoading
+			case 't':
+				c.flags |= redisCmdStale
+			case 'F':
+				c.flags |= redisCmdFast
+			default:
+				panic("Unsupported command flag")
+			}
+		}
 		server.commands.dictAdd(c.name, c)
 	}
 	log.Printf("populateCommandTable successfully: %v", server.commands)
@@ -270,32 +1068,163 @@ func populateCommandTable() {
 
 func serverCron() time.Duration {
 	server.lruclock = getLruClock()
+	clientsCron()
 	databasesCron()
+
+	//BGSAVE执行期间调度的BGREWRITEAOF
+	if !hasActiveChildProcess() && server.aofRewriteScheduled {
+		rewriteAppendOnlyFileBackground()
+	}
+
+	now := time.Now().Unix()
+	if hasActiveChildProcess() {
+		//BGSAVE和BGREWRITEAOF在定时任务中分多次完成
+		rdbSnapshotCron()
+	} else {
+		//满足save配置的条件时开始BGSAVE，上一次BGSAVE失败时至少等待redisBgsaveRetryDelay秒再重试
+		for _, sp := range server.saveparams {
+			if server.dirty >= sp.changes && now-server.lastsave > sp.seconds &&
+				(now-server.lastbgsaveTry > redisBgsaveRetryDelay || server.lastbgsaveStatus == redisOk) {
+				log.Printf("%d changes in %d seconds. Saving...", sp.changes, sp.seconds)
+				rdbSaveBackground(server.rdbFilename)
+				break
+			}
+		}
+
+		//AOF比上一次重写之后增长了auto-aof-rewrite-percentage时自动重写
+		if server.aofState == redisAofOn && !hasActiveChildProcess() &&
+			server.aofRewritePerc != 0 && server.aofCurrentSize > server.aofRewriteMinSize {
+			base := server.aofRewriteBaseSize
+			if base == 0 {
+				base = 1
+			}
+			growth := server.aofCurrentSize*100/base - 100
+			if growth >= int64(server.aofRewritePerc) {
+				log.Printf("Starting automatic rewriting of AOF on %d%% growth", growth)
+				rewriteAppendOnlyFileBackground()
+			}
+		}
+	}
+
+	//BGREWRITEAOF执行期间或者事务中调度的BGSAVE
+	if !hasActiveChildProcess() && server.rdbBgsaveScheduled &&
+		(now-server.lastbgsaveTry > redisBgsaveRetryDelay || server.lastbgsaveStatus == redisOk) {
+		if rdbSaveBackground(server.rdbFilename) == redisOk {
+			server.rdbBgsaveScheduled = false
+		}
+	}
+
+	//关闭需要异步关闭的客户端
+	freeClientsInAsyncFreeQueue()
+
+	//定时任务中也可能产生回复数据
+	beforeSleep()
 	return time.Millisecond * time.Duration(1000/server.hz)
 }
 
+//客户端的后台定时任务
+func clientsCron() {
+	now := mstime()
+	server.clients.dictForEach(func(_ interface{}, v interface{}) bool {
+		clientsCronHandleTimeout(v.(*redisClient), now)
+		return true
+	})
+}
+
+//每一轮事件处理结束后调用，将本轮产生的回复数据发送给客户端
+func beforeSleep() {
+	//继续处理被唤醒的客户端中剩余的命令
+	processUnblockedClients()
+
+	//回复客户端之前先写入AOF
+	if server.aofState == redisAofOn {
+		flushAppendOnlyFile()
+	}
+
+	handleClientsWithPendingWrites()
+	freeClientsInAsyncFreeQueue()
+}
+
 //db的后台定时任务
 func databasesCron() {
 
 	activeExpireCycle()
 
-	//TODO 后续RDB或AOF的情况需要做其它处理
+	//删除大量key后缩小hash表，并且在空闲时推进rehash
+	dbsPerCall := cronDbsPerCall
+	if dbsPerCall > server.dbnum {
+		dbsPerCall = server.dbnum
+	}
+	for j := 0; j < dbsPerCall; j++ {
+		tryResizeHashTables(server.db[server.resizeDb%server.dbnum])
+		server.resizeDb++
+	}
+	//一次只rehash一个db
+	for j := 0; j < dbsPerCall; j++ {
+		if incrementallyRehash(server.db[server.rehashDb]) {
+			break
+		}
+		server.rehashDb = (server.rehashDb + 1) % server.dbnum
+	}
+
+	//BGSAVE使用dictScan遍历，rehash和缩小hash表都不影响快照，不需要暂停
 }
 
-func activeExpireCycle() {
-	//目前我们只有一个DB，就不需要循环处理DB了
-	//多DB的情况下最外层应该还有一层循环： for db in server.dbs {}
+//hash表的使用率低于10%时需要缩小
+func htNeedsResize(d *dict) bool {
+	size := d.size()
+	used := d.used()
+	return size > dictHtInitialSize && used*100/size < hashtableMinFill
+}
+
+func tryResizeHashTables(db *redisDb) {
+	if htNeedsResize(db.dict) {
+		db.dict.dictResize()
+	}
+	if htNeedsResize(db.expires) {
+		db.expires.dictResize()
+	}
+}
+
+//每次最多花1毫秒rehash，返回true表示执行了rehash
+func incrementallyRehash(db *redisDb) bool {
+	if db.dict.isRehashing() {
+		db.dict.dictRehashMilliseconds(1)
+		return true
+	}
+	if db.expires.isRehashing() {
+		db.expires.dictRehashMilliseconds(1)
+		return true
+	}
+	return false
+}
 
+//每次最多处理cronDbsPerCall个db，从上一次停下的db开始，所有db共用一个执行时间限制
+func activeExpireCycle() {
 	//记录开始时间
 	start := ustime()
 
-	//每个DB的最长执行时间限制
+	//上一次超时退出时，说明过期的key很多，这次处理所有的db
+	dbsPerCall := cronDbsPerCall
+	if dbsPerCall > server.dbnum || server.activeExpireTimelimitExit {
+		dbsPerCall = server.dbnum
+	}
+
+	//最长执行时间限制
 	timelimit := int64(1000000 * activeExpireCycleSlowTimeperc / server.hz / 100)
 
 	if timelimit <= 0 {
 		timelimit = 1
 	}
-	db := server.db
+	server.activeExpireTimelimitExit = false
+	for j := 0; j < dbsPerCall && !server.activeExpireTimelimitExit; j++ {
+		db := server.db[server.activeExpireCurrentDb%server.dbnum]
+		server.activeExpireCurrentDb++
+		activeExpireCycleDb(db, start, timelimit)
+	}
+}
+
+func activeExpireCycleDb(db *redisDb, start int64, timelimit int64) {
 	for {
 		nums := 0
 		expired := 0
@@ -331,6 +1260,7 @@ func activeExpireCycle() {
 		elapsed := ustime() - start
 
 		if elapsed > timelimit {
+			server.activeExpireTimelimitExit = true
 			break
 		}
 		if expired < activeExpireCycleLookupsPerLoop/4 {
@@ -346,6 +1276,9 @@ func activeExpireCycleTryExpire(db *redisDb, key *robj, now int64) bool {
 	}
 	if now > t.(int64) {
 		db.dbDelete(key)
+		propagateDeletion(db, key)
+		notifyKeyspaceEvent(notifyExpired, "expired", key, db.id)
+		db.signalModifiedKey(key)
 		return true
 	}
 	return false
@@ -365,96 +1298,121 @@ func freeMemoryIfNeeded() int {
 		return redisErr
 	}
 
+	allkeys := server.maxMemoryPolicy == redisMaxMemoryAllKeysLru ||
+		server.maxMemoryPolicy == redisMaxMemoryAllKeysLfu ||
+		server.maxMemoryPolicy == redisMaxMemoryAllKeysRandom
+
 	memToFree := memUsed - server.maxMemory
 	var memFreed uint64 = 0
 	for memFreed < memToFree {
 
-		var dt *dict
 		var bestKey *robj
-		var bestVal int64
+		var bestDb *redisDb
 
-		if server.maxMemoryPolicy == redisMaxMemoryAllKeysLru ||
-			server.maxMemoryPolicy == redisMaxMemoryAllKeysRandom {
-			dt = server.db.dict
-		} else {
-			dt = server.db.expires
-		}
 		if server.maxMemoryPolicy == redisMaxMemoryAllKeysRandom ||
 			server.maxMemoryPolicy == redisMaxMemoryVolatileRandom {
-			//随机淘汰
-			val := dt.getRandomKey()
-			if val != nil {
-				bestKey = val
+			//随机淘汰，每次从下一个db中选择，保证所有db被淘汰的机会相同
+			for i := 0; i < server.dbnum; i++ {
+				server.evictionNextDb++
+				db := server.db[server.evictionNextDb%server.dbnum]
+				dt := db.expires
+				if allkeys {
+					dt = db.dict
+				}
+				if key := dt.getRandomKey(); key != nil {
+					bestKey = key
+					bestDb = db
+					break
+				}
 			}
-		} else if server.maxMemoryPolicy == redisMaxMemoryAllKeysLru ||
-			server.maxMemoryPolicy == redisMaxMemoryVolatileLru {
-			//LRU淘汰
+		} else {
+			//LRU/LFU/TTL淘汰，所有db的采样放到同一个淘汰池中
+			pool := server.evictionPool
 			for bestKey == nil {
-				pool := server.db.evictionPool
-				evictionPoolPopulate(dt, server.db.dict, pool)
+				keys := 0
+				for _, db := range server.db {
+					dt := db.expires
+					if allkeys {
+						dt = db.dict
+					}
+					if dt.used() != 0 {
+						evictionPoolPopulate(db.id, dt, db.dict, pool)
+						keys += dt.used()
+					}
+				}
+				//没有可以淘汰的key
+				if keys == 0 {
+					break
+				}
 
 				for k := redisEvictionPoolSize - 1; k >= 0; k-- {
 					//从后往前遍历，空间时间长的往短的
 					if len(pool[k].key) == 0 {
 						continue
 					}
-					val := dt.dictFind(pool[k].key).(*robj)
-					//释放pool对象
-					//sdsfree(pool[k].key)
-					//模拟
-					pool[k].key = ""
-					//链表元素的右边全部左移，如果是最后一个元素不需要移动
-					if k < redisEvictionPoolSize-1 {
-						copy(pool[k:], pool[k+1:])
+					db := server.db[pool[k].dbid]
+					var de interface{}
+					if allkeys {
+						de = db.dict.dictFind(pool[k].key)
+					} else {
+						de = db.expires.dictFind(pool[k].key)
 					}
-					//左移后最后一个元素重新初始化
-					pool[redisEvictionPoolSize-1].key = ""
-					pool[redisEvictionPoolSize-1].idle = 0
+					key := pool[k].key
+					//从淘汰池中移除，这是最右边的元素，不需要移动其它元素
+					pool[k].key = ""
+					pool[k].idle = 0
 
-					if val != nil {
-						bestKey = val
+					//淘汰池中的key可能已经被删除了
+					if de != nil {
+						bestKey = createStringObject(key)
+						bestDb = db
 						break
 					}
 				}
 			}
-		} else if server.maxMemoryPolicy == redisMaxMemoryVolatileTtl {
-			//TTL淘汰
-			for k := 0; k < server.maxMemorySamples; k++ {
-				key := dt.getRandomKey()
-				val := dt.dictFind(key.ptr).(int64)
-
-				if bestKey != nil || val < bestVal {
-					bestKey = key
-					bestVal = val
-				}
-			}
 		}
 
-		if bestKey != nil {
-			//free memory
-			delta := usedMemory()
-			server.db.dbDelete(bestKey)
-			delta -= usedMemory()
-			memFreed += delta
+		//没有可以淘汰的key
+		if bestKey == nil {
+			return redisErr
 		}
+
+		//free memory
+		delta := usedMemory()
+		bestDb.dbDelete(bestKey)
+		delta -= usedMemory()
+		memFreed += delta
+		propagateDeletion(bestDb, bestKey)
+		//发布消息占用的输出缓冲区不计入释放的内存
+		bestDb.signalModifiedKey(bestKey)
+		notifyKeyspaceEvent(notifyEvicted, "evicted", bestKey, bestDb.id)
 	}
 	return redisOk
 }
 
-func evictionPoolPopulate(sampleDict *dict, keyDict *dict, pool []*evictionPoolEntry) {
-	//sampleCount := 16
-	//if server.maxMemorySamples <= sampleCount {
-	//}
-	samples := sampleDict.getSomeKeys(server.maxMemorySamples)
-	var o *robj
-	for k, v := range samples {
-		o = v.(*robj)
-		key := k.(sds)
-		if sampleDict != keyDict {
-			//sampledict是过期字典，要重新从数据字典中拿到value
-			o = keyDict.dictFind(k).(*robj)
+//从sampleDict中采样，按照idle从小到大插入淘汰池中，idle越大越先被淘汰
+func evictionPoolPopulate(dbid int, sampleDict *dict, keyDict *dict, pool []*evictionPoolEntry) {
+	samples := sampleDict.dictGetSomeKeys(server.maxMemorySamples)
+	for _, de := range samples {
+		key := de.key.(sds)
+
+		var idle uint64
+		if server.maxMemoryPolicy == redisMaxMemoryVolatileTtl {
+			//TTL淘汰中，越早过期越先被淘汰
+			idle = math.MaxUint64 - uint64(de.val.(int64))
+		} else {
+			o, _ := de.val.(*robj)
+			if sampleDict != keyDict {
+				//sampledict是过期字典，要重新从数据字典中拿到value
+				o = keyDict.dictFind(key).(*robj)
+			}
+			//LFU策略中，访问频率越低越先被淘汰
+			if maxMemoryPolicyIsLfu() {
+				idle = 255 - lfuDecrAndReturn(o)
+			} else {
+				idle = estimateObjectIdleTime(o)
+			}
 		}
-		idle := estimateObjectIdleTime(o)
 
 		k := 0
 		for k < redisEvictionPoolSize && len(pool[k].key) != 0 && pool[k].idle < idle {
@@ -472,18 +1430,17 @@ func evictionPoolPopulate(sampleDict *dict, keyDict *dict, pool []*evictionPoolE
 				//未满，后移
 				copy(pool[k+1:], pool[k:])
 			} else {
-				//满了，前移
-				//free(pool[0])
-				pool[0].key = ""
+				//满了，前移，丢弃idle最小的pool[0]
 				k--
-				copy(pool[:k-1], pool[1:k])
+				copy(pool[:k], pool[1:k+1])
 			}
+			//移动后pool[k]和相邻的元素指向同一个entry，需要新建
+			pool[k] = &evictionPoolEntry{}
 		}
 		pool[k].key = key
 		pool[k].idle = idle
+		pool[k].dbid = dbid
 	}
-	//free samples
-	samples = nil
 }
 
 func estimateObjectIdleTime(o *robj) uint64 {
@@ -495,15 +1452,92 @@ func estimateObjectIdleTime(o *robj) uint64 {
 	return (lruclock + (redisLruClockMax - o.lru)) * redisLruClockResolution
 }
 
+//-----------------------------------------------------------------------------
+// LFU
+//-----------------------------------------------------------------------------
+
+func maxMemoryPolicyIsLru() bool {
+	return server.maxMemoryPolicy == redisMaxMemoryVolatileLru || server.maxMemoryPolicy == redisMaxMemoryAllKeysLru
+}
+
+func maxMemoryPolicyIsLfu() bool {
+	return server.maxMemoryPolicy == redisMaxMemoryVolatileLfu || server.maxMemoryPolicy == redisMaxMemoryAllKeysLfu
+}
+
+//当前时间（分钟），只保留低16位
+func lfuGetTimeInMinutes() uint64 {
+	return uint64(mstime()/1000/60) & 65535
+}
+
+//距离ldt经过的分钟数，时间已经走了一圈时只计算一圈
+func lfuTimeElapsed(ldt uint64) uint64 {
+	now := lfuGetTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 65535 - ldt + now
+}
+
+//按照对数增长计数器，计数器越大增长的概率越小
+func lfuLogIncr(counter uint64) uint64 {
+	if counter == 255 {
+		return 255
+	}
+	r := rand.Float64()
+	baseval := float64(counter) - redisLfuInitVal
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*float64(server.lfuLogFactor) + 1)
+	if r < p {
+		counter++
+	}
+	return counter
+}
+
+//根据经过的时间衰减计数器，不修改对象
+func lfuDecrAndReturn(o *robj) uint64 {
+	ldt := o.lru >> 8
+	counter := o.lru & 255
+	var numPeriods uint64
+	if server.lfuDecayTime > 0 {
+		numPeriods = lfuTimeElapsed(ldt) / uint64(server.lfuDecayTime)
+	}
+	if numPeriods > 0 {
+		if numPeriods > counter {
+			counter = 0
+		} else {
+			counter -= numPeriods
+		}
+	}
+	return counter
+}
+
+//访问对象时更新访问频率，先衰减再增长
+func updateLFU(val *robj) {
+	counter := lfuDecrAndReturn(val)
+	counter = lfuLogIncr(counter)
+	val.lru = lfuGetTimeInMinutes()<<8 | counter
+}
+
 func usedMemory() uint64 {
 	//TODO  没有手动分配内存，暂时无法获取 模拟使用redis的key
-	used := uint64(server.db.dict.used() + server.db.expires.used())
+	var used uint64
+	for _, db := range server.db {
+		used += uint64(db.dict.used() + db.expires.used())
+	}
 	log.Printf("used memory is : %v", used)
 	return used
 }
 
 func Start() {
+	//在创建任何dict之前设置hash的seed
+	dictSetHashFunctionSeed(getRandomBytes(16))
 	initServerConfig()
+	//第一个参数为配置文件路径
+	if len(os.Args) > 1 {
+		loadServerConfig(os.Args[1])
+	}
 	initServer()
 	elMain()
 }
@@ -0,0 +1,72 @@
+package redis
+
+import (
+	"github.com/panjf2000/gnet"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+//测试用的连接，发送给客户端的数据保存在out中
+type testConn struct {
+	ctx    interface{}
+	out    []byte
+	closed bool
+}
+
+var _ gnet.Conn = (*testConn)(nil)
+
+func (c *testConn) Context() interface{}        { return c.ctx }
+func (c *testConn) SetContext(ctx interface{})  { c.ctx = ctx }
+func (c *testConn) LocalAddr() net.Addr         { return nil }
+func (c *testConn) RemoteAddr() net.Addr        { return nil }
+func (c *testConn) Read() []byte                { return nil }
+func (c *testConn) ResetBuffer()                {}
+func (c *testConn) ReadN(n int) (int, []byte)   { return 0, nil }
+func (c *testConn) ShiftN(n int) int            { return 0 }
+func (c *testConn) BufferLength() int           { return 0 }
+func (c *testConn) SendTo(buf []byte) error     { return nil }
+func (c *testConn) Wake() error                 { return nil }
+func (c *testConn) Close() error                { c.closed = true; return nil }
+func (c *testConn) AsyncWrite(buf []byte) error { c.out = append(c.out, buf...); return nil }
+func (c *testConn) AsyncWritev(bs [][]byte) error {
+	for _, b := range bs {
+		c.out = append(c.out, b...)
+	}
+	return nil
+}
+
+var initTestServerOnce sync.Once
+
+//初始化server，并创建一个连接到server的客户端
+func newTestConn(t *testing.T) *testConn {
+	initTestServerOnce.Do(func() {
+		dictSetHashFunctionSeed(getRandomBytes(16))
+		initServerConfig()
+		initServer()
+	})
+	c := &testConn{}
+	server.events.OnOpened(c)
+	t.Cleanup(func() {
+		server.events.OnClosed(c, nil)
+	})
+	return c
+}
+
+//发送一条命令，返回这一轮事件处理中发送给这个客户端的数据
+func (c *testConn) command(args ...string) string {
+	req := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		req += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	reply, _ := c.send(req)
+	return reply
+}
+
+//发送原始数据，返回发送给这个客户端的数据和事件处理返回的action
+func (c *testConn) send(data string) (string, gnet.Action) {
+	c.out = c.out[:0]
+	_, action := server.events.React([]byte(data), c)
+	return string(c.out), action
+}
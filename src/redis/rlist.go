@@ -8,3 +8,53 @@ func (l *rlist) Init() *rlist {
 	lt := (*list.List)(l).Init()
 	return (*rlist)(lt)
 }
+
+func (l *rlist) Len() int {
+	return (*list.List)(l).Len()
+}
+
+func (l *rlist) Front() *list.Element {
+	return (*list.List)(l).Front()
+}
+
+func (l *rlist) Back() *list.Element {
+	return (*list.List)(l).Back()
+}
+
+func (l *rlist) PushFront(v interface{}) *list.Element {
+	return (*list.List)(l).PushFront(v)
+}
+
+func (l *rlist) PushBack(v interface{}) *list.Element {
+	return (*list.List)(l).PushBack(v)
+}
+
+func (l *rlist) InsertBefore(v interface{}, mark *list.Element) *list.Element {
+	return (*list.List)(l).InsertBefore(v, mark)
+}
+
+func (l *rlist) InsertAfter(v interface{}, mark *list.Element) *list.Element {
+	return (*list.List)(l).InsertAfter(v, mark)
+}
+
+func (l *rlist) Remove(e *list.Element) interface{} {
+	return (*list.List)(l).Remove(e)
+}
+
+//根据下标查找元素，下标可以为负数，-1表示最后一个元素，超出范围时返回nil
+func (l *rlist) Index(index int) *list.Element {
+	var e *list.Element
+	if index < 0 {
+		index = (-index) - 1
+		e = l.Back()
+		for ; index > 0 && e != nil; index-- {
+			e = e.Prev()
+		}
+	} else {
+		e = l.Front()
+		for ; index > 0 && e != nil; index-- {
+			e = e.Next()
+		}
+	}
+	return e
+}
@@ -1,3 +1,165 @@
 package redis
 
+import "fmt"
+
 type sds = string
+
+//判断是否为16进制字符
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+//16进制字符转为整数
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10
+	}
+	return 0
+}
+
+//将一行文本按空格拆分为参数，规则和redis的sdssplitargs一致：
+//支持双引号（可以包含 \n \r \t \b \a \\ \" 和 \xHH 转义）和单引号（只支持 \' 转义），
+//引号闭合后必须跟着空白字符或者结束。引号不匹配时返回false
+func sdssplitargs(line string) ([]sds, bool) {
+	p := 0
+	var vector []sds
+
+	for {
+		//跳过空白字符
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p >= len(line) {
+			return vector, true
+		}
+
+		inq := false  //在双引号中
+		insq := false //在单引号中
+		done := false
+		current := make([]byte, 0, 16)
+
+		for !done {
+			if inq {
+				if p >= len(line) {
+					//双引号没有闭合
+					return nil, false
+				}
+				if line[p] == '\\' && p+3 < len(line) && line[p+1] == 'x' &&
+					isHexDigit(line[p+2]) && isHexDigit(line[p+3]) {
+					current = append(current, hexDigitToInt(line[p+2])*16+hexDigitToInt(line[p+3]))
+					p += 3
+				} else if line[p] == '\\' && p+1 < len(line) {
+					p++
+					switch line[p] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[p])
+					}
+				} else if line[p] == '"' {
+					//闭合的引号后面必须是空白字符或者结束
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, false
+					}
+					done = true
+				} else {
+					current = append(current, line[p])
+				}
+			} else if insq {
+				if p >= len(line) {
+					//单引号没有闭合
+					return nil, false
+				}
+				if line[p] == '\\' && p+1 < len(line) && line[p+1] == '\'' {
+					p++
+					current = append(current, '\'')
+				} else if line[p] == '\'' {
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, false
+					}
+					done = true
+				} else {
+					current = append(current, line[p])
+				}
+			} else {
+				if p >= len(line) {
+					done = true
+					break
+				}
+				switch line[p] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					current = append(current, line[p])
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		vector = append(vector, sds(current))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+//字符串中是否有需要转义的字符，没有时可以直接作为sdssplitargs的一个参数
+func sdsneedsrepr(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' || c == '"' || c == '\'' || c < 0x20 || c >= 0x7f || isSpace(c) {
+			return true
+		}
+	}
+	return false
+}
+
+//转换为带双引号的字符串，不可打印的字符使用转义，可以被sdssplitargs还原
+func sdscatrepr(s string) sds {
+	buf := make([]byte, 0, len(s)+2)
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\', '"':
+			buf = append(buf, '\\', c)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		case '\a':
+			buf = append(buf, '\\', 'a')
+		case '\b':
+			buf = append(buf, '\\', 'b')
+		default:
+			if c >= 0x20 && c < 0x7f {
+				buf = append(buf, c)
+			} else {
+				buf = append(buf, fmt.Sprintf("\\x%02x", c)...)
+			}
+		}
+	}
+	buf = append(buf, '"')
+	return sds(buf)
+}
@@ -0,0 +1,69 @@
+package redis
+
+import "math/bits"
+
+//SipHash-1-2，和redis一样用作dict的hash函数
+//seed在启动时随机生成，避免客户端构造大量hash冲突的key
+
+var dictHashFunctionSeed [16]byte
+
+func dictSetHashFunctionSeed(seed []byte) {
+	copy(dictHashFunctionSeed[:], seed)
+}
+
+func siphashLoad64(b []byte, i int) uint64 {
+	return uint64(b[i]) | uint64(b[i+1])<<8 | uint64(b[i+2])<<16 | uint64(b[i+3])<<24 |
+		uint64(b[i+4])<<32 | uint64(b[i+5])<<40 | uint64(b[i+6])<<48 | uint64(b[i+7])<<56
+}
+
+func siphash(in string, k [16]byte) uint64 {
+	k0 := siphashLoad64(k[:], 0)
+	k1 := siphashLoad64(k[:], 8)
+
+	v0 := 0x736f6d6570736575 ^ k0
+	v1 := 0x646f72616e646f6d ^ k1
+	v2 := 0x6c7967656e657261 ^ k0
+	v3 := 0x7465646279746573 ^ k1
+
+	sipround := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(in)
+	i := 0
+	for ; i+8 <= length; i += 8 {
+		m := uint64(in[i]) | uint64(in[i+1])<<8 | uint64(in[i+2])<<16 | uint64(in[i+3])<<24 |
+			uint64(in[i+4])<<32 | uint64(in[i+5])<<40 | uint64(in[i+6])<<48 | uint64(in[i+7])<<56
+		v3 ^= m
+		sipround()
+		v0 ^= m
+	}
+
+	//剩余不足8个字节的部分和长度
+	b := uint64(length) << 56
+	for j := length - i - 1; j >= 0; j-- {
+		b |= uint64(in[i+j]) << (8 * uint(j))
+	}
+
+	v3 ^= b
+	sipround()
+	v0 ^= b
+
+	v2 ^= 0xff
+	sipround()
+	sipround()
+	return v0 ^ v1 ^ v2 ^ v3
+}
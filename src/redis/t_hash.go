@@ -0,0 +1,618 @@
+package redis
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Hash type API
+//-----------------------------------------------------------------------------
+
+//检查参数的长度，field或value超过hashMaxListpackValue时转换为hashtable编码
+func hashTypeTryConversion(o *robj, argv []*robj, start int, end int) {
+	if o.encoding != redisEncodingListpack {
+		return
+	}
+	for i := start; i <= end; i++ {
+		if len(argv[i].ptr.(sds)) > server.hashMaxListpackValue {
+			hashTypeConvert(o, redisEncodingHt)
+			return
+		}
+	}
+}
+
+//listpack中查找field的位置，找不到时返回-1
+func hashTypeListpackFind(lp []sds, field sds) int {
+	for i := 0; i < len(lp); i += 2 {
+		if lp[i] == field {
+			return i
+		}
+	}
+	return -1
+}
+
+//获取field对应的value
+func hashTypeGetValue(o *robj, field sds) (sds, bool) {
+	if o.encoding == redisEncodingListpack {
+		lp := o.ptr.([]sds)
+		i := hashTypeListpackFind(lp, field)
+		if i < 0 {
+			return "", false
+		}
+		return lp[i+1], true
+	} else if o.encoding == redisEncodingHt {
+		v := o.ptr.(*dict).dictFind(field)
+		if v == nil {
+			return "", false
+		}
+		return v.(sds), true
+	}
+	panic("Unknown hash encoding")
+}
+
+func hashTypeExists(o *robj, field sds) bool {
+	_, ok := hashTypeGetValue(o, field)
+	return ok
+}
+
+//设置field的值，field已经存在时返回true（更新），否则返回false（新增）
+func hashTypeSet(o *robj, field sds, value sds) bool {
+	update := false
+	if o.encoding == redisEncodingListpack {
+		lp := o.ptr.([]sds)
+		i := hashTypeListpackFind(lp, field)
+		if i >= 0 {
+			lp[i+1] = value
+			update = true
+		} else {
+			o.ptr = append(lp, field, value)
+		}
+
+		//元素数量超过限制时转换为hashtable编码
+		if hashTypeLength(o) > server.hashMaxListpackEntries {
+			hashTypeConvert(o, redisEncodingHt)
+		}
+	} else if o.encoding == redisEncodingHt {
+		if o.ptr.(*dict).dictReplace(field, value) == 1 {
+			update = true
+		}
+	} else {
+		panic("Unknown hash encoding")
+	}
+	return update
+}
+
+//删除field，删除成功返回true
+func hashTypeDelete(o *robj, field sds) bool {
+	if o.encoding == redisEncodingListpack {
+		lp := o.ptr.([]sds)
+		i := hashTypeListpackFind(lp, field)
+		if i < 0 {
+			return false
+		}
+		o.ptr = append(lp[:i], lp[i+2:]...)
+		return true
+	} else if o.encoding == redisEncodingHt {
+		d := o.ptr.(*dict)
+		if d.dictDelete(field) != dictOk {
+			return false
+		}
+		//删除后元素太少时缩小hash表
+		if htNeedsResize(d) {
+			d.dictResize()
+		}
+		return true
+	}
+	panic("Unknown hash encoding")
+}
+
+//hash中元素的数量
+func hashTypeLength(o *robj) int {
+	if o.encoding == redisEncodingListpack {
+		return len(o.ptr.([]sds)) / 2
+	} else if o.encoding == redisEncodingHt {
+		return o.ptr.(*dict).used()
+	}
+	panic("Unknown hash encoding")
+}
+
+//遍历hash中的所有元素，fn返回false时停止遍历
+func hashTypeForEach(o *robj, fn func(field sds, value sds) bool) {
+	if o.encoding == redisEncodingListpack {
+		lp := o.ptr.([]sds)
+		for i := 0; i < len(lp); i += 2 {
+			if !fn(lp[i], lp[i+1]) {
+				return
+			}
+		}
+	} else if o.encoding == redisEncodingHt {
+		o.ptr.(*dict).dictForEach(func(k interface{}, v interface{}) bool {
+			return fn(k.(sds), v.(sds))
+		})
+	} else {
+		panic("Unknown hash encoding")
+	}
+}
+
+//查找hash对象，不存在时创建
+func hashTypeLookupWriteOrCreate(client *redisClient, key *robj) *robj {
+	o := client.db.lookupKeyWrite(key)
+	if o == nil {
+		o = createHashObject()
+		client.db.dbAdd(key, o)
+		return o
+	}
+	if o.rtype != redisHash {
+		addReply(client, shared.wrongtypeerr)
+		return nil
+	}
+	return o
+}
+
+//转换hash的编码，只支持listpack转换为hashtable
+func hashTypeConvert(o *robj, enc uint8) {
+	if o.encoding == redisEncodingListpack && enc == redisEncodingHt {
+		lp := o.ptr.([]sds)
+		d := dictCreate()
+		for i := 0; i < len(lp); i += 2 {
+			if d.dictAdd(lp[i], lp[i+1]) != dictOk {
+				panic("Listpack corruption detected")
+			}
+		}
+		o.ptr = d
+		o.encoding = redisEncodingHt
+	} else if o.encoding == redisEncodingHt {
+		panic("Not implemented")
+	} else {
+		panic("Unknown hash encoding")
+	}
+}
+
+//复制hash对象，编码保持不变，用于COPY命令
+func hashTypeDup(o *robj) *robj {
+	hash := createHashObject()
+	if o.encoding == redisEncodingListpack {
+		hash.ptr = append([]sds(nil), o.ptr.([]sds)...)
+	} else if o.encoding == redisEncodingHt {
+		d := dictCreate()
+		hashTypeForEach(o, func(field sds, value sds) bool {
+			d.dictAdd(field, value)
+			return true
+		})
+		hash.ptr = d
+		hash.encoding = redisEncodingHt
+	} else {
+		panic("Unknown hash encoding")
+	}
+	return hash
+}
+
+//随机返回一个元素
+func hashTypeRandomElement(o *robj) (sds, sds) {
+	if o.encoding == redisEncodingListpack {
+		lp := o.ptr.([]sds)
+		i := rand.Intn(len(lp)/2) * 2
+		return lp[i], lp[i+1]
+	}
+	d := o.ptr.(*dict)
+	field := d.dictGetRandomKey()
+	return field.(sds), d.dictFind(field).(sds)
+}
+
+//-----------------------------------------------------------------------------
+// Hash type commands
+//-----------------------------------------------------------------------------
+
+//HSETNX key field value
+func hsetnxCommand(client *redisClient) {
+	o := hashTypeLookupWriteOrCreate(client, client.argv[1])
+	if o == nil {
+		return
+	}
+
+	if hashTypeExists(o, client.argv[2].ptr.(sds)) {
+		addReply(client, shared.czero)
+		return
+	}
+	hashTypeTryConversion(o, client.argv, 2, 3)
+	hashTypeSet(o, client.argv[2].ptr.(sds), client.argv[3].ptr.(sds))
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyHash, "hset", client.argv[1], client.db.id)
+	server.dirty++
+	addReply(client, shared.cone)
+}
+
+//HSET key field value [field value ...]
+//HMSET key field value [field value ...]
+func hsetCommand(client *redisClient) {
+	if client.argc%2 == 1 {
+		addReplyError(client, "wrong number of arguments for '"+client.cmd.name+"' command")
+		return
+	}
+
+	o := hashTypeLookupWriteOrCreate(client, client.argv[1])
+	if o == nil {
+		return
+	}
+	hashTypeTryConversion(o, client.argv, 2, client.argc-1)
+
+	created := 0
+	for i := 2; i < client.argc; i += 2 {
+		if !hashTypeSet(o, client.argv[i].ptr.(sds), client.argv[i+1].ptr.(sds)) {
+			created++
+		}
+	}
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyHash, "hset", client.argv[1], client.db.id)
+	server.dirty++
+
+	//HMSET返回OK，HSET返回新增的field数量
+	if client.cmd.name == "hset" {
+		addReplyLongLong(client, int64(created))
+	} else {
+		addReply(client, shared.ok)
+	}
+}
+
+//HINCRBY key field increment
+func hincrbyCommand(client *redisClient) {
+	incr, ok := getLongLongFromObjectOrReply(client, client.argv[3], "")
+	if !ok {
+		return
+	}
+
+	o := hashTypeLookupWriteOrCreate(client, client.argv[1])
+	if o == nil {
+		return
+	}
+
+	var value int64
+	if cur, exists := hashTypeGetValue(o, client.argv[2].ptr.(sds)); exists {
+		value, ok = string2ll(cur)
+		if !ok {
+			addReplyError(client, "hash value is not an integer")
+			return
+		}
+	}
+
+	oldvalue := value
+	if (incr < 0 && oldvalue < 0 && incr < math.MinInt64-oldvalue) ||
+		(incr > 0 && oldvalue > 0 && incr > math.MaxInt64-oldvalue) {
+		addReplyError(client, "increment or decrement would overflow")
+		return
+	}
+	value += incr
+
+	hashTypeTryConversion(o, client.argv, 2, 2)
+	hashTypeSet(o, client.argv[2].ptr.(sds), strconv.FormatInt(value, 10))
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyHash, "hincrby", client.argv[1], client.db.id)
+	server.dirty++
+	addReplyLongLong(client, value)
+}
+
+//HINCRBYFLOAT key field increment
+func hincrbyfloatCommand(client *redisClient) {
+	incr, ok := getDoubleFromObjectOrReply(client, client.argv[3], "")
+	if !ok {
+		return
+	}
+	if math.IsInf(incr, 0) {
+		addReplyError(client, "increment would produce NaN or Infinity")
+		return
+	}
+
+	o := hashTypeLookupWriteOrCreate(client, client.argv[1])
+	if o == nil {
+		return
+	}
+
+	var value float64
+	if cur, exists := hashTypeGetValue(o, client.argv[2].ptr.(sds)); exists {
+		value, ok = string2d(cur)
+		if !ok {
+			addReplyError(client, "hash value is not a float")
+			return
+		}
+	}
+
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		addReplyError(client, "increment would produce NaN or Infinity")
+		return
+	}
+
+	newValue := ld2string(value)
+	hashTypeTryConversion(o, client.argv, 2, 2)
+	hashTypeSet(o, client.argv[2].ptr.(sds), newValue)
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyHash, "hincrbyfloat", client.argv[1], client.db.id)
+	server.dirty++
+	addReplyBulkCBuffer(client, newValue)
+
+	//浮点数的计算在不同的平台上可能有差异，传播为HSET key field value
+	rewriteClientCommandArgument(client, 0, shared.hset)
+	rewriteClientCommandArgument(client, 3, createStringObject(sds(newValue)))
+}
+
+//回复field对应的value，不存在时回复null
+func addHashFieldToReply(client *redisClient, o *robj, field sds) {
+	if o == nil {
+		addReplyNull(client)
+		return
+	}
+	value, ok := hashTypeGetValue(o, field)
+	if !ok {
+		addReplyNull(client)
+		return
+	}
+	addReplyBulkCBuffer(client, value)
+}
+
+//HGET key field
+func hgetCommand(client *redisClient) {
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.null[client.resp])
+	if o == nil || checkType(client, o, redisHash) {
+		return
+	}
+	addHashFieldToReply(client, o, client.argv[2].ptr.(sds))
+}
+
+//HMGET key field [field ...]
+func hmgetCommand(client *redisClient) {
+	//key不存在时，所有的field都回复null
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o != nil && checkType(client, o, redisHash) {
+		return
+	}
+
+	addReplyArrayLen(client, client.argc-2)
+	for i := 2; i < client.argc; i++ {
+		addHashFieldToReply(client, o, client.argv[i].ptr.(sds))
+	}
+}
+
+//HDEL key field [field ...]
+func hdelCommand(client *redisClient) {
+	o := lookupKeyWriteOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisHash) {
+		return
+	}
+
+	deleted := 0
+	keyremoved := false
+	for i := 2; i < client.argc; i++ {
+		if hashTypeDelete(o, client.argv[i].ptr.(sds)) {
+			deleted++
+			//hash为空时删除key
+			if hashTypeLength(o) == 0 {
+				client.db.dbDelete(client.argv[1])
+				keyremoved = true
+				break
+			}
+		}
+	}
+	if deleted > 0 {
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyHash, "hdel", client.argv[1], client.db.id)
+		server.dirty += int64(deleted)
+		if keyremoved {
+			notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+		}
+	}
+	addReplyLongLong(client, int64(deleted))
+}
+
+//HLEN key
+func hlenCommand(client *redisClient) {
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisHash) {
+		return
+	}
+	addReplyLongLong(client, int64(hashTypeLength(o)))
+}
+
+//HSTRLEN key field
+func hstrlenCommand(client *redisClient) {
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisHash) {
+		return
+	}
+	value, _ := hashTypeGetValue(o, client.argv[2].ptr.(sds))
+	addReplyLongLong(client, int64(len(value)))
+}
+
+const (
+	redisHashKey   = 1 << 0
+	redisHashValue = 1 << 1
+)
+
+//HKEYS/HVALS/HGETALL的实现，flags表示需要返回field还是value
+func genericHgetallCommand(client *redisClient, flags int) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		if flags == redisHashKey|redisHashValue {
+			addReplyMapLen(client, 0)
+		} else {
+			addReply(client, shared.emptyarray)
+		}
+		return
+	}
+	if checkType(client, o, redisHash) {
+		return
+	}
+
+	length := hashTypeLength(o)
+	if flags == redisHashKey|redisHashValue {
+		addReplyMapLen(client, length)
+	} else {
+		addReplyArrayLen(client, length)
+	}
+
+	hashTypeForEach(o, func(field sds, value sds) bool {
+		if flags&redisHashKey != 0 {
+			addReplyBulkCBuffer(client, field)
+		}
+		if flags&redisHashValue != 0 {
+			addReplyBulkCBuffer(client, value)
+		}
+		return true
+	})
+}
+
+//HKEYS key
+func hkeysCommand(client *redisClient) {
+	genericHgetallCommand(client, redisHashKey)
+}
+
+//HVALS key
+func hvalsCommand(client *redisClient) {
+	genericHgetallCommand(client, redisHashValue)
+}
+
+//HGETALL key
+func hgetallCommand(client *redisClient) {
+	genericHgetallCommand(client, redisHashKey|redisHashValue)
+}
+
+//HEXISTS key field
+func hexistsCommand(client *redisClient) {
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisHash) {
+		return
+	}
+	addReplyBool(client, hashTypeExists(o, client.argv[2].ptr.(sds)))
+}
+
+//HSCAN key cursor [MATCH pattern] [COUNT count]
+func hscanCommand(client *redisClient) {
+	cursor, ok := parseScanCursorOrReply(client, client.argv[2])
+	if !ok {
+		return
+	}
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.emptyscan)
+	if o == nil || checkType(client, o, redisHash) {
+		return
+	}
+	scanGenericCommand(client, o, cursor)
+}
+
+//回复HRANDFIELD中的一个元素
+func addHashRandomElementToReply(client *redisClient, field sds, value sds, withvalues bool) {
+	if withvalues && client.resp > 2 {
+		addReplyArrayLen(client, 2)
+	}
+	addReplyBulkCBuffer(client, field)
+	if withvalues {
+		addReplyBulkCBuffer(client, value)
+	}
+}
+
+//HRANDFIELD key count [WITHVALUES]
+//count为正数时返回不重复的元素，负数时可能会返回重复的元素
+func hrandfieldWithCountCommand(client *redisClient, l int64, withvalues bool) {
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.emptyarray)
+	if o == nil || checkType(client, o, redisHash) {
+		return
+	}
+	size := int64(hashTypeLength(o))
+
+	if l == 0 {
+		addReply(client, shared.emptyarray)
+		return
+	}
+
+	replyLen := func(count int64) {
+		if withvalues && client.resp == 2 {
+			addReplyArrayLen(client, int(count*2))
+		} else {
+			addReplyArrayLen(client, int(count))
+		}
+	}
+
+	//CASE 1: count为负数，元素可以重复，随机返回|count|个元素
+	if l < 0 {
+		count := -l
+		replyLen(count)
+		for ; count > 0; count-- {
+			field, value := hashTypeRandomElement(o)
+			addHashRandomElementToReply(client, field, value, withvalues)
+		}
+		return
+	}
+
+	//CASE 2: count大于等于hash的元素数量，返回所有的元素
+	count := l
+	if count >= size {
+		replyLen(size)
+		hashTypeForEach(o, func(field sds, value sds) bool {
+			addHashRandomElementToReply(client, field, value, withvalues)
+			return true
+		})
+		return
+	}
+
+	//CASE 3: count接近hash的元素数量，复制所有的元素后随机删除多余的元素
+	//CASE 4: count比hash的元素数量小很多，随机选择元素直到足够的数量
+	picked := make(map[sds]sds, count)
+	if count*3 > size {
+		hashTypeForEach(o, func(field sds, value sds) bool {
+			picked[field] = value
+			return true
+		})
+		fields := make([]sds, 0, size)
+		for field := range picked {
+			fields = append(fields, field)
+		}
+		rand.Shuffle(len(fields), func(i, j int) {
+			fields[i], fields[j] = fields[j], fields[i]
+		})
+		for _, field := range fields[count:] {
+			delete(picked, field)
+		}
+	} else {
+		for int64(len(picked)) < count {
+			field, value := hashTypeRandomElement(o)
+			picked[field] = value
+		}
+	}
+
+	replyLen(count)
+	for field, value := range picked {
+		addHashRandomElementToReply(client, field, value, withvalues)
+	}
+}
+
+//HRANDFIELD key [count [WITHVALUES]]
+func hrandfieldCommand(client *redisClient) {
+	if client.argc >= 3 {
+		l, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+		if !ok {
+			return
+		}
+		withvalues := false
+		if client.argc > 4 || (client.argc == 4 && !strings.EqualFold(client.argv[3].ptr.(sds), "withvalues")) {
+			addReply(client, shared.syntaxerr)
+			return
+		} else if client.argc == 4 {
+			withvalues = true
+			if l < -math.MaxInt64/2 || l > math.MaxInt64/2 {
+				addReplyError(client, "value is out of range")
+				return
+			}
+		}
+		hrandfieldWithCountCommand(client, l, withvalues)
+		return
+	}
+
+	//没有count参数，返回一个随机的field
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.null[client.resp])
+	if o == nil || checkType(client, o, redisHash) {
+		return
+	}
+	field, _ := hashTypeRandomElement(o)
+	addReplyBulkCBuffer(client, field)
+}
@@ -0,0 +1,931 @@
+package redis
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	redisHead = 0
+	redisTail = 1
+)
+
+//-----------------------------------------------------------------------------
+// List API
+//-----------------------------------------------------------------------------
+
+//list的长度
+func listTypeLength(o *robj) int {
+	return o.ptr.(*rlist).Len()
+}
+
+//向list的头部或尾部添加元素
+func listTypePush(o *robj, value sds, where int) {
+	l := o.ptr.(*rlist)
+	if where == redisHead {
+		l.PushFront(value)
+	} else {
+		l.PushBack(value)
+	}
+}
+
+//从list的头部或尾部弹出元素，list为空时返回false
+func listTypePop(o *robj, where int) (sds, bool) {
+	l := o.ptr.(*rlist)
+	var e *list.Element
+	if where == redisHead {
+		e = l.Front()
+	} else {
+		e = l.Back()
+	}
+	if e == nil {
+		return "", false
+	}
+	return l.Remove(e).(sds), true
+}
+
+//复制list对象，用于COPY命令
+func listTypeDup(o *robj) *robj {
+	lobj := createListObject()
+	for e := o.ptr.(*rlist).Front(); e != nil; e = e.Next() {
+		listTypePush(lobj, e.Value.(sds), redisTail)
+	}
+	return lobj
+}
+
+//将LEFT/RIGHT参数转换为redisHead/redisTail
+func getListPositionFromObjectOrReply(client *redisClient, arg *robj) (int, bool) {
+	s := arg.ptr.(sds)
+	if strings.EqualFold(s, "right") {
+		return redisTail, true
+	} else if strings.EqualFold(s, "left") {
+		return redisHead, true
+	}
+	addReply(client, shared.syntaxerr)
+	return 0, false
+}
+
+//将start和end转换为[0, llen)中的下标，范围为空时返回false
+func listRangeIndexes(start int64, end int64, llen int64) (int64, int64, bool) {
+	if start < 0 {
+		start = llen + start
+	}
+	if end < 0 {
+		end = llen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= llen {
+		return 0, 0, false
+	}
+	if end >= llen {
+		end = llen - 1
+	}
+	return start, end, true
+}
+
+//-----------------------------------------------------------------------------
+// List Commands
+//-----------------------------------------------------------------------------
+
+//LPUSH/RPUSH/LPUSHX/RPUSHX的实现，xx为true时只有key存在才添加
+func pushGenericCommand(client *redisClient, where int, xx bool) {
+	lobj := client.db.lookupKeyWrite(client.argv[1])
+	if lobj != nil && checkType(client, lobj, redisList) {
+		return
+	}
+
+	if lobj == nil {
+		if xx {
+			addReply(client, shared.czero)
+			return
+		}
+		lobj = createListObject()
+		client.db.dbAdd(client.argv[1], lobj)
+	}
+
+	for j := 2; j < client.argc; j++ {
+		listTypePush(lobj, client.argv[j].ptr.(sds), where)
+	}
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyList, listPushEvent(where), client.argv[1], client.db.id)
+	server.dirty += int64(client.argc - 2)
+	addReplyLongLong(client, int64(listTypeLength(lobj)))
+}
+
+//LPUSH key element [element ...]
+func lpushCommand(client *redisClient) {
+	pushGenericCommand(client, redisHead, false)
+}
+
+//RPUSH key element [element ...]
+func rpushCommand(client *redisClient) {
+	pushGenericCommand(client, redisTail, false)
+}
+
+//LPUSHX key element [element ...]
+func lpushxCommand(client *redisClient) {
+	pushGenericCommand(client, redisHead, true)
+}
+
+//RPUSHX key element [element ...]
+func rpushxCommand(client *redisClient) {
+	pushGenericCommand(client, redisTail, true)
+}
+
+//LINSERT key BEFORE|AFTER pivot element
+func linsertCommand(client *redisClient) {
+	var after bool
+	if strings.EqualFold(client.argv[2].ptr.(sds), "after") {
+		after = true
+	} else if strings.EqualFold(client.argv[2].ptr.(sds), "before") {
+		after = false
+	} else {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	subject := lookupKeyWriteOrReply(client, client.argv[1], shared.czero)
+	if subject == nil || checkType(client, subject, redisList) {
+		return
+	}
+
+	//查找pivot，找不到时回复-1
+	l := subject.ptr.(*rlist)
+	pivot := client.argv[3].ptr.(sds)
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e.Value.(sds) == pivot {
+			if after {
+				l.InsertAfter(client.argv[4].ptr.(sds), e)
+			} else {
+				l.InsertBefore(client.argv[4].ptr.(sds), e)
+			}
+			client.db.signalModifiedKey(client.argv[1])
+			notifyKeyspaceEvent(notifyList, "linsert", client.argv[1], client.db.id)
+			server.dirty++
+			addReplyLongLong(client, int64(l.Len()))
+			return
+		}
+	}
+	addReplyLongLong(client, -1)
+}
+
+//LLEN key
+func llenCommand(client *redisClient) {
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisList) {
+		return
+	}
+	addReplyLongLong(client, int64(listTypeLength(o)))
+}
+
+//LINDEX key index
+func lindexCommand(client *redisClient) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		addReplyNull(client)
+		return
+	}
+	if checkType(client, o, redisList) {
+		return
+	}
+
+	index, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+
+	e := o.ptr.(*rlist).Index(int(index))
+	if e == nil {
+		addReplyNull(client)
+		return
+	}
+	addReplyBulkCBuffer(client, e.Value.(sds))
+}
+
+//LSET key index element
+func lsetCommand(client *redisClient) {
+	o := lookupKeyWriteOrReply(client, client.argv[1], shared.nokeyerr)
+	if o == nil || checkType(client, o, redisList) {
+		return
+	}
+
+	index, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+
+	e := o.ptr.(*rlist).Index(int(index))
+	if e == nil {
+		addReply(client, shared.outofrangeerr)
+		return
+	}
+	e.Value = client.argv[3].ptr.(sds)
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyList, "lset", client.argv[1], client.db.id)
+	server.dirty++
+	addReply(client, shared.ok)
+}
+
+//添加元素的事件名称
+func listPushEvent(where int) string {
+	if where == redisHead {
+		return "lpush"
+	}
+	return "rpush"
+}
+
+//弹出元素的事件名称
+func listPopEvent(where int) string {
+	if where == redisHead {
+		return "lpop"
+	}
+	return "rpop"
+}
+
+//从list的where端弹出元素之后调用，发布事件，list为空时删除key
+func listElementsRemoved(db *redisDb, key *robj, where int, o *robj) {
+	notifyKeyspaceEvent(notifyList, listPopEvent(where), key, db.id)
+	if listTypeLength(o) == 0 {
+		db.dbDelete(key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key, db.id)
+	}
+	db.signalModifiedKey(key)
+	server.dirty++
+}
+
+//LPOP/RPOP的实现
+//LPOP key [count]
+func popGenericCommand(client *redisClient, where int) {
+	hascount := client.argc == 3
+	var count int64
+
+	if client.argc > 3 {
+		addReplyError(client, "wrong number of arguments for '"+client.cmd.name+"' command")
+		return
+	} else if hascount {
+		var ok bool
+		count, ok = getPositiveLongFromObjectOrReply(client, client.argv[2], "value is out of range, must be positive")
+		if !ok {
+			return
+		}
+	}
+
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o == nil {
+		if hascount {
+			addReplyNullArray(client)
+		} else {
+			addReplyNull(client)
+		}
+		return
+	}
+	if checkType(client, o, redisList) {
+		return
+	}
+
+	if hascount && count == 0 {
+		addReply(client, shared.emptyarray)
+		return
+	}
+
+	if !hascount {
+		value, _ := listTypePop(o, where)
+		addReplyBulkCBuffer(client, value)
+	} else {
+		llen := int64(listTypeLength(o))
+		if count > llen {
+			count = llen
+		}
+		addReplyArrayLen(client, int(count))
+		for ; count > 0; count-- {
+			value, _ := listTypePop(o, where)
+			addReplyBulkCBuffer(client, value)
+		}
+	}
+
+	listElementsRemoved(client.db, client.argv[1], where, o)
+}
+
+//LPOP key [count]
+func lpopCommand(client *redisClient) {
+	popGenericCommand(client, redisHead)
+}
+
+//RPOP key [count]
+func rpopCommand(client *redisClient) {
+	popGenericCommand(client, redisTail)
+}
+
+//LRANGE key start stop
+func lrangeCommand(client *redisClient) {
+	start, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongLongFromObjectOrReply(client, client.argv[3], "")
+	if !ok {
+		return
+	}
+
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.emptyarray)
+	if o == nil || checkType(client, o, redisList) {
+		return
+	}
+
+	llen := int64(listTypeLength(o))
+	start, end, ok = listRangeIndexes(start, end, llen)
+	if !ok {
+		addReply(client, shared.emptyarray)
+		return
+	}
+
+	rangelen := end - start + 1
+	addReplyArrayLen(client, int(rangelen))
+	e := o.ptr.(*rlist).Index(int(start))
+	for ; rangelen > 0; rangelen-- {
+		addReplyBulkCBuffer(client, e.Value.(sds))
+		e = e.Next()
+	}
+}
+
+//LTRIM key start stop
+func ltrimCommand(client *redisClient) {
+	start, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongLongFromObjectOrReply(client, client.argv[3], "")
+	if !ok {
+		return
+	}
+
+	o := lookupKeyWriteOrReply(client, client.argv[1], shared.ok)
+	if o == nil || checkType(client, o, redisList) {
+		return
+	}
+
+	//计算头部和尾部需要删除的元素数量
+	llen := int64(listTypeLength(o))
+	var ltrim, rtrim int64
+	start, end, ok = listRangeIndexes(start, end, llen)
+	if !ok {
+		//范围为空，删除所有元素
+		ltrim = llen
+		rtrim = 0
+	} else {
+		ltrim = start
+		rtrim = llen - end - 1
+	}
+
+	l := o.ptr.(*rlist)
+	for j := int64(0); j < ltrim; j++ {
+		l.Remove(l.Front())
+	}
+	for j := int64(0); j < rtrim; j++ {
+		l.Remove(l.Back())
+	}
+
+	notifyKeyspaceEvent(notifyList, "ltrim", client.argv[1], client.db.id)
+	server.dirty++
+	if l.Len() == 0 {
+		client.db.dbDelete(client.argv[1])
+		notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+	}
+	client.db.signalModifiedKey(client.argv[1])
+	addReply(client, shared.ok)
+}
+
+//LREM key count element
+//count > 0: 从头部开始删除count个元素
+//count < 0: 从尾部开始删除-count个元素
+//count = 0: 删除所有相等的元素
+func lremCommand(client *redisClient) {
+	toremove, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+
+	o := lookupKeyWriteOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisList) {
+		return
+	}
+
+	l := o.ptr.(*rlist)
+	element := client.argv[3].ptr.(sds)
+	var removed int64
+	if toremove < 0 {
+		toremove = -toremove
+		for e := l.Back(); e != nil; {
+			prev := e.Prev()
+			if e.Value.(sds) == element {
+				l.Remove(e)
+				removed++
+				if toremove != 0 && removed == toremove {
+					break
+				}
+			}
+			e = prev
+		}
+	} else {
+		for e := l.Front(); e != nil; {
+			next := e.Next()
+			if e.Value.(sds) == element {
+				l.Remove(e)
+				removed++
+				if toremove != 0 && removed == toremove {
+					break
+				}
+			}
+			e = next
+		}
+	}
+
+	if removed > 0 {
+		notifyKeyspaceEvent(notifyList, "lrem", client.argv[1], client.db.id)
+		server.dirty += int64(removed)
+		if l.Len() == 0 {
+			client.db.dbDelete(client.argv[1])
+			notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+		}
+		client.db.signalModifiedKey(client.argv[1])
+	}
+	addReplyLongLong(client, removed)
+}
+
+//LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+//rank为正数时从头部开始查找，负数时从尾部开始查找，跳过前|rank|-1个匹配的元素
+func lposCommand(client *redisClient) {
+	ele := client.argv[2].ptr.(sds)
+	var rank int64 = 1
+	var count int64 = -1
+	var maxlen int64 = 0
+
+	for j := 3; j < client.argc; j++ {
+		opt := client.argv[j].ptr.(sds)
+		moreargs := client.argc - 1 - j
+
+		if strings.EqualFold(opt, "RANK") && moreargs > 0 {
+			j++
+			var ok bool
+			if rank, ok = getLongLongFromObjectOrReply(client, client.argv[j], ""); !ok {
+				return
+			}
+			if rank == 0 {
+				addReplyError(client, "RANK can't be zero: use 1 to start from "+
+					"the first match, 2 from the second ... "+
+					"or use negative to start from the end of the list")
+				return
+			}
+			//从尾部查找时需要取反，LLONG_MIN取反会溢出
+			if rank == math.MinInt64 {
+				addReplyError(client, fmt.Sprintf("value is out of range, value must between %d and %d",
+					int64(math.MinInt64+1), int64(math.MaxInt64)))
+				return
+			}
+		} else if strings.EqualFold(opt, "COUNT") && moreargs > 0 {
+			j++
+			var ok bool
+			if count, ok = getLongLongFromObjectOrReply(client, client.argv[j], ""); !ok {
+				return
+			}
+			if count < 0 {
+				addReplyError(client, "COUNT can't be negative")
+				return
+			}
+		} else if strings.EqualFold(opt, "MAXLEN") && moreargs > 0 {
+			j++
+			var ok bool
+			if maxlen, ok = getLongLongFromObjectOrReply(client, client.argv[j], ""); !ok {
+				return
+			}
+			if maxlen < 0 {
+				addReplyError(client, "MAXLEN can't be negative")
+				return
+			}
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o != nil && checkType(client, o, redisList) {
+		return
+	}
+	if o == nil {
+		if count != -1 {
+			addReply(client, shared.emptyarray)
+		} else {
+			addReplyNull(client)
+		}
+		return
+	}
+
+	l := o.ptr.(*rlist)
+	var matches []int64
+	var e *list.Element
+	var index int64
+	direction := redisHead
+	if rank < 0 {
+		rank = -rank
+		direction = redisTail
+		e = l.Back()
+		index = int64(l.Len()) - 1
+	} else {
+		e = l.Front()
+	}
+
+	var checked int64
+	for e != nil && (maxlen == 0 || checked < maxlen) {
+		if e.Value.(sds) == ele {
+			if rank == 1 {
+				matches = append(matches, index)
+				//没有COUNT时只需要第一个匹配的元素，COUNT 0表示返回所有匹配的元素
+				if count == -1 || (count > 0 && int64(len(matches)) == count) {
+					break
+				}
+			} else {
+				rank--
+			}
+		}
+		checked++
+		if direction == redisHead {
+			e = e.Next()
+			index++
+		} else {
+			e = e.Prev()
+			index--
+		}
+	}
+
+	if count != -1 {
+		addReplyArrayLen(client, len(matches))
+		for _, idx := range matches {
+			addReplyLongLong(client, idx)
+		}
+	} else {
+		if len(matches) > 0 {
+			addReplyLongLong(client, matches[0])
+		} else {
+			addReplyNull(client)
+		}
+	}
+}
+
+//将value添加到目标list中，目标list不存在时创建
+func lmoveHandlePush(client *redisClient, dstkey *robj, dstobj *robj, value sds, where int) {
+	if dstobj == nil {
+		dstobj = createListObject()
+		client.db.dbAdd(dstkey, dstobj)
+	}
+	listTypePush(dstobj, value, where)
+	client.db.signalModifiedKey(dstkey)
+	notifyKeyspaceEvent(notifyList, listPushEvent(where), dstkey, client.db.id)
+	server.dirty++
+	addReplyBulkCBuffer(client, value)
+}
+
+//LMOVE和RPOPLPUSH的实现，从source的wherefrom端弹出元素，添加到destination的whereto端
+func lmoveGenericCommand(client *redisClient, wherefrom int, whereto int) {
+	sobj := lookupKeyWriteOrReply(client, client.argv[1], shared.null[client.resp])
+	if sobj == nil || checkType(client, sobj, redisList) {
+		return
+	}
+
+	if listTypeLength(sobj) == 0 {
+		//list为空时key会被删除，这里不会出现
+		addReplyNull(client)
+		return
+	}
+
+	dobj := client.db.lookupKeyWrite(client.argv[2])
+	if dobj != nil && checkType(client, dobj, redisList) {
+		return
+	}
+
+	value, _ := listTypePop(sobj, wherefrom)
+	lmoveHandlePush(client, client.argv[2], dobj, value, whereto)
+
+	//source和destination相同时，list不会为空
+	listElementsRemoved(client.db, client.argv[1], wherefrom, sobj)
+}
+
+//LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func lmoveCommand(client *redisClient) {
+	wherefrom, ok := getListPositionFromObjectOrReply(client, client.argv[3])
+	if !ok {
+		return
+	}
+	whereto, ok := getListPositionFromObjectOrReply(client, client.argv[4])
+	if !ok {
+		return
+	}
+	lmoveGenericCommand(client, wherefrom, whereto)
+}
+
+//RPOPLPUSH source destination
+func rpoplpushCommand(client *redisClient) {
+	lmoveGenericCommand(client, redisTail, redisHead)
+}
+
+//-----------------------------------------------------------------------------
+// Blocking POP operations
+//-----------------------------------------------------------------------------
+
+//list的一端对应的LEFT/RIGHT参数
+func getStringObjectFromListPosition(where int) *robj {
+	if where == redisHead {
+		return shared.left
+	}
+	return shared.right
+}
+
+//list的一端对应的LPOP/RPOP命令
+func getPopCommandFromListPosition(where int) *robj {
+	if where == redisHead {
+		return shared.lpop
+	}
+	return shared.rpop
+}
+
+//回复被唤醒的客户端，value为从key的wherefrom端弹出的元素
+//BLMOVE需要将元素添加到目标list中，目标key类型错误时返回err，调用方需要将元素放回原list
+func serveClientBlockedOnList(receiver *redisClient, key *robj, db *redisDb, value sds, wherefrom int) int {
+	if receiver.bpop.target == nil {
+		//BLPOP/BRPOP，传播为LPOP/RPOP
+		alsoPropagate(db.id, []*robj{getPopCommandFromListPosition(wherefrom), key})
+		addReplyArrayLen(receiver, 2)
+		addReplyBulkCBuffer(receiver, key.ptr.(sds))
+		addReplyBulkCBuffer(receiver, value)
+	} else {
+		//BLMOVE，传播为LMOVE
+		dstkey := receiver.bpop.target
+		dstobj := db.lookupKeyWrite(dstkey)
+		if dstobj != nil && checkType(receiver, dstobj, redisList) {
+			return redisErr
+		}
+		lmoveHandlePush(receiver, dstkey, dstobj, value, receiver.bpop.whereto)
+		alsoPropagate(db.id, []*robj{shared.lmove, key, dstkey,
+			getStringObjectFromListPosition(wherefrom), getStringObjectFromListPosition(receiver.bpop.whereto)})
+	}
+	return redisOk
+}
+
+//按照阻塞的先后顺序唤醒阻塞在list上的客户端，直到list为空
+func serveClientsBlockedOnListKey(o *robj, rl *readyList) {
+	de := rl.db.blockingKeys.dictFind(rl.key.ptr)
+	if de == nil {
+		return
+	}
+	clients := de.(*list.List)
+
+	var next *list.Element
+	for e := clients.Front(); e != nil && listTypeLength(o) > 0; e = next {
+		next = e.Next()
+		receiver := e.Value.(*redisClient)
+		//同一个key上可能还有阻塞在其它类型上的客户端（比如XREAD）
+		if receiver.btype != redisBlockedList {
+			continue
+		}
+		wherefrom := receiver.bpop.wherefrom
+
+		if receiver.bpop.count > 0 {
+			//BLMPOP，一次弹出多个元素
+			count := receiver.bpop.count
+			llen := int64(listTypeLength(o))
+			if count > llen {
+				count = llen
+			}
+			//传播为LPOP/RPOP key count
+			alsoPropagate(rl.db.id, []*robj{getPopCommandFromListPosition(wherefrom), rl.key,
+				createStringObjectFromLongLong(count)})
+			addReplyArrayLen(receiver, 2)
+			addReplyBulkCBuffer(receiver, rl.key.ptr.(sds))
+			addReplyArrayLen(receiver, int(count))
+			for ; count > 0; count-- {
+				value, _ := listTypePop(o, wherefrom)
+				addReplyBulkCBuffer(receiver, value)
+			}
+			notifyKeyspaceEvent(notifyList, listPopEvent(wherefrom), rl.key, rl.db.id)
+			server.dirty++
+		} else {
+			value, _ := listTypePop(o, wherefrom)
+			if serveClientBlockedOnList(receiver, rl.key, rl.db, value, wherefrom) == redisErr {
+				//目标key的类型错误，将元素放回原list
+				listTypePush(o, value, wherefrom)
+			} else {
+				notifyKeyspaceEvent(notifyList, listPopEvent(wherefrom), rl.key, rl.db.id)
+				server.dirty++
+			}
+		}
+
+		//unblockClient会将客户端从clients中移除
+		unblockClient(receiver)
+	}
+
+	if listTypeLength(o) == 0 {
+		rl.db.dbDelete(rl.key)
+		notifyKeyspaceEvent(notifyGeneric, "del", rl.key, rl.db.id)
+	}
+	rl.db.signalModifiedKey(rl.key)
+}
+
+//BLPOP/BRPOP的实现
+//BLPOP key [key ...] timeout
+func blockingPopGenericCommand(client *redisClient, where int) {
+	timeout, ok := getTimeoutFromObjectOrReply(client, client.argv[client.argc-1], unitSeconds)
+	if !ok {
+		return
+	}
+
+	for j := 1; j < client.argc-1; j++ {
+		o := client.db.lookupKeyWrite(client.argv[j])
+		if o == nil {
+			continue
+		}
+		if checkType(client, o, redisList) {
+			return
+		}
+		if listTypeLength(o) == 0 {
+			continue
+		}
+
+		//有数据，不需要阻塞
+		value, _ := listTypePop(o, where)
+		addReplyArrayLen(client, 2)
+		addReplyBulk(client, client.argv[j])
+		addReplyBulkCBuffer(client, value)
+		listElementsRemoved(client.db, client.argv[j], where, o)
+
+		//传播为LPOP/RPOP key
+		rewriteClientCommandVector(client, getPopCommandFromListPosition(where), client.argv[j])
+		return
+	}
+
+	//在事务中或者不能阻塞时，当作超时处理
+	if client.flags&(redisMulti|redisDenyBlocking) != 0 {
+		addReplyNullArray(client)
+		return
+	}
+
+	//所有的list都为空，阻塞客户端
+	client.bpop.wherefrom = where
+	blockForKeys(client, redisBlockedList, client.argv[1:client.argc-1], timeout, nil, nil)
+}
+
+//BLPOP key [key ...] timeout
+func blpopCommand(client *redisClient) {
+	blockingPopGenericCommand(client, redisHead)
+}
+
+//BRPOP key [key ...] timeout
+func brpopCommand(client *redisClient) {
+	blockingPopGenericCommand(client, redisTail)
+}
+
+//BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func blmoveCommand(client *redisClient) {
+	wherefrom, ok := getListPositionFromObjectOrReply(client, client.argv[3])
+	if !ok {
+		return
+	}
+	whereto, ok := getListPositionFromObjectOrReply(client, client.argv[4])
+	if !ok {
+		return
+	}
+	timeout, ok := getTimeoutFromObjectOrReply(client, client.argv[5], unitSeconds)
+	if !ok {
+		return
+	}
+
+	key := client.db.lookupKeyWrite(client.argv[1])
+	if key != nil && checkType(client, key, redisList) {
+		return
+	}
+	if key == nil {
+		//在事务中或者不能阻塞时，当作超时处理
+		if client.flags&(redisMulti|redisDenyBlocking) != 0 {
+			addReplyNull(client)
+			return
+		}
+		//source为空，阻塞客户端
+		client.bpop.wherefrom = wherefrom
+		client.bpop.whereto = whereto
+		blockForKeys(client, redisBlockedList, client.argv[1:2], timeout, client.argv[2], nil)
+		return
+	}
+
+	//source不为空，和LMOVE一样，传播为LMOVE
+	lmoveGenericCommand(client, wherefrom, whereto)
+	rewriteClientCommandVector(client, shared.lmove, client.argv[1], client.argv[2], client.argv[3], client.argv[4])
+}
+
+//LMPOP和BLMPOP的实现，numkeysIdx为numkeys参数的位置
+//LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count]
+//BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func lmpopGenericCommand(client *redisClient, numkeysIdx int, timeout int64, blocking bool) {
+	numkeys, ok := getLongLongFromObjectOrReply(client, client.argv[numkeysIdx], "")
+	if !ok {
+		return
+	}
+	if numkeys <= 0 {
+		addReplyError(client, "numkeys should be greater than 0")
+		return
+	}
+
+	//numkeys后面至少需要numkeys个key和LEFT|RIGHT
+	whereIdx := int64(numkeysIdx) + numkeys + 1
+	if whereIdx >= int64(client.argc) {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+	where, ok := getListPositionFromObjectOrReply(client, client.argv[whereIdx])
+	if !ok {
+		return
+	}
+
+	var count int64 = -1
+	for j := int(whereIdx) + 1; j < client.argc; j++ {
+		opt := client.argv[j].ptr.(sds)
+		moreargs := client.argc - 1 - j
+		if count == -1 && strings.EqualFold(opt, "COUNT") && moreargs > 0 {
+			j++
+			if count, ok = getLongLongFromObjectOrReply(client, client.argv[j], ""); !ok {
+				return
+			}
+			if count <= 0 {
+				addReplyError(client, "count should be greater than 0")
+				return
+			}
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+	if count == -1 {
+		count = 1
+	}
+
+	keys := client.argv[numkeysIdx+1 : whereIdx]
+	for _, key := range keys {
+		o := client.db.lookupKeyWrite(key)
+		if o == nil {
+			continue
+		}
+		if checkType(client, o, redisList) {
+			return
+		}
+		if listTypeLength(o) == 0 {
+			continue
+		}
+
+		//回复 [key, [element ...]]
+		llen := int64(listTypeLength(o))
+		n := count
+		if n > llen {
+			n = llen
+		}
+		addReplyArrayLen(client, 2)
+		addReplyBulk(client, key)
+		addReplyArrayLen(client, int(n))
+		countObj := createStringObjectFromLongLong(n)
+		for ; n > 0; n-- {
+			value, _ := listTypePop(o, where)
+			addReplyBulkCBuffer(client, value)
+		}
+		listElementsRemoved(client.db, key, where, o)
+
+		//传播为LPOP/RPOP key count
+		rewriteClientCommandVector(client, getPopCommandFromListPosition(where), key, countObj)
+		return
+	}
+
+	//在事务中或者不能阻塞时，当作超时处理
+	if !blocking || client.flags&(redisMulti|redisDenyBlocking) != 0 {
+		addReplyNullArray(client)
+		return
+	}
+
+	//所有的list都为空，阻塞客户端
+	client.bpop.wherefrom = where
+	client.bpop.count = count
+	blockForKeys(client, redisBlockedList, keys, timeout, nil, nil)
+}
+
+//LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func lmpopCommand(client *redisClient) {
+	lmpopGenericCommand(client, 1, 0, false)
+}
+
+//BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func blmpopCommand(client *redisClient) {
+	timeout, ok := getTimeoutFromObjectOrReply(client, client.argv[1], unitSeconds)
+	if !ok {
+		return
+	}
+	lmpopGenericCommand(client, 2, timeout, true)
+}
@@ -0,0 +1,32 @@
+package redis
+
+import "testing"
+
+func TestLposRank(t *testing.T) {
+	c := newTestConn(t)
+	defer c.command("del", "mylist")
+	c.command("rpush", "mylist", "a", "b", "c", "a", "b", "a")
+
+	tests := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"rank", "1"}, ":0\r\n"},
+		{[]string{"rank", "2"}, ":3\r\n"},
+		{[]string{"rank", "-1"}, ":5\r\n"},
+		{[]string{"rank", "-3"}, ":0\r\n"},
+		{[]string{"rank", "-4"}, "$-1\r\n"},
+		{[]string{"rank", "9223372036854775807"}, "$-1\r\n"},
+		{[]string{"rank", "-9223372036854775807"}, "$-1\r\n"},
+		{[]string{"rank", "0"}, "-ERR RANK can't be zero: use 1 to start from the first match, " +
+			"2 from the second ... or use negative to start from the end of the list\r\n"},
+		{[]string{"rank", "-9223372036854775808"}, "-ERR value is out of range, " +
+			"value must between -9223372036854775807 and 9223372036854775807\r\n"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"lpos", "mylist", "a"}, tt.args...)
+		if reply := c.command(args...); reply != tt.reply {
+			t.Errorf("%v: got %q, want %q", args, reply, tt.reply)
+		}
+	}
+}
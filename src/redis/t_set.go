@@ -0,0 +1,695 @@
+package redis
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Set Commands
+//-----------------------------------------------------------------------------
+
+//根据第一个元素创建set对象，元素为整数时使用intset编码
+func setTypeCreate(value sds) *robj {
+	if _, ok := string2ll(value); ok {
+		return createIntsetObject()
+	}
+	return createSetObject()
+}
+
+//添加元素，已经存在时返回false
+func setTypeAdd(subject *robj, value sds) bool {
+	if subject.encoding == redisEncodingHt {
+		return subject.ptr.(*dict).dictAdd(value, struct{}{}) == dictOk
+	} else if subject.encoding == redisEncodingIntset {
+		if llval, ok := string2ll(value); ok {
+			is := subject.ptr.(*intset)
+			if !is.intsetAdd(llval) {
+				return false
+			}
+			//元素数量超过限制时转换为hashtable编码
+			if is.intsetLen() > server.setMaxIntsetEntries {
+				setTypeConvert(subject, redisEncodingHt)
+			}
+			return true
+		}
+		//不是整数，转换为hashtable编码后再添加
+		setTypeConvert(subject, redisEncodingHt)
+		subject.ptr.(*dict).dictAdd(value, struct{}{})
+		return true
+	}
+	panic("Unknown set encoding")
+}
+
+//删除元素，不存在时返回false
+func setTypeRemove(setobj *robj, value sds) bool {
+	if setobj.encoding == redisEncodingHt {
+		d := setobj.ptr.(*dict)
+		if d.dictDelete(value) != dictOk {
+			return false
+		}
+		if htNeedsResize(d) {
+			d.dictResize()
+		}
+		return true
+	} else if setobj.encoding == redisEncodingIntset {
+		if llval, ok := string2ll(value); ok {
+			return setobj.ptr.(*intset).intsetRemove(llval)
+		}
+		return false
+	}
+	panic("Unknown set encoding")
+}
+
+func setTypeIsMember(set *robj, value sds) bool {
+	if set.encoding == redisEncodingHt {
+		return set.ptr.(*dict).dictFind(value) != nil
+	} else if set.encoding == redisEncodingIntset {
+		if llval, ok := string2ll(value); ok {
+			return set.ptr.(*intset).intsetFind(llval)
+		}
+		return false
+	}
+	panic("Unknown set encoding")
+}
+
+//set中元素的数量
+func setTypeSize(subject *robj) int {
+	if subject.encoding == redisEncodingHt {
+		return subject.ptr.(*dict).used()
+	} else if subject.encoding == redisEncodingIntset {
+		return subject.ptr.(*intset).intsetLen()
+	}
+	panic("Unknown set encoding")
+}
+
+//遍历set中的所有元素，fn返回false时停止遍历
+func setTypeForEach(subject *robj, fn func(value sds) bool) {
+	if subject.encoding == redisEncodingHt {
+		subject.ptr.(*dict).dictForEach(func(k interface{}, _ interface{}) bool {
+			return fn(k.(sds))
+		})
+	} else if subject.encoding == redisEncodingIntset {
+		for _, v := range *subject.ptr.(*intset) {
+			if !fn(ll2string(v)) {
+				return
+			}
+		}
+	} else {
+		panic("Unknown set encoding")
+	}
+}
+
+//随机返回一个元素
+func setTypeRandomElement(setobj *robj) sds {
+	if setobj.encoding == redisEncodingHt {
+		return setobj.ptr.(*dict).dictGetRandomKey().(sds)
+	} else if setobj.encoding == redisEncodingIntset {
+		return ll2string(setobj.ptr.(*intset).intsetRandom())
+	}
+	panic("Unknown set encoding")
+}
+
+//转换set的编码，只支持intset转换为hashtable
+func setTypeConvert(setobj *robj, enc uint8) {
+	if setobj.encoding != redisEncodingIntset || enc != redisEncodingHt {
+		panic("Unsupported set conversion")
+	}
+	d := dictCreate()
+	for _, v := range *setobj.ptr.(*intset) {
+		d.dictAdd(ll2string(v), struct{}{})
+	}
+	setobj.ptr = d
+	setobj.encoding = redisEncodingHt
+}
+
+//复制set对象，编码保持不变，用于COPY命令
+func setTypeDup(o *robj) *robj {
+	var set *robj
+	if o.encoding == redisEncodingIntset {
+		set = createIntsetObject()
+		is := append(intset(nil), *o.ptr.(*intset)...)
+		set.ptr = &is
+	} else if o.encoding == redisEncodingHt {
+		set = createSetObject()
+		setTypeForEach(o, func(value sds) bool {
+			setTypeAdd(set, value)
+			return true
+		})
+	} else {
+		panic("Unknown set encoding")
+	}
+	return set
+}
+
+//SADD key member [member ...]
+func saddCommand(client *redisClient) {
+	set := client.db.lookupKeyWrite(client.argv[1])
+	if set == nil {
+		set = setTypeCreate(client.argv[2].ptr.(sds))
+		client.db.dbAdd(client.argv[1], set)
+	} else if set.rtype != redisSet {
+		addReply(client, shared.wrongtypeerr)
+		return
+	}
+
+	added := 0
+	for j := 2; j < client.argc; j++ {
+		if setTypeAdd(set, client.argv[j].ptr.(sds)) {
+			added++
+		}
+	}
+	if added > 0 {
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifySet, "sadd", client.argv[1], client.db.id)
+		server.dirty += int64(added)
+	}
+	addReplyLongLong(client, int64(added))
+}
+
+//SREM key member [member ...]
+func sremCommand(client *redisClient) {
+	set := lookupKeyWriteOrReply(client, client.argv[1], shared.czero)
+	if set == nil || checkType(client, set, redisSet) {
+		return
+	}
+
+	deleted := 0
+	keyremoved := false
+	for j := 2; j < client.argc; j++ {
+		if setTypeRemove(set, client.argv[j].ptr.(sds)) {
+			deleted++
+			//set为空时删除key
+			if setTypeSize(set) == 0 {
+				client.db.dbDelete(client.argv[1])
+				keyremoved = true
+				break
+			}
+		}
+	}
+	if deleted > 0 {
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifySet, "srem", client.argv[1], client.db.id)
+		server.dirty += int64(deleted)
+		if keyremoved {
+			notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+		}
+	}
+	addReplyLongLong(client, int64(deleted))
+}
+
+//SMOVE source destination member
+func smoveCommand(client *redisClient) {
+	srcset := client.db.lookupKeyWrite(client.argv[1])
+	dstset := client.db.lookupKeyWrite(client.argv[2])
+	ele := client.argv[3].ptr.(sds)
+
+	//source不存在时回复0
+	if srcset == nil {
+		addReply(client, shared.czero)
+		return
+	}
+
+	if checkType(client, srcset, redisSet) || (dstset != nil && checkType(client, dstset, redisSet)) {
+		return
+	}
+
+	//source和destination相同时，只需要检查元素是否存在
+	if srcset == dstset {
+		if setTypeIsMember(srcset, ele) {
+			addReply(client, shared.cone)
+		} else {
+			addReply(client, shared.czero)
+		}
+		return
+	}
+
+	//元素不存在时回复0
+	if !setTypeRemove(srcset, ele) {
+		addReply(client, shared.czero)
+		return
+	}
+
+	notifyKeyspaceEvent(notifySet, "srem", client.argv[1], client.db.id)
+	if setTypeSize(srcset) == 0 {
+		client.db.dbDelete(client.argv[1])
+		notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+	}
+	client.db.signalModifiedKey(client.argv[1])
+
+	if dstset == nil {
+		dstset = setTypeCreate(ele)
+		client.db.dbAdd(client.argv[2], dstset)
+	}
+	if setTypeAdd(dstset, ele) {
+		notifyKeyspaceEvent(notifySet, "sadd", client.argv[2], client.db.id)
+	}
+	client.db.signalModifiedKey(client.argv[2])
+	server.dirty++
+	addReply(client, shared.cone)
+}
+
+//SISMEMBER key member
+func sismemberCommand(client *redisClient) {
+	set := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if set == nil || checkType(client, set, redisSet) {
+		return
+	}
+	if setTypeIsMember(set, client.argv[2].ptr.(sds)) {
+		addReply(client, shared.cone)
+	} else {
+		addReply(client, shared.czero)
+	}
+}
+
+//SMISMEMBER key member [member ...]
+func smismemberCommand(client *redisClient) {
+	//key不存在时，所有的元素都回复0
+	set := client.db.lookupKeyRead(client.argv[1])
+	if set != nil && checkType(client, set, redisSet) {
+		return
+	}
+
+	addReplyArrayLen(client, client.argc-2)
+	for j := 2; j < client.argc; j++ {
+		if set != nil && setTypeIsMember(set, client.argv[j].ptr.(sds)) {
+			addReply(client, shared.cone)
+		} else {
+			addReply(client, shared.czero)
+		}
+	}
+}
+
+//SCARD key
+func scardCommand(client *redisClient) {
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisSet) {
+		return
+	}
+	addReplyLongLong(client, int64(setTypeSize(o)))
+}
+
+//SPOP count传播为SREM时，每个SREM最多包含的元素数量
+const spopBatchSize = 1024
+
+//SPOP key count
+func spopWithCountCommand(client *redisClient) {
+	count, ok := getPositiveLongFromObjectOrReply(client, client.argv[2], "value is out of range, must be positive")
+	if !ok {
+		return
+	}
+
+	set := lookupKeyWriteOrReply(client, client.argv[1], shared.emptyarray)
+	if set == nil || checkType(client, set, redisSet) {
+		return
+	}
+
+	if count == 0 {
+		addReply(client, shared.emptyarray)
+		return
+	}
+
+	size := int64(setTypeSize(set))
+
+	//CASE 1: count大于等于set的元素数量，返回所有的元素并删除key
+	if count >= size {
+		addReplySetLen(client, int(size))
+		setTypeForEach(set, func(value sds) bool {
+			addReplyBulkCBuffer(client, value)
+			return true
+		})
+		client.db.dbDelete(client.argv[1])
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifySet, "spop", client.argv[1], client.db.id)
+		server.dirty++
+		notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+		//传播为DEL
+		rewriteClientCommandVector(client, shared.del, client.argv[1])
+		return
+	}
+
+	//CASE 2: 随机弹出count个元素
+	//弹出的元素是随机的，传播为SREM，每个SREM最多包含spopBatchSize个元素
+	addReplySetLen(client, int(count))
+	argv := []*robj{shared.srem, client.argv[1]}
+	for ; count > 0; count-- {
+		value := setTypeRandomElement(set)
+		setTypeRemove(set, value)
+		addReplyBulkCBuffer(client, value)
+
+		argv = append(argv, createStringObject(value))
+		if len(argv)-2 == spopBatchSize || count == 1 {
+			alsoPropagate(client.db.id, argv)
+			argv = []*robj{shared.srem, client.argv[1]}
+		}
+	}
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifySet, "spop", client.argv[1], client.db.id)
+	server.dirty++
+	preventCommandPropagation(client)
+}
+
+//SPOP key [count]
+func spopCommand(client *redisClient) {
+	if client.argc == 3 {
+		spopWithCountCommand(client)
+		return
+	} else if client.argc > 3 {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	set := lookupKeyWriteOrReply(client, client.argv[1], shared.null[client.resp])
+	if set == nil || checkType(client, set, redisSet) {
+		return
+	}
+
+	value := setTypeRandomElement(set)
+	setTypeRemove(set, value)
+	addReplyBulkCBuffer(client, value)
+
+	//弹出的元素是随机的，传播为SREM key member
+	rewriteClientCommandVector(client, shared.srem, client.argv[1], createStringObject(value))
+
+	notifyKeyspaceEvent(notifySet, "spop", client.argv[1], client.db.id)
+	server.dirty++
+	if setTypeSize(set) == 0 {
+		client.db.dbDelete(client.argv[1])
+		notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+	}
+	client.db.signalModifiedKey(client.argv[1])
+}
+
+//SRANDMEMBER key count
+//count为正数时返回不重复的元素，负数时可能会返回重复的元素
+func srandmemberWithCountCommand(client *redisClient) {
+	l, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+
+	set := lookupKeyReadOrReply(client, client.argv[1], shared.emptyarray)
+	if set == nil || checkType(client, set, redisSet) {
+		return
+	}
+
+	if l == 0 {
+		addReply(client, shared.emptyarray)
+		return
+	}
+
+	//CASE 1: count为负数，元素可以重复，随机返回|count|个元素
+	if l < 0 {
+		if l == math.MinInt64 {
+			addReplyError(client, "value is out of range")
+			return
+		}
+		count := -l
+		addReplyArrayLen(client, int(count))
+		for ; count > 0; count-- {
+			addReplyBulkCBuffer(client, setTypeRandomElement(set))
+		}
+		return
+	}
+
+	//CASE 2: count大于等于set的元素数量，返回所有的元素
+	count := l
+	size := int64(setTypeSize(set))
+	if count >= size {
+		addReplySetLen(client, int(size))
+		setTypeForEach(set, func(value sds) bool {
+			addReplyBulkCBuffer(client, value)
+			return true
+		})
+		return
+	}
+
+	//CASE 3: count接近set的元素数量，复制所有的元素后随机删除多余的元素
+	//CASE 4: count比set的元素数量小很多，随机选择元素直到足够的数量
+	picked := make(map[sds]struct{}, count)
+	if count*3 > size {
+		members := make([]sds, 0, size)
+		setTypeForEach(set, func(value sds) bool {
+			members = append(members, value)
+			return true
+		})
+		rand.Shuffle(len(members), func(i, j int) {
+			members[i], members[j] = members[j], members[i]
+		})
+		for _, member := range members[:count] {
+			picked[member] = struct{}{}
+		}
+	} else {
+		for int64(len(picked)) < count {
+			picked[setTypeRandomElement(set)] = struct{}{}
+		}
+	}
+
+	addReplySetLen(client, int(count))
+	for member := range picked {
+		addReplyBulkCBuffer(client, member)
+	}
+}
+
+//SRANDMEMBER key [count]
+func srandmemberCommand(client *redisClient) {
+	if client.argc == 3 {
+		srandmemberWithCountCommand(client)
+		return
+	} else if client.argc > 3 {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	set := lookupKeyReadOrReply(client, client.argv[1], shared.null[client.resp])
+	if set == nil || checkType(client, set, redisSet) {
+		return
+	}
+	addReplyBulkCBuffer(client, setTypeRandomElement(set))
+}
+
+//查找SINTER/SUNION/SDIFF的所有key，类型错误时回复WRONGTYPE并返回false
+//不存在的key对应的位置为nil
+func lookupSetKeys(client *redisClient, keys []*robj, write bool) ([]*robj, bool) {
+	sets := make([]*robj, len(keys))
+	for j, key := range keys {
+		var setobj *robj
+		if write {
+			setobj = client.db.lookupKeyWrite(key)
+		} else {
+			setobj = client.db.lookupKeyRead(key)
+		}
+		if setobj != nil && checkType(client, setobj, redisSet) {
+			return nil, false
+		}
+		sets[j] = setobj
+	}
+	return sets, true
+}
+
+//计算多个set的交集，limit大于0时最多返回limit个元素
+func setsIntersection(sets []*robj, limit int64) []sds {
+	//任意一个set不存在，交集为空
+	for _, set := range sets {
+		if set == nil {
+			return nil
+		}
+	}
+
+	//按照元素数量从小到大排序，遍历最小的set，检查元素是否在其它的set中
+	sorted := make([]*robj, len(sets))
+	copy(sorted, sets)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return setTypeSize(sorted[i]) < setTypeSize(sorted[j])
+	})
+
+	var result []sds
+	setTypeForEach(sorted[0], func(value sds) bool {
+		for _, other := range sorted[1:] {
+			if !setTypeIsMember(other, value) {
+				return true
+			}
+		}
+		result = append(result, value)
+		return limit == 0 || int64(len(result)) < limit
+	})
+	return result
+}
+
+//SINTER/SINTERSTORE/SMEMBERS的实现，dstkey不为nil时将结果保存到dstkey中
+func sinterGenericCommand(client *redisClient, keys []*robj, dstkey *robj) {
+	sets, ok := lookupSetKeys(client, keys, dstkey != nil)
+	if !ok {
+		return
+	}
+
+	result := setsIntersection(sets, 0)
+	if dstkey == nil {
+		addReplySetLen(client, len(result))
+		for _, value := range result {
+			addReplyBulkCBuffer(client, value)
+		}
+		return
+	}
+	storeSetResult(client, dstkey, result)
+}
+
+//将SINTERSTORE/SUNIONSTORE/SDIFFSTORE的结果保存到dstkey中，结果为空时删除dstkey
+func storeSetResult(client *redisClient, dstkey *robj, result []sds) {
+	if len(result) == 0 {
+		if client.db.dbDelete(dstkey) {
+			client.db.signalModifiedKey(dstkey)
+			notifyKeyspaceEvent(notifyGeneric, "del", dstkey, client.db.id)
+			server.dirty++
+		}
+		addReply(client, shared.czero)
+		return
+	}
+
+	dstset := setTypeCreate(result[0])
+	for _, value := range result {
+		setTypeAdd(dstset, value)
+	}
+	client.db.setKey(dstkey, dstset, false)
+	//事件名称和命令名称相同：sinterstore、sunionstore、sdiffstore
+	notifyKeyspaceEvent(notifySet, client.cmd.name, dstkey, client.db.id)
+	server.dirty++
+	addReplyLongLong(client, int64(setTypeSize(dstset)))
+}
+
+//SINTER key [key ...]
+//SMEMBERS key
+func sinterCommand(client *redisClient) {
+	sinterGenericCommand(client, client.argv[1:], nil)
+}
+
+//SINTERSTORE destination key [key ...]
+func sinterstoreCommand(client *redisClient) {
+	sinterGenericCommand(client, client.argv[2:], client.argv[1])
+}
+
+//SINTERCARD numkeys key [key ...] [LIMIT limit]
+func sintercardCommand(client *redisClient) {
+	numkeys, ok := getLongLongFromObjectOrReply(client, client.argv[1], "")
+	if !ok {
+		return
+	}
+	if numkeys <= 0 {
+		addReplyError(client, "numkeys should be greater than 0")
+		return
+	}
+	if numkeys > int64(client.argc-2) {
+		addReplyError(client, "Number of keys can't be greater than number of args")
+		return
+	}
+
+	var limit int64
+	for j := 2 + int(numkeys); j < client.argc; j++ {
+		opt := client.argv[j].ptr.(sds)
+		moreargs := client.argc - 1 - j
+		if strings.EqualFold(opt, "LIMIT") && moreargs > 0 {
+			j++
+			if limit, ok = getLongLongFromObjectOrReply(client, client.argv[j], ""); !ok {
+				return
+			}
+			if limit < 0 {
+				addReplyError(client, "LIMIT can't be negative")
+				return
+			}
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	sets, ok := lookupSetKeys(client, client.argv[2:2+numkeys], false)
+	if !ok {
+		return
+	}
+	addReplyLongLong(client, int64(len(setsIntersection(sets, limit))))
+}
+
+const (
+	setOpUnion = 0
+	setOpDiff  = 1
+)
+
+//SUNION/SDIFF及STORE的实现，dstkey不为nil时将结果保存到dstkey中
+func sunionDiffGenericCommand(client *redisClient, keys []*robj, dstkey *robj, op int) {
+	sets, ok := lookupSetKeys(client, keys, dstkey != nil)
+	if !ok {
+		return
+	}
+
+	resultSet := make(map[sds]struct{})
+	var result []sds
+	if op == setOpUnion {
+		for _, set := range sets {
+			if set == nil {
+				continue
+			}
+			setTypeForEach(set, func(value sds) bool {
+				if _, exists := resultSet[value]; !exists {
+					resultSet[value] = struct{}{}
+					result = append(result, value)
+				}
+				return true
+			})
+		}
+	} else if op == setOpDiff && sets[0] != nil {
+		//遍历第一个set，删除在其它set中存在的元素
+		setTypeForEach(sets[0], func(value sds) bool {
+			for _, other := range sets[1:] {
+				if other != nil && setTypeIsMember(other, value) {
+					return true
+				}
+			}
+			result = append(result, value)
+			return true
+		})
+	}
+
+	if dstkey == nil {
+		addReplySetLen(client, len(result))
+		for _, value := range result {
+			addReplyBulkCBuffer(client, value)
+		}
+		return
+	}
+	storeSetResult(client, dstkey, result)
+}
+
+//SUNION key [key ...]
+func sunionCommand(client *redisClient) {
+	sunionDiffGenericCommand(client, client.argv[1:], nil, setOpUnion)
+}
+
+//SUNIONSTORE destination key [key ...]
+func sunionstoreCommand(client *redisClient) {
+	sunionDiffGenericCommand(client, client.argv[2:], client.argv[1], setOpUnion)
+}
+
+//SDIFF key [key ...]
+func sdiffCommand(client *redisClient) {
+	sunionDiffGenericCommand(client, client.argv[1:], nil, setOpDiff)
+}
+
+//SDIFFSTORE destination key [key ...]
+func sdiffstoreCommand(client *redisClient) {
+	sunionDiffGenericCommand(client, client.argv[2:], client.argv[1], setOpDiff)
+}
+
+//SSCAN key cursor [MATCH pattern] [COUNT count]
+func sscanCommand(client *redisClient) {
+	cursor, ok := parseScanCursorOrReply(client, client.argv[2])
+	if !ok {
+		return
+	}
+	set := lookupKeyReadOrReply(client, client.argv[1], shared.emptyscan)
+	if set == nil || checkType(client, set, redisSet) {
+		return
+	}
+	scanGenericCommand(client, set, cursor)
+}
@@ -0,0 +1,2252 @@
+package redis
+
+import (
+	"container/list"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Stream data structures
+//-----------------------------------------------------------------------------
+
+//消息ID，ms为毫秒时间戳，seq为同一毫秒内的序号
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+//stream，消息按照ID的顺序存储在B树中
+type stream struct {
+	rax               *btree   //消息，key = streamID, value = []sds(field, value, ...)
+	length            uint64   //消息的数量
+	lastID            streamID //最后添加的消息ID，stream为空时也会保留
+	firstID           streamID //第一条消息的ID
+	maxDeletedEntryID streamID //被XDEL删除的最大的消息ID
+	entriesAdded      uint64   //添加过的消息总数
+	cgroups           *dict    //消费组，key = sds, value = *streamCG
+}
+
+//消费组的entriesRead无效，需要重新估算
+const scgInvalidEntriesRead = -1
+
+//消费组
+type streamCG struct {
+	name        sds
+	lastID      streamID //最后发送给消费者的消息ID
+	entriesRead int64    //消费组已经读取的消息数量，用来计算lag
+	pel         *btree   //已经发送给消费者但是还没有ACK的消息，key = streamID, value = *streamNACK
+	consumers   *dict    //消费者，key = sds, value = *streamConsumer
+}
+
+//消费者
+type streamConsumer struct {
+	name     sds
+	seenTime int64  //最后一次活跃的时间
+	pel      *btree //发送给这个消费者但是还没有ACK的消息，和消费组的PEL共享*streamNACK
+}
+
+//等待ACK的消息
+type streamNACK struct {
+	deliveryTime  int64           //最后一次发送的时间
+	deliveryCount uint64          //发送的次数
+	consumer      *streamConsumer //最后一次发送给哪个消费者
+}
+
+//XADD/XTRIM的裁剪策略
+const (
+	trimStrategyNone   = 0
+	trimStrategyMaxlen = 1
+	trimStrategyMinid  = 2
+)
+
+//没有指定LIMIT时，~ 裁剪最多删除的消息数量
+const streamDefaultTrimLimit = 100 * 100
+
+//XADD/XTRIM的参数
+type streamAddTrimArgs struct {
+	//XADD
+	id         streamID //指定的消息ID
+	idGiven    bool     //是否指定了消息ID，为false时自动生成
+	seqGiven   bool     //是否指定了序号，比如 5-* 只指定了毫秒时间戳
+	noMkStream bool     //key不存在时不创建stream
+
+	//裁剪
+	trimStrategy int
+	approxTrim   bool  //~ 近似裁剪
+	limit        int64 //近似裁剪时最多删除的消息数量，0表示不限制
+	maxlen       int64
+	minid        streamID
+}
+
+//streamReplyWithRange的选项
+const (
+	streamRwrNoAck      = 1 << 0 //XREADGROUP NOACK，不添加到PEL中
+	streamRwrRawEntries = 1 << 1 //不回复数组的长度，只回复消息
+	streamRwrHistory    = 1 << 2 //从消费者的PEL中读取历史消息
+)
+
+//XREADGROUP中 > 对应的ID，表示读取新消息
+var streamNewMessagesID = streamID{ms: math.MaxUint64, seq: math.MaxUint64}
+
+func streamCreate() *stream {
+	return &stream{
+		rax:     newBtree(),
+		cgroups: dictCreate(),
+	}
+}
+
+//-----------------------------------------------------------------------------
+// Stream ID
+//-----------------------------------------------------------------------------
+
+func streamCompareID(a *streamID, b *streamID) int {
+	if a.ms > b.ms {
+		return 1
+	} else if a.ms < b.ms {
+		return -1
+	} else if a.seq > b.seq {
+		return 1
+	} else if a.seq < b.seq {
+		return -1
+	}
+	return 0
+}
+
+//ID加1，溢出时返回false
+func streamIncrID(id *streamID) bool {
+	if id.seq == math.MaxUint64 {
+		if id.ms == math.MaxUint64 {
+			return false
+		}
+		id.ms++
+		id.seq = 0
+		return true
+	}
+	id.seq++
+	return true
+}
+
+//ID减1，溢出时返回false
+func streamDecrID(id *streamID) bool {
+	if id.seq == 0 {
+		if id.ms == 0 {
+			return false
+		}
+		id.ms--
+		id.seq = math.MaxUint64
+		return true
+	}
+	id.seq--
+	return true
+}
+
+func streamIDToString(id *streamID) sds {
+	return sds(strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10))
+}
+
+func addReplyStreamID(client *redisClient, id *streamID) {
+	addReplyBulkCBuffer(client, streamIDToString(id))
+}
+
+//解析消息ID，格式为 <ms>-<seq>，只有<ms>时seq为missingSeq
+//strict为false时，"-"和"+"表示最小和最大的ID
+//seqGiven不为nil时允许 <ms>-* 的格式，*表示自动生成序号，此时seqGiven为false
+//client为nil时不回复错误
+func streamGenericParseIDOrReply(client *redisClient, o *robj, missingSeq uint64, strict bool, seqGiven *bool) (streamID, bool) {
+	buf := o.ptr.(sds)
+	if seqGiven != nil {
+		*seqGiven = true
+	}
+
+	if len(buf) == 0 || len(buf) > 127 {
+		goto invalid
+	}
+	if buf == "-" || buf == "+" {
+		if strict {
+			goto invalid
+		}
+		if buf == "-" {
+			return streamID{}, true
+		}
+		return streamID{ms: math.MaxUint64, seq: math.MaxUint64}, true
+	}
+
+	{
+		var id streamID
+		var err error
+		dot := strings.IndexByte(buf, '-')
+		if dot < 0 {
+			if id.ms, err = strconv.ParseUint(buf, 10, 64); err != nil {
+				goto invalid
+			}
+			id.seq = missingSeq
+			return id, true
+		}
+
+		if id.ms, err = strconv.ParseUint(buf[:dot], 10, 64); err != nil {
+			goto invalid
+		}
+		if seqGiven != nil && buf[dot+1:] == "*" {
+			*seqGiven = false
+			return id, true
+		}
+		if id.seq, err = strconv.ParseUint(buf[dot+1:], 10, 64); err != nil {
+			goto invalid
+		}
+		return id, true
+	}
+
+invalid:
+	if client != nil {
+		addReplyError(client, "Invalid stream ID specified as stream command argument")
+	}
+	return streamID{}, false
+}
+
+//解析消息ID，"-"和"+"表示最小和最大的ID
+func streamParseIDOrReply(client *redisClient, o *robj, missingSeq uint64) (streamID, bool) {
+	return streamGenericParseIDOrReply(client, o, missingSeq, false, nil)
+}
+
+//解析消息ID，不允许"-"和"+"
+func streamParseStrictIDOrReply(client *redisClient, o *robj, missingSeq uint64, seqGiven *bool) (streamID, bool) {
+	return streamGenericParseIDOrReply(client, o, missingSeq, true, seqGiven)
+}
+
+//解析区间的边界，"("开头表示不包含这个ID
+func streamParseIntervalIDOrReply(client *redisClient, o *robj, missingSeq uint64) (streamID, bool, bool) {
+	buf := o.ptr.(sds)
+	if len(buf) > 1 && buf[0] == '(' {
+		id, ok := streamParseStrictIDOrReply(client, createObject(redisString, buf[1:]), missingSeq, nil)
+		return id, true, ok
+	}
+	id, ok := streamParseIDOrReply(client, o, missingSeq)
+	return id, false, ok
+}
+
+//-----------------------------------------------------------------------------
+// Low level stream API
+//-----------------------------------------------------------------------------
+
+//streamAppendItem的返回值
+const (
+	streamAppendOk         = 0
+	streamAppendIDTooSmall = 1 //ID小于等于stream中最后一条消息的ID
+	streamAppendOverflow   = 2 //自动生成的ID溢出了
+)
+
+//根据最后一条消息的ID生成新的ID：当前时间大于最后一条消息的时间时使用当前时间，否则序号加1
+func streamNextID(last *streamID) (streamID, bool) {
+	ms := uint64(mstime())
+	if ms > last.ms {
+		return streamID{ms: ms, seq: 0}, true
+	}
+	id := *last
+	return id, streamIncrID(&id)
+}
+
+//添加一条消息，useID为nil时自动生成ID，seqGiven为false时自动生成useID的序号
+func streamAppendItem(s *stream, fields []sds, useID *streamID, seqGiven bool) (streamID, int) {
+	var id streamID
+	if useID != nil {
+		if seqGiven {
+			id = *useID
+		} else if s.lastID.ms == useID.ms {
+			//和最后一条消息的时间戳相同时序号加1
+			if s.lastID.seq == math.MaxUint64 {
+				return id, streamAppendIDTooSmall
+			}
+			id = streamID{ms: useID.ms, seq: s.lastID.seq + 1}
+		} else {
+			id = streamID{ms: useID.ms, seq: 0}
+		}
+	} else {
+		var ok bool
+		if id, ok = streamNextID(&s.lastID); !ok {
+			return id, streamAppendOverflow
+		}
+	}
+
+	//新消息的ID必须大于最后一条消息的ID
+	if streamCompareID(&id, &s.lastID) <= 0 {
+		return id, streamAppendIDTooSmall
+	}
+
+	s.rax.insert(id, fields)
+	s.length++
+	s.entriesAdded++
+	s.lastID = id
+	if s.length == 1 {
+		s.firstID = id
+	}
+	return id, streamAppendOk
+}
+
+//更新stream的第一条消息的ID
+func streamUpdateFirstID(s *stream) {
+	if first, ok := s.rax.first(); ok {
+		s.firstID = first.key
+	} else {
+		s.firstID = streamID{}
+	}
+}
+
+//按照MAXLEN/MINID从头开始删除消息，返回删除的数量
+//B树中的每条消息都是单独存储的，所以 ~ 也是精确裁剪，只是受LIMIT的限制
+func streamTrim(s *stream, args *streamAddTrimArgs) int64 {
+	var deleted int64
+	for s.length > 0 {
+		if args.approxTrim && args.limit > 0 && deleted >= args.limit {
+			break
+		}
+		first, _ := s.rax.first()
+		if args.trimStrategy == trimStrategyMaxlen {
+			if s.length <= uint64(args.maxlen) {
+				break
+			}
+		} else if streamCompareID(&first.key, &args.minid) >= 0 {
+			break
+		}
+		s.rax.remove(first.key)
+		s.length--
+		deleted++
+	}
+	if deleted > 0 {
+		streamUpdateFirstID(s)
+	}
+	return deleted
+}
+
+//删除一条消息，不存在时返回false
+func streamDeleteItem(s *stream, id streamID) bool {
+	if _, ok := s.rax.remove(id); !ok {
+		return false
+	}
+	s.length--
+	return true
+}
+
+func streamEntryExists(s *stream, id streamID) bool {
+	_, ok := s.rax.find(id)
+	return ok
+}
+
+//start和end之间（包含边界）是否有被XDEL删除的消息，end为nil时表示到最后
+func streamRangeHasTombstones(s *stream, start *streamID, end *streamID) bool {
+	if s.length == 0 || (s.maxDeletedEntryID == streamID{}) {
+		return false
+	}
+	startID := streamID{}
+	if start != nil {
+		startID = *start
+	}
+	endID := streamID{ms: math.MaxUint64, seq: math.MaxUint64}
+	if end != nil {
+		endID = *end
+	}
+	return streamCompareID(&startID, &s.maxDeletedEntryID) <= 0 &&
+		streamCompareID(&s.maxDeletedEntryID, &endID) <= 0
+}
+
+//估算id在所有添加过的消息中的位置，也就是读取到id时一共读取了多少条消息，无法估算时返回scgInvalidEntriesRead
+func streamEstimateDistanceFromFirstEverEntry(s *stream, id *streamID) int64 {
+	//stream从来没有添加过消息
+	if s.entriesAdded == 0 {
+		return 0
+	}
+
+	//stream为空，并且id小于等于最后一条消息的ID
+	if s.length == 0 && streamCompareID(id, &s.lastID) < 1 {
+		return int64(s.entriesAdded)
+	}
+
+	cmpLast := streamCompareID(id, &s.lastID)
+	if cmpLast == 0 {
+		return int64(s.entriesAdded)
+	} else if cmpLast > 0 {
+		//未来的ID无法估算
+		return scgInvalidEntriesRead
+	}
+
+	cmpIDFirst := streamCompareID(id, &s.firstID)
+	cmpXdelFirst := streamCompareID(&s.maxDeletedEntryID, &s.firstID)
+	if (s.maxDeletedEntryID == streamID{}) || cmpXdelFirst < 0 {
+		//第一条消息之后没有被删除的消息
+		if cmpIDFirst < 0 {
+			return int64(s.entriesAdded - s.length)
+		} else if cmpIDFirst == 0 {
+			return int64(s.entriesAdded - s.length + 1)
+		}
+	}
+	return scgInvalidEntriesRead
+}
+
+//-----------------------------------------------------------------------------
+// Consumer groups
+//-----------------------------------------------------------------------------
+
+func streamLookupCG(s *stream, name sds) *streamCG {
+	cg := s.cgroups.dictFind(name)
+	if cg == nil {
+		return nil
+	}
+	return cg.(*streamCG)
+}
+
+//创建消费组，已经存在时返回nil
+func streamCreateCG(s *stream, name sds, id streamID, entriesRead int64) *streamCG {
+	if s.cgroups.dictFind(name) != nil {
+		return nil
+	}
+	cg := &streamCG{
+		name:        name,
+		lastID:      id,
+		entriesRead: entriesRead,
+		pel:         newBtree(),
+		consumers:   dictCreate(),
+	}
+	s.cgroups.dictAdd(name, cg)
+	return cg
+}
+
+//按照名称排序的消费组
+func streamSortedCGs(s *stream) []*streamCG {
+	cgs := make([]*streamCG, 0, s.cgroups.used())
+	s.cgroups.dictForEach(func(_ interface{}, cg interface{}) bool {
+		cgs = append(cgs, cg.(*streamCG))
+		return true
+	})
+	sort.Slice(cgs, func(i, j int) bool {
+		return cgs[i].name < cgs[j].name
+	})
+	return cgs
+}
+
+//查找消费者，refresh为true时更新消费者的活跃时间
+func streamLookupConsumer(cg *streamCG, name sds, refresh bool) *streamConsumer {
+	de := cg.consumers.dictFind(name)
+	if de == nil {
+		return nil
+	}
+	consumer := de.(*streamConsumer)
+	if refresh {
+		consumer.seenTime = mstime()
+	}
+	return consumer
+}
+
+//创建消费者，已经存在时返回nil
+func streamCreateConsumer(cg *streamCG, name sds) *streamConsumer {
+	if cg.consumers.dictFind(name) != nil {
+		return nil
+	}
+	consumer := &streamConsumer{
+		name:     name,
+		seenTime: mstime(),
+		pel:      newBtree(),
+	}
+	cg.consumers.dictAdd(name, consumer)
+	return consumer
+}
+
+//查找消费者，不存在时创建，并传播为XGROUP CREATECONSUMER
+func streamLookupOrCreateConsumer(client *redisClient, key *robj, cg *streamCG, name sds) *streamConsumer {
+	consumer := streamLookupConsumer(cg, name, true)
+	if consumer == nil {
+		consumer = streamCreateConsumer(cg, name)
+		streamPropagateConsumerCreation(client, key, cg, name)
+		server.dirty++
+	}
+	return consumer
+}
+
+//复制stream对象，包括消费组、消费者和PEL，用于COPY命令
+func streamDup(o *robj) *robj {
+	s := o.ptr.(*stream)
+	sobj := createStreamObject()
+	news := sobj.ptr.(*stream)
+
+	s.rax.ascend(streamID{}, func(id streamID, value interface{}) bool {
+		news.rax.insert(id, append([]sds(nil), value.([]sds)...))
+		return true
+	})
+	news.length = s.length
+	news.lastID = s.lastID
+	news.firstID = s.firstID
+	news.maxDeletedEntryID = s.maxDeletedEntryID
+	news.entriesAdded = s.entriesAdded
+
+	s.cgroups.dictForEach(func(_ interface{}, v interface{}) bool {
+		cg := v.(*streamCG)
+		newcg := streamCreateCG(news, cg.name, cg.lastID, cg.entriesRead)
+		cg.pel.ascend(streamID{}, func(id streamID, value interface{}) bool {
+			nack := value.(*streamNACK)
+			newcg.pel.insert(id, &streamNACK{deliveryTime: nack.deliveryTime, deliveryCount: nack.deliveryCount})
+			return true
+		})
+		//消费者的PEL和消费组的PEL共享streamNACK
+		cg.consumers.dictForEach(func(_ interface{}, c interface{}) bool {
+			consumer := c.(*streamConsumer)
+			newconsumer := streamCreateConsumer(newcg, consumer.name)
+			newconsumer.seenTime = consumer.seenTime
+			consumer.pel.ascend(streamID{}, func(id streamID, value interface{}) bool {
+				nack, _ := newcg.pel.find(id)
+				nack.(*streamNACK).consumer = newconsumer
+				newconsumer.pel.insert(id, nack)
+				return true
+			})
+			return true
+		})
+		return true
+	})
+	return sobj
+}
+
+//按照名称排序的消费者
+func streamSortedConsumers(cg *streamCG) []*streamConsumer {
+	consumers := make([]*streamConsumer, 0, cg.consumers.used())
+	cg.consumers.dictForEach(func(_ interface{}, consumer interface{}) bool {
+		consumers = append(consumers, consumer.(*streamConsumer))
+		return true
+	})
+	sort.Slice(consumers, func(i, j int) bool {
+		return consumers[i].name < consumers[j].name
+	})
+	return consumers
+}
+
+//删除消费者，消费者PEL中的消息也从消费组的PEL中删除
+func streamDelConsumer(cg *streamCG, consumer *streamConsumer) {
+	consumer.pel.ascend(streamID{}, func(id streamID, value interface{}) bool {
+		cg.pel.remove(id)
+		return true
+	})
+	cg.consumers.dictDelete(consumer.name)
+}
+
+//遍历PEL中在[start, end]之间的消息
+func streamPELForEach(pel *btree, start *streamID, end *streamID, fn func(id streamID, nack *streamNACK) bool) {
+	pel.ascend(*start, func(id streamID, value interface{}) bool {
+		if streamCompareID(&id, end) > 0 {
+			return false
+		}
+		return fn(id, value.(*streamNACK))
+	})
+}
+
+//-----------------------------------------------------------------------------
+// Stream reply
+//-----------------------------------------------------------------------------
+
+//回复一条消息：[id, [field, value, ...]]
+func addReplyStreamEntry(client *redisClient, id *streamID, fields []sds) {
+	addReplyArrayLen(client, 2)
+	addReplyStreamID(client, id)
+	addReplyArrayLen(client, len(fields))
+	for _, field := range fields {
+		addReplyBulkCBuffer(client, field)
+	}
+}
+
+//XREADGROUP对消费组的修改不能通过重放XREADGROUP得到相同的结果，传播为确定的命令：
+//发送的每条消息传播为XCLAIM，消费组的lastID传播为XGROUP SETID
+
+//传播为XCLAIM，使用确定的发送时间和发送次数，重放的结果是幂等的
+//XCLAIM <key> <group> <consumer> 0 <id> TIME <ms> RETRYCOUNT <count> FORCE JUSTID LASTID <id>
+func streamPropagateXCLAIM(client *redisClient, key *robj, group *streamCG, id *streamID, nack *streamNACK) {
+	argv := []*robj{
+		createStringObject("XCLAIM"),
+		key,
+		createStringObject(group.name),
+		createStringObject(nack.consumer.name),
+		createStringObjectFromLongLong(0),
+		createStringObject(streamIDToString(id)),
+		createStringObject("TIME"),
+		createStringObjectFromLongLong(nack.deliveryTime),
+		createStringObject("RETRYCOUNT"),
+		createStringObjectFromLongLong(int64(nack.deliveryCount)),
+		createStringObject("FORCE"),
+		createStringObject("JUSTID"),
+		createStringObject("LASTID"),
+		createStringObject(streamIDToString(&group.lastID)),
+	}
+	alsoPropagate(client.db.id, argv)
+}
+
+//传播为XGROUP SETID <key> <group> <id> ENTRIESREAD <entries_read>
+func streamPropagateGroupID(client *redisClient, key *robj, group *streamCG) {
+	argv := []*robj{
+		createStringObject("XGROUP"),
+		createStringObject("SETID"),
+		key,
+		createStringObject(group.name),
+		createStringObject(streamIDToString(&group.lastID)),
+		createStringObject("ENTRIESREAD"),
+		createStringObjectFromLongLong(group.entriesRead),
+	}
+	alsoPropagate(client.db.id, argv)
+}
+
+//传播为XGROUP CREATECONSUMER <key> <group> <consumer>
+func streamPropagateConsumerCreation(client *redisClient, key *robj, group *streamCG, name sds) {
+	argv := []*robj{
+		createStringObject("XGROUP"),
+		createStringObject("CREATECONSUMER"),
+		key,
+		createStringObject(group.name),
+		createStringObject(name),
+	}
+	alsoPropagate(client.db.id, argv)
+}
+
+//回复[start, end]之间的消息，start/end为nil时表示最小/最大的ID，count为0时表示不限制数量
+//group不为nil时（XREADGROUP），消息会添加到消费组和consumer的PEL中，并更新消费组的lastID
+//propkey不为nil时，传播对消费组的修改
+//返回回复的消息数量
+func streamReplyWithRange(client *redisClient, s *stream, start *streamID, end *streamID, count int64,
+	rev bool, group *streamCG, consumer *streamConsumer, flags int, propkey *robj) int64 {
+	startID := streamID{}
+	if start != nil {
+		startID = *start
+	}
+	endID := streamID{ms: math.MaxUint64, seq: math.MaxUint64}
+	if end != nil {
+		endID = *end
+	}
+
+	if flags&streamRwrHistory != 0 {
+		return streamReplyWithRangeFromConsumerPEL(client, s, &startID, &endID, count, group, consumer, propkey)
+	}
+
+	var arraylenNode *list.Element
+	if flags&streamRwrRawEntries == 0 {
+		arraylenNode = addReplyDeferredLen(client)
+	}
+
+	var arraylen int64
+	propagateLastID := false
+	emit := func(id streamID, value interface{}) bool {
+		//更新消费组的lastID和已经读取的消息数量
+		if group != nil && streamCompareID(&id, &group.lastID) > 0 {
+			if group.entriesRead != scgInvalidEntriesRead && !streamRangeHasTombstones(s, &id, nil) {
+				group.entriesRead++
+			} else if s.entriesAdded != 0 {
+				group.entriesRead = streamEstimateDistanceFromFirstEverEntry(s, &id)
+			}
+			group.lastID = id
+			server.dirty++
+			propagateLastID = true
+		}
+
+		addReplyStreamEntry(client, &id, value.([]sds))
+
+		//添加到PEL中，消息已经在PEL中时（比如XGROUP SETID之后重新读取），转移给当前的consumer
+		if group != nil && flags&streamRwrNoAck == 0 {
+			nack := &streamNACK{deliveryTime: mstime(), deliveryCount: 1, consumer: consumer}
+			if old, exists := group.pel.find(id); exists {
+				nack = old.(*streamNACK)
+				nack.consumer.pel.remove(id)
+				nack.consumer = consumer
+				nack.deliveryTime = mstime()
+				nack.deliveryCount = 1
+			} else {
+				group.pel.insert(id, nack)
+			}
+			consumer.pel.insert(id, nack)
+			server.dirty++
+
+			if propkey != nil {
+				streamPropagateXCLAIM(client, propkey, group, &id, nack)
+			}
+		}
+
+		arraylen++
+		return count == 0 || arraylen < count
+	}
+
+	if rev {
+		s.rax.descend(endID, func(id streamID, value interface{}) bool {
+			if streamCompareID(&id, &startID) < 0 {
+				return false
+			}
+			return emit(id, value)
+		})
+	} else {
+		s.rax.ascend(startID, func(id streamID, value interface{}) bool {
+			if streamCompareID(&id, &endID) > 0 {
+				return false
+			}
+			return emit(id, value)
+		})
+	}
+
+	if arraylenNode != nil {
+		setDeferredArrayLen(client, arraylenNode, int(arraylen))
+	}
+	if propkey != nil && propagateLastID {
+		streamPropagateGroupID(client, propkey, group)
+	}
+	return arraylen
+}
+
+//从消费者的PEL中回复[start, end]之间的历史消息，消息已经被删除时回复[id, nil]
+func streamReplyWithRangeFromConsumerPEL(client *redisClient, s *stream, start *streamID, end *streamID,
+	count int64, group *streamCG, consumer *streamConsumer, propkey *robj) int64 {
+	arraylenNode := addReplyDeferredLen(client)
+	var arraylen int64
+	streamPELForEach(consumer.pel, start, end, func(id streamID, nack *streamNACK) bool {
+		if fields, ok := s.rax.find(id); ok {
+			addReplyStreamEntry(client, &id, fields.([]sds))
+			nack.deliveryTime = mstime()
+			nack.deliveryCount++
+			server.dirty++
+			if propkey != nil {
+				streamPropagateXCLAIM(client, propkey, group, &id, nack)
+			}
+		} else {
+			addReplyArrayLen(client, 2)
+			addReplyStreamID(client, &id)
+			addReplyNullArray(client)
+		}
+		arraylen++
+		return count == 0 || arraylen < count
+	})
+	setDeferredArrayLen(client, arraylenNode, int(arraylen))
+	return arraylen
+}
+
+//-----------------------------------------------------------------------------
+// Stream commands
+//-----------------------------------------------------------------------------
+
+//查找stream对象，不存在时创建
+func streamTypeLookupWriteOrCreate(client *redisClient, key *robj, noCreate bool) *robj {
+	o := client.db.lookupKeyWrite(key)
+	if o != nil {
+		if checkType(client, o, redisStream) {
+			return nil
+		}
+		return o
+	}
+	if noCreate {
+		addReplyNull(client)
+		return nil
+	}
+	o = createStreamObject()
+	client.db.dbAdd(key, o)
+	return o
+}
+
+//解析XADD/XTRIM的参数，XADD时返回消息ID参数的位置
+func streamParseAddOrTrimArgsOrReply(client *redisClient, xadd bool) (*streamAddTrimArgs, int, bool) {
+	args := &streamAddTrimArgs{}
+	limitGiven := false
+
+	i := 2
+	for ; i < client.argc; i++ {
+		moreargs := client.argc - 1 - i
+		opt := client.argv[i].ptr.(sds)
+		if xadd && opt == "*" {
+			//自动生成ID
+			break
+		} else if strings.EqualFold(opt, "maxlen") && moreargs > 0 {
+			if args.trimStrategy != trimStrategyNone {
+				addReplyError(client, "syntax error, MAXLEN and MINID options at the same time are not compatible")
+				return nil, 0, false
+			}
+			next := client.argv[i+1].ptr.(sds)
+			if moreargs >= 2 && (next == "~" || next == "=") {
+				args.approxTrim = next == "~"
+				i++
+			}
+			maxlen, ok := getLongLongFromObjectOrReply(client, client.argv[i+1], "")
+			if !ok {
+				return nil, 0, false
+			}
+			if maxlen < 0 {
+				addReplyError(client, "The MAXLEN argument must be >= 0.")
+				return nil, 0, false
+			}
+			args.maxlen = maxlen
+			args.trimStrategy = trimStrategyMaxlen
+			i++
+		} else if strings.EqualFold(opt, "minid") && moreargs > 0 {
+			if args.trimStrategy != trimStrategyNone {
+				addReplyError(client, "syntax error, MAXLEN and MINID options at the same time are not compatible")
+				return nil, 0, false
+			}
+			next := client.argv[i+1].ptr.(sds)
+			if moreargs >= 2 && (next == "~" || next == "=") {
+				args.approxTrim = next == "~"
+				i++
+			}
+			minid, ok := streamParseStrictIDOrReply(client, client.argv[i+1], 0, nil)
+			if !ok {
+				return nil, 0, false
+			}
+			args.minid = minid
+			args.trimStrategy = trimStrategyMinid
+			i++
+		} else if strings.EqualFold(opt, "limit") && moreargs > 0 {
+			limit, ok := getLongLongFromObjectOrReply(client, client.argv[i+1], "")
+			if !ok {
+				return nil, 0, false
+			}
+			if limit < 0 {
+				addReplyError(client, "The LIMIT argument must be >= 0.")
+				return nil, 0, false
+			}
+			args.limit = limit
+			limitGiven = true
+			i++
+		} else if xadd && strings.EqualFold(opt, "nomkstream") {
+			args.noMkStream = true
+		} else if xadd {
+			//消息ID
+			id, ok := streamParseStrictIDOrReply(client, client.argv[i], 0, &args.seqGiven)
+			if !ok {
+				return nil, 0, false
+			}
+			args.id = id
+			args.idGiven = true
+			break
+		} else {
+			addReply(client, shared.syntaxerr)
+			return nil, 0, false
+		}
+	}
+
+	if limitGiven && !args.approxTrim {
+		addReplyError(client, "syntax error, LIMIT cannot be used without the special ~ option")
+		return nil, 0, false
+	}
+	if args.approxTrim && !limitGiven {
+		args.limit = streamDefaultTrimLimit
+	}
+	if !xadd && args.trimStrategy == trimStrategyNone {
+		addReply(client, shared.syntaxerr)
+		return nil, 0, false
+	}
+	return args, i, true
+}
+
+//XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func xaddCommand(client *redisClient) {
+	args, idPos, ok := streamParseAddOrTrimArgsOrReply(client, true)
+	if !ok {
+		return
+	}
+
+	//field和value必须成对出现
+	fieldPos := idPos + 1
+	if client.argc-fieldPos < 2 || (client.argc-fieldPos)%2 == 1 {
+		addReplyError(client, "wrong number of arguments for '"+client.cmd.name+"' command")
+		return
+	}
+
+	if args.idGiven && args.seqGiven && args.id == (streamID{}) {
+		addReplyError(client, "The ID specified in XADD must be greater than 0-0")
+		return
+	}
+
+	o := streamTypeLookupWriteOrCreate(client, client.argv[1], args.noMkStream)
+	if o == nil {
+		return
+	}
+	s := o.ptr.(*stream)
+
+	if s.lastID.ms == math.MaxUint64 && s.lastID.seq == math.MaxUint64 {
+		addReplyError(client, "The stream has exhausted the last possible ID, unable to add more items")
+		return
+	}
+
+	fields := make([]sds, 0, client.argc-fieldPos)
+	for j := fieldPos; j < client.argc; j++ {
+		fields = append(fields, client.argv[j].ptr.(sds))
+	}
+
+	var useID *streamID
+	if args.idGiven {
+		useID = &args.id
+	}
+	id, ret := streamAppendItem(s, fields, useID, args.seqGiven)
+	if ret == streamAppendIDTooSmall {
+		addReplyError(client, "The ID specified in XADD is equal or smaller than the target stream top item")
+		return
+	} else if ret == streamAppendOverflow {
+		addReplyError(client, "The stream has exhausted the last possible ID, unable to add more items")
+		return
+	}
+	addReplyStreamID(client, &id)
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyStream, "xadd", client.argv[1], client.db.id)
+	server.dirty++
+
+	//自动生成的ID传播为确定的ID
+	if !args.idGiven || !args.seqGiven {
+		rewriteClientCommandArgument(client, idPos, createStringObject(streamIDToString(&id)))
+	}
+
+	if args.trimStrategy != trimStrategyNone {
+		if streamTrim(s, args) > 0 {
+			notifyKeyspaceEvent(notifyStream, "xtrim", client.argv[1], client.db.id)
+		}
+	}
+
+	//唤醒阻塞在XREAD/XREADGROUP上的客户端
+	signalKeyAsReady(client.db, client.argv[1])
+}
+
+//XRANGE/XREVRANGE的实现
+func xrangeGenericCommand(client *redisClient, rev bool) {
+	startarg, endarg := client.argv[2], client.argv[3]
+	if rev {
+		startarg, endarg = endarg, startarg
+	}
+
+	//解析区间，只有时间戳的ID作为起始时序号为0，作为结束时序号为最大值
+	startid, startex, ok := streamParseIntervalIDOrReply(client, startarg, 0)
+	if !ok {
+		return
+	}
+	if startex && !streamIncrID(&startid) {
+		addReplyError(client, "invalid start ID for the interval")
+		return
+	}
+	endid, endex, ok := streamParseIntervalIDOrReply(client, endarg, math.MaxUint64)
+	if !ok {
+		return
+	}
+	if endex && !streamDecrID(&endid) {
+		addReplyError(client, "invalid end ID for the interval")
+		return
+	}
+
+	count := int64(-1)
+	for j := 4; j < client.argc; j++ {
+		additional := client.argc - j - 1
+		if strings.EqualFold(client.argv[j].ptr.(sds), "count") && additional >= 1 {
+			if count, ok = getLongLongFromObjectOrReply(client, client.argv[j+1], ""); !ok {
+				return
+			}
+			if count < 0 {
+				count = 0
+			}
+			j++
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.emptyarray)
+	if o == nil || checkType(client, o, redisStream) {
+		return
+	}
+
+	if count == 0 {
+		addReplyNullArray(client)
+		return
+	}
+	if count == -1 {
+		count = 0
+	}
+	if streamCompareID(&startid, &endid) > 0 {
+		addReply(client, shared.emptyarray)
+		return
+	}
+	streamReplyWithRange(client, o.ptr.(*stream), &startid, &endid, count, rev, nil, nil, 0, nil)
+}
+
+//XRANGE key start end [COUNT count]
+func xrangeCommand(client *redisClient) {
+	xrangeGenericCommand(client, false)
+}
+
+//XREVRANGE key end start [COUNT count]
+func xrevrangeCommand(client *redisClient) {
+	xrangeGenericCommand(client, true)
+}
+
+//XLEN key
+func xlenCommand(client *redisClient) {
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisStream) {
+		return
+	}
+	addReplyLongLong(client, int64(o.ptr.(*stream).length))
+}
+
+//XDEL key id [id ...]
+func xdelCommand(client *redisClient) {
+	o := lookupKeyWriteOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisStream) {
+		return
+	}
+	s := o.ptr.(*stream)
+
+	//先检查所有的ID，有错误时不删除任何消息
+	ids := make([]streamID, 0, client.argc-2)
+	for j := 2; j < client.argc; j++ {
+		id, ok := streamParseStrictIDOrReply(client, client.argv[j], 0, nil)
+		if !ok {
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	var deleted int64
+	for _, id := range ids {
+		if streamDeleteItem(s, id) {
+			//记录被删除的最大ID，用来判断消费组的entriesRead是否有效
+			if streamCompareID(&id, &s.maxDeletedEntryID) > 0 {
+				s.maxDeletedEntryID = id
+			}
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		streamUpdateFirstID(s)
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyStream, "xdel", client.argv[1], client.db.id)
+		server.dirty += deleted
+	}
+	addReplyLongLong(client, deleted)
+}
+
+//XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func xtrimCommand(client *redisClient) {
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o != nil && checkType(client, o, redisStream) {
+		return
+	}
+
+	args, _, ok := streamParseAddOrTrimArgsOrReply(client, false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		addReply(client, shared.czero)
+		return
+	}
+	deleted := streamTrim(o.ptr.(*stream), args)
+	if deleted > 0 {
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyStream, "xtrim", client.argv[1], client.db.id)
+		server.dirty += deleted
+	}
+	addReplyLongLong(client, deleted)
+}
+
+//XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+//XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+func xreadCommand(client *redisClient) {
+	xreadgroup := client.cmd.name == "xreadgroup"
+	block := false
+	timeout := int64(0)
+	count := int64(0)
+	streamsArg := 0
+	streamsCount := 0
+	noack := false
+	var groupname, consumername sds
+
+	//解析参数
+	for i := 1; i < client.argc; i++ {
+		moreargs := client.argc - i - 1
+		opt := client.argv[i].ptr.(sds)
+		if strings.EqualFold(opt, "block") && moreargs > 0 {
+			var ok bool
+			i++
+			if timeout, ok = getTimeoutFromObjectOrReply(client, client.argv[i], unitMilliseconds); !ok {
+				return
+			}
+			block = true
+		} else if strings.EqualFold(opt, "count") && moreargs > 0 {
+			var ok bool
+			i++
+			if count, ok = getLongLongFromObjectOrReply(client, client.argv[i], ""); !ok {
+				return
+			}
+			if count < 0 {
+				count = 0
+			}
+		} else if strings.EqualFold(opt, "streams") && moreargs > 0 {
+			streamsArg = i + 1
+			streamsCount = client.argc - streamsArg
+			if streamsCount%2 != 0 {
+				symbol := "$"
+				if xreadgroup {
+					symbol = ">"
+				}
+				addReplyError(client, "Unbalanced '"+client.cmd.name+"' list of streams: for each stream key an ID or '"+
+					symbol+"' must be specified.")
+				return
+			}
+			streamsCount /= 2
+			break
+		} else if strings.EqualFold(opt, "group") && moreargs >= 2 {
+			if !xreadgroup {
+				addReplyError(client, "The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+				return
+			}
+			groupname = client.argv[i+1].ptr.(sds)
+			consumername = client.argv[i+2].ptr.(sds)
+			i += 2
+		} else if strings.EqualFold(opt, "noack") {
+			if !xreadgroup {
+				addReplyError(client, "The NOACK option is only supported by XREADGROUP. You called XREAD instead.")
+				return
+			}
+			noack = true
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	if streamsArg == 0 {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+	if xreadgroup && groupname == "" {
+		addReplyError(client, "Missing GROUP option for XREADGROUP")
+		return
+	}
+	//XREADGROUP对消费组的修改通过XCLAIM和XGROUP SETID传播
+	if xreadgroup {
+		preventCommandPropagation(client)
+	}
+
+	//解析每个key对应的ID
+	keys := client.argv[streamsArg : streamsArg+streamsCount]
+	ids := make([]streamID, streamsCount)
+	groups := make([]*streamCG, streamsCount)
+	for i, key := range keys {
+		var o *robj
+		if xreadgroup {
+			o = client.db.lookupKeyWrite(key)
+		} else {
+			o = client.db.lookupKeyRead(key)
+		}
+		if o != nil && checkType(client, o, redisStream) {
+			return
+		}
+
+		if xreadgroup {
+			var group *streamCG
+			if o != nil {
+				group = streamLookupCG(o.ptr.(*stream), groupname)
+			}
+			if group == nil {
+				addReplyString(client, "-NOGROUP No such key '"+key.ptr.(sds)+"' or consumer group '"+groupname+
+					"' in XREADGROUP with GROUP option\r\n")
+				return
+			}
+			groups[i] = group
+		}
+
+		idarg := client.argv[streamsArg+streamsCount+i].ptr.(sds)
+		if idarg == "$" {
+			if xreadgroup {
+				addReplyError(client, "The $ ID is meaningless in the context of XREADGROUP: you want to read "+
+					"the history of this consumer by specifying a proper ID, or use the > ID to get new messages. "+
+					"The $ ID would just return an empty result set.")
+				return
+			}
+			//读取调用命令之后添加的消息
+			if o != nil {
+				ids[i] = o.ptr.(*stream).lastID
+			}
+			continue
+		} else if idarg == ">" {
+			if !xreadgroup {
+				addReplyError(client, "The > ID can be specified only when calling XREADGROUP using the GROUP "+
+					"<group> <consumer> option.")
+				return
+			}
+			ids[i] = streamNewMessagesID
+			continue
+		}
+
+		id, ok := streamParseStrictIDOrReply(client, client.argv[streamsArg+streamsCount+i], 0, nil)
+		if !ok {
+			return
+		}
+		ids[i] = id
+	}
+
+	//尝试立即回复
+	var arraylenNode *list.Element
+	arraylen := 0
+	for i, key := range keys {
+		o := client.db.lookupKeyRead(key)
+		if o == nil {
+			continue
+		}
+		s := o.ptr.(*stream)
+		gt := ids[i]
+		serveSynchronously := false
+		serveHistory := false
+
+		if groups[i] != nil {
+			if gt == streamNewMessagesID {
+				//有消费组还没有读取的新消息
+				if streamCompareID(&s.lastID, &groups[i].lastID) > 0 {
+					gt = groups[i].lastID
+					serveSynchronously = true
+				}
+			} else {
+				//读取消费者PEL中的历史消息，总是立即回复
+				serveSynchronously = true
+				serveHistory = true
+			}
+		} else if s.length > 0 && streamCompareID(&s.lastID, &gt) > 0 {
+			serveSynchronously = true
+		}
+
+		if !serveSynchronously {
+			continue
+		}
+
+		arraylen++
+		if arraylen == 1 {
+			arraylenNode = addReplyDeferredLen(client)
+		}
+
+		//回复ID大于gt的消息
+		start := gt
+		streamIncrID(&start)
+
+		if client.resp == 2 {
+			addReplyArrayLen(client, 2)
+		}
+		addReplyBulk(client, key)
+
+		var consumer *streamConsumer
+		flags := 0
+		if groups[i] != nil {
+			consumer = streamLookupOrCreateConsumer(client, key, groups[i], consumername)
+			if noack {
+				flags |= streamRwrNoAck
+			}
+			if serveHistory {
+				flags |= streamRwrHistory
+			}
+		}
+		streamReplyWithRange(client, s, &start, nil, count, false, groups[i], consumer, flags, key)
+	}
+
+	if arraylen > 0 {
+		if client.resp == 2 {
+			setDeferredArrayLen(client, arraylenNode, arraylen)
+		} else {
+			setDeferredMapLen(client, arraylenNode, arraylen)
+		}
+		return
+	}
+
+	//没有可以回复的消息，阻塞客户端直到有新的消息或者超时
+	//在事务中不能阻塞，当作超时处理
+	if block && client.flags&(redisMulti|redisDenyBlocking) == 0 {
+		client.bpop.xreadCount = count
+		if xreadgroup {
+			client.bpop.xreadGroup = groupname
+			client.bpop.xreadConsumer = consumername
+			client.bpop.xreadGroupNoAck = noack
+		}
+		blockForKeys(client, redisBlockedStream, keys, timeout, nil, ids)
+		return
+	}
+
+	addReplyNullArray(client)
+}
+
+//唤醒阻塞在stream上的客户端，有比客户端等待的ID更大的消息时回复客户端
+func serveClientsBlockedOnStreamKey(o *robj, rl *readyList) {
+	de := rl.db.blockingKeys.dictFind(rl.key.ptr)
+	if de == nil {
+		return
+	}
+	clients := de.(*list.List)
+	s := o.ptr.(*stream)
+
+	var next *list.Element
+	for e := clients.Front(); e != nil; e = next {
+		next = e.Next()
+		receiver := e.Value.(*redisClient)
+		if receiver.btype != redisBlockedStream {
+			continue
+		}
+
+		gt := receiver.bpop.keys.dictFind(rl.key.ptr).(*streamID)
+
+		//XREADGROUP总是读取消费组的新消息，消费组可能已经被删除了
+		var group *streamCG
+		if receiver.bpop.xreadGroup != "" {
+			group = streamLookupCG(s, receiver.bpop.xreadGroup)
+			if group == nil {
+				addReplyString(receiver, "-NOGROUP the consumer group this client was blocked on no longer exists\r\n")
+				unblockClient(receiver)
+				continue
+			}
+			*gt = group.lastID
+		}
+
+		if streamCompareID(&s.lastID, gt) <= 0 {
+			continue
+		}
+
+		start := *gt
+		streamIncrID(&start)
+
+		var consumer *streamConsumer
+		flags := 0
+		if group != nil {
+			consumer = streamLookupOrCreateConsumer(receiver, rl.key, group, receiver.bpop.xreadConsumer)
+			if receiver.bpop.xreadGroupNoAck {
+				flags |= streamRwrNoAck
+			}
+		}
+
+		//和XREAD的回复格式相同，只有一个key
+		if receiver.resp == 2 {
+			addReplyArrayLen(receiver, 1)
+			addReplyArrayLen(receiver, 2)
+		} else {
+			addReplyMapLen(receiver, 1)
+		}
+		addReplyBulk(receiver, rl.key)
+		streamReplyWithRange(receiver, s, &start, nil, receiver.bpop.xreadCount, false, group, consumer, flags, rl.key)
+
+		//unblockClient会将客户端从clients中移除
+		unblockClient(receiver)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// Consumer group commands
+//-----------------------------------------------------------------------------
+
+var xgroupHelp = []string{
+	"CREATE <key> <groupname> <id|$> [option]",
+	"    Create a new consumer group. Options are:",
+	"    * MKSTREAM",
+	"      Create the empty stream if it does not exist.",
+	"    * ENTRIESREAD entries_read",
+	"      Set the group's entries_read counter (internal use).",
+	"CREATECONSUMER <key> <groupname> <consumer>",
+	"    Create a new consumer in the specified group.",
+	"DELCONSUMER <key> <groupname> <consumer>",
+	"    Remove the specified consumer.",
+	"DESTROY <key> <groupname>",
+	"    Remove the specified group.",
+	"SETID <key> <groupname> <id|$> [ENTRIESREAD entries_read]",
+	"    Set the current group ID and entries_read counter.",
+}
+
+//XGROUP CREATE key groupname id|$ [MKSTREAM] [ENTRIESREAD entries_read]
+//XGROUP SETID key groupname id|$ [ENTRIESREAD entries_read]
+//XGROUP DESTROY key groupname
+//XGROUP CREATECONSUMER key groupname consumername
+//XGROUP DELCONSUMER key groupname consumername
+func xgroupCommand(client *redisClient) {
+	opt := strings.ToLower(client.argv[1].ptr.(sds))
+
+	if opt == "help" && client.argc == 2 {
+		addReplyHelp(client, xgroupHelp)
+		return
+	}
+
+	//检查子命令的参数数量
+	switch opt {
+	case "create", "setid":
+		if client.argc < 5 {
+			addReplySubcommandArityError(client)
+			return
+		}
+	case "destroy":
+		if client.argc != 4 {
+			addReplySubcommandArityError(client)
+			return
+		}
+	case "createconsumer", "delconsumer":
+		if client.argc != 5 {
+			addReplySubcommandArityError(client)
+			return
+		}
+	default:
+		addReplySubcommandSyntaxError(client)
+		return
+	}
+
+	key := client.argv[2]
+	grpname := client.argv[3].ptr.(sds)
+	mkstream := false
+	entriesRead := int64(scgInvalidEntriesRead)
+	entriesReadGiven := false
+
+	//CREATE和SETID的选项
+	if opt == "create" || opt == "setid" {
+		for i := 5; i < client.argc; i++ {
+			moreargs := client.argc - 1 - i
+			arg := client.argv[i].ptr.(sds)
+			if opt == "create" && strings.EqualFold(arg, "mkstream") {
+				mkstream = true
+			} else if strings.EqualFold(arg, "entriesread") && moreargs > 0 {
+				i++
+				var ok bool
+				if entriesRead, ok = getLongLongFromObjectOrReply(client, client.argv[i], ""); !ok {
+					return
+				}
+				if entriesRead < 0 && entriesRead != scgInvalidEntriesRead {
+					addReplyError(client, "value for ENTRIESREAD must be positive or -1")
+					return
+				}
+				entriesReadGiven = true
+			} else {
+				addReplySubcommandSyntaxError(client)
+				return
+			}
+		}
+	}
+
+	o := client.db.lookupKeyWrite(key)
+	if o != nil && checkType(client, o, redisStream) {
+		return
+	}
+	var s *stream
+	if o != nil {
+		s = o.ptr.(*stream)
+	} else if opt != "create" || !mkstream {
+		addReplyError(client, "The XGROUP subcommand requires the key to exist. Note that for CREATE you may "+
+			"want to use the MKSTREAM option to create an empty stream automatically.")
+		return
+	}
+
+	//除了CREATE和DESTROY，消费组都必须存在
+	var cg *streamCG
+	if s != nil {
+		cg = streamLookupCG(s, grpname)
+	}
+	if cg == nil && (opt == "setid" || opt == "createconsumer" || opt == "delconsumer") {
+		addReplyString(client, "-NOGROUP No such consumer group '"+grpname+"' for key name '"+key.ptr.(sds)+"'\r\n")
+		return
+	}
+
+	switch opt {
+	case "create", "setid":
+		//$表示stream最后一条消息的ID
+		var id streamID
+		idarg := client.argv[4].ptr.(sds)
+		if idarg == "$" {
+			if s != nil {
+				id = s.lastID
+				if !entriesReadGiven {
+					entriesRead = int64(s.entriesAdded)
+				}
+			}
+		} else {
+			var ok bool
+			if id, ok = streamParseStrictIDOrReply(client, client.argv[4], 0, nil); !ok {
+				return
+			}
+		}
+
+		if opt == "setid" {
+			cg.lastID = id
+			cg.entriesRead = entriesRead
+			notifyKeyspaceEvent(notifyStream, "xgroup-setid", key, client.db.id)
+			server.dirty++
+			addReply(client, shared.ok)
+			return
+		}
+
+		//MKSTREAM，key不存在时创建空的stream
+		if s == nil {
+			o = createStreamObject()
+			client.db.dbAdd(key, o)
+			s = o.ptr.(*stream)
+		}
+		if streamCreateCG(s, grpname, id, entriesRead) == nil {
+			addReplyString(client, "-BUSYGROUP Consumer Group name already exists\r\n")
+			return
+		}
+		notifyKeyspaceEvent(notifyStream, "xgroup-create", key, client.db.id)
+		server.dirty++
+		addReply(client, shared.ok)
+	case "destroy":
+		if cg == nil {
+			addReply(client, shared.czero)
+			return
+		}
+		s.cgroups.dictDelete(grpname)
+		//唤醒阻塞在这个消费组上的客户端，回复NOGROUP错误
+		signalKeyAsReady(client.db, key)
+		notifyKeyspaceEvent(notifyStream, "xgroup-destroy", key, client.db.id)
+		server.dirty++
+		addReply(client, shared.cone)
+	case "createconsumer":
+		if streamCreateConsumer(cg, client.argv[4].ptr.(sds)) != nil {
+			notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key, client.db.id)
+			server.dirty++
+			addReply(client, shared.cone)
+		} else {
+			addReply(client, shared.czero)
+		}
+	case "delconsumer":
+		//回复消费者PEL中消息的数量
+		consumer := streamLookupConsumer(cg, client.argv[4].ptr.(sds), false)
+		if consumer == nil {
+			addReply(client, shared.czero)
+			return
+		}
+		pending := consumer.pel.length
+		streamDelConsumer(cg, consumer)
+		notifyKeyspaceEvent(notifyStream, "xgroup-delconsumer", key, client.db.id)
+		server.dirty++
+		addReplyLongLong(client, int64(pending))
+	}
+}
+
+//XACK key group id [id ...]
+func xackCommand(client *redisClient) {
+	//先检查所有的ID，有错误时不ACK任何消息
+	ids := make([]streamID, 0, client.argc-3)
+	for j := 3; j < client.argc; j++ {
+		id, ok := streamParseStrictIDOrReply(client, client.argv[j], 0, nil)
+		if !ok {
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o != nil && checkType(client, o, redisStream) {
+		return
+	}
+
+	//key或者消费组不存在时回复0
+	var group *streamCG
+	if o != nil {
+		group = streamLookupCG(o.ptr.(*stream), client.argv[2].ptr.(sds))
+	}
+	if group == nil {
+		addReply(client, shared.czero)
+		return
+	}
+
+	var acknowledged int64
+	for _, id := range ids {
+		nack, ok := group.pel.remove(id)
+		if !ok {
+			continue
+		}
+		nack.(*streamNACK).consumer.pel.remove(id)
+		acknowledged++
+		server.dirty++
+	}
+	addReplyLongLong(client, acknowledged)
+}
+
+//XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func xpendingCommand(client *redisClient) {
+	justinfo := client.argc == 3
+	key := client.argv[1]
+	groupname := client.argv[2].ptr.(sds)
+	var consumername sds
+	var startid, endid streamID
+	var count, minidle int64
+
+	if client.argc != 3 && (client.argc < 6 || client.argc > 9) {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	if client.argc >= 6 {
+		startidx := 3
+		if strings.EqualFold(client.argv[3].ptr.(sds), "idle") {
+			var ok bool
+			if minidle, ok = getLongLongFromObjectOrReply(client, client.argv[4], ""); !ok {
+				return
+			}
+			if client.argc < 8 {
+				addReply(client, shared.syntaxerr)
+				return
+			}
+			startidx += 2
+		}
+
+		//count之后还有consumer参数
+		if client.argc == startidx+4 {
+			consumername = client.argv[startidx+3].ptr.(sds)
+		} else if client.argc != startidx+3 {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+
+		var startex, endex, ok bool
+		if startid, startex, ok = streamParseIntervalIDOrReply(client, client.argv[startidx], 0); !ok {
+			return
+		}
+		if startex && !streamIncrID(&startid) {
+			addReplyError(client, "invalid start ID for the interval")
+			return
+		}
+		if endid, endex, ok = streamParseIntervalIDOrReply(client, client.argv[startidx+1], math.MaxUint64); !ok {
+			return
+		}
+		if endex && !streamDecrID(&endid) {
+			addReplyError(client, "invalid end ID for the interval")
+			return
+		}
+		if count, ok = getLongLongFromObjectOrReply(client, client.argv[startidx+2], ""); !ok {
+			return
+		}
+		if count < 0 {
+			count = 0
+		}
+	}
+
+	o := client.db.lookupKeyRead(key)
+	if o != nil && checkType(client, o, redisStream) {
+		return
+	}
+	var group *streamCG
+	if o != nil {
+		group = streamLookupCG(o.ptr.(*stream), groupname)
+	}
+	if group == nil {
+		addReplyString(client, "-NOGROUP No such key '"+key.ptr.(sds)+"' or consumer group '"+groupname+"'\r\n")
+		return
+	}
+
+	if justinfo {
+		//[pending数量, 最小ID, 最大ID, [[consumer, pending数量], ...]]
+		addReplyArrayLen(client, 4)
+		addReplyLongLong(client, int64(group.pel.length))
+		if group.pel.length == 0 {
+			addReplyNull(client)
+			addReplyNull(client)
+			addReplyNullArray(client)
+			return
+		}
+		first, _ := group.pel.first()
+		last, _ := group.pel.last()
+		addReplyStreamID(client, &first.key)
+		addReplyStreamID(client, &last.key)
+
+		arraylenNode := addReplyDeferredLen(client)
+		arraylen := 0
+		for _, consumer := range streamSortedConsumers(group) {
+			if consumer.pel.length == 0 {
+				continue
+			}
+			addReplyArrayLen(client, 2)
+			addReplyBulkCBuffer(client, consumer.name)
+			addReplyBulkCBuffer(client, ll2string(int64(consumer.pel.length)))
+			arraylen++
+		}
+		setDeferredArrayLen(client, arraylenNode, arraylen)
+		return
+	}
+
+	//[[id, consumer, idle, delivery count], ...]
+	pel := group.pel
+	if consumername != "" {
+		consumer := streamLookupConsumer(group, consumername, false)
+		if consumer == nil {
+			addReply(client, shared.emptyarray)
+			return
+		}
+		pel = consumer.pel
+	}
+
+	now := mstime()
+	arraylenNode := addReplyDeferredLen(client)
+	var arraylen int64
+	if count > 0 {
+		streamPELForEach(pel, &startid, &endid, func(id streamID, nack *streamNACK) bool {
+			idle := now - nack.deliveryTime
+			if minidle > 0 && idle < minidle {
+				return true
+			}
+			addReplyArrayLen(client, 4)
+			addReplyStreamID(client, &id)
+			addReplyBulkCBuffer(client, nack.consumer.name)
+			if idle < 0 {
+				idle = 0
+			}
+			addReplyLongLong(client, idle)
+			addReplyLongLong(client, int64(nack.deliveryCount))
+			arraylen++
+			return arraylen < count
+		})
+	}
+	setDeferredArrayLen(client, arraylenNode, int(arraylen))
+}
+
+//将PEL中的消息转移给consumer，justid为false时增加发送次数
+func streamClaimNACK(nack *streamNACK, id streamID, consumer *streamConsumer, deliverytime int64,
+	retrycount int64, justid bool) {
+	if nack.consumer != consumer {
+		if nack.consumer != nil {
+			nack.consumer.pel.remove(id)
+		}
+		consumer.pel.insert(id, nack)
+		nack.consumer = consumer
+	}
+	nack.deliveryTime = deliverytime
+	//指定了RETRYCOUNT时使用指定的值，否则除了JUSTID都增加发送次数
+	if retrycount >= 0 {
+		nack.deliveryCount = uint64(retrycount)
+	} else if !justid {
+		nack.deliveryCount++
+	}
+}
+
+//从消费组和消费者的PEL中删除消息
+func streamDelNACK(group *streamCG, id streamID, nack *streamNACK) {
+	group.pel.remove(id)
+	if nack.consumer != nil {
+		nack.consumer.pel.remove(id)
+	}
+}
+
+//XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds]
+//[RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+func xclaimCommand(client *redisClient) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o != nil && checkType(client, o, redisStream) {
+		return
+	}
+	var group *streamCG
+	if o != nil {
+		group = streamLookupCG(o.ptr.(*stream), client.argv[2].ptr.(sds))
+	}
+	if group == nil {
+		addReplyString(client, "-NOGROUP No such key '"+client.argv[1].ptr.(sds)+"' or consumer group '"+
+			client.argv[2].ptr.(sds)+"'\r\n")
+		return
+	}
+	s := o.ptr.(*stream)
+
+	minidle, ok := getLongLongFromObjectOrReply(client, client.argv[4], "Invalid min-idle-time argument for XCLAIM")
+	if !ok {
+		return
+	}
+	if minidle < 0 {
+		minidle = 0
+	}
+
+	//ID一直到第一个不是ID的参数为止
+	j := 5
+	for ; j < client.argc; j++ {
+		if _, ok := streamParseStrictIDOrReply(nil, client.argv[j], 0, nil); !ok {
+			break
+		}
+	}
+	lastIDArg := j - 1
+
+	now := mstime()
+	deliverytime := int64(-1)
+	retrycount := int64(-1)
+	force := false
+	justid := false
+	var lastID streamID
+	propagateLastID := false
+	for ; j < client.argc; j++ {
+		moreargs := client.argc - 1 - j
+		opt := client.argv[j].ptr.(sds)
+		if strings.EqualFold(opt, "force") {
+			force = true
+		} else if strings.EqualFold(opt, "justid") {
+			justid = true
+		} else if strings.EqualFold(opt, "idle") && moreargs > 0 {
+			j++
+			idle, ok := getLongLongFromObjectOrReply(client, client.argv[j], "Invalid IDLE option argument for XCLAIM")
+			if !ok {
+				return
+			}
+			deliverytime = now - idle
+		} else if strings.EqualFold(opt, "time") && moreargs > 0 {
+			j++
+			if deliverytime, ok = getLongLongFromObjectOrReply(client, client.argv[j],
+				"Invalid TIME option argument for XCLAIM"); !ok {
+				return
+			}
+		} else if strings.EqualFold(opt, "retrycount") && moreargs > 0 {
+			j++
+			if retrycount, ok = getLongLongFromObjectOrReply(client, client.argv[j],
+				"Invalid RETRYCOUNT option argument for XCLAIM"); !ok {
+				return
+			}
+		} else if strings.EqualFold(opt, "lastid") && moreargs > 0 {
+			j++
+			if lastID, ok = streamParseStrictIDOrReply(client, client.argv[j], 0, nil); !ok {
+				return
+			}
+			propagateLastID = true
+		} else {
+			addReplyError(client, "Unrecognized XCLAIM option '"+opt+"'")
+			return
+		}
+	}
+
+	//LASTID只有比消费组的lastID大时才更新和传播
+	if propagateLastID && streamCompareID(&lastID, &group.lastID) > 0 {
+		group.lastID = lastID
+	} else {
+		propagateLastID = false
+	}
+
+	//发送时间不能是未来的时间
+	if deliverytime != -1 {
+		if deliverytime < 0 || deliverytime > now {
+			deliverytime = now
+		}
+	} else {
+		deliverytime = now
+	}
+
+	var consumer *streamConsumer
+	arraylenNode := addReplyDeferredLen(client)
+	arraylen := 0
+	for j := 5; j <= lastIDArg; j++ {
+		id, _ := streamParseStrictIDOrReply(nil, client.argv[j], 0, nil)
+
+		var nack *streamNACK
+		if de, exists := group.pel.find(id); exists {
+			nack = de.(*streamNACK)
+		} else if force && streamEntryExists(s, id) {
+			//FORCE，消息不在PEL中时也创建
+			nack = &streamNACK{}
+			group.pel.insert(id, nack)
+		}
+		if nack == nil {
+			continue
+		}
+
+		//消息已经被删除了，从PEL中删除，重放XCLAIM时也会删除
+		if !streamEntryExists(s, id) {
+			streamPropagateXCLAIM(client, client.argv[1], group, &id, nack)
+			streamDelNACK(group, id, nack)
+			server.dirty++
+			continue
+		}
+
+		//空闲的时间太短，不转移
+		if minidle > 0 && now-nack.deliveryTime < minidle {
+			continue
+		}
+
+		if consumer == nil {
+			consumer = streamLookupOrCreateConsumer(client, client.argv[1], group, client.argv[3].ptr.(sds))
+		}
+		streamClaimNACK(nack, id, consumer, deliverytime, retrycount, justid)
+		server.dirty++
+		streamPropagateXCLAIM(client, client.argv[1], group, &id, nack)
+
+		if justid {
+			addReplyStreamID(client, &id)
+		} else {
+			streamReplyWithRange(client, s, &id, &id, 1, false, nil, nil, streamRwrRawEntries, nil)
+		}
+		arraylen++
+	}
+	if propagateLastID {
+		streamPropagateGroupID(client, client.argv[1], group)
+		server.dirty++
+	}
+	setDeferredArrayLen(client, arraylenNode, arraylen)
+
+	//IDLE等参数是相对时间，传播为上面确定的XCLAIM
+	preventCommandPropagation(client)
+}
+
+//XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func xautoclaimCommand(client *redisClient) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o != nil && checkType(client, o, redisStream) {
+		return
+	}
+	var group *streamCG
+	if o != nil {
+		group = streamLookupCG(o.ptr.(*stream), client.argv[2].ptr.(sds))
+	}
+	if group == nil {
+		addReplyString(client, "-NOGROUP No such key '"+client.argv[1].ptr.(sds)+"' or consumer group '"+
+			client.argv[2].ptr.(sds)+"'\r\n")
+		return
+	}
+	s := o.ptr.(*stream)
+
+	minidle, ok := getLongLongFromObjectOrReply(client, client.argv[4], "Invalid min-idle-time argument for XAUTOCLAIM")
+	if !ok {
+		return
+	}
+	if minidle < 0 {
+		minidle = 0
+	}
+
+	startid, startex, ok := streamParseIntervalIDOrReply(client, client.argv[5], 0)
+	if !ok {
+		return
+	}
+	if startex && !streamIncrID(&startid) {
+		addReplyError(client, "invalid start ID for the interval")
+		return
+	}
+
+	count := int64(100)
+	justid := false
+	for j := 6; j < client.argc; j++ {
+		moreargs := client.argc - 1 - j
+		opt := client.argv[j].ptr.(sds)
+		if strings.EqualFold(opt, "count") && moreargs > 0 {
+			j++
+			if count, ok = getLongLongFromObjectOrReply(client, client.argv[j], "COUNT must be > 0"); !ok {
+				return
+			}
+			if count < 1 || count > math.MaxInt64/10 {
+				addReplyError(client, "COUNT must be > 0")
+				return
+			}
+		} else if strings.EqualFold(opt, "justid") {
+			justid = true
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	//最多检查count * 10条PEL中的消息，先取出来，处理的过程中会修改PEL
+	attempts := count * 10
+	var pending []btreeItem
+	group.pel.ascend(startid, func(id streamID, value interface{}) bool {
+		pending = append(pending, btreeItem{key: id, value: value})
+		return int64(len(pending)) <= attempts
+	})
+
+	now := mstime()
+	consumer := streamLookupOrCreateConsumer(client, client.argv[1], group, client.argv[3].ptr.(sds))
+	var claimedIDs, deletedIDs []streamID
+	processed := 0
+	for ; int64(processed) < attempts && count > 0 && processed < len(pending); processed++ {
+		id := pending[processed].key
+		nack := pending[processed].value.(*streamNACK)
+
+		//消息已经被删除了，从PEL中删除
+		if !streamEntryExists(s, id) {
+			streamPropagateXCLAIM(client, client.argv[1], group, &id, nack)
+			streamDelNACK(group, id, nack)
+			server.dirty++
+			deletedIDs = append(deletedIDs, id)
+			continue
+		}
+
+		if minidle > 0 && now-nack.deliveryTime < minidle {
+			continue
+		}
+
+		streamClaimNACK(nack, id, consumer, now, -1, justid)
+		server.dirty++
+		streamPropagateXCLAIM(client, client.argv[1], group, &id, nack)
+		claimedIDs = append(claimedIDs, id)
+		count--
+	}
+
+	//下一次从PEL中的下一条消息开始，PEL已经遍历完时为0-0
+	var endid streamID
+	if processed < len(pending) {
+		endid = pending[processed].key
+	}
+
+	//[下一次开始的ID, [消息...], [被删除的ID...]]
+	addReplyArrayLen(client, 3)
+	addReplyStreamID(client, &endid)
+	addReplyArrayLen(client, len(claimedIDs))
+	for i := range claimedIDs {
+		if justid {
+			addReplyStreamID(client, &claimedIDs[i])
+		} else {
+			streamReplyWithRange(client, s, &claimedIDs[i], &claimedIDs[i], 1, false, nil, nil, streamRwrRawEntries, nil)
+		}
+	}
+	addReplyArrayLen(client, len(deletedIDs))
+	for i := range deletedIDs {
+		addReplyStreamID(client, &deletedIDs[i])
+	}
+
+	//传播为上面确定的XCLAIM
+	preventCommandPropagation(client)
+}
+
+var xinfoHelp = []string{
+	"CONSUMERS <key> <groupname>",
+	"    Show consumers of <groupname>.",
+	"GROUPS <key>",
+	"    Show the stream consumer groups.",
+	"STREAM <key> [FULL [COUNT <count>]",
+	"    Show information about the stream.",
+}
+
+//回复消费组的lag，也就是还没有读取的消息数量，无法计算时回复null
+func streamReplyWithCGLag(client *redisClient, s *stream, cg *streamCG) {
+	valid := false
+	var lag int64
+
+	if s.entriesAdded == 0 {
+		valid = true
+	} else if cg.entriesRead != scgInvalidEntriesRead && !streamRangeHasTombstones(s, &cg.lastID, nil) {
+		lag = int64(s.entriesAdded) - cg.entriesRead
+		valid = true
+	} else if entriesRead := streamEstimateDistanceFromFirstEverEntry(s, &cg.lastID); entriesRead != scgInvalidEntriesRead {
+		cg.entriesRead = entriesRead
+		lag = int64(s.entriesAdded) - entriesRead
+		valid = true
+	}
+
+	if valid {
+		addReplyLongLong(client, lag)
+	} else {
+		addReplyNull(client)
+	}
+}
+
+//回复消费组的entriesRead，无效时回复null
+func addReplyEntriesRead(client *redisClient, cg *streamCG) {
+	if cg.entriesRead != scgInvalidEntriesRead {
+		addReplyLongLong(client, cg.entriesRead)
+	} else {
+		addReplyNull(client)
+	}
+}
+
+//XINFO STREAM key FULL [COUNT count]
+func xinfoReplyWithStreamInfoFull(client *redisClient, s *stream, count int64) {
+	addReplyMapLen(client, 8)
+	addReplyBulkCBuffer(client, "length")
+	addReplyLongLong(client, int64(s.length))
+	addReplyBulkCBuffer(client, "radix-tree-keys")
+	addReplyLongLong(client, int64(s.rax.length))
+	addReplyBulkCBuffer(client, "radix-tree-nodes")
+	addReplyLongLong(client, int64(s.rax.nodes))
+	addReplyBulkCBuffer(client, "last-generated-id")
+	addReplyStreamID(client, &s.lastID)
+	addReplyBulkCBuffer(client, "max-deleted-entry-id")
+	addReplyStreamID(client, &s.maxDeletedEntryID)
+	addReplyBulkCBuffer(client, "entries-added")
+	addReplyLongLong(client, int64(s.entriesAdded))
+
+	addReplyBulkCBuffer(client, "entries")
+	streamReplyWithRange(client, s, nil, nil, count, false, nil, nil, 0, nil)
+
+	addReplyBulkCBuffer(client, "groups")
+	cgs := streamSortedCGs(s)
+	addReplyArrayLen(client, len(cgs))
+	for _, cg := range cgs {
+		addReplyMapLen(client, 7)
+		addReplyBulkCBuffer(client, "name")
+		addReplyBulkCBuffer(client, cg.name)
+		addReplyBulkCBuffer(client, "last-delivered-id")
+		addReplyStreamID(client, &cg.lastID)
+		addReplyBulkCBuffer(client, "entries-read")
+		addReplyEntriesRead(client, cg)
+		addReplyBulkCBuffer(client, "lag")
+		streamReplyWithCGLag(client, s, cg)
+		addReplyBulkCBuffer(client, "pel-count")
+		addReplyLongLong(client, int64(cg.pel.length))
+
+		//[[id, consumer, delivery time, delivery count], ...]
+		addReplyBulkCBuffer(client, "pending")
+		arraylenNode := addReplyDeferredLen(client)
+		var arraylen int64
+		cg.pel.ascend(streamID{}, func(id streamID, value interface{}) bool {
+			nack := value.(*streamNACK)
+			addReplyArrayLen(client, 4)
+			addReplyStreamID(client, &id)
+			addReplyBulkCBuffer(client, nack.consumer.name)
+			addReplyLongLong(client, nack.deliveryTime)
+			addReplyLongLong(client, int64(nack.deliveryCount))
+			arraylen++
+			return count == 0 || arraylen < count
+		})
+		setDeferredArrayLen(client, arraylenNode, int(arraylen))
+
+		addReplyBulkCBuffer(client, "consumers")
+		consumers := streamSortedConsumers(cg)
+		addReplyArrayLen(client, len(consumers))
+		for _, consumer := range consumers {
+			addReplyMapLen(client, 4)
+			addReplyBulkCBuffer(client, "name")
+			addReplyBulkCBuffer(client, consumer.name)
+			addReplyBulkCBuffer(client, "seen-time")
+			addReplyLongLong(client, consumer.seenTime)
+			addReplyBulkCBuffer(client, "pel-count")
+			addReplyLongLong(client, int64(consumer.pel.length))
+
+			//[[id, delivery time, delivery count], ...]
+			addReplyBulkCBuffer(client, "pending")
+			arraylenNode := addReplyDeferredLen(client)
+			var arraylen int64
+			consumer.pel.ascend(streamID{}, func(id streamID, value interface{}) bool {
+				nack := value.(*streamNACK)
+				addReplyArrayLen(client, 3)
+				addReplyStreamID(client, &id)
+				addReplyLongLong(client, nack.deliveryTime)
+				addReplyLongLong(client, int64(nack.deliveryCount))
+				arraylen++
+				return count == 0 || arraylen < count
+			})
+			setDeferredArrayLen(client, arraylenNode, int(arraylen))
+		}
+	}
+}
+
+//XINFO STREAM key [FULL [COUNT count]]
+func xinfoReplyWithStreamInfo(client *redisClient, s *stream) {
+	full := false
+	count := int64(10)
+	if client.argc > 3 {
+		if !strings.EqualFold(client.argv[3].ptr.(sds), "full") {
+			addReplySubcommandSyntaxError(client)
+			return
+		}
+		full = true
+		if client.argc == 6 && strings.EqualFold(client.argv[4].ptr.(sds), "count") {
+			var ok bool
+			if count, ok = getLongLongFromObjectOrReply(client, client.argv[5], ""); !ok {
+				return
+			}
+			if count < 0 {
+				count = 10
+			}
+		} else if client.argc != 4 {
+			addReplySubcommandSyntaxError(client)
+			return
+		}
+	}
+
+	if full {
+		xinfoReplyWithStreamInfoFull(client, s, count)
+		return
+	}
+
+	addReplyMapLen(client, 9)
+	addReplyBulkCBuffer(client, "length")
+	addReplyLongLong(client, int64(s.length))
+	addReplyBulkCBuffer(client, "radix-tree-keys")
+	addReplyLongLong(client, int64(s.rax.length))
+	addReplyBulkCBuffer(client, "radix-tree-nodes")
+	addReplyLongLong(client, int64(s.rax.nodes))
+	addReplyBulkCBuffer(client, "last-generated-id")
+	addReplyStreamID(client, &s.lastID)
+	addReplyBulkCBuffer(client, "max-deleted-entry-id")
+	addReplyStreamID(client, &s.maxDeletedEntryID)
+	addReplyBulkCBuffer(client, "entries-added")
+	addReplyLongLong(client, int64(s.entriesAdded))
+	addReplyBulkCBuffer(client, "groups")
+	addReplyLongLong(client, int64(s.cgroups.used()))
+
+	addReplyBulkCBuffer(client, "first-entry")
+	if first, ok := s.rax.first(); ok {
+		addReplyStreamEntry(client, &first.key, first.value.([]sds))
+	} else {
+		addReplyNull(client)
+	}
+	addReplyBulkCBuffer(client, "last-entry")
+	if last, ok := s.rax.last(); ok {
+		addReplyStreamEntry(client, &last.key, last.value.([]sds))
+	} else {
+		addReplyNull(client)
+	}
+}
+
+//XINFO CONSUMERS key groupname
+//XINFO GROUPS key
+//XINFO STREAM key [FULL [COUNT count]]
+func xinfoCommand(client *redisClient) {
+	opt := strings.ToLower(client.argv[1].ptr.(sds))
+
+	if opt == "help" && client.argc == 2 {
+		addReplyHelp(client, xinfoHelp)
+		return
+	}
+
+	switch opt {
+	case "consumers":
+		if client.argc != 4 {
+			addReplySubcommandArityError(client)
+			return
+		}
+	case "groups":
+		if client.argc != 3 {
+			addReplySubcommandArityError(client)
+			return
+		}
+	case "stream":
+		if client.argc < 3 || client.argc > 6 {
+			addReplySubcommandArityError(client)
+			return
+		}
+	default:
+		addReplySubcommandSyntaxError(client)
+		return
+	}
+
+	key := client.argv[2]
+	o := lookupKeyReadOrReply(client, key, shared.nokeyerr)
+	if o == nil || checkType(client, o, redisStream) {
+		return
+	}
+	s := o.ptr.(*stream)
+
+	switch opt {
+	case "consumers":
+		cg := streamLookupCG(s, client.argv[3].ptr.(sds))
+		if cg == nil {
+			addReplyString(client, "-NOGROUP No such consumer group '"+client.argv[3].ptr.(sds)+
+				"' for key name '"+key.ptr.(sds)+"'\r\n")
+			return
+		}
+		consumers := streamSortedConsumers(cg)
+		now := mstime()
+		addReplyArrayLen(client, len(consumers))
+		for _, consumer := range consumers {
+			idle := now - consumer.seenTime
+			if idle < 0 {
+				idle = 0
+			}
+			addReplyMapLen(client, 3)
+			addReplyBulkCBuffer(client, "name")
+			addReplyBulkCBuffer(client, consumer.name)
+			addReplyBulkCBuffer(client, "pending")
+			addReplyLongLong(client, int64(consumer.pel.length))
+			addReplyBulkCBuffer(client, "idle")
+			addReplyLongLong(client, idle)
+		}
+	case "groups":
+		cgs := streamSortedCGs(s)
+		addReplyArrayLen(client, len(cgs))
+		for _, cg := range cgs {
+			addReplyMapLen(client, 6)
+			addReplyBulkCBuffer(client, "name")
+			addReplyBulkCBuffer(client, cg.name)
+			addReplyBulkCBuffer(client, "consumers")
+			addReplyLongLong(client, int64(cg.consumers.used()))
+			addReplyBulkCBuffer(client, "pending")
+			addReplyLongLong(client, int64(cg.pel.length))
+			addReplyBulkCBuffer(client, "last-delivered-id")
+			addReplyStreamID(client, &cg.lastID)
+			addReplyBulkCBuffer(client, "entries-read")
+			addReplyEntriesRead(client, cg)
+			addReplyBulkCBuffer(client, "lag")
+			streamReplyWithCGLag(client, s, cg)
+		}
+	case "stream":
+		xinfoReplyWithStreamInfo(client, s)
+	}
+}
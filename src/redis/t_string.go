@@ -1,54 +1,155 @@
 package redis
 
 import (
+	"container/list"
 	"log"
-	"strconv"
+	"math"
+	"math/bits"
+	"strings"
 )
 
 const (
-	redisSetNoFlag = 0
-	redisSetNx     = 1 << 0
-	redisSetXx     = 1 << 1
+	redisSetNoFlag  = 0
+	redisSetNx      = 1 << 0 //key不存在时才设置
+	redisSetXx      = 1 << 1 //key存在时才设置
+	redisSetEx      = 1 << 2 //过期时间，单位为秒
+	redisSetPx      = 1 << 3 //过期时间，单位为毫秒
+	redisSetKeepTTL = 1 << 4 //保留原来的过期时间
+	redisSetGet     = 1 << 5 //回复原来的值
+	redisSetExat    = 1 << 6 //过期的时间戳，单位为秒
+	redisSetPxat    = 1 << 7 //过期的时间戳，单位为毫秒
+	redisSetPersist = 1 << 8 //GETEX，删除过期时间
 
 	unitSeconds      int = 0
 	unitMilliseconds int = 1
 )
 
-//SET key value [NX] [XX] [EX <seconds>] [PX <milliseconds>]
-//将key,value保存到db.dict中
-//如果有设置过期时间，那么在db.expires中也保存
-func setCommand(client *redisClient) {
-	log.Print("starting set command")
-	var expire *robj = nil
+//parseExtendedStringArgumentsOrReply解析的是哪个命令的参数
+const (
+	commandSet = 0
+	commandGet = 1
+)
+
+//检查字符串的长度是否超过了限制
+func checkStringLength(client *redisClient, size int64) bool {
+	if size > redisMaxBulkLen {
+		addReplyError(client, "string exceeds maximum allowed size (proto-max-bulk-len)")
+		return false
+	}
+	return true
+}
+
+//解析SET和GETEX的参数：[NX|XX] [GET] [EX|PX|EXAT|PXAT <time>|KEEPTTL|PERSIST]
+//返回选项、过期时间参数和过期时间的单位
+func parseExtendedStringArgumentsOrReply(client *redisClient, commandType int) (int, *robj, int, bool) {
 	flags := redisSetNoFlag
 	unit := unitSeconds
-	for i := 3; i < client.argc; i++ {
-		c := client.argv[i].ptr.(sds)
-		var next *robj = nil
-		if i < client.argc-1 {
-			next = client.argv[i+1]
-		}
-		//处理NX XX EX PX
-		if (c[0] == 'n' || c[0] == 'N') && (c[1] == 'x' || c[1] == 'X') {
+	var expire *robj
+
+	j := 3
+	if commandType == commandGet {
+		j = 2
+	}
+	for ; j < client.argc; j++ {
+		opt := client.argv[j].ptr.(sds)
+		var next *robj
+		if j < client.argc-1 {
+			next = client.argv[j+1]
+		}
+
+		if strings.EqualFold(opt, "nx") && flags&(redisSetXx) == 0 && commandType == commandSet {
 			flags |= redisSetNx
-		} else if (c[0] == 'x' || c[0] == 'X') && (c[1] == 'x' || c[1] == 'X') {
+		} else if strings.EqualFold(opt, "xx") && flags&(redisSetNx) == 0 && commandType == commandSet {
 			flags |= redisSetXx
-		} else if (c[0] == 'e' || c[0] == 'E') && (c[1] == 'x' || c[1] == 'X') && next != nil {
-			unit = unitSeconds
-			expire = next
-			i++
-		} else if (c[0] == 'p' || c[0] == 'P') && (c[1] == 'x' || c[1] == 'X') && next != nil {
-			unit = unitMilliseconds
+		} else if strings.EqualFold(opt, "get") && commandType == commandSet {
+			flags |= redisSetGet
+		} else if strings.EqualFold(opt, "keepttl") && flags&redisSetPersist == 0 &&
+			flags&(redisSetEx|redisSetPx|redisSetExat|redisSetPxat) == 0 && commandType == commandSet {
+			flags |= redisSetKeepTTL
+		} else if strings.EqualFold(opt, "persist") && commandType == commandGet &&
+			flags&(redisSetEx|redisSetPx|redisSetExat|redisSetPxat|redisSetKeepTTL) == 0 {
+			flags |= redisSetPersist
+		} else if next != nil && flags&(redisSetKeepTTL|redisSetPersist) == 0 &&
+			flags&(redisSetEx|redisSetPx|redisSetExat|redisSetPxat) == 0 &&
+			(strings.EqualFold(opt, "ex") || strings.EqualFold(opt, "px") ||
+				strings.EqualFold(opt, "exat") || strings.EqualFold(opt, "pxat")) {
+			switch strings.ToLower(opt) {
+			case "ex":
+				flags |= redisSetEx
+			case "px":
+				flags |= redisSetPx
+				unit = unitMilliseconds
+			case "exat":
+				flags |= redisSetExat
+			case "pxat":
+				flags |= redisSetPxat
+				unit = unitMilliseconds
+			}
 			expire = next
-			i++
+			j++
 		} else {
 			//命令异常
 			addReply(client, shared.syntaxerr)
-			return
+			return 0, nil, 0, false
+		}
+	}
+	return flags, expire, unit, true
+}
+
+//解析过期时间，返回过期的时间戳（毫秒）
+func getExpireMillisecondsOrReply(client *redisClient, expire *robj, flags int, unit int) (int64, bool) {
+	milliseconds, ok := getLongLongFromObjectOrReply(client, expire, "")
+	if !ok {
+		return 0, false
+	}
+	if milliseconds <= 0 || (unit == unitSeconds && milliseconds > math.MaxInt64/1000) {
+		addReplyError(client, "invalid expire time in '"+client.cmd.name+"' command")
+		return 0, false
+	}
+	if unit == unitSeconds {
+		milliseconds *= 1000
+	}
+	//EX/PX是相对时间
+	if flags&(redisSetPx|redisSetEx) != 0 {
+		now := mstime()
+		if milliseconds > math.MaxInt64-now {
+			addReplyError(client, "invalid expire time in '"+client.cmd.name+"' command")
+			return 0, false
 		}
+		milliseconds += now
 	}
-	setGenericCommand(client, flags, client.argv[1], client.argv[2], expire, unit)
+	return milliseconds, true
+}
+
+//SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|EXAT timestamp|PXAT milliseconds-timestamp|KEEPTTL]
+//将key,value保存到db.dict中
+//如果有设置过期时间，那么在db.expires中也保存
+func setCommand(client *redisClient) {
+	log.Print("starting set command")
+	flags, expire, unit, ok := parseExtendedStringArgumentsOrReply(client, commandSet)
+	if !ok {
+		return
+	}
+	client.argv[2] = tryObjectEncoding(client.argv[2])
+	setGenericCommand(client, flags, client.argv[1], client.argv[2], expire, unit, nil, nil)
+}
+
+//SETNX key value
+func setnxCommand(client *redisClient) {
+	client.argv[2] = tryObjectEncoding(client.argv[2])
+	setGenericCommand(client, redisSetNx, client.argv[1], client.argv[2], nil, 0, shared.cone, shared.czero)
+}
+
+//SETEX key seconds value
+func setexCommand(client *redisClient) {
+	client.argv[3] = tryObjectEncoding(client.argv[3])
+	setGenericCommand(client, redisSetEx, client.argv[1], client.argv[3], client.argv[2], unitSeconds, nil, nil)
+}
 
+//PSETEX key milliseconds value
+func psetexCommand(client *redisClient) {
+	client.argv[3] = tryObjectEncoding(client.argv[3])
+	setGenericCommand(client, redisSetPx, client.argv[1], client.argv[3], client.argv[2], unitMilliseconds, nil, nil)
 }
 
 //GET key
@@ -57,43 +158,1237 @@ func getCommand(client *redisClient) {
 }
 
 //get命令很简单，直接根据key从db.dict中查询对应的value返回
+//key不是字符串时回复错误并返回err
 func getGenericCommand(client *redisClient) int {
-	o := client.db.lookupKey(client.argv[1])
-
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.null[client.resp])
 	if o == nil {
-		addReply(client, shared.ok)
-		return redisErr
-	} else {
-		addReplyBulk(client, o)
 		return redisOk
 	}
+
+	if checkType(client, o, redisString) {
+		return redisErr
+	}
+	addReplyBulk(client, o)
+	return redisOk
 }
 
-func setGenericCommand(client *redisClient, flags int, key *robj, val *robj, expire *robj, unit int) {
-	var milliseconds int64 = 0
+//okReply和abortReply为nil时，分别回复OK和null
+func setGenericCommand(client *redisClient, flags int, key *robj, val *robj, expire *robj, unit int,
+	okReply *robj, abortReply *robj) {
+	var milliseconds int64
 	if expire != nil {
-		imsstr, _ := strconv.Atoi(string(expire.ptr.(sds)))
-		milliseconds = int64(imsstr)
-		if milliseconds < 0 {
-			addReply(client, shared.err)
+		var ok bool
+		if milliseconds, ok = getExpireMillisecondsOrReply(client, expire, flags, unit); !ok {
 			return
 		}
 	}
 
-	if unit == unitSeconds {
-		milliseconds = milliseconds * 1000
+	//GET，先回复原来的值
+	if flags&redisSetGet != 0 && getGenericCommand(client) == redisErr {
+		return
 	}
 
-	if (flags&redisSetNx > 0 && client.db.lookupKey(key) != nil) ||
-		(flags&redisSetXx > 0 && client.db.lookupKey(key) != nil) {
-		addReply(client, shared.nullbulk)
+	found := client.db.lookupKeyWrite(key) != nil
+	if (flags&redisSetNx != 0 && found) || (flags&redisSetXx != 0 && !found) {
+		if flags&redisSetGet == 0 {
+			if abortReply != nil {
+				addReply(client, abortReply)
+			} else {
+				addReplyNull(client)
+			}
+		}
+		return
 	}
 
-	client.db.setKey(key, val)
+	client.db.setKey(key, val, flags&redisSetKeepTTL != 0)
+	notifyKeyspaceEvent(notifyString, "set", key, client.db.id)
+	server.dirty++
 
 	if expire != nil {
 		//如果存在expire，则在db.expires中添加key
-		client.db.setExpire(key, mstime()+milliseconds)
+		client.db.setExpire(key, milliseconds)
+		notifyKeyspaceEvent(notifyGeneric, "expire", key, client.db.id)
+	}
+
+	//EX/PX/EXAT传播为SET key value PXAT <毫秒时间戳>，SETEX和PSETEX也一样
+	if expire != nil && flags&redisSetPxat == 0 {
+		rewriteClientCommandVector(client, shared.set, key, val, shared.pxat, createStringObjectFromLongLong(milliseconds))
+	}
+
+	if flags&redisSetGet == 0 {
+		if okReply != nil {
+			addReply(client, okReply)
+		} else {
+			addReply(client, shared.ok)
+		}
+	}
+}
+
+//GETEX key [EX seconds|PX milliseconds|EXAT timestamp|PXAT milliseconds-timestamp|PERSIST]
+func getexCommand(client *redisClient) {
+	flags, expire, unit, ok := parseExtendedStringArgumentsOrReply(client, commandGet)
+	if !ok {
+		return
+	}
+
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.null[client.resp])
+	if o == nil || checkType(client, o, redisString) {
+		return
+	}
+
+	var milliseconds int64
+	if expire != nil {
+		if milliseconds, ok = getExpireMillisecondsOrReply(client, expire, flags, unit); !ok {
+			return
+		}
+	}
+
+	addReplyBulk(client, o)
+
+	//过期时间已经过去时直接删除key
+	//GETEX传播为DEL、PEXPIREAT或者PERSIST
+	if expire != nil && milliseconds <= mstime() {
+		client.db.dbDelete(client.argv[1])
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+		server.dirty++
+		rewriteClientCommandVector(client, shared.del, client.argv[1])
+	} else if expire != nil {
+		client.db.setExpire(client.argv[1], milliseconds)
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyGeneric, "expire", client.argv[1], client.db.id)
+		server.dirty++
+		rewriteClientCommandVector(client, shared.pexpireat, client.argv[1], createStringObjectFromLongLong(milliseconds))
+	} else if flags&redisSetPersist != 0 {
+		if client.db.removeExpire(client.argv[1]) {
+			client.db.signalModifiedKey(client.argv[1])
+			notifyKeyspaceEvent(notifyGeneric, "persist", client.argv[1], client.db.id)
+			server.dirty++
+			rewriteClientCommandVector(client, shared.persist, client.argv[1])
+		}
+	}
+}
+
+//GETDEL key
+func getdelCommand(client *redisClient) {
+	if getGenericCommand(client) == redisErr {
+		return
+	}
+	if client.db.dbDelete(client.argv[1]) {
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+		server.dirty++
+	}
+}
+
+//GETSET key value
+func getsetCommand(client *redisClient) {
+	if getGenericCommand(client) == redisErr {
+		return
+	}
+	client.argv[2] = tryObjectEncoding(client.argv[2])
+	client.db.setKey(client.argv[1], client.argv[2], false)
+	notifyKeyspaceEvent(notifyString, "set", client.argv[1], client.db.id)
+	server.dirty++
+}
+
+//SETRANGE key offset value
+func setrangeCommand(client *redisClient) {
+	offset, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+	if offset < 0 {
+		addReplyError(client, "offset is out of range")
+		return
+	}
+	value := client.argv[3].ptr.(sds)
+
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o == nil {
+		//value为空时不创建key
+		if len(value) == 0 {
+			addReply(client, shared.czero)
+			return
+		}
+		if !checkStringLength(client, offset+int64(len(value))) {
+			return
+		}
+		o = createRawStringObject(sds(strings.Repeat("\x00", int(offset)) + value))
+		client.db.dbAdd(client.argv[1], o)
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyString, "setrange", client.argv[1], client.db.id)
+		server.dirty++
+		addReplyLongLong(client, int64(len(o.ptr.(sds))))
+		return
+	}
+
+	if checkType(client, o, redisString) {
+		return
+	}
+	cur := getDecodedObject(o).ptr.(sds)
+	if len(value) == 0 {
+		addReplyLongLong(client, int64(len(cur)))
+		return
+	}
+	if !checkStringLength(client, offset+int64(len(value))) {
+		return
+	}
+
+	//长度不够时用0补齐
+	buf := []byte(cur)
+	if end := int(offset) + len(value); end > len(buf) {
+		buf = append(buf, make([]byte, end-len(buf))...)
+	}
+	copy(buf[offset:], value)
+	o = createRawStringObject(sds(buf))
+	client.db.dbOverwrite(client.argv[1], o)
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyString, "setrange", client.argv[1], client.db.id)
+	server.dirty++
+	addReplyLongLong(client, int64(len(buf)))
+}
+
+//GETRANGE key start end
+func getrangeCommand(client *redisClient) {
+	start, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongLongFromObjectOrReply(client, client.argv[3], "")
+	if !ok {
+		return
+	}
+
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.emptybulk)
+	if o == nil || checkType(client, o, redisString) {
+		return
+	}
+	str := getDecodedObject(o).ptr.(sds)
+	strlen := int64(len(str))
+
+	//负数表示从尾部开始的位置
+	if start < 0 && end < 0 && start > end {
+		addReply(client, shared.emptybulk)
+		return
+	}
+	if start < 0 {
+		start = strlen + start
+	}
+	if end < 0 {
+		end = strlen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= strlen {
+		end = strlen - 1
+	}
+
+	if start > end || strlen == 0 {
+		addReply(client, shared.emptybulk)
+		return
+	}
+	addReplyBulkCBuffer(client, str[start:end+1])
+}
+
+//MGET key [key ...]
+//key不存在或者不是字符串时回复null
+func mgetCommand(client *redisClient) {
+	addReplyArrayLen(client, client.argc-1)
+	for j := 1; j < client.argc; j++ {
+		o := client.db.lookupKeyRead(client.argv[j])
+		if o == nil || o.rtype != redisString {
+			addReplyNull(client)
+		} else {
+			addReplyBulk(client, o)
+		}
+	}
+}
+
+//MSET/MSETNX的实现，nx为true时只要有一个key存在就不设置任何key
+func msetGenericCommand(client *redisClient, nx bool) {
+	if client.argc%2 == 0 {
+		addReplyError(client, "wrong number of arguments for '"+client.cmd.name+"' command")
+		return
+	}
+
+	if nx {
+		for j := 1; j < client.argc; j += 2 {
+			if client.db.lookupKeyWrite(client.argv[j]) != nil {
+				addReply(client, shared.czero)
+				return
+			}
+		}
+	}
+
+	for j := 1; j < client.argc; j += 2 {
+		client.db.setKey(client.argv[j], client.argv[j+1], false)
+		notifyKeyspaceEvent(notifyString, "set", client.argv[j], client.db.id)
+		server.dirty++
+	}
+	if nx {
+		addReply(client, shared.cone)
+	} else {
+		addReply(client, shared.ok)
+	}
+}
+
+//MSET key value [key value ...]
+func msetCommand(client *redisClient) {
+	msetGenericCommand(client, false)
+}
+
+//MSETNX key value [key value ...]
+func msetnxCommand(client *redisClient) {
+	msetGenericCommand(client, true)
+}
+
+//INCR/DECR/INCRBY/DECRBY的实现，保留原来的过期时间
+func incrDecrCommand(client *redisClient, incr int64) {
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o != nil && checkType(client, o, redisString) {
+		return
+	}
+	value, ok := getLongLongFromObjectOrReply(client, o, "")
+	if !ok {
+		return
+	}
+
+	if (incr < 0 && value < 0 && incr < math.MinInt64-value) ||
+		(incr > 0 && value > 0 && incr > math.MaxInt64-value) {
+		addReplyError(client, "increment or decrement would overflow")
+		return
+	}
+	value += incr
+
+	//不是共享对象时直接修改原来的对象
+	if o != nil && o.refcount == 1 && o.encoding == redisEncodingInt &&
+		(value < 0 || value >= redisSharedIntegers) {
+		o.ptr = value
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyString, "incrby", client.argv[1], client.db.id)
+		server.dirty++
+		addReplyLongLong(client, value)
+		return
+	}
+
+	newObj := createStringObjectFromLongLong(value)
+	if o != nil {
+		client.db.dbOverwrite(client.argv[1], newObj)
+	} else {
+		client.db.dbAdd(client.argv[1], newObj)
+	}
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyString, "incrby", client.argv[1], client.db.id)
+	server.dirty++
+	addReplyLongLong(client, value)
+}
+
+//INCR key
+func incrCommand(client *redisClient) {
+	incrDecrCommand(client, 1)
+}
+
+//DECR key
+func decrCommand(client *redisClient) {
+	incrDecrCommand(client, -1)
+}
+
+//INCRBY key increment
+func incrbyCommand(client *redisClient) {
+	incr, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+	incrDecrCommand(client, incr)
+}
+
+//DECRBY key decrement
+func decrbyCommand(client *redisClient) {
+	incr, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+	//-math.MinInt64会溢出
+	if incr == math.MinInt64 {
+		addReplyError(client, "decrement would overflow")
+		return
+	}
+	incrDecrCommand(client, -incr)
+}
+
+//INCRBYFLOAT key increment
+func incrbyfloatCommand(client *redisClient) {
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o != nil && checkType(client, o, redisString) {
+		return
+	}
+	value, ok := getDoubleFromObjectOrReply(client, o, "")
+	if !ok {
+		return
+	}
+	incr, ok := getDoubleFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		addReplyError(client, "increment would produce NaN or Infinity")
+		return
+	}
+
+	newObj := createStringObject(sds(ld2string(value)))
+	if o != nil {
+		client.db.dbOverwrite(client.argv[1], newObj)
+	} else {
+		client.db.dbAdd(client.argv[1], newObj)
+	}
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyString, "incrbyfloat", client.argv[1], client.db.id)
+	server.dirty++
+	addReplyBulk(client, newObj)
+
+	//浮点数的计算在不同的平台上可能有差异，传播为SET key value KEEPTTL
+	rewriteClientCommandArgument(client, 0, shared.set)
+	rewriteClientCommandArgument(client, 2, newObj)
+	rewriteClientCommandArgument(client, 3, shared.keepttl)
+}
+
+//APPEND key value
+func appendCommand(client *redisClient) {
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o == nil {
+		//key不存在时和SET相同
+		client.argv[2] = tryObjectEncoding(client.argv[2])
+		client.db.dbAdd(client.argv[1], client.argv[2])
+		incrRefCount(client.argv[2])
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyString, "append", client.argv[1], client.db.id)
+		server.dirty++
+		addReplyLongLong(client, int64(stringObjectLen(client.argv[2])))
+		return
+	}
+
+	if checkType(client, o, redisString) {
+		return
+	}
+	cur := getDecodedObject(o).ptr.(sds)
+	value := client.argv[2].ptr.(sds)
+	if !checkStringLength(client, int64(len(cur)+len(value))) {
+		return
+	}
+	o = createRawStringObject(cur + value)
+	client.db.dbOverwrite(client.argv[1], o)
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyString, "append", client.argv[1], client.db.id)
+	server.dirty++
+	addReplyLongLong(client, int64(len(o.ptr.(sds))))
+}
+
+//STRLEN key
+func strlenCommand(client *redisClient) {
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisString) {
+		return
+	}
+	addReplyLongLong(client, int64(stringObjectLen(o)))
+}
+
+//LCS key1 key2 [LEN] [IDX] [MINMATCHLEN len] [WITHMATCHLEN]
+//最长公共子序列，使用动态规划，需要O(N*M)的时间和空间
+func lcsCommand(client *redisClient) {
+	getlen, getidx, withmatchlen := false, false, false
+	var minmatchlen int64
+
+	for j := 3; j < client.argc; j++ {
+		opt := client.argv[j].ptr.(sds)
+		moreargs := client.argc - 1 - j
+		if strings.EqualFold(opt, "idx") {
+			getidx = true
+		} else if strings.EqualFold(opt, "len") {
+			getlen = true
+		} else if strings.EqualFold(opt, "withmatchlen") {
+			withmatchlen = true
+		} else if strings.EqualFold(opt, "minmatchlen") && moreargs > 0 {
+			var ok bool
+			if minmatchlen, ok = getLongLongFromObjectOrReply(client, client.argv[j+1], ""); !ok {
+				return
+			}
+			if minmatchlen < 0 {
+				minmatchlen = 0
+			}
+			j++
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	//key不存在时当作空字符串
+	var a, b sds
+	obja := client.db.lookupKeyRead(client.argv[1])
+	objb := client.db.lookupKeyRead(client.argv[2])
+	if (obja != nil && obja.rtype != redisString) || (objb != nil && objb.rtype != redisString) {
+		addReplyError(client, "The specified keys must contain string values")
+		return
+	}
+	if obja != nil {
+		a = getDecodedObject(obja).ptr.(sds)
+	}
+	if objb != nil {
+		b = getDecodedObject(objb).ptr.(sds)
+	}
+
+	if getidx && getlen {
+		addReplyError(client, "If you want both the length and indexes, please just use IDX.")
+		return
+	}
+
+	alen, blen := len(a), len(b)
+	if uint64(alen+1)*uint64(blen+1) >= math.MaxUint32/4 {
+		addReplyError(client, "String too long for LCS")
+		return
+	}
+
+	//lcs(i, j)为a[0:i]和b[0:j]的最长公共子序列的长度
+	dp := make([]uint32, (alen+1)*(blen+1))
+	lcs := func(i, j int) uint32 {
+		return dp[j+i*(blen+1)]
+	}
+	for i := 1; i <= alen; i++ {
+		for j := 1; j <= blen; j++ {
+			if a[i-1] == b[j-1] {
+				dp[j+i*(blen+1)] = lcs(i-1, j-1) + 1
+			} else if lcs1, lcs2 := lcs(i-1, j), lcs(i, j-1); lcs1 > lcs2 {
+				dp[j+i*(blen+1)] = lcs1
+			} else {
+				dp[j+i*(blen+1)] = lcs2
+			}
+		}
+	}
+
+	//从尾部开始回溯得到公共子序列，IDX时同时回复匹配的区间
+	idx := lcs(alen, blen)
+	result := make([]byte, idx)
+	computelcs := getidx || !getlen
+
+	var arraylenNode *list.Element
+	arraylen := 0
+	if getidx {
+		addReplyMapLen(client, 2)
+		addReplyBulkCBuffer(client, "matches")
+		arraylenNode = addReplyDeferredLen(client)
+	}
+
+	i, j := alen, blen
+	arangeStart, arangeEnd, brangeStart, brangeEnd := alen, 0, 0, 0
+	for computelcs && i > 0 && j > 0 {
+		emitRange := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+
+			if arangeStart == alen {
+				//开始一个新的区间
+				arangeStart, arangeEnd = i-1, i-1
+				brangeStart, brangeEnd = j-1, j-1
+			} else if arangeStart == i && brangeStart == j {
+				//和当前的区间连续，向前扩展
+				arangeStart--
+				brangeStart--
+			} else {
+				emitRange = true
+			}
+			//到达了字符串的开头，回复当前的区间
+			if arangeStart == 0 || brangeStart == 0 {
+				emitRange = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if lcs(i-1, j) > lcs(i, j-1) {
+				i--
+			} else {
+				j--
+			}
+			if arangeStart != alen {
+				emitRange = true
+			}
+		}
+
+		if emitRange {
+			matchLen := int64(arangeEnd - arangeStart + 1)
+			if getidx && (minmatchlen == 0 || matchLen >= minmatchlen) {
+				if withmatchlen {
+					addReplyArrayLen(client, 3)
+				} else {
+					addReplyArrayLen(client, 2)
+				}
+				addReplyArrayLen(client, 2)
+				addReplyLongLong(client, int64(arangeStart))
+				addReplyLongLong(client, int64(arangeEnd))
+				addReplyArrayLen(client, 2)
+				addReplyLongLong(client, int64(brangeStart))
+				addReplyLongLong(client, int64(brangeEnd))
+				if withmatchlen {
+					addReplyLongLong(client, matchLen)
+				}
+				arraylen++
+			}
+			arangeStart = alen
+		}
+	}
+
+	if getidx {
+		setDeferredArrayLen(client, arraylenNode, arraylen)
+		addReplyBulkCBuffer(client, "len")
+		addReplyLongLong(client, int64(lcs(alen, blen)))
+	} else if getlen {
+		addReplyLongLong(client, int64(lcs(alen, blen)))
+	} else {
+		addReplyBulkCBuffer(client, sds(result))
+	}
+}
+
+//位操作的最大偏移量，和字符串的最大长度相同
+const redisBitOffsetMax = redisMaxBulkLen*8 - 1
+
+//BITFIELD的溢出处理方式
+const (
+	bfOverflowWrap = 0 //回绕
+	bfOverflowSat  = 1 //饱和到最大值或最小值
+	bfOverflowFail = 2 //不修改并回复null
+)
+
+//BITFIELD的操作
+const (
+	bitfieldOpGet    = 0
+	bitfieldOpSet    = 1
+	bitfieldOpIncrby = 2
+)
+
+//解析位偏移量，hash为true时允许 #N 的格式，表示第N个bits位宽的整数
+func getBitOffsetFromArgument(client *redisClient, o *robj, hash bool, bits uint64) (uint64, bool) {
+	p := o.ptr.(sds)
+	usehash := false
+	if hash && len(p) > 0 && p[0] == '#' {
+		usehash = true
+		p = p[1:]
+	}
+
+	loffset, ok := string2ll(p)
+	if ok && usehash {
+		if loffset > math.MaxInt64/int64(bits) {
+			ok = false
+		} else {
+			loffset *= int64(bits)
+		}
+	}
+	if !ok || loffset < 0 || loffset > redisBitOffsetMax {
+		addReplyError(client, "bit offset is not an integer or out of range")
+		return 0, false
+	}
+	return uint64(loffset), true
+}
+
+//解析BITFIELD的类型：i1 ~ i64, u1 ~ u63，返回是否有符号和位宽
+func getBitfieldTypeFromArgument(client *redisClient, o *robj) (bool, uint64, bool) {
+	p := o.ptr.(sds)
+	sign := false
+	var bits int64
+	ok := len(p) > 1 && (p[0] == 'i' || p[0] == 'I' || p[0] == 'u' || p[0] == 'U')
+	if ok {
+		sign = p[0] == 'i' || p[0] == 'I'
+		bits, ok = string2ll(p[1:])
+	}
+	if !ok || (sign && (bits < 1 || bits > 64)) || (!sign && (bits < 1 || bits > 63)) {
+		addReplyError(client, "Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+		return false, 0, false
+	}
+	return sign, uint64(bits), true
+}
+
+//查找或者创建用于位操作的字符串对象，长度不够时用0补齐到maxbit所在的字节
+//返回的对象是raw编码并且没有被共享，可以直接修改
+func lookupStringForBitCommand(client *redisClient, maxbit uint64) *robj {
+	byteLen := maxbit>>3 + 1
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o == nil {
+		o = createRawStringObject(sds(make([]byte, byteLen)))
+		client.db.dbAdd(client.argv[1], o)
+		return o
+	}
+
+	if checkType(client, o, redisString) {
+		return nil
+	}
+	o = client.db.dbUnshareStringValue(client.argv[1], o)
+	if cur := o.ptr.(sds); uint64(len(cur)) < byteLen {
+		o.ptr = cur + sds(make([]byte, byteLen-uint64(len(cur))))
+	}
+	return o
+}
+
+//SETBIT key offset value
+func setbitCommand(client *redisClient) {
+	bitoffset, ok := getBitOffsetFromArgument(client, client.argv[2], false, 0)
+	if !ok {
+		return
+	}
+	on, ok := string2ll(client.argv[3].ptr.(sds))
+	if !ok || (on != 0 && on != 1) {
+		addReplyError(client, "bit is not an integer or out of range")
+		return
+	}
+
+	o := lookupStringForBitCommand(client, bitoffset)
+	if o == nil {
+		return
+	}
+
+	//高位在前
+	buf := []byte(o.ptr.(sds))
+	byteIdx := bitoffset >> 3
+	bit := 7 - byte(bitoffset&0x7)
+	bitval := buf[byteIdx] >> bit & 1
+	buf[byteIdx] = buf[byteIdx]&^(1<<bit) | byte(on)<<bit
+	o.ptr = sds(buf)
+	client.db.signalModifiedKey(client.argv[1])
+	notifyKeyspaceEvent(notifyString, "setbit", client.argv[1], client.db.id)
+	server.dirty++
+	addReplyLongLong(client, int64(bitval))
+}
+
+//GETBIT key offset
+func getbitCommand(client *redisClient) {
+	bitoffset, ok := getBitOffsetFromArgument(client, client.argv[2], false, 0)
+	if !ok {
+		return
+	}
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisString) {
+		return
+	}
+
+	str := getDecodedObject(o).ptr.(sds)
+	byteIdx := bitoffset >> 3
+	bitval := 0
+	if byteIdx < uint64(len(str)) {
+		bitval = int(str[byteIdx]>>(7-byte(bitoffset&0x7))) & 1
+	}
+	addReplyLongLong(client, int64(bitval))
+}
+
+//解析BITCOUNT/BITPOS的区间 start end [BYTE|BIT]，转换为位的区间[startbit, endbit]
+//start > end时返回的区间为空
+func parseBitRangeOrReply(client *redisClient, startArg *robj, endArg *robj, unitArg *robj, strlen int64) (int64, int64, bool) {
+	start, ok := getLongLongFromObjectOrReply(client, startArg, "")
+	if !ok {
+		return 0, 0, false
+	}
+	end := int64(math.MaxInt64)
+	if endArg != nil {
+		if end, ok = getLongLongFromObjectOrReply(client, endArg, ""); !ok {
+			return 0, 0, false
+		}
+	}
+	isbit := false
+	if unitArg != nil {
+		if strings.EqualFold(unitArg.ptr.(sds), "bit") {
+			isbit = true
+		} else if !strings.EqualFold(unitArg.ptr.(sds), "byte") {
+			addReply(client, shared.syntaxerr)
+			return 0, 0, false
+		}
+	}
+
+	//负数表示从尾部开始的位置
+	totlen := strlen
+	if isbit {
+		totlen <<= 3
+	}
+	if start < 0 {
+		start = totlen + start
+	}
+	if end < 0 {
+		end = totlen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= totlen {
+		end = totlen - 1
+	}
+
+	if !isbit {
+		start <<= 3
+		end = end<<3 + 7
+		if end < 0 {
+			end = -1
+		}
+	}
+	return start, end, true
+}
+
+//统计buf中[startbit, endbit]之间的1的数量
+func bitcountRange(buf sds, startbit int64, endbit int64) int64 {
+	var count int64
+	for startbit <= endbit && startbit&7 != 0 {
+		count += int64(buf[startbit>>3] >> (7 - byte(startbit&7)) & 1)
+		startbit++
+	}
+	for ; startbit+7 <= endbit; startbit += 8 {
+		count += int64(bits.OnesCount8(buf[startbit>>3]))
+	}
+	for ; startbit <= endbit; startbit++ {
+		count += int64(buf[startbit>>3] >> (7 - byte(startbit&7)) & 1)
+	}
+	return count
+}
+
+//BITCOUNT key [start end [BYTE|BIT]]
+func bitcountCommand(client *redisClient) {
+	if client.argc != 2 && client.argc != 4 && client.argc != 5 {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	o := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if o == nil || checkType(client, o, redisString) {
+		return
+	}
+	str := getDecodedObject(o).ptr.(sds)
+
+	startbit, endbit := int64(0), int64(len(str))*8-1
+	if client.argc > 2 {
+		var unitArg *robj
+		if client.argc == 5 {
+			unitArg = client.argv[4]
+		}
+		var ok bool
+		if startbit, endbit, ok = parseBitRangeOrReply(client, client.argv[2], client.argv[3], unitArg, int64(len(str))); !ok {
+			return
+		}
+	}
+
+	if startbit > endbit {
+		addReply(client, shared.czero)
+		return
+	}
+	addReplyLongLong(client, bitcountRange(str, startbit, endbit))
+}
+
+//查找buf中[startbit, endbit]之间第一个值为bit的位，找不到时返回-1
+func bitposRange(buf sds, bit byte, startbit int64, endbit int64) int64 {
+	//整个字节都不是要找的值时直接跳过
+	var skip byte
+	if bit == 0 {
+		skip = 0xff
+	}
+	for pos := startbit; pos <= endbit; {
+		if pos&7 == 0 && pos+7 <= endbit && buf[pos>>3] == skip {
+			pos += 8
+			continue
+		}
+		if buf[pos>>3]>>(7-byte(pos&7))&1 == bit {
+			return pos
+		}
+		pos++
+	}
+	return -1
+}
+
+//BITPOS key bit [start [end [BYTE|BIT]]]
+func bitposCommand(client *redisClient) {
+	bit, ok := getLongLongFromObjectOrReply(client, client.argv[2], "")
+	if !ok {
+		return
+	}
+	if bit != 0 && bit != 1 {
+		addReplyError(client, "The bit argument must be 1 or 0.")
+		return
+	}
+	if client.argc > 6 {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	//key不存在时当作全是0的字符串
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		if bit == 1 {
+			addReplyLongLong(client, -1)
+		} else {
+			addReply(client, shared.czero)
+		}
+		return
+	}
+	if checkType(client, o, redisString) {
+		return
+	}
+	str := getDecodedObject(o).ptr.(sds)
+
+	startbit, endbit := int64(0), int64(len(str))*8-1
+	endGiven := client.argc >= 5
+	if client.argc > 3 {
+		var endArg, unitArg *robj
+		if client.argc >= 5 {
+			endArg = client.argv[4]
+		}
+		if client.argc == 6 {
+			unitArg = client.argv[5]
+		}
+		if startbit, endbit, ok = parseBitRangeOrReply(client, client.argv[3], endArg, unitArg, int64(len(str))); !ok {
+			return
+		}
+	}
+
+	if startbit > endbit {
+		addReplyLongLong(client, -1)
+		return
+	}
+
+	pos := bitposRange(str, byte(bit), startbit, endbit)
+	//查找0并且没有指定end时，字符串后面的位都当作0
+	if pos == -1 && bit == 0 && !endGiven {
+		pos = endbit + 1
+	}
+	addReplyLongLong(client, pos)
+}
+
+//BITOP AND|OR|XOR|NOT destkey key [key ...]
+func bitopCommand(client *redisClient) {
+	op := strings.ToLower(client.argv[1].ptr.(sds))
+	if op != "and" && op != "or" && op != "xor" && op != "not" {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+	if op == "not" && client.argc != 4 {
+		addReplyError(client, "BITOP NOT must be called with a single source key.")
+		return
+	}
+
+	//key不存在时当作空字符串
+	numkeys := client.argc - 3
+	srcs := make([]sds, numkeys)
+	maxlen := 0
+	for j := 0; j < numkeys; j++ {
+		o := client.db.lookupKeyRead(client.argv[j+3])
+		if o == nil {
+			continue
+		}
+		if checkType(client, o, redisString) {
+			return
+		}
+		srcs[j] = getDecodedObject(o).ptr.(sds)
+		if len(srcs[j]) > maxlen {
+			maxlen = len(srcs[j])
+		}
+	}
+
+	//较短的字符串用0补齐
+	res := make([]byte, maxlen)
+	for i := 0; i < maxlen; i++ {
+		var output byte
+		for j, src := range srcs {
+			var b byte
+			if i < len(src) {
+				b = src[i]
+			}
+			if j == 0 {
+				output = b
+				if op == "not" {
+					output = ^b
+				}
+				continue
+			}
+			switch op {
+			case "and":
+				output &= b
+			case "or":
+				output |= b
+			case "xor":
+				output ^= b
+			}
+		}
+		res[i] = output
+	}
+
+	//结果为空时删除destkey
+	if maxlen == 0 {
+		if client.db.dbDelete(client.argv[2]) {
+			client.db.signalModifiedKey(client.argv[2])
+			notifyKeyspaceEvent(notifyGeneric, "del", client.argv[2], client.db.id)
+			server.dirty++
+		}
+	} else {
+		client.db.setKey(client.argv[2], createRawStringObject(sds(res)), false)
+		notifyKeyspaceEvent(notifyString, "set", client.argv[2], client.db.id)
+		server.dirty++
+	}
+	addReplyLongLong(client, int64(maxlen))
+}
+
+//读取从offset开始的bits位的无符号整数，超出字符串长度的位当作0
+func getUnsignedBitfield(buf []byte, offset uint64, bits uint64) uint64 {
+	var value uint64
+	for j := uint64(0); j < bits; j++ {
+		byteIdx := offset >> 3
+		var bitval uint64
+		if byteIdx < uint64(len(buf)) {
+			bitval = uint64(buf[byteIdx]>>(7-byte(offset&0x7))) & 1
+		}
+		value = value<<1 | bitval
+		offset++
+	}
+	return value
+}
+
+//读取从offset开始的bits位的有符号整数
+func getSignedBitfield(buf []byte, offset uint64, bits uint64) int64 {
+	value := getUnsignedBitfield(buf, offset, bits)
+	//符号位为1时，高位都设置为1
+	if bits < 64 && value&(1<<(bits-1)) != 0 {
+		value |= math.MaxUint64 << bits
+	}
+	return int64(value)
+}
+
+//将value的低bits位写入从offset开始的位置，buf的长度必须足够
+func setUnsignedBitfield(buf []byte, offset uint64, bits uint64, value uint64) {
+	for j := uint64(0); j < bits; j++ {
+		bitval := byte(value>>(bits-1-j)) & 1
+		byteIdx := offset >> 3
+		bit := 7 - byte(offset&0x7)
+		buf[byteIdx] = buf[byteIdx]&^(1<<bit) | bitval<<bit
+		offset++
+	}
+}
+
+//检查无符号整数value加上incr之后是否溢出，溢出时按照owtype返回新的值
+//返回1表示上溢，-1表示下溢，0表示没有溢出
+func checkUnsignedBitfieldOverflow(value uint64, incr int64, bits uint64, owtype int) (int, uint64) {
+	max := uint64(1)<<bits - 1
+	maxincr := int64(max - value)
+	minincr := -int64(value)
+
+	if value > max || (incr > 0 && incr > maxincr) {
+		if owtype == bfOverflowWrap {
+			return 1, (value + uint64(incr)) &^ (math.MaxUint64 << bits)
+		}
+		return 1, max
+	} else if incr < 0 && incr < minincr {
+		if owtype == bfOverflowWrap {
+			return -1, (value + uint64(incr)) &^ (math.MaxUint64 << bits)
+		}
+		return -1, 0
+	}
+	return 0, value + uint64(incr)
+}
+
+//检查有符号整数value加上incr之后是否溢出，溢出时按照owtype返回新的值
+//返回1表示上溢，-1表示下溢，0表示没有溢出
+func checkSignedBitfieldOverflow(value int64, incr int64, bits uint64, owtype int) (int, int64) {
+	max := int64(math.MaxInt64)
+	if bits != 64 {
+		max = int64(1)<<(bits-1) - 1
+	}
+	min := -max - 1
+	//bits为64时可能溢出，和下面的条件配合判断
+	maxincr := max - value
+	minincr := min - value
+
+	//回绕，截取低bits位并扩展符号位
+	wrap := func() int64 {
+		c := uint64(value) + uint64(incr)
+		if bits < 64 {
+			mask := uint64(math.MaxUint64) << bits
+			if c&(1<<(bits-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c)
+	}
+
+	if value > max || (bits != 64 && incr > maxincr) || (value >= 0 && incr > 0 && incr > maxincr) {
+		if owtype == bfOverflowWrap {
+			return 1, wrap()
+		}
+		return 1, max
+	} else if value < min || (bits != 64 && incr < minincr) || (value < 0 && incr < 0 && incr < minincr) {
+		if owtype == bfOverflowWrap {
+			return -1, wrap()
+		}
+		return -1, min
+	}
+	return 0, value + incr
+}
+
+//BITFIELD的一个操作
+type bitfieldOp struct {
+	offset uint64
+	i64    int64 //SET的值或者INCRBY的增量
+	opcode int
+	owtype int
+	bits   uint64
+	sign   bool
+}
+
+//BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL]
+//BITFIELD_RO key [GET type offset ...]
+func bitfieldCommand(client *redisClient) {
+	readonly := client.cmd.name == "bitfield_ro"
+	owtype := bfOverflowWrap
+	changes := false
+	var highestWriteOffset uint64
+	ops := make([]bitfieldOp, 0, (client.argc-2)/3)
+
+	for j := 2; j < client.argc; j++ {
+		remargs := client.argc - j - 1
+		subcmd := client.argv[j].ptr.(sds)
+		var opcode int
+		if strings.EqualFold(subcmd, "get") && remargs >= 2 {
+			opcode = bitfieldOpGet
+		} else if strings.EqualFold(subcmd, "set") && remargs >= 3 {
+			opcode = bitfieldOpSet
+		} else if strings.EqualFold(subcmd, "incrby") && remargs >= 3 {
+			opcode = bitfieldOpIncrby
+		} else if strings.EqualFold(subcmd, "overflow") && remargs >= 1 {
+			j++
+			switch strings.ToLower(client.argv[j].ptr.(sds)) {
+			case "wrap":
+				owtype = bfOverflowWrap
+			case "sat":
+				owtype = bfOverflowSat
+			case "fail":
+				owtype = bfOverflowFail
+			default:
+				addReplyError(client, "Invalid OVERFLOW type specified")
+				return
+			}
+			continue
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+
+		sign, bits, ok := getBitfieldTypeFromArgument(client, client.argv[j+1])
+		if !ok {
+			return
+		}
+		offset, ok := getBitOffsetFromArgument(client, client.argv[j+2], true, bits)
+		if !ok {
+			return
+		}
+
+		var i64 int64
+		if opcode != bitfieldOpGet {
+			if readonly {
+				addReplyError(client, "BITFIELD_RO only supports the GET subcommand")
+				return
+			}
+			if i64, ok = getLongLongFromObjectOrReply(client, client.argv[j+3], ""); !ok {
+				return
+			}
+			changes = true
+			if offset+bits-1 > highestWriteOffset {
+				highestWriteOffset = offset + bits - 1
+			}
+			j++
+		}
+		ops = append(ops, bitfieldOp{offset: offset, i64: i64, opcode: opcode, owtype: owtype, bits: bits, sign: sign})
+		j += 2
+	}
+
+	//只有GET时key不存在也可以，当作全是0的字符串
+	var o *robj
+	if changes {
+		if o = lookupStringForBitCommand(client, highestWriteOffset); o == nil {
+			return
+		}
+	} else {
+		o = client.db.lookupKeyRead(client.argv[1])
+		if o != nil && checkType(client, o, redisString) {
+			return
+		}
+	}
+
+	var buf []byte
+	if o != nil {
+		buf = []byte(getDecodedObject(o).ptr.(sds))
+	}
+
+	addReplyArrayLen(client, len(ops))
+	for _, op := range ops {
+		if op.opcode == bitfieldOpGet {
+			if op.sign {
+				addReplyLongLong(client, getSignedBitfield(buf, op.offset, op.bits))
+			} else {
+				addReplyLongLong(client, int64(getUnsignedBitfield(buf, op.offset, op.bits)))
+			}
+			continue
+		}
+
+		//SET回复原来的值，INCRBY回复新的值
+		overflow := 0
+		var newval uint64
+		var retval int64
+		if op.sign {
+			oldval := getSignedBitfield(buf, op.offset, op.bits)
+			var value, incr int64
+			if op.opcode == bitfieldOpSet {
+				value, incr = op.i64, 0
+			} else {
+				value, incr = oldval, op.i64
+			}
+			var wrapped int64
+			overflow, wrapped = checkSignedBitfieldOverflow(value, incr, op.bits, op.owtype)
+			newval = uint64(wrapped)
+			if op.opcode == bitfieldOpSet {
+				retval = oldval
+			} else {
+				retval = wrapped
+			}
+		} else {
+			oldval := getUnsignedBitfield(buf, op.offset, op.bits)
+			var value uint64
+			var incr int64
+			if op.opcode == bitfieldOpSet {
+				value, incr = uint64(op.i64), 0
+			} else {
+				value, incr = oldval, op.i64
+			}
+			overflow, newval = checkUnsignedBitfieldOverflow(value, incr, op.bits, op.owtype)
+			if op.opcode == bitfieldOpSet {
+				retval = int64(oldval)
+			} else {
+				retval = int64(newval)
+			}
+		}
+
+		//FAIL，溢出时不修改并回复null
+		if overflow != 0 && op.owtype == bfOverflowFail {
+			addReplyNull(client)
+			continue
+		}
+		setUnsignedBitfield(buf, op.offset, op.bits, newval)
+		addReplyLongLong(client, retval)
+	}
+
+	if changes {
+		o.ptr = sds(buf)
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyString, "setbit", client.argv[1], client.db.id)
+		server.dirty++
 	}
-	addReply(client, shared.ok)
 }
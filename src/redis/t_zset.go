@@ -0,0 +1,1606 @@
+package redis
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Skiplist implementation of the low level API
+//-----------------------------------------------------------------------------
+
+const (
+	zskiplistMaxLevel = 32   //skiplist的最大层数，足够存储2^64个元素
+	zskiplistP        = 0.25 //skiplist节点层数增加的概率
+)
+
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    uint64 //到forward节点之间的距离，用来计算排名
+}
+
+type zskiplistNode struct {
+	ele      sds
+	score    float64
+	backward *zskiplistNode
+	level    []zskiplistLevel
+}
+
+type zskiplist struct {
+	header *zskiplistNode
+	tail   *zskiplistNode
+	length uint64
+	level  int
+}
+
+//skiplist编码的zset，dict用来O(1)查找member的score，key = sds, value = float64
+type zset struct {
+	dict *dict
+	zsl  *zskiplist
+}
+
+func zslCreateNode(level int, score float64, ele sds) *zskiplistNode {
+	return &zskiplistNode{
+		ele:   ele,
+		score: score,
+		level: make([]zskiplistLevel, level),
+	}
+}
+
+func zslCreate() *zskiplist {
+	return &zskiplist{
+		header: zslCreateNode(zskiplistMaxLevel, 0, ""),
+		level:  1,
+	}
+}
+
+//随机生成新节点的层数，层数越高的概率越小
+func zslRandomLevel() int {
+	level := 1
+	for rand.Float64() < zskiplistP && level < zskiplistMaxLevel {
+		level++
+	}
+	return level
+}
+
+//节点是否排在(score, ele)前面，score相同时按照ele的字典序排序
+func zslNodeLess(x *zskiplistNode, score float64, ele sds) bool {
+	return x.score < score || (x.score == score && x.ele < ele)
+}
+
+//插入新节点，调用方需要保证ele不存在
+func (zsl *zskiplist) zslInsert(score float64, ele sds) *zskiplistNode {
+	var update [zskiplistMaxLevel]*zskiplistNode
+	var rank [zskiplistMaxLevel]uint64
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		//rank保存了到达update[i]时经过的距离
+		if i != zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zslNodeLess(x.level[i].forward, score, ele) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = zslCreateNode(level, score, ele)
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+
+	//没有触及的层span加1
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+//删除节点，update为每一层中x的前一个节点
+func (zsl *zskiplist) zslDeleteNode(x *zskiplistNode, update []*zskiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+//查找(score, ele)在每一层中的前一个节点
+func (zsl *zskiplist) zslFindUpdate(score float64, ele sds, update []*zskiplistNode) *zskiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslNodeLess(x.level[i].forward, score, ele) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return x.level[0].forward
+}
+
+//删除(score, ele)对应的节点，不存在时返回false
+func (zsl *zskiplist) zslDelete(score float64, ele sds) bool {
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.zslFindUpdate(score, ele, update)
+	if x != nil && x.score == score && x.ele == ele {
+		zsl.zslDeleteNode(x, update)
+		return true
+	}
+	return false
+}
+
+//更新ele的score，新的score不影响节点的位置时直接修改，否则删除后重新插入
+func (zsl *zskiplist) zslUpdateScore(curscore float64, ele sds, newscore float64) *zskiplistNode {
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.zslFindUpdate(curscore, ele, update)
+	if x == nil || x.score != curscore || x.ele != ele {
+		panic("zslUpdateScore: element not found")
+	}
+
+	if (x.backward == nil || x.backward.score < newscore) &&
+		(x.level[0].forward == nil || x.level[0].forward.score > newscore) {
+		x.score = newscore
+		return x
+	}
+
+	zsl.zslDeleteNode(x, update)
+	return zsl.zslInsert(newscore, ele)
+}
+
+//获取元素的排名，从1开始，不存在时返回0
+func (zsl *zskiplist) zslGetRank(score float64, ele sds) uint64 {
+	var rank uint64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(zslNodeLess(x.level[i].forward, score, ele) ||
+				(x.level[i].forward.score == score && x.level[i].forward.ele == ele)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.ele == ele {
+			return rank
+		}
+	}
+	return 0
+}
+
+//根据排名查找节点，排名从1开始
+func (zsl *zskiplist) zslGetElementByRank(rank uint64) *zskiplistNode {
+	var traversed uint64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+//返回第一个满足gteMin的节点的排名（从0开始），没有满足的节点时返回length
+//gteMin对于有序的元素必须是单调的：某个节点满足时，后面的节点都满足
+func (zsl *zskiplist) zslFirstRankInRange(gteMin func(ele sds, score float64) bool) uint64 {
+	var rank uint64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !gteMin(x.level[i].forward.ele, x.level[i].forward.score) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+	}
+	return rank
+}
+
+//返回满足lteMax的节点的数量，也就是最后一个满足lteMax的节点的排名（从1开始）
+func (zsl *zskiplist) zslLastRankInRange(lteMax func(ele sds, score float64) bool) uint64 {
+	var rank uint64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && lteMax(x.level[i].forward.ele, x.level[i].forward.score) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+	}
+	return rank
+}
+
+//删除排名在[start, end]之间的节点，排名从1开始，同时从dict中删除，返回删除的数量
+func (zsl *zskiplist) zslDeleteRangeByRank(start uint64, end uint64, d *dict) uint64 {
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	var traversed, removed uint64
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span < start {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	traversed++
+	x = x.level[0].forward
+	for x != nil && traversed <= end {
+		next := x.level[0].forward
+		zsl.zslDeleteNode(x, update)
+		d.dictDelete(x.ele)
+		removed++
+		traversed++
+		x = next
+	}
+	return removed
+}
+
+//-----------------------------------------------------------------------------
+// Range specifications
+//-----------------------------------------------------------------------------
+
+//score范围，minex/maxex为true时不包含边界
+type zrangespec struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+//字典序范围，minInf/maxInf为-1时表示"-"，为1时表示"+"
+type zlexrangespec struct {
+	min, max       sds
+	minex, maxex   bool
+	minInf, maxInf int
+}
+
+//解析score范围的一个边界，"("开头表示不包含边界
+func zslParseRangeItem(item sds) (float64, bool, bool) {
+	ex := false
+	if len(item) > 0 && item[0] == '(' {
+		ex = true
+		item = item[1:]
+	}
+	value, ok := string2d(item)
+	return value, ex, ok
+}
+
+//解析score范围，比如 (1 5、-inf +inf
+func zslParseRange(min *robj, max *robj) (*zrangespec, bool) {
+	spec := &zrangespec{}
+	var minOk, maxOk bool
+	spec.min, spec.minex, minOk = zslParseRangeItem(min.ptr.(sds))
+	spec.max, spec.maxex, maxOk = zslParseRangeItem(max.ptr.(sds))
+	return spec, minOk && maxOk
+}
+
+func (spec *zrangespec) valueGteMin(ele sds, score float64) bool {
+	if spec.minex {
+		return score > spec.min
+	}
+	return score >= spec.min
+}
+
+func (spec *zrangespec) valueLteMax(ele sds, score float64) bool {
+	if spec.maxex {
+		return score < spec.max
+	}
+	return score <= spec.max
+}
+
+//解析字典序范围的一个边界："["开头表示包含边界，"("开头表示不包含边界，"-"和"+"表示负无穷和正无穷
+func zslParseLexRangeItem(item sds) (value sds, ex bool, inf int, ok bool) {
+	if len(item) == 0 {
+		return "", false, 0, false
+	}
+	switch item[0] {
+	case '+':
+		if len(item) != 1 {
+			return "", false, 0, false
+		}
+		return "", false, 1, true
+	case '-':
+		if len(item) != 1 {
+			return "", false, 0, false
+		}
+		return "", false, -1, true
+	case '(':
+		return item[1:], true, 0, true
+	case '[':
+		return item[1:], false, 0, true
+	}
+	return "", false, 0, false
+}
+
+//解析字典序范围，比如 [a (c、- +
+func zslParseLexRange(min *robj, max *robj) (*zlexrangespec, bool) {
+	spec := &zlexrangespec{}
+	var minOk, maxOk bool
+	spec.min, spec.minex, spec.minInf, minOk = zslParseLexRangeItem(min.ptr.(sds))
+	spec.max, spec.maxex, spec.maxInf, maxOk = zslParseLexRangeItem(max.ptr.(sds))
+	return spec, minOk && maxOk
+}
+
+func (spec *zlexrangespec) valueGteMin(ele sds, score float64) bool {
+	if spec.minInf != 0 {
+		return spec.minInf < 0
+	}
+	if spec.minex {
+		return ele > spec.min
+	}
+	return ele >= spec.min
+}
+
+func (spec *zlexrangespec) valueLteMax(ele sds, score float64) bool {
+	if spec.maxInf != 0 {
+		return spec.maxInf > 0
+	}
+	if spec.maxex {
+		return ele < spec.max
+	}
+	return ele <= spec.max
+}
+
+//-----------------------------------------------------------------------------
+// Listpack-backed sorted set API
+//-----------------------------------------------------------------------------
+
+//获取listpack中第i个元素的score
+func zzlGetScore(lp []sds, i int) float64 {
+	score, _ := string2d(lp[i*2+1])
+	return score
+}
+
+//listpack中查找ele的位置，找不到时返回-1
+func zzlFind(lp []sds, ele sds) int {
+	for i := 0; i < len(lp); i += 2 {
+		if lp[i] == ele {
+			return i / 2
+		}
+	}
+	return -1
+}
+
+//按照(score, ele)的顺序插入元素，调用方需要保证ele不存在
+func zzlInsert(lp []sds, ele sds, score float64) []sds {
+	n := len(lp) / 2
+	i := sort.Search(n, func(i int) bool {
+		s := zzlGetScore(lp, i)
+		return s > score || (s == score && lp[i*2] > ele)
+	})
+	lp = append(lp, "", "")
+	copy(lp[i*2+2:], lp[i*2:])
+	lp[i*2] = ele
+	lp[i*2+1] = d2string(score)
+	return lp
+}
+
+//删除第i个元素
+func zzlDelete(lp []sds, i int) []sds {
+	return append(lp[:i*2], lp[i*2+2:]...)
+}
+
+//-----------------------------------------------------------------------------
+// Common sorted set API
+//-----------------------------------------------------------------------------
+
+//zset中的一个元素
+type zsetEntry struct {
+	ele   sds
+	score float64
+}
+
+//zsetAdd的输入标记
+const (
+	zaddInNone = 0
+	zaddInIncr = 1 << 0 //增加score，而不是设置score
+	zaddInNx   = 1 << 1 //元素不存在时才执行
+	zaddInXx   = 1 << 2 //元素存在时才执行
+	zaddInGt   = 1 << 3 //新的score大于当前的score时才更新
+	zaddInLt   = 1 << 4 //新的score小于当前的score时才更新
+)
+
+//zsetAdd的输出标记
+const (
+	zaddOutNop     = 1 << 0 //因为NX/XX/GT/LT没有执行操作
+	zaddOutNan     = 1 << 1 //score为NaN
+	zaddOutAdded   = 1 << 2 //添加了新元素
+	zaddOutUpdated = 1 << 3 //更新了元素的score
+)
+
+//根据元素数量和元素长度创建合适编码的zset
+func zsetTypeCreate(sizeHint int, valueLenHint int) *robj {
+	if sizeHint <= server.zsetMaxListpackEntries && valueLenHint <= server.zsetMaxListpackValue &&
+		server.zsetMaxListpackEntries > 0 {
+		return createZsetListpackObject()
+	}
+	return createZsetObject()
+}
+
+//zset中元素的数量
+func zsetLength(zobj *robj) int {
+	if zobj.encoding == redisEncodingListpack {
+		return len(zobj.ptr.([]sds)) / 2
+	} else if zobj.encoding == redisEncodingSkiplist {
+		return int(zobj.ptr.(*zset).zsl.length)
+	}
+	panic("Unknown sorted set encoding")
+}
+
+//转换zset的编码，只支持listpack转换为skiplist
+func zsetConvert(zobj *robj, encoding uint8) {
+	if zobj.encoding != redisEncodingListpack || encoding != redisEncodingSkiplist {
+		panic("Unsupported zset conversion")
+	}
+	lp := zobj.ptr.([]sds)
+	zs := &zset{dict: dictCreate(), zsl: zslCreate()}
+	for i := 0; i < len(lp)/2; i++ {
+		score := zzlGetScore(lp, i)
+		zs.zsl.zslInsert(score, lp[i*2])
+		zs.dict.dictAdd(lp[i*2], score)
+	}
+	zobj.ptr = zs
+	zobj.encoding = redisEncodingSkiplist
+}
+
+//复制zset对象，编码保持不变，用于COPY命令
+func zsetDup(o *robj) *robj {
+	var zobj *robj
+	if o.encoding == redisEncodingListpack {
+		zobj = createZsetListpackObject()
+		zobj.ptr = append([]sds(nil), o.ptr.([]sds)...)
+	} else if o.encoding == redisEncodingSkiplist {
+		zobj = createZsetObject()
+		zs := zobj.ptr.(*zset)
+		//从后往前插入，每次都插入到跳表的头部
+		for ln := o.ptr.(*zset).zsl.tail; ln != nil; ln = ln.backward {
+			zs.zsl.zslInsert(ln.score, ln.ele)
+			zs.dict.dictAdd(ln.ele, ln.score)
+		}
+	} else {
+		panic("Unknown sorted set encoding")
+	}
+	return zobj
+}
+
+//获取ele的score
+func zsetScore(zobj *robj, ele sds) (float64, bool) {
+	if zobj.encoding == redisEncodingListpack {
+		lp := zobj.ptr.([]sds)
+		i := zzlFind(lp, ele)
+		if i < 0 {
+			return 0, false
+		}
+		return zzlGetScore(lp, i), true
+	} else if zobj.encoding == redisEncodingSkiplist {
+		score := zobj.ptr.(*zset).dict.dictFind(ele)
+		if score == nil {
+			return 0, false
+		}
+		return score.(float64), true
+	}
+	panic("Unknown sorted set encoding")
+}
+
+//添加或者更新元素，inFlags为zaddIn*，返回zaddOut*标记和元素最新的score
+//score为NaN时返回false
+func zsetAdd(zobj *robj, score float64, ele sds, inFlags int) (int, float64, bool) {
+	incr := inFlags&zaddInIncr != 0
+	nx := inFlags&zaddInNx != 0
+	xx := inFlags&zaddInXx != 0
+	gt := inFlags&zaddInGt != 0
+	lt := inFlags&zaddInLt != 0
+
+	if math.IsNaN(score) {
+		return zaddOutNan, 0, false
+	}
+
+	curscore, exists := zsetScore(zobj, ele)
+	if exists {
+		if nx {
+			return zaddOutNop, curscore, true
+		}
+		if incr {
+			score += curscore
+			if math.IsNaN(score) {
+				return zaddOutNan, 0, false
+			}
+		}
+		if (lt && score >= curscore) || (gt && score <= curscore) {
+			return zaddOutNop, curscore, true
+		}
+		if score == curscore {
+			return 0, score, true
+		}
+
+		if zobj.encoding == redisEncodingListpack {
+			lp := zobj.ptr.([]sds)
+			lp = zzlDelete(lp, zzlFind(lp, ele))
+			zobj.ptr = zzlInsert(lp, ele, score)
+		} else if zobj.encoding == redisEncodingSkiplist {
+			zs := zobj.ptr.(*zset)
+			zs.zsl.zslUpdateScore(curscore, ele, score)
+			zs.dict.dictReplace(ele, score)
+		} else {
+			panic("Unknown sorted set encoding")
+		}
+		return zaddOutUpdated, score, true
+	}
+
+	if xx {
+		return zaddOutNop, 0, true
+	}
+
+	if zobj.encoding == redisEncodingListpack {
+		zobj.ptr = zzlInsert(zobj.ptr.([]sds), ele, score)
+		//元素数量或者元素长度超过限制时转换为skiplist编码
+		if zsetLength(zobj) > server.zsetMaxListpackEntries || len(ele) > server.zsetMaxListpackValue {
+			zsetConvert(zobj, redisEncodingSkiplist)
+		}
+	} else if zobj.encoding == redisEncodingSkiplist {
+		zs := zobj.ptr.(*zset)
+		zs.zsl.zslInsert(score, ele)
+		zs.dict.dictAdd(ele, score)
+	} else {
+		panic("Unknown sorted set encoding")
+	}
+	return zaddOutAdded, score, true
+}
+
+//删除元素，不存在时返回false
+func zsetDel(zobj *robj, ele sds) bool {
+	if zobj.encoding == redisEncodingListpack {
+		lp := zobj.ptr.([]sds)
+		i := zzlFind(lp, ele)
+		if i < 0 {
+			return false
+		}
+		zobj.ptr = zzlDelete(lp, i)
+		return true
+	} else if zobj.encoding == redisEncodingSkiplist {
+		zs := zobj.ptr.(*zset)
+		score := zs.dict.dictFind(ele)
+		if score == nil {
+			return false
+		}
+		zs.dict.dictDelete(ele)
+		zs.zsl.zslDelete(score.(float64), ele)
+		if htNeedsResize(zs.dict) {
+			zs.dict.dictResize()
+		}
+		return true
+	}
+	panic("Unknown sorted set encoding")
+}
+
+//获取元素的排名（从0开始），reverse为true时按照score从大到小排名
+func zsetRank(zobj *robj, ele sds, reverse bool) (int64, bool) {
+	llen := int64(zsetLength(zobj))
+	var rank int64
+	if zobj.encoding == redisEncodingListpack {
+		i := zzlFind(zobj.ptr.([]sds), ele)
+		if i < 0 {
+			return 0, false
+		}
+		rank = int64(i)
+	} else if zobj.encoding == redisEncodingSkiplist {
+		zs := zobj.ptr.(*zset)
+		score := zs.dict.dictFind(ele)
+		if score == nil {
+			return 0, false
+		}
+		rank = int64(zs.zsl.zslGetRank(score.(float64), ele)) - 1
+	} else {
+		panic("Unknown sorted set encoding")
+	}
+
+	if reverse {
+		return llen - 1 - rank, true
+	}
+	return rank, true
+}
+
+//获取在范围内的元素的排名区间[first, last]（从0开始），first > last表示没有元素在范围内
+func zsetRankRangeInRange(zobj *robj, gteMin func(ele sds, score float64) bool,
+	lteMax func(ele sds, score float64) bool) (int64, int64) {
+	if zobj.encoding == redisEncodingListpack {
+		lp := zobj.ptr.([]sds)
+		n := len(lp) / 2
+		first := sort.Search(n, func(i int) bool {
+			return gteMin(lp[i*2], zzlGetScore(lp, i))
+		})
+		last := sort.Search(n, func(i int) bool {
+			return !lteMax(lp[i*2], zzlGetScore(lp, i))
+		}) - 1
+		return int64(first), int64(last)
+	} else if zobj.encoding == redisEncodingSkiplist {
+		zsl := zobj.ptr.(*zset).zsl
+		first := zsl.zslFirstRankInRange(gteMin)
+		last := zsl.zslLastRankInRange(lteMax)
+		return int64(first), int64(last) - 1
+	}
+	panic("Unknown sorted set encoding")
+}
+
+//遍历排名在[start, end]之间的元素（从0开始），reverse为true时从end向start遍历
+func zsetRangeForEach(zobj *robj, start int64, end int64, reverse bool, fn func(ele sds, score float64)) {
+	if start > end {
+		return
+	}
+	if zobj.encoding == redisEncodingListpack {
+		lp := zobj.ptr.([]sds)
+		if reverse {
+			for i := end; i >= start; i-- {
+				fn(lp[i*2], zzlGetScore(lp, int(i)))
+			}
+		} else {
+			for i := start; i <= end; i++ {
+				fn(lp[i*2], zzlGetScore(lp, int(i)))
+			}
+		}
+	} else if zobj.encoding == redisEncodingSkiplist {
+		zsl := zobj.ptr.(*zset).zsl
+		if reverse {
+			x := zsl.zslGetElementByRank(uint64(end + 1))
+			for i := end; i >= start; i-- {
+				fn(x.ele, x.score)
+				x = x.backward
+			}
+		} else {
+			x := zsl.zslGetElementByRank(uint64(start + 1))
+			for i := start; i <= end; i++ {
+				fn(x.ele, x.score)
+				x = x.level[0].forward
+			}
+		}
+	} else {
+		panic("Unknown sorted set encoding")
+	}
+}
+
+//删除排名在[start, end]之间的元素（从0开始），返回删除的数量
+func zsetDeleteRangeByRank(zobj *robj, start int64, end int64) int64 {
+	if start > end {
+		return 0
+	}
+	if zobj.encoding == redisEncodingListpack {
+		lp := zobj.ptr.([]sds)
+		zobj.ptr = append(lp[:start*2], lp[(end+1)*2:]...)
+		return end - start + 1
+	} else if zobj.encoding == redisEncodingSkiplist {
+		zs := zobj.ptr.(*zset)
+		return int64(zs.zsl.zslDeleteRangeByRank(uint64(start+1), uint64(end+1), zs.dict))
+	}
+	panic("Unknown sorted set encoding")
+}
+
+//回复zset的元素，withscores时RESP2中member和score交替，RESP3中每个元素为[member, score]数组
+func zsetReplyEntries(client *redisClient, entries []zsetEntry, withscores bool) {
+	if withscores && client.resp == 2 {
+		addReplyArrayLen(client, len(entries)*2)
+	} else {
+		addReplyArrayLen(client, len(entries))
+	}
+	for _, entry := range entries {
+		if withscores && client.resp > 2 {
+			addReplyArrayLen(client, 2)
+		}
+		addReplyBulkCBuffer(client, entry.ele)
+		if withscores {
+			addReplyDouble(client, entry.score)
+		}
+	}
+}
+
+//将结果保存到dstkey中，结果为空时删除dstkey，回复结果的元素数量
+func zsetStoreEntries(client *redisClient, dstkey *robj, entries []zsetEntry) {
+	if len(entries) == 0 {
+		if client.db.dbDelete(dstkey) {
+			client.db.signalModifiedKey(dstkey)
+			notifyKeyspaceEvent(notifyGeneric, "del", dstkey, client.db.id)
+			server.dirty++
+		}
+		addReply(client, shared.czero)
+		return
+	}
+
+	maxelelen := 0
+	for _, entry := range entries {
+		if len(entry.ele) > maxelelen {
+			maxelelen = len(entry.ele)
+		}
+	}
+	dstobj := zsetTypeCreate(len(entries), maxelelen)
+	for _, entry := range entries {
+		zsetAdd(dstobj, entry.score, entry.ele, zaddInNone)
+	}
+	client.db.setKey(dstkey, dstobj, false)
+	//事件名称和命令名称相同，比如zunionstore、geosearchstore
+	notifyKeyspaceEvent(notifyZset, client.cmd.name, dstkey, client.db.id)
+	server.dirty++
+	addReplyLongLong(client, int64(len(entries)))
+}
+
+//-----------------------------------------------------------------------------
+// Sorted set commands
+//-----------------------------------------------------------------------------
+
+//ZADD/ZINCRBY的实现
+func zaddGenericCommand(client *redisClient, flags int) {
+	//解析选项
+	scoreidx := 2
+	ch := false
+	for ; scoreidx < client.argc; scoreidx++ {
+		opt := client.argv[scoreidx].ptr.(sds)
+		if strings.EqualFold(opt, "nx") {
+			flags |= zaddInNx
+		} else if strings.EqualFold(opt, "xx") {
+			flags |= zaddInXx
+		} else if strings.EqualFold(opt, "ch") {
+			//CH只影响回复，返回新增和更新的元素数量
+			ch = true
+		} else if strings.EqualFold(opt, "incr") {
+			flags |= zaddInIncr
+		} else if strings.EqualFold(opt, "gt") {
+			flags |= zaddInGt
+		} else if strings.EqualFold(opt, "lt") {
+			flags |= zaddInLt
+		} else {
+			break
+		}
+	}
+
+	incr := flags&zaddInIncr != 0
+	nx := flags&zaddInNx != 0
+	xx := flags&zaddInXx != 0
+	gt := flags&zaddInGt != 0
+	lt := flags&zaddInLt != 0
+
+	//score和member必须成对出现
+	elements := client.argc - scoreidx
+	if elements%2 != 0 || elements == 0 {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+	elements /= 2
+
+	if nx && xx {
+		addReplyError(client, "XX and NX options at the same time are not compatible")
+		return
+	}
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		addReplyError(client, "GT, LT, and/or NX options at the same time are not compatible")
+		return
+	}
+	if incr && elements > 1 {
+		addReplyError(client, "INCR option supports a single increment-element pair")
+		return
+	}
+
+	//先解析所有的score，有错误时不修改数据
+	scores := make([]float64, elements)
+	for j := 0; j < elements; j++ {
+		score, ok := getDoubleFromObjectOrReply(client, client.argv[scoreidx+j*2], "")
+		if !ok {
+			return
+		}
+		scores[j] = score
+	}
+
+	zobj := client.db.lookupKeyWrite(client.argv[1])
+	if zobj != nil && checkType(client, zobj, redisZset) {
+		return
+	}
+
+	added, updated, processed := 0, 0, 0
+	var score float64
+	if zobj == nil && !xx {
+		zobj = zsetTypeCreate(elements, len(client.argv[scoreidx+1].ptr.(sds)))
+		client.db.dbAdd(client.argv[1], zobj)
+	}
+	if zobj != nil {
+		for j := 0; j < elements; j++ {
+			ele := client.argv[scoreidx+1+j*2].ptr.(sds)
+			retflags, newscore, ok := zsetAdd(zobj, scores[j], ele, flags)
+			if !ok {
+				addReplyError(client, "resulting score is not a number (NaN)")
+				return
+			}
+			if retflags&zaddOutAdded != 0 {
+				added++
+			}
+			if retflags&zaddOutUpdated != 0 {
+				updated++
+			}
+			if retflags&zaddOutNop == 0 {
+				processed++
+			}
+			score = newscore
+		}
+	}
+	if added+updated > 0 {
+		client.db.signalModifiedKey(client.argv[1])
+		if incr {
+			notifyKeyspaceEvent(notifyZset, "zincr", client.argv[1], client.db.id)
+		} else {
+			notifyKeyspaceEvent(notifyZset, "zadd", client.argv[1], client.db.id)
+		}
+		server.dirty += int64(added + updated)
+	}
+
+	if incr {
+		//INCR因为NX/XX/GT/LT没有执行时回复null
+		if processed > 0 {
+			addReplyDouble(client, score)
+		} else {
+			addReplyNull(client)
+		}
+	} else if ch {
+		addReplyLongLong(client, int64(added+updated))
+	} else {
+		addReplyLongLong(client, int64(added))
+	}
+}
+
+//ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func zaddCommand(client *redisClient) {
+	zaddGenericCommand(client, zaddInNone)
+}
+
+//ZINCRBY key increment member
+func zincrbyCommand(client *redisClient) {
+	zaddGenericCommand(client, zaddInIncr)
+}
+
+//ZREM key member [member ...]
+func zremCommand(client *redisClient) {
+	zobj := lookupKeyWriteOrReply(client, client.argv[1], shared.czero)
+	if zobj == nil || checkType(client, zobj, redisZset) {
+		return
+	}
+
+	deleted := 0
+	keyremoved := false
+	for j := 2; j < client.argc; j++ {
+		if zsetDel(zobj, client.argv[j].ptr.(sds)) {
+			deleted++
+			//zset为空时删除key
+			if zsetLength(zobj) == 0 {
+				client.db.dbDelete(client.argv[1])
+				keyremoved = true
+				break
+			}
+		}
+	}
+	if deleted > 0 {
+		client.db.signalModifiedKey(client.argv[1])
+		notifyKeyspaceEvent(notifyZset, "zrem", client.argv[1], client.db.id)
+		server.dirty += int64(deleted)
+		if keyremoved {
+			notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+		}
+	}
+	addReplyLongLong(client, int64(deleted))
+}
+
+//范围的类型
+const (
+	zrangeAuto  = 0
+	zrangeRank  = 1
+	zrangeScore = 2
+	zrangeLex   = 3
+)
+
+//范围的方向
+const (
+	zrangeDirectionAuto    = 0
+	zrangeDirectionForward = 1
+	zrangeDirectionReverse = 2
+)
+
+//解析范围参数，返回在范围内的元素的排名区间[first, last]（从0开始），
+//reverse为true时start和end是按照score从大到小的排名
+func zsetRankRangeOrReply(client *redisClient, zobj *robj, rangetype int, reverse bool,
+	minobj *robj, maxobj *robj) (int64, int64, bool) {
+	switch rangetype {
+	case zrangeScore:
+		spec, ok := zslParseRange(minobj, maxobj)
+		if !ok {
+			addReplyError(client, "min or max is not a float")
+			return 0, 0, false
+		}
+		if zobj == nil {
+			return 0, -1, true
+		}
+		first, last := zsetRankRangeInRange(zobj, spec.valueGteMin, spec.valueLteMax)
+		return first, last, true
+	case zrangeLex:
+		spec, ok := zslParseLexRange(minobj, maxobj)
+		if !ok {
+			addReplyError(client, "min or max not valid string range item")
+			return 0, 0, false
+		}
+		if zobj == nil {
+			return 0, -1, true
+		}
+		first, last := zsetRankRangeInRange(zobj, spec.valueGteMin, spec.valueLteMax)
+		return first, last, true
+	}
+
+	start, ok := getLongLongFromObjectOrReply(client, minobj, "")
+	if !ok {
+		return 0, 0, false
+	}
+	end, ok := getLongLongFromObjectOrReply(client, maxobj, "")
+	if !ok {
+		return 0, 0, false
+	}
+	if zobj == nil {
+		return 0, -1, true
+	}
+
+	llen := int64(zsetLength(zobj))
+	if start < 0 {
+		start += llen
+	}
+	if end < 0 {
+		end += llen
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= llen {
+		return 0, -1, true
+	}
+	if end >= llen {
+		end = llen - 1
+	}
+	if reverse {
+		return llen - 1 - end, llen - 1 - start, true
+	}
+	return start, end, true
+}
+
+//ZRANGE/ZRANGESTORE/ZREVRANGE/ZRANGEBYSCORE/ZRANGEBYLEX等命令的实现
+//argvStart为key所在的位置，store为true时将结果保存到argv[1]中
+func zrangeGenericCommand(client *redisClient, argvStart int, store bool, rangetype int, direction int) {
+	key := client.argv[argvStart]
+	minidx, maxidx := argvStart+1, argvStart+2
+	var offset, limit int64 = 0, -1
+	withscores := false
+
+	//解析选项
+	for j := argvStart + 3; j < client.argc; j++ {
+		opt := client.argv[j].ptr.(sds)
+		leftargs := client.argc - j - 1
+		if !store && strings.EqualFold(opt, "withscores") {
+			withscores = true
+		} else if strings.EqualFold(opt, "limit") && leftargs >= 2 {
+			var ok bool
+			if offset, ok = getLongLongFromObjectOrReply(client, client.argv[j+1], ""); !ok {
+				return
+			}
+			if limit, ok = getLongLongFromObjectOrReply(client, client.argv[j+2], ""); !ok {
+				return
+			}
+			j += 2
+		} else if direction == zrangeDirectionAuto && strings.EqualFold(opt, "rev") {
+			direction = zrangeDirectionReverse
+		} else if rangetype == zrangeAuto && strings.EqualFold(opt, "bylex") {
+			rangetype = zrangeLex
+		} else if rangetype == zrangeAuto && strings.EqualFold(opt, "byscore") {
+			rangetype = zrangeScore
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	if direction == zrangeDirectionAuto {
+		direction = zrangeDirectionForward
+	}
+	if rangetype == zrangeAuto {
+		rangetype = zrangeRank
+	}
+	reverse := direction == zrangeDirectionReverse
+
+	if (offset != 0 || limit != -1) && rangetype == zrangeRank {
+		addReplyError(client, "syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+		return
+	}
+	if withscores && rangetype == zrangeLex {
+		addReplyError(client, "syntax error, WITHSCORES not supported in combination with BYLEX")
+		return
+	}
+
+	//按照score或字典序倒序时，参数的顺序为 max min
+	if reverse && (rangetype == zrangeScore || rangetype == zrangeLex) {
+		minidx, maxidx = maxidx, minidx
+	}
+
+	var zobj *robj
+	if store {
+		zobj = client.db.lookupKeyWrite(key)
+	} else {
+		zobj = client.db.lookupKeyRead(key)
+	}
+	if zobj != nil && checkType(client, zobj, redisZset) {
+		return
+	}
+
+	first, last, ok := zsetRankRangeOrReply(client, zobj, rangetype, reverse, client.argv[minidx], client.argv[maxidx])
+	if !ok {
+		return
+	}
+
+	//LIMIT按照遍历的顺序跳过offset个元素，最多返回limit个元素，offset为负数时返回空
+	if offset < 0 {
+		first, last = 0, -1
+	} else if !reverse {
+		first += offset
+		if limit >= 0 && first+limit-1 < last {
+			last = first + limit - 1
+		}
+	} else {
+		last -= offset
+		if limit >= 0 && last-limit+1 > first {
+			first = last - limit + 1
+		}
+	}
+
+	var entries []zsetEntry
+	if zobj != nil {
+		zsetRangeForEach(zobj, first, last, reverse, func(ele sds, score float64) {
+			entries = append(entries, zsetEntry{ele: ele, score: score})
+		})
+	}
+
+	if store {
+		zsetStoreEntries(client, client.argv[1], entries)
+	} else {
+		zsetReplyEntries(client, entries, withscores)
+	}
+}
+
+//ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func zrangeCommand(client *redisClient) {
+	zrangeGenericCommand(client, 1, false, zrangeAuto, zrangeDirectionAuto)
+}
+
+//ZRANGESTORE dst src min max [BYSCORE|BYLEX] [REV] [LIMIT offset count]
+func zrangestoreCommand(client *redisClient) {
+	zrangeGenericCommand(client, 2, true, zrangeAuto, zrangeDirectionAuto)
+}
+
+//ZREVRANGE key start stop [WITHSCORES]
+func zrevrangeCommand(client *redisClient) {
+	zrangeGenericCommand(client, 1, false, zrangeRank, zrangeDirectionReverse)
+}
+
+//ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func zrangebyscoreCommand(client *redisClient) {
+	zrangeGenericCommand(client, 1, false, zrangeScore, zrangeDirectionForward)
+}
+
+//ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count]
+func zrevrangebyscoreCommand(client *redisClient) {
+	zrangeGenericCommand(client, 1, false, zrangeScore, zrangeDirectionReverse)
+}
+
+//ZRANGEBYLEX key min max [LIMIT offset count]
+func zrangebylexCommand(client *redisClient) {
+	zrangeGenericCommand(client, 1, false, zrangeLex, zrangeDirectionForward)
+}
+
+//ZREVRANGEBYLEX key max min [LIMIT offset count]
+func zrevrangebylexCommand(client *redisClient) {
+	zrangeGenericCommand(client, 1, false, zrangeLex, zrangeDirectionReverse)
+}
+
+//ZCOUNT/ZLEXCOUNT的实现
+func zcountGenericCommand(client *redisClient, rangetype int) {
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj != nil && checkType(client, zobj, redisZset) {
+		return
+	}
+
+	first, last, ok := zsetRankRangeOrReply(client, zobj, rangetype, false, client.argv[2], client.argv[3])
+	if !ok {
+		return
+	}
+	if first > last {
+		addReply(client, shared.czero)
+		return
+	}
+	addReplyLongLong(client, last-first+1)
+}
+
+//ZCOUNT key min max
+func zcountCommand(client *redisClient) {
+	zcountGenericCommand(client, zrangeScore)
+}
+
+//ZLEXCOUNT key min max
+func zlexcountCommand(client *redisClient) {
+	zcountGenericCommand(client, zrangeLex)
+}
+
+//ZREMRANGEBYRANK/ZREMRANGEBYSCORE/ZREMRANGEBYLEX的实现
+func zremrangeGenericCommand(client *redisClient, rangetype int) {
+	zobj := client.db.lookupKeyWrite(client.argv[1])
+	if zobj != nil && checkType(client, zobj, redisZset) {
+		return
+	}
+
+	//key不存在时也需要检查范围参数
+	first, last, ok := zsetRankRangeOrReply(client, zobj, rangetype, false, client.argv[2], client.argv[3])
+	if !ok {
+		return
+	}
+	if zobj == nil {
+		addReply(client, shared.czero)
+		return
+	}
+
+	deleted := zsetDeleteRangeByRank(zobj, first, last)
+	if deleted > 0 {
+		//事件名称和命令名称相同：zremrangebyrank、zremrangebyscore、zremrangebylex
+		notifyKeyspaceEvent(notifyZset, client.cmd.name, client.argv[1], client.db.id)
+		server.dirty += deleted
+		if zsetLength(zobj) == 0 {
+			client.db.dbDelete(client.argv[1])
+			notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+		}
+		client.db.signalModifiedKey(client.argv[1])
+	}
+	addReplyLongLong(client, deleted)
+}
+
+//ZREMRANGEBYRANK key start stop
+func zremrangebyrankCommand(client *redisClient) {
+	zremrangeGenericCommand(client, zrangeRank)
+}
+
+//ZREMRANGEBYSCORE key min max
+func zremrangebyscoreCommand(client *redisClient) {
+	zremrangeGenericCommand(client, zrangeScore)
+}
+
+//ZREMRANGEBYLEX key min max
+func zremrangebylexCommand(client *redisClient) {
+	zremrangeGenericCommand(client, zrangeLex)
+}
+
+//ZCARD key
+func zcardCommand(client *redisClient) {
+	zobj := lookupKeyReadOrReply(client, client.argv[1], shared.czero)
+	if zobj == nil || checkType(client, zobj, redisZset) {
+		return
+	}
+	addReplyLongLong(client, int64(zsetLength(zobj)))
+}
+
+//ZSCORE key member
+func zscoreCommand(client *redisClient) {
+	zobj := lookupKeyReadOrReply(client, client.argv[1], shared.null[client.resp])
+	if zobj == nil || checkType(client, zobj, redisZset) {
+		return
+	}
+	score, ok := zsetScore(zobj, client.argv[2].ptr.(sds))
+	if !ok {
+		addReplyNull(client)
+		return
+	}
+	addReplyDouble(client, score)
+}
+
+//ZMSCORE key member [member ...]
+func zmscoreCommand(client *redisClient) {
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj != nil && checkType(client, zobj, redisZset) {
+		return
+	}
+
+	addReplyArrayLen(client, client.argc-2)
+	for j := 2; j < client.argc; j++ {
+		if zobj == nil {
+			addReplyNull(client)
+			continue
+		}
+		score, ok := zsetScore(zobj, client.argv[j].ptr.(sds))
+		if !ok {
+			addReplyNull(client)
+			continue
+		}
+		addReplyDouble(client, score)
+	}
+}
+
+//ZRANK/ZREVRANK的实现
+func zrankGenericCommand(client *redisClient, reverse bool) {
+	zobj := lookupKeyReadOrReply(client, client.argv[1], shared.null[client.resp])
+	if zobj == nil || checkType(client, zobj, redisZset) {
+		return
+	}
+	rank, ok := zsetRank(zobj, client.argv[2].ptr.(sds), reverse)
+	if !ok {
+		addReplyNull(client)
+		return
+	}
+	addReplyLongLong(client, rank)
+}
+
+//ZRANK key member
+func zrankCommand(client *redisClient) {
+	zrankGenericCommand(client, false)
+}
+
+//ZREVRANK key member
+func zrevrankCommand(client *redisClient) {
+	zrankGenericCommand(client, true)
+}
+
+//ZPOPMIN/ZPOPMAX的实现，where为redisHead时弹出score最小的元素
+func genericZpopCommand(client *redisClient, where int) {
+	if client.argc > 3 {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	count := int64(1)
+	hasCount := client.argc == 3
+	if hasCount {
+		var ok bool
+		if count, ok = getPositiveLongFromObjectOrReply(client, client.argv[2], ""); !ok {
+			return
+		}
+	}
+
+	zobj := lookupKeyWriteOrReply(client, client.argv[1], shared.emptyarray)
+	if zobj == nil || checkType(client, zobj, redisZset) {
+		return
+	}
+	if count == 0 {
+		addReply(client, shared.emptyarray)
+		return
+	}
+
+	llen := int64(zsetLength(zobj))
+	if count > llen {
+		count = llen
+	}
+	first, last := int64(0), count-1
+	if where == redisTail {
+		first, last = llen-count, llen-1
+	}
+
+	var entries []zsetEntry
+	zsetRangeForEach(zobj, first, last, where == redisTail, func(ele sds, score float64) {
+		entries = append(entries, zsetEntry{ele: ele, score: score})
+	})
+	zsetDeleteRangeByRank(zobj, first, last)
+	if where == redisHead {
+		notifyKeyspaceEvent(notifyZset, "zpopmin", client.argv[1], client.db.id)
+	} else {
+		notifyKeyspaceEvent(notifyZset, "zpopmax", client.argv[1], client.db.id)
+	}
+	server.dirty++
+	if zsetLength(zobj) == 0 {
+		client.db.dbDelete(client.argv[1])
+		notifyKeyspaceEvent(notifyGeneric, "del", client.argv[1], client.db.id)
+	}
+	client.db.signalModifiedKey(client.argv[1])
+
+	//RESP3中指定了count时每个元素为[member, score]数组，否则为member和score交替的数组
+	if hasCount {
+		zsetReplyEntries(client, entries, true)
+		return
+	}
+	addReplyArrayLen(client, len(entries)*2)
+	for _, entry := range entries {
+		addReplyBulkCBuffer(client, entry.ele)
+		addReplyDouble(client, entry.score)
+	}
+}
+
+//ZPOPMIN key [count]
+func zpopminCommand(client *redisClient) {
+	genericZpopCommand(client, redisHead)
+}
+
+//ZPOPMAX key [count]
+func zpopmaxCommand(client *redisClient) {
+	genericZpopCommand(client, redisTail)
+}
+
+//ZUNION/ZINTER/ZDIFF的操作类型
+const (
+	setOpZUnion = 0
+	setOpZInter = 1
+	setOpZDiff  = 2
+)
+
+//AGGREGATE的类型
+const (
+	zaggregateSum = 0
+	zaggregateMin = 1
+	zaggregateMax = 2
+)
+
+//合并元素的score
+func zunionInterAggregate(target float64, value float64, aggregate int) float64 {
+	switch aggregate {
+	case zaggregateSum:
+		target += value
+		//inf + -inf = NaN，按照0处理
+		if math.IsNaN(target) {
+			return 0
+		}
+		return target
+	case zaggregateMin:
+		return math.Min(target, value)
+	case zaggregateMax:
+		return math.Max(target, value)
+	}
+	panic("Unknown ZUNION/INTER aggregate type")
+}
+
+//获取集合的元素数量，集合可以是set或者zset
+func zuiLength(o *robj) int {
+	if o == nil {
+		return 0
+	}
+	if o.rtype == redisSet {
+		return setTypeSize(o)
+	}
+	return zsetLength(o)
+}
+
+//遍历集合中的元素，set中元素的score为1
+func zuiForEach(o *robj, fn func(ele sds, score float64)) {
+	if o == nil {
+		return
+	}
+	if o.rtype == redisSet {
+		setTypeForEach(o, func(value sds) bool {
+			fn(value, 1.0)
+			return true
+		})
+		return
+	}
+	zsetRangeForEach(o, 0, int64(zsetLength(o))-1, false, fn)
+}
+
+//查找集合中元素的score，set中元素的score为1
+func zuiFind(o *robj, ele sds) (float64, bool) {
+	if o == nil {
+		return 0, false
+	}
+	if o.rtype == redisSet {
+		return 1.0, setTypeIsMember(o, ele)
+	}
+	return zsetScore(o, ele)
+}
+
+//ZUNION/ZINTER/ZDIFF及STORE的实现，dstkey不为nil时将结果保存到dstkey中
+//numkeysIndex为numkeys参数的位置
+func zunionInterDiffGenericCommand(client *redisClient, dstkey *robj, numkeysIndex int, op int) {
+	numkeys, ok := getLongLongFromObjectOrReply(client, client.argv[numkeysIndex], "")
+	if !ok {
+		return
+	}
+	if numkeys < 1 {
+		addReplyError(client, "at least 1 input key is needed for '"+client.cmd.name+"' command")
+		return
+	}
+	if numkeys > int64(client.argc-numkeysIndex-1) {
+		addReply(client, shared.syntaxerr)
+		return
+	}
+
+	//查找所有的key，可以是set或者zset
+	srcs := make([]*robj, numkeys)
+	weights := make([]float64, numkeys)
+	for i := range srcs {
+		key := client.argv[numkeysIndex+1+i]
+		var obj *robj
+		if dstkey != nil {
+			obj = client.db.lookupKeyWrite(key)
+		} else {
+			obj = client.db.lookupKeyRead(key)
+		}
+		if obj != nil && obj.rtype != redisZset && obj.rtype != redisSet {
+			addReply(client, shared.wrongtypeerr)
+			return
+		}
+		srcs[i] = obj
+		weights[i] = 1
+	}
+
+	//解析选项
+	aggregate := zaggregateSum
+	withscores := false
+	for j := numkeysIndex + 1 + int(numkeys); j < client.argc; j++ {
+		opt := client.argv[j].ptr.(sds)
+		remaining := client.argc - j - 1
+		if op != setOpZDiff && strings.EqualFold(opt, "weights") && int64(remaining) >= numkeys {
+			for i := range weights {
+				j++
+				weight, ok := getDoubleFromObject(client.argv[j])
+				if !ok {
+					addReplyError(client, "weight value is not a float")
+					return
+				}
+				weights[i] = weight
+			}
+		} else if op != setOpZDiff && strings.EqualFold(opt, "aggregate") && remaining >= 1 {
+			j++
+			value := client.argv[j].ptr.(sds)
+			if strings.EqualFold(value, "sum") {
+				aggregate = zaggregateSum
+			} else if strings.EqualFold(value, "min") {
+				aggregate = zaggregateMin
+			} else if strings.EqualFold(value, "max") {
+				aggregate = zaggregateMax
+			} else {
+				addReply(client, shared.syntaxerr)
+				return
+			}
+		} else if dstkey == nil && strings.EqualFold(opt, "withscores") {
+			withscores = true
+		} else {
+			addReply(client, shared.syntaxerr)
+			return
+		}
+	}
+
+	//元素的score乘以权重，0 * inf = NaN，按照0处理
+	weighted := func(score float64, weight float64) float64 {
+		value := score * weight
+		if math.IsNaN(value) {
+			return 0
+		}
+		return value
+	}
+
+	result := make(map[sds]float64)
+	switch op {
+	case setOpZInter:
+		//从元素最少的集合开始遍历，检查元素是否在其它的集合中
+		order := make([]int, numkeys)
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return zuiLength(srcs[order[a]]) < zuiLength(srcs[order[b]])
+		})
+		zuiForEach(srcs[order[0]], func(ele sds, score float64) {
+			value := weighted(score, weights[order[0]])
+			for _, i := range order[1:] {
+				other, ok := zuiFind(srcs[i], ele)
+				if !ok {
+					return
+				}
+				value = zunionInterAggregate(value, weighted(other, weights[i]), aggregate)
+			}
+			result[ele] = value
+		})
+	case setOpZUnion:
+		for i, src := range srcs {
+			zuiForEach(src, func(ele sds, score float64) {
+				value := weighted(score, weights[i])
+				if cur, exists := result[ele]; exists {
+					value = zunionInterAggregate(cur, value, aggregate)
+				}
+				result[ele] = value
+			})
+		}
+	case setOpZDiff:
+		zuiForEach(srcs[0], func(ele sds, score float64) {
+			for _, other := range srcs[1:] {
+				if _, ok := zuiFind(other, ele); ok {
+					return
+				}
+			}
+			result[ele] = score
+		})
+	}
+
+	//按照(score, member)排序
+	entries := make([]zsetEntry, 0, len(result))
+	for ele, score := range result {
+		entries = append(entries, zsetEntry{ele: ele, score: score})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].score != entries[j].score {
+			return entries[i].score < entries[j].score
+		}
+		return entries[i].ele < entries[j].ele
+	})
+
+	if dstkey != nil {
+		zsetStoreEntries(client, dstkey, entries)
+	} else {
+		zsetReplyEntries(client, entries, withscores)
+	}
+}
+
+//ZUNIONSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+func zunionstoreCommand(client *redisClient) {
+	zunionInterDiffGenericCommand(client, client.argv[1], 2, setOpZUnion)
+}
+
+//ZINTERSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+func zinterstoreCommand(client *redisClient) {
+	zunionInterDiffGenericCommand(client, client.argv[1], 2, setOpZInter)
+}
+
+//ZDIFFSTORE destination numkeys key [key ...]
+func zdiffstoreCommand(client *redisClient) {
+	zunionInterDiffGenericCommand(client, client.argv[1], 2, setOpZDiff)
+}
+
+//ZUNION numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+func zunionCommand(client *redisClient) {
+	zunionInterDiffGenericCommand(client, nil, 1, setOpZUnion)
+}
+
+//ZINTER numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+func zinterCommand(client *redisClient) {
+	zunionInterDiffGenericCommand(client, nil, 1, setOpZInter)
+}
+
+//ZDIFF numkeys key [key ...] [WITHSCORES]
+func zdiffCommand(client *redisClient) {
+	zunionInterDiffGenericCommand(client, nil, 1, setOpZDiff)
+}
+
+//ZSCAN key cursor [MATCH pattern] [COUNT count]
+func zscanCommand(client *redisClient) {
+	cursor, ok := parseScanCursorOrReply(client, client.argv[2])
+	if !ok {
+		return
+	}
+	zobj := lookupKeyReadOrReply(client, client.argv[1], shared.emptyscan)
+	if zobj == nil || checkType(client, zobj, redisZset) {
+		return
+	}
+	scanGenericCommand(client, zobj, cursor)
+}
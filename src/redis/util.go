@@ -0,0 +1,257 @@
+package redis
+
+import (
+	"crypto/rand"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//将带单位的内存大小转换为字节数，比如 1gb => 1073741824
+//支持的单位：b k kb m mb g gb（不区分大小写），k/m/g为1000的倍数，kb/mb/gb为1024的倍数
+func memtoll(p string) (int64, bool) {
+	p = strings.ToLower(p)
+	var mul int64 = 1
+	num := p
+	for _, unit := range []struct {
+		suffix string
+		mul    int64
+	}{
+		{"gb", 1024 * 1024 * 1024},
+		{"mb", 1024 * 1024},
+		{"kb", 1024},
+		{"g", 1000 * 1000 * 1000},
+		{"m", 1000 * 1000},
+		{"k", 1000},
+		{"b", 1},
+	} {
+		if strings.HasSuffix(p, unit.suffix) {
+			mul = unit.mul
+			num = p[:len(p)-len(unit.suffix)]
+			break
+		}
+	}
+	val, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return val * mul, true
+}
+
+//将浮点数转换为字符串，使用能够精确还原的最短表示
+//整数部分较大或者小数部分很小时使用科学计数法，inf和nan按照redis的格式输出
+func d2string(d float64) string {
+	if math.IsNaN(d) {
+		return "nan"
+	}
+	if math.IsInf(d, 1) {
+		return "inf"
+	}
+	if math.IsInf(d, -1) {
+		return "-inf"
+	}
+	abs := math.Abs(d)
+	if d == 0 || (abs >= 1e-4 && abs < 1e21) {
+		return strconv.FormatFloat(d, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(d, 'e', -1, 64)
+}
+
+//整数转换为字符串
+func ll2string(v int64) sds {
+	return sds(strconv.FormatInt(v, 10))
+}
+
+//将字符串转换为整数，规则和redis的string2ll一致：
+//不允许有空格、正号和多余的前导0，转换后的整数再转换回字符串必须和原字符串相同
+func string2ll(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	if s == "0" {
+		return 0, true
+	}
+	p := 0
+	if s[0] == '-' {
+		p++
+		if len(s) == 1 {
+			return 0, false
+		}
+	}
+	//第一个数字必须是1-9
+	if s[p] < '1' || s[p] > '9' {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+//glob风格的字符串匹配，支持 * ? [abc] [^abc] [a-z] 和 \ 转义，nocase为true时不区分大小写
+func stringmatchlen(pattern string, str string, nocase bool) bool {
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true //match
+			}
+			for s < len(str) {
+				if stringmatchlen(pattern[p+1:], str[s:], nocase) {
+					return true //match
+				}
+				s++
+			}
+			return false //no match
+		case '?':
+			s++
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if p >= len(pattern) {
+					//没有闭合的[，将最后一个字符当作]
+					p--
+					break
+				} else if pattern[p] == '\\' && len(pattern)-p >= 2 {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if pattern[p] == ']' {
+					break
+				} else if len(pattern)-p >= 3 && pattern[p+1] == '-' {
+					start, end, c := pattern[p], pattern[p+2], str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else {
+					if !nocase {
+						if pattern[p] == str[s] {
+							match = true
+						}
+					} else {
+						if toLower(pattern[p]) == toLower(str[s]) {
+							match = true
+						}
+					}
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false //no match
+			}
+			s++
+		default:
+			if pattern[p] == '\\' && len(pattern)-p >= 2 {
+				p++
+			}
+			if !nocase {
+				if pattern[p] != str[s] {
+					return false //no match
+				}
+			} else {
+				if toLower(pattern[p]) != toLower(str[s]) {
+					return false //no match
+				}
+			}
+			s++
+		}
+		p++
+		if s == len(str) {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			break
+		}
+	}
+	return p == len(pattern) && s == len(str)
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+//将字符串转换为浮点数，不允许有空格、溢出，不允许为nan
+func string2d(s string) (float64, bool) {
+	if len(s) == 0 || isSpace(s[0]) || isSpace(s[len(s)-1]) {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	if math.IsNaN(v) {
+		return 0, false
+	}
+	return v, true
+}
+
+//将浮点数转换为便于阅读的字符串，不使用科学计数法，比如 10.5、3000
+//用于INCRBYFLOAT、HINCRBYFLOAT的结果
+func ld2string(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+//生成n个随机字节
+func getRandomBytes(n int) []byte {
+	p := make([]byte, n)
+	if _, err := rand.Read(p); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+//文件是否存在
+func fileExist(filename string) bool {
+	fi, err := os.Stat(filename)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+//目录是否存在
+func dirExists(dname string) bool {
+	fi, err := os.Stat(dname)
+	return err == nil && fi.IsDir()
+}
+
+//目录不存在时创建
+func dirCreateIfMissing(dname string) error {
+	if err := os.Mkdir(dname, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+//fsync文件所在的目录，保证文件的创建和重命名已经持久化
+func fsyncFileDir(filename string) error {
+	d, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
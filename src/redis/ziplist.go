@@ -0,0 +1,118 @@
+package redis
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//ziplist的序列化格式，只用于加载旧版本redis保存的RDB文件
+//
+//<zlbytes(4)> <zltail(4)> <zllen(2)> <entry> <entry> ... <entry> <zlend(0xFF)>
+//每个元素为：<prevlen> <encoding> <entry-data>
+//prevlen小于254时占1个字节，否则为0xFE加上4个字节的长度
+
+const (
+	zipHeaderSize = 10
+	zipEnd        = 0xFF
+	zipBigPrevlen = 254
+)
+
+var errZiplistCorrupt = errors.New("invalid ziplist")
+
+//解析ziplist中的所有元素，整数元素转换为字符串
+func zipDecode(buf []byte) ([]sds, error) {
+	if len(buf) < zipHeaderSize+1 || int(binary.LittleEndian.Uint32(buf)) != len(buf) {
+		return nil, errZiplistCorrupt
+	}
+	var elements []sds
+	p := zipHeaderSize
+	for {
+		if p >= len(buf) {
+			return nil, errZiplistCorrupt
+		}
+		if buf[p] == zipEnd {
+			break
+		}
+
+		//跳过prevlen
+		if buf[p] < zipBigPrevlen {
+			p++
+		} else {
+			p += 5
+		}
+		if p >= len(buf) {
+			return nil, errZiplistCorrupt
+		}
+
+		b := buf[p]
+		var ele sds
+		switch {
+		case b>>6 == 0:
+			//00pppppp，6位长度的字符串
+			l := int(b & 0x3F)
+			if p+1+l > len(buf) {
+				return nil, errZiplistCorrupt
+			}
+			ele = sds(buf[p+1 : p+1+l])
+			p += 1 + l
+		case b>>6 == 1:
+			//01pppppp qqqqqqqq，14位长度的字符串，大端
+			if p+2 > len(buf) {
+				return nil, errZiplistCorrupt
+			}
+			l := int(b&0x3F)<<8 | int(buf[p+1])
+			if p+2+l > len(buf) {
+				return nil, errZiplistCorrupt
+			}
+			ele = sds(buf[p+2 : p+2+l])
+			p += 2 + l
+		case b == 0x80:
+			//10000000 + 4个字节的长度，大端
+			if p+5 > len(buf) {
+				return nil, errZiplistCorrupt
+			}
+			l := int(binary.BigEndian.Uint32(buf[p+1:]))
+			if l < 0 || p+5+l > len(buf) {
+				return nil, errZiplistCorrupt
+			}
+			ele = sds(buf[p+5 : p+5+l])
+			p += 5 + l
+		case b >= 0xF1 && b <= 0xFD:
+			//1111xxxx，0到12的整数直接保存在encoding中
+			ele = ll2string(int64(b&0x0F) - 1)
+			p++
+		default:
+			//整数，小端
+			var size int
+			switch b {
+			case 0xFE:
+				size = 1
+			case 0xC0:
+				size = 2
+			case 0xF0:
+				size = 3
+			case 0xD0:
+				size = 4
+			case 0xE0:
+				size = 8
+			default:
+				return nil, errZiplistCorrupt
+			}
+			if p+1+size > len(buf) {
+				return nil, errZiplistCorrupt
+			}
+			var uv uint64
+			for i := size - 1; i >= 0; i-- {
+				uv = uv<<8 | uint64(buf[p+1+i])
+			}
+			shift := uint(64 - size*8)
+			ele = ll2string(int64(uv<<shift) >> shift)
+			p += 1 + size
+		}
+		elements = append(elements, ele)
+	}
+	if p != len(buf)-1 {
+		return nil, errZiplistCorrupt
+	}
+	return elements, nil
+}